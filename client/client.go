@@ -0,0 +1,467 @@
+// Package client lets other programs embed gotorrent, downloading any number of torrents from magnet links or
+// .torrent files. Nothing is written to stdout or the working directory unless asked for with an Option.
+//
+// Logging goes through zerolog's global logger, which embedders can silence with zerolog.SetGlobalLevel.
+package client
+
+import (
+	"context"
+	"errors"
+	"gotorrent/models"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Priorities a file can have, see File
+const (
+	PrioritySkip   = models.PrioritySkip
+	PriorityNormal = models.PriorityNormal
+)
+
+// States a torrent can be in, see Stats
+const (
+	StateQueued           = models.StateQueued
+	StateFetchingMetadata = models.StateFetchingMetadata
+	StateDownloading      = models.StateDownloading
+	StatePaused           = models.StatePaused
+	StateDone             = models.StateDone
+	StateStopped          = models.StateStopped
+	StateSeeding          = models.StateSeeding
+)
+
+// StateName returns a human readable name for one of the State constants
+func StateName(state int) string {
+	return models.StateName(state)
+}
+
+// Where a peer was found, see Peer
+const (
+	PeerSourceTracker  = models.PeerSourceTracker
+	PeerSourceMagnet   = models.PeerSourceMagnet
+	PeerSourceIncoming = models.PeerSourceIncoming
+	PeerSourcePEX      = models.PeerSourcePEX
+	PeerSourceDHT      = models.PeerSourceDHT
+	PeerSourceLSD      = models.PeerSourceLSD
+)
+
+// How connections to and from peers are encrypted, see WithEncryption
+const (
+	EncryptionDisabled  = models.EncryptionDisabled
+	EncryptionPreferred = models.EncryptionPreferred
+	EncryptionRequired  = models.EncryptionRequired
+)
+
+// ParseEncryption returns the Encryption constant named disabled, preferred or required
+func ParseEncryption(s string) (int, error) {
+	return models.ParseEncryption(s)
+}
+
+// Types of Event
+const (
+	EventMetadataReceived = models.EventMetadataReceived
+	EventPieceVerified    = models.EventPieceVerified
+	EventPieceHashFailed  = models.EventPieceHashFailed
+	EventFileCompleted    = models.EventFileCompleted
+	EventTorrentCompleted = models.EventTorrentCompleted
+	EventPeerConnected    = models.EventPeerConnected
+	EventPeerDisconnected = models.EventPeerDisconnected
+	EventTrackerAnnounce  = models.EventTrackerAnnounce
+	EventStorageError     = models.EventStorageError
+	EventMetadataFailed   = models.EventMetadataFailed
+)
+
+// Event is something that happened to a torrent, see models.Event for which fields each type sets
+type Event = models.Event
+
+// Subscription delivers events until it's closed, see Client.Subscribe
+type Subscription = models.Subscription
+
+// MaxQueuedEvents is how many events a Subscription holds for a subscriber that has fallen behind, past which the
+// oldest are dropped
+const MaxQueuedEvents = models.MaxQueuedEvents
+
+// ErrDuplicate is returned when adding a torrent that is already in the client
+var ErrDuplicate = models.ErrDuplicateTorrent
+
+// ErrBadMetadata is returned when a torrent's info dictionary describes pieces that can't be downloaded
+var ErrBadMetadata = models.ErrBadMetadata
+
+// Config is the client's configuration, see Client.Config
+type Config = models.SessionConfig
+
+// Info describes a torrent, most of which is only known once its metadata has been fetched
+type Info = models.TorrentInfo
+
+// File is one file within a torrent
+type File = models.FileInfo
+
+// Stats is a snapshot of a torrent's progress
+type Stats = models.TorrentStats
+
+// Peer is a peer that a torrent is connected to
+type Peer = models.PeerInfo
+
+// Tracker is one of a torrent's trackers
+type Tracker = models.TrackerInfo
+
+// Metrics is a snapshot of a torrent's counters for monitoring
+type Metrics = models.TorrentMetrics
+
+// TrackerMetrics counts the announces to one of a torrent's trackers
+type TrackerMetrics = models.TrackerMetrics
+
+// Histogram is a snapshot of how long something took, see Metrics
+type Histogram = models.Histogram
+
+// Option configures a Client
+type Option func(*models.SessionConfig)
+
+// WithListenPort sets the port that peers connect to us on, 6881 by default
+func WithListenPort(port int) Option {
+	return func(config *models.SessionConfig) { config.ListenPort = port }
+}
+
+// WithoutListening stops peers from connecting to us, we will only connect to them
+func WithoutListening() Option {
+	return func(config *models.SessionConfig) { config.ListenPort = -1 }
+}
+
+// WithMaxConnections limits the number of peer connections across all torrents, unlimited by default
+func WithMaxConnections(n int) Option {
+	return func(config *models.SessionConfig) { config.MaxConnections = n }
+}
+
+// WithMaxPeersPerTorrent limits the number of peer connections of each torrent, 50 by default
+func WithMaxPeersPerTorrent(n int) Option {
+	return func(config *models.SessionConfig) { config.MaxPeersPerTorrent = n }
+}
+
+// WithRateLimits limits download and upload speeds across all torrents in bytes per second, 0 for unlimited
+func WithRateLimits(downloadRate int, uploadRate int) Option {
+	return func(config *models.SessionConfig) {
+		config.DownloadRate = downloadRate
+		config.UploadRate = uploadRate
+	}
+}
+
+// WithRateSchedule replaces the rate limits with those of the first schedule that applies, whenever one does
+func WithRateSchedule(schedules ...RateSchedule) Option {
+	return func(config *models.SessionConfig) { config.Schedule = schedules }
+}
+
+// WithSeeding keeps torrents running once they're downloaded, uploading to peers. Anything already in the download
+// directory is verified when a torrent with metadata is added, so that it's seeded rather than downloaded again
+func WithSeeding() Option {
+	return func(config *models.SessionConfig) { config.Seed = true }
+}
+
+// WithOutput writes progress bars and status messages to w, they are discarded by default
+func WithOutput(w io.Writer) Option {
+	return func(config *models.SessionConfig) { config.Output = w }
+}
+
+// WithMetadataDir saves the metadata of torrents added from magnet links to dir as metadata.torrent
+func WithMetadataDir(dir string) Option {
+	return func(config *models.SessionConfig) { config.MetadataDir = dir }
+}
+
+// RateSchedule is a time of the week with different rate limits, see WithRateSchedule
+type RateSchedule = models.RateSchedule
+
+// ParseRateSchedule parses a schedule such as "mon-fri 09:00-17:00 down=512 up=64", with rates in KiB/s
+func ParseRateSchedule(s string) (RateSchedule, error) {
+	return models.ParseRateSchedule(s)
+}
+
+// Dialer makes outgoing connections, see WithDialer
+type Dialer = models.Dialer
+
+// ListenConfig opens listening sockets, see WithListenConfig
+type ListenConfig = models.ListenConfig
+
+// Clock tells the time and schedules timers, see WithClock
+type Clock = models.Clock
+
+// WithDialer makes every outgoing connection, to peers, trackers and web seeds, through dialer
+func WithDialer(dialer Dialer) Option {
+	return func(config *models.SessionConfig) { config.Dialer = dialer }
+}
+
+// WithListenConfig opens the peer listener and the UDP tracker socket through listenConfig
+func WithListenConfig(listenConfig ListenConfig) Option {
+	return func(config *models.SessionConfig) { config.ListenConfig = listenConfig }
+}
+
+// WithClock replaces the real time for everything that's scheduled, such as announces, retries and rate limits
+func WithClock(clock Clock) Option {
+	return func(config *models.SessionConfig) { config.Clock = clock }
+}
+
+// WithProxy connects to peers and trackers through a socks5://[user:password@]host[:port] or
+// http://[user:password@]host[:port] proxy, only a socks5 one can reach UDP trackers. If the proxy is unavailable
+// connections are made directly, unless only is set, which also stops peers from connecting to us
+func WithProxy(proxyURL string, only bool) Option {
+	return func(config *models.SessionConfig) {
+		config.Proxy = proxyURL
+		config.ProxyOnly = only
+	}
+}
+
+// WithUTP sets whether peers are connected to and accepted over uTP as well as TCP, which they are by default unless
+// there's a proxy or custom dialer
+func WithUTP(enabled bool) Option {
+	return func(config *models.SessionConfig) { config.DisableUTP = !enabled }
+}
+
+// WithEncryption sets whether connections to and from peers use message stream encryption, one of the Encryption
+// constants. Without it, connections are plaintext
+func WithEncryption(encryption int) Option {
+	return func(config *models.SessionConfig) { config.Encryption = encryption }
+}
+
+// Client downloads torrents into a single directory, sharing connections and limits between them
+type Client struct {
+	session *models.Session
+
+	torrents   map[*models.Torrent]*Torrent
+	torrentsMx sync.Mutex
+}
+
+// New creates a client which saves finished downloads to downloadDir
+func New(downloadDir string, opts ...Option) (*Client, error) {
+	if downloadDir == "" {
+		return nil, errors.New("a download directory is required")
+	}
+
+	config := models.SessionConfig{DownloadDir: downloadDir}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	session, err := models.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{session: session, torrents: make(map[*models.Torrent]*Torrent)}, nil
+}
+
+// Close drops every torrent, waiting for them to disconnect and tell their trackers, and releases the client's
+// port and sockets
+func (client *Client) Close() error {
+	client.torrentsMx.Lock()
+	clear(client.torrents)
+	client.torrentsMx.Unlock()
+	return client.session.Close()
+}
+
+// Config returns the client's configuration, including the current rate limits and schedules
+func (client *Client) Config() Config {
+	return client.session.Config()
+}
+
+// HTTPTransport returns the transport the client fetches from trackers and web seeds over, so that anything else
+// fetched on its behalf, such as .torrent files, goes through the same dialer and proxy
+func (client *Client) HTTPTransport() http.RoundTripper {
+	return client.session.HTTPTransport()
+}
+
+// SetRateLimits changes the download and upload limits in bytes per second, 0 for unlimited, which apply whenever
+// none of the schedules do
+func (client *Client) SetRateLimits(downloadRate int, uploadRate int) {
+	client.session.SetRateLimits(downloadRate, uploadRate)
+}
+
+// SetRateSchedule replaces the schedules given to WithRateSchedule
+func (client *Client) SetRateSchedule(schedules ...RateSchedule) {
+	client.session.SetRateSchedule(schedules)
+}
+
+// RateLimits returns the download and upload limits in force right now, which come from a schedule if one applies
+func (client *Client) RateLimits() (int, int) {
+	return client.session.RateLimits()
+}
+
+// AddMagnet starts downloading the torrent of a magnet link. If the torrent is already in the client it's returned
+// along with an error wrapping ErrDuplicate
+func (client *Client) AddMagnet(link string) (*Torrent, error) {
+	magnet, err := models.NewMagnet(link)
+	if err != nil {
+		return nil, err
+	}
+	return client.add(client.session.AddMagnet(magnet))
+}
+
+// AddTorrentFile starts downloading the torrent described by the .torrent file at path
+func (client *Client) AddTorrentFile(path string) (*Torrent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return client.AddTorrentData(data)
+}
+
+// AddTorrentData starts downloading the torrent described by the contents of a .torrent file, duplicates are handled
+// the same as by AddMagnet
+func (client *Client) AddTorrentData(data []byte) (*Torrent, error) {
+	mi, err := models.ParseMetaInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	return client.add(client.session.AddMetaInfo(mi))
+}
+
+// add starts a torrent that was just added to the session, or returns the existing handle of a duplicate
+func (client *Client) add(t *models.Torrent, err error) (*Torrent, error) {
+	if errors.Is(err, models.ErrDuplicateTorrent) {
+		client.torrentsMx.Lock()
+		defer client.torrentsMx.Unlock()
+		return client.torrents[t], err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return client.start(t), nil
+}
+
+func (client *Client) start(t *models.Torrent) *Torrent {
+	torrent := &Torrent{torrent: t, client: client}
+	client.torrentsMx.Lock()
+	client.torrents[t] = torrent
+	client.torrentsMx.Unlock()
+
+	go t.StartDownload(context.Background())
+	return torrent
+}
+
+// Subscribe returns a subscription to the events of the torrents with the given info hashes, or of every torrent
+// if none are given. Events are queued until received rather than dropped, so keep reading or Close the
+// subscription. It's closed along with the client, after any events already published have been received
+func (client *Client) Subscribe(infoHashes ...[]byte) *Subscription {
+	return client.session.Subscribe(infoHashes...)
+}
+
+// Get returns the torrent with the given v1 or v2 info hash, or nil if there is none
+func (client *Client) Get(infoHash []byte) *Torrent {
+	t := client.session.Get(infoHash)
+	if t == nil {
+		return nil
+	}
+	client.torrentsMx.Lock()
+	defer client.torrentsMx.Unlock()
+	return client.torrents[t]
+}
+
+// Torrents returns every torrent that hasn't been dropped
+func (client *Client) Torrents() []*Torrent {
+	client.torrentsMx.Lock()
+	defer client.torrentsMx.Unlock()
+
+	torrents := make([]*Torrent, 0, len(client.torrents))
+	for _, torrent := range client.torrents {
+		torrents = append(torrents, torrent)
+	}
+	return torrents
+}
+
+// Torrent is a handle to a torrent in a Client
+type Torrent struct {
+	torrent *models.Torrent
+	client  *Client
+}
+
+// Info returns what we know about the torrent so far
+func (torrent *Torrent) Info() Info {
+	return torrent.torrent.Info()
+}
+
+// Files returns every file in the torrent, or nil if its metadata hasn't been fetched yet
+func (torrent *Torrent) Files() []File {
+	return torrent.torrent.Files()
+}
+
+// Stats returns a snapshot of the torrent's progress
+func (torrent *Torrent) Stats() Stats {
+	return torrent.torrent.Stats()
+}
+
+// Peers returns every peer the torrent is connected to
+func (torrent *Torrent) Peers() []Peer {
+	return torrent.torrent.Peers()
+}
+
+// Trackers returns the state of each of the torrent's trackers
+func (torrent *Torrent) Trackers() []Tracker {
+	return torrent.torrent.Trackers()
+}
+
+// Metrics returns a snapshot of the torrent's counters
+func (torrent *Torrent) Metrics() Metrics {
+	return torrent.torrent.Metrics()
+}
+
+// MagnetLink returns a magnet link for the torrent
+func (torrent *Torrent) MagnetLink() string {
+	return torrent.torrent.MagnetLink()
+}
+
+// SetFilePriority changes the priority of the file at fileIndex in Files, once the torrent has its metadata
+func (torrent *Torrent) SetFilePriority(fileIndex int, priority int) error {
+	return torrent.torrent.SetFilePriority(fileIndex, priority)
+}
+
+// SetRateLimits limits the torrent's download and upload speeds in bytes per second, 0 for unlimited. The client's
+// limits still apply on top
+func (torrent *Torrent) SetRateLimits(downloadRate int, uploadRate int) {
+	torrent.torrent.SetRateLimits(downloadRate, uploadRate)
+}
+
+// RateLimits returns the torrent's own download and upload limits, see SetRateLimits
+func (torrent *Torrent) RateLimits() (int, int) {
+	return torrent.torrent.RateLimits()
+}
+
+// Subscribe returns a subscription to this torrent's events, see Client.Subscribe
+func (torrent *Torrent) Subscribe() *Subscription {
+	return torrent.torrent.Subscribe()
+}
+
+// Wait blocks until the torrent has been downloaded and written to disk, returning an error if it's dropped,
+// runs out of peers or ctx is done first
+func (torrent *Torrent) Wait(ctx context.Context) error {
+	return torrent.torrent.Wait(ctx)
+}
+
+// Pause disconnects from every peer until Resume is called, keeping everything downloaded so far
+func (torrent *Torrent) Pause() {
+	torrent.torrent.Pause()
+}
+
+// Resume reconnects to peers after Pause
+func (torrent *Torrent) Resume() {
+	torrent.torrent.Resume()
+}
+
+// Drop stops the torrent and removes it from the client, anything already written to disk is kept
+func (torrent *Torrent) Drop() error {
+	torrent.client.torrentsMx.Lock()
+	delete(torrent.client.torrents, torrent.torrent)
+	torrent.client.torrentsMx.Unlock()
+
+	info := torrent.torrent.Info()
+	infoHash := info.InfoHash
+	if len(infoHash) == 0 {
+		infoHash = info.InfoHashV2
+	}
+	return torrent.client.session.Remove(infoHash)
+}
+
+// Delete drops the torrent and removes anything of it that has been written to disk
+func (torrent *Torrent) Delete() error {
+	err := torrent.Drop()
+	if err != nil {
+		return err
+	}
+	return torrent.torrent.DeleteFiles()
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gotorrent/models"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWebSeededTorrent creates a .torrent file for a single random file, served by a web seed
+func newWebSeededTorrent(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+	served := t.TempDir()
+	if err := os.WriteFile(filepath.Join(served, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(served)))
+	t.Cleanup(server.Close)
+
+	mi, err := models.CreateTorrent(models.CreateOptions{Path: filepath.Join(served, "file"), WebSeeds: []string{server.URL + "/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "file.torrent")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := mi.Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestClientDownload(t *testing.T) {
+	torrentPath, data := newWebSeededTorrent(t)
+
+	// nothing should be written to the working directory
+	wd, _ := os.Getwd()
+	empty := t.TempDir()
+	os.Chdir(empty)
+	defer os.Chdir(wd)
+
+	downloadDir := t.TempDir()
+	client, err := New(downloadDir, WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	torrent, err := client.AddTorrentFile(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := torrent.Info(); info.Name != "file" || info.Length != len(data) || !info.HasMetadata {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if files := torrent.Files(); len(files) != 1 || files[0].Path != "file" || files[0].Priority != PriorityNormal {
+		t.Errorf("Unexpected files %+v", files)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := torrent.Stats()
+	if stats.State != StateDone || stats.BytesDownloaded != len(data) || stats.PiecesDownloaded != stats.PiecesWanted {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	got, err := os.ReadFile(filepath.Join(downloadDir, "file"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("file was not downloaded correctly: %v", err)
+	}
+	if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+		t.Errorf("Expected nothing in the working directory, found %d files", len(entries))
+	}
+}
+
+func TestClientAddMalformed(t *testing.T) {
+	client, err := New(t.TempDir(), WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// an info dictionary with a piece length of 0
+	data := []byte("d4:infod6:lengthi10e4:name1:x12:piece lengthi0e6:pieces20:" + strings.Repeat("h", 20) + "ee")
+	if _, err := client.AddTorrentData(data); !errors.Is(err, ErrBadMetadata) {
+		t.Errorf("Expected %v, got %v", ErrBadMetadata, err)
+	}
+	if len(client.Torrents()) != 0 {
+		t.Errorf("Expected the torrent not to be added")
+	}
+}
+
+func TestClientPauseAndDrop(t *testing.T) {
+	client, err := New(t.TempDir(), WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	torrent, err := client.AddMagnet("magnet:?xt=urn:btih:" + "abababababababababababababababababababab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddMagnet("not a magnet link"); err == nil {
+		t.Errorf("Expected an error adding an invalid magnet link")
+	}
+
+	torrent.Pause()
+	if state := torrent.Stats().State; state != StatePaused {
+		t.Errorf("Expected paused, got %s", models.StateName(state))
+	}
+	torrent.Resume()
+	if state := torrent.Stats().State; state == StatePaused {
+		t.Errorf("Torrent is still paused after resuming")
+	}
+
+	if err := torrent.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Torrents()) != 0 {
+		t.Errorf("Torrent is still in the client after being dropped")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("Expected Wait to fail once the torrent was dropped, got %v", err)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	torrentPath, _ := newWebSeededTorrent(t)
+	downloadDir := t.TempDir()
+	client, err := New(downloadDir, WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribe before adding so that we don't miss anything
+	all := client.Subscribe()
+	torrent, err := client.AddTorrentFile(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := client.Subscribe(bytes.Repeat([]byte{1}, 20))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	counts := make(map[int]int)
+	for ev := range all.Events() {
+		counts[ev.Type]++
+		if !bytes.Equal(ev.InfoHash, torrent.Info().InfoHash) || ev.Name != "file" {
+			t.Errorf("Event is for the wrong torrent: %+v", ev)
+		}
+		if ev.Type == EventFileCompleted && ev.File != filepath.Join(downloadDir, "file") {
+			t.Errorf("Expected %s to be completed, got %s", filepath.Join(downloadDir, "file"), ev.File)
+		}
+	}
+	if counts[EventPieceVerified] != torrent.Info().NumPieces || counts[EventFileCompleted] != 1 || counts[EventTorrentCompleted] != 1 {
+		t.Errorf("Unexpected events %v", counts)
+	}
+	for ev := range other.Events() {
+		t.Errorf("Received %s for a torrent we didn't subscribe to", models.EventName(ev.Type))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gotorrent/models"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringsFlag is a flag that may be given multiple times
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
+
+// runCreate implements `gotorrent create`, which hashes a file or directory into a new .torrent file
+func runCreate(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds stringsFlag
+	output := flags.String("o", "", "where to write the .torrent file (defaults to <name>.torrent)")
+	name := flags.String("name", "", "name of the torrent (defaults to the file or directory name)")
+	pieceLen := flags.Int("piece-length", 0, "piece length in bytes, a power of two (chosen automatically if 0)")
+	comment := flags.String("comment", "", "comment to embed in the torrent")
+	private := flags.Bool("private", false, "mark the torrent as private (BEP 27)")
+	flags.Var(&trackers, "tracker", "tracker url, may be given multiple times (each becomes its own tier)")
+	flags.Var(&webSeeds, "webseed", "web seed url, may be given multiple times")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gotorrent create [flags] <file or directory>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	opts := models.CreateOptions{
+		Path:     flags.Arg(0),
+		Name:     *name,
+		PieceLen: *pieceLen,
+		WebSeeds: webSeeds,
+		Comment:  *comment,
+		Private:  *private,
+	}
+	for _, tracker := range trackers {
+		opts.Trackers = append(opts.Trackers, []string{tracker})
+	}
+
+	metaInfo, err := models.CreateTorrent(opts)
+	if err != nil {
+		return err
+	}
+
+	path := *output
+	if path == "" {
+		path = filepath.Base(filepath.Clean(flags.Arg(0))) + ".torrent"
+		if *name != "" {
+			path = *name + ".torrent"
+		}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = metaInfo.Encode(file)
+	if err != nil {
+		return err
+	}
+
+	magnetLink, err := metaInfo.MagnetLink()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created %s\n%s\n", path, magnetLink)
+	return nil
+}
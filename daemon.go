@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gotorrent/client"
+	"gotorrent/rpc"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runDaemon implements `gotorrent daemon`, which downloads torrents added over Transmission's RPC protocol until
+// it's interrupted
+func runDaemon(args []string) error {
+	flags := newFlagSet("daemon", "")
+	addr := flags.String("rpc-addr", "127.0.0.1:9091", "address to serve the Transmission RPC on")
+	username := flags.String("rpc-username", "", "require basic auth with this username")
+	password := flags.String("rpc-password", "", "require basic auth with this password, or set GOTORRENT_RPC_PASSWORD")
+	flags.StringVar(&downloadDir, "download-dir", downloadDir, "same as -dir")
+	parseFlags(flags, args, 0, 0)
+
+	if *password == "" {
+		*password = os.Getenv("GOTORRENT_RPC_PASSWORD")
+	}
+
+	c, err := client.New(downloadDir,
+		client.WithListenPort(port),
+		client.WithMaxConnections(maxConnections),
+		client.WithMaxPeersPerTorrent(connections),
+		client.WithRateLimits(downloadRate*1024, uploadRate*1024),
+		client.WithRateSchedule(schedules...),
+		client.WithProxy(proxy, proxyOnly),
+		client.WithEncryption(int(encryption)),
+		client.WithUTP(useUTP),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stopMetrics, err := serveMetrics(c)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	server := rpc.NewServer(c, rpc.ServerConfig{Username: *username, Password: *password})
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.Path, server)
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	// on ctrl-c we stop taking requests, then every torrent disconnects and tells its trackers that it's leaving
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving the Transmission RPC on http://%s%s\n", listener.Addr(), rpc.Path)
+	err = httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
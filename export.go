@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gotorrent/models"
+	"os"
+	"time"
+)
+
+// runExport implements `gotorrent export`, which fetches a magnet link's metadata and writes it out as a complete .torrent
+func runExport(args []string) error {
+	flags := newFlagSet("export", "<magnet link or .torrent file>")
+	output := flags.String("o", "", "where to write the .torrent file (defaults to <name>.torrent)")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait for the metadata")
+	parseFlags(flags, args, 1, 1)
+	return exportTorrent(flags.Arg(0), *output, *timeout)
+}
+
+// exportTorrent writes a complete .torrent for a magnet link or .torrent file to output, or <name>.torrent if
+// that's empty
+func exportTorrent(arg string, output string, timeout time.Duration) error {
+	session, torr, err := fetchMetadata(arg, timeout)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	path := output
+	if path == "" {
+		path = torr.ExportFileName()
+	}
+	err = torr.ExportTorrentFile(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %s\n%s\n", path, torr.MagnetLink())
+	return nil
+}
+
+// fetchMetadata adds a magnet link or .torrent file to a new session, downloading from peers until it has the
+// metadata. The download is abandoned when the session is closed
+func fetchMetadata(arg string, timeout time.Duration) (*models.Session, *models.Torrent, error) {
+	config := sharedSessionConfig()
+	// we aren't sharing anything, so there's no need to accept connections
+	config.ListenPort = -1
+	config.Output = os.Stderr
+	session, err := models.NewSession(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	torr, err := loadTorrent(session, arg)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	// a .torrent file already has it, so we needn't go anywhere near the swarm
+	select {
+	case <-torr.MetadataReady():
+		return session, torr, nil
+	default:
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- torr.StartDownload(context.Background()) }()
+	err = waitForMetadata(torr, stopped, timeout)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, torr, nil
+}
+
+// waitForMetadata waits for a torrent that's been started to get its metadata, stopped being what StartDownload
+// returned. If it stops first, e.g. as what it got couldn't be parsed, that's exitMetadata
+func waitForMetadata(torr *models.Torrent, stopped <-chan error, timeout time.Duration) error {
+	select {
+	case <-torr.MetadataReady():
+		return nil
+	case err := <-stopped:
+		// it may have got the metadata and finished straight after
+		select {
+		case <-torr.MetadataReady():
+			return nil
+		default:
+		}
+		fmt.Fprintln(os.Stderr, "Could not get the metadata:", err)
+		return exitStatus(exitMetadata)
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for metadata")
+	}
+}
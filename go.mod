@@ -5,11 +5,11 @@ go 1.22.0
 require (
 	github.com/jackpal/bencode-go v1.0.0
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/sys v0.12.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 )
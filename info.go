@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runInfo implements `gotorrent info`, which prints a torrent's metadata along with its files and which pieces
+// each of them spans. Magnet links have their metadata fetched from peers first
+func runInfo(args []string) error {
+	flags := newFlagSet("info", "<magnet link or .torrent file>")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait for a magnet link's metadata")
+	parseFlags(flags, args, 1, 1)
+
+	session, torr, err := fetchMetadata(flags.Arg(0), *timeout)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	info := torr.Info()
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(out, "Name:\t%s\n", info.Name)
+	if len(info.InfoHash) != 0 {
+		fmt.Fprintf(out, "Info hash:\t%s\n", hex.EncodeToString(info.InfoHash))
+	}
+	if len(info.InfoHashV2) != 0 {
+		fmt.Fprintf(out, "Info hash v2:\t%s\n", hex.EncodeToString(info.InfoHashV2))
+	}
+	fmt.Fprintf(out, "Size:\t%s (%d bytes)\n", formatSize(info.Length), info.Length)
+	fmt.Fprintf(out, "Pieces:\t%d of %s\n", info.NumPieces, formatSize(info.PieceLength))
+	fmt.Fprintf(out, "Private:\t%t\n", info.Private)
+	if info.Comment != "" {
+		fmt.Fprintf(out, "Comment:\t%s\n", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Fprintf(out, "Created by:\t%s\n", info.CreatedBy)
+	}
+	for i, tracker := range torr.Trackers() {
+		label := ""
+		if i == 0 {
+			label = "Trackers:"
+		}
+		fmt.Fprintf(out, "%s\t%s\n", label, tracker.URL)
+	}
+	fmt.Fprintf(out, "Magnet link:\t%s\n", torr.MagnetLink())
+	out.Flush()
+
+	fmt.Println("\nFiles:")
+	out = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(out, "Pieces\tSize\tPath\n")
+	for _, file := range torr.Files() {
+		pieces := "-"
+		if file.Length != 0 {
+			first := file.Offset / info.PieceLength
+			last := (file.Offset + file.Length - 1) / info.PieceLength
+			pieces = fmt.Sprint(first)
+			if last != first {
+				pieces += fmt.Sprintf("-%d", last)
+			}
+		}
+		path := file.Path
+		if file.Padding {
+			path += " (padding)"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\n", pieces, formatSize(file.Length), path)
+	}
+	return out.Flush()
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+func formatSize(n int) string {
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(sizeUnits)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, sizeUnits[unit])
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// runMagnet implements `gotorrent magnet`, which prints a .torrent file's magnet link, or fetches a magnet link's
+// metadata and writes it out as a .torrent file the same as `gotorrent export`
+func runMagnet(args []string) error {
+	flags := newFlagSet("magnet", "<magnet link or .torrent file>")
+	output := flags.String("o", "", "where to write a magnet link's .torrent file (defaults to <name>.torrent)")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait for a magnet link's metadata")
+	parseFlags(flags, args, 1, 1)
+
+	if strings.HasPrefix(flags.Arg(0), "magnet:") {
+		return exportTorrent(flags.Arg(0), *output, *timeout)
+	}
+
+	metaInfo, err := readMetaInfo(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	magnetLink, err := metaInfo.MagnetLink()
+	if err != nil {
+		return err
+	}
+	fmt.Println(magnetLink)
+	return nil
+}
@@ -1,43 +1,342 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"gotorrent/client"
 	"gotorrent/models"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
 )
 
-// var seed bool
-var connections int
+// shared by every command, see addSharedFlags
+var downloadDir = "downloads"
+var connections = 50
+var maxConnections int
+var port = models.DefaultListenPort
+var downloadRate int
+var uploadRate int
 var debug bool
+var metricsAddr string
+var proxy string
+var proxyOnly bool
+var useUTP = true
+var schedules scheduleFlag
+var encryption = encryptionFlag(client.EncryptionPreferred)
+
+// scheduleFlag collects every -schedule
+type scheduleFlag []client.RateSchedule
+
+func (sf *scheduleFlag) String() string {
+	return ""
+}
+
+func (sf *scheduleFlag) Set(value string) error {
+	schedule, err := client.ParseRateSchedule(value)
+	if err != nil {
+		return err
+	}
+	*sf = append(*sf, schedule)
+	return nil
+}
+
+// encryptionFlag is one of the Encryption constants, given by name
+type encryptionFlag int
+
+func (ef *encryptionFlag) String() string {
+	return models.EncryptionName(int(*ef))
+}
+
+func (ef *encryptionFlag) Set(value string) error {
+	parsed, err := client.ParseEncryption(value)
+	*ef = encryptionFlag(parsed)
+	return err
+}
+
+// get's flags, which may also come before the command as that's where they used to go
+var useTUI bool
+var outputFormat = "text"
+
+// command is one of gotorrent's subcommands, run with the arguments that follow its name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
 
 func init() {
-	// flag.BoolVar(&seed, "seed", false, "continue seeding after download")
-	flag.IntVar(&connections, "connections", 50, "number of connections to use")
-	flag.BoolVar(&debug, "debug", false, "enable debug logging")
-	flag.Parse()
+	commands = []command{
+		{"get", "download torrents, the default when no command is given", runGet},
+		{"info", "print a torrent's metadata, files and piece layout", runInfo},
+		{"verify", "hash check a torrent's data in the download directory", runVerify},
+		{"seed", "upload a torrent's data from the download directory until interrupted", runSeed},
+		{"magnet", "convert a .torrent file to a magnet link or a magnet link to a .torrent file", runMagnet},
+		{"create", "create a .torrent file from a file or directory", runCreate},
+		{"export", "fetch a magnet link's metadata as a .torrent file, like magnet", runExport},
+		{"daemon", "download torrents added over the Transmission RPC protocol", runDaemon},
+	}
+
+	addSharedFlags(flag.CommandLine)
+	addGetFlags(flag.CommandLine)
+	flag.Usage = usage
 }
 
-func main() {
+// addSharedFlags registers the flags every command accepts. The defaults are whatever was given before the
+// command, so `gotorrent -port 6882 get ...` and `gotorrent get -port 6882 ...` are the same
+func addSharedFlags(flags *flag.FlagSet) {
+	flags.StringVar(&downloadDir, "dir", downloadDir, "directory that downloads are saved to and seeded or verified from")
+	flags.IntVar(&port, "port", port, "port to accept peer connections on")
+	flags.IntVar(&connections, "connections", connections, "number of connections to use per torrent")
+	flags.IntVar(&maxConnections, "max-connections", maxConnections, "number of connections to use across all torrents, 0 for no limit")
+	flags.IntVar(&downloadRate, "download-rate", downloadRate, "download limit in KiB/s across all torrents, 0 for no limit")
+	flags.IntVar(&uploadRate, "upload-rate", uploadRate, "upload limit in KiB/s across all torrents, 0 for no limit")
+	flags.Var(&schedules, "schedule", `different limits at certain times, e.g. "mon-fri 09:00-17:00 down=512 up=64" in KiB/s, may be repeated`)
+	flags.BoolVar(&debug, "debug", debug, "enable debug logging")
+	flags.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "serve prometheus metrics on this address, e.g. 127.0.0.1:9100")
+	flags.StringVar(&proxy, "proxy", proxy, "connect to peers and trackers through this proxy, socks5://[user:pass@]host[:port] or http://[user:pass@]host[:port]")
+	flags.BoolVar(&proxyOnly, "proxy-only", proxyOnly, "never connect directly if the proxy is unavailable, and don't accept connections from peers")
+	flags.BoolVar(&useUTP, "utp", useUTP, "connect to and accept peers over uTP as well as TCP")
+	flags.Var(&encryption, "encryption", "encrypt connections to and from peers: disabled, preferred (falling back to plaintext) or required")
+}
+
+func addGetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&outputFormat, "output", outputFormat, "text for progress bars, or json for newline-delimited JSON records on stdout")
+	flags.BoolVar(&useTUI, "tui", useTUI, "show a full-screen terminal UI instead of progress bars")
+}
+
+// newFlagSet returns the flags of a command, starting with the shared ones
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	addSharedFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), strings.TrimSpace("Usage: gotorrent "+name+" [flags] "+arguments))
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses a command's arguments, exiting with a usage error unless it got between minArgs and maxArgs
+// positional arguments (maxArgs < 0 for no limit)
+func parseFlags(flags *flag.FlagSet, args []string, minArgs int, maxArgs int) {
+	flags.Parse(args)
+	setLogLevel()
+	if flags.NArg() < minArgs || (maxArgs >= 0 && flags.NArg() > maxArgs) {
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+func setLogLevel() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: gotorrent [flags] <command> [flags] [arguments]\n")
+	fmt.Fprintf(out, "       gotorrent [flags] <magnet links or .torrent files...>\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nRun gotorrent <command> -h for a command's flags. These may be given before or after the command:\n")
+	flag.PrintDefaults()
+}
+
+// exitStatus is returned by a command to exit with a particular code, without printing anything more
+type exitStatus int
+
+func (status exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(status))
+}
+
+var errNoCommand = errors.New("no command or torrents given")
+
+// parseCommand parses the flags given before the command, returning the command and the arguments it's to be run
+// with. Anything that isn't a command is a torrent to download, as before there were commands
+func parseCommand(flags *flag.FlagSet, argv []string) (command, []string, error) {
+	err := flags.Parse(argv)
+	if err != nil {
+		return command{}, nil, err
+	}
+
+	args := flags.Args()
+	if len(args) == 0 && !useTUI {
+		return command{}, nil, errNoCommand
+	}
+	for _, cmd := range commands {
+		if len(args) != 0 && args[0] == cmd.name {
+			return cmd, args[1:], nil
+		}
+	}
+	// which is get
+	return commands[0], args, nil
+}
+
+func main() {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
+	cmd, args, err := parseCommand(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		usage()
+		os.Exit(2)
+	}
+	setLogLevel()
 
-	if len(os.Args) < 2 {
-		fmt.Printf("Provide a magnet link\n")
-		return
+	err = cmd.run(args)
+	var status exitStatus
+	if errors.As(err, &status) {
+		os.Exit(int(status))
 	}
-	magnetLink, err := models.NewMagnet(os.Args[1])
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+}
+
+// runGet implements `gotorrent get`, which downloads every torrent given to it at once
+func runGet(args []string) error {
+	flags := newFlagSet("get", "<magnet links or .torrent files...>")
+	addGetFlags(flags)
+	minArgs := 1
+	if useTUI {
+		// more can be added from the terminal UI
+		minArgs = 0
+	}
+	parseFlags(flags, args, minArgs, -1)
+
+	if useTUI {
+		return runTUI(flags.Args())
 	}
 
-	torr := models.NewTorrent(magnetLink, connections)
+	report, err := newReporter(outputFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	code := runDownload(report, flags.Args())
+	if code != exitSuccess {
+		return exitStatus(code)
+	}
+	return nil
+}
+
+// runDownload downloads every torrent in args at once, returning the exit code
+func runDownload(report *reporter, args []string) int {
+	c, err := client.New(downloadDir,
+		client.WithListenPort(port),
+		client.WithMaxConnections(maxConnections),
+		client.WithMaxPeersPerTorrent(connections),
+		client.WithRateLimits(downloadRate*1024, uploadRate*1024),
+		client.WithRateSchedule(schedules...),
+		client.WithProxy(proxy, proxyOnly),
+		client.WithEncryption(int(encryption)),
+		client.WithUTP(useUTP),
+		client.WithMetadataDir("."),
+		client.WithOutput(report.human()),
+	)
+	if err != nil {
+		fmt.Fprintln(report.human(), err)
+		return exitError
+	}
+	defer c.Close()
+
+	stopMetrics, err := serveMetrics(c)
+	if err != nil {
+		fmt.Fprintln(report.human(), err)
+		return exitError
+	}
+	defer stopMetrics()
 
-	torr.StartDownload()
+	var torrents []*client.Torrent
+	for _, arg := range args {
+		torr, err := addTorrent(c, arg)
+		if err != nil {
+			fmt.Fprintln(report.human(), arg+": "+err.Error())
+			return exitError
+		}
+		torrents = append(torrents, torr)
+	}
+
+	// on ctrl-c every torrent disconnects and tells its trackers that it's leaving before we exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// every torrent is downloaded at once
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	code := exitSuccess
+	for _, torr := range torrents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			torrentCode := report.download(ctx, torr)
+			mx.Lock()
+			code = worseExit(code, torrentCode)
+			mx.Unlock()
+		}()
+	}
+	wg.Wait()
+	return code
+}
+
+// sharedSessionConfig is the session the shared flags describe, the same as runDownload's client is given, for
+// commands that use a session directly
+func sharedSessionConfig() models.SessionConfig {
+	return models.SessionConfig{
+		ListenPort:         port,
+		MaxConnections:     maxConnections,
+		MaxPeersPerTorrent: connections,
+		DownloadRate:       downloadRate * 1024,
+		UploadRate:         uploadRate * 1024,
+		DownloadDir:        downloadDir,
+		Schedule:           schedules,
+		Encryption:         int(encryption),
+		Proxy:              proxy,
+		ProxyOnly:          proxyOnly,
+		DisableUTP:         !useUTP,
+	}
+}
+
+// addTorrent adds a torrent to the client from either a magnet link or the path to a .torrent file
+func addTorrent(c *client.Client, arg string) (*client.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return c.AddMagnet(arg)
+	}
+	return c.AddTorrentFile(arg)
+}
+
+// loadTorrent adds a torrent to the session from either a magnet link or the path to a .torrent file
+func loadTorrent(session *models.Session, arg string) (*models.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		magnetLink, err := models.NewMagnet(arg)
+		if err != nil {
+			return nil, err
+		}
+		return session.AddMagnet(magnetLink)
+	}
+
+	metaInfo, err := readMetaInfo(arg)
+	if err != nil {
+		return nil, err
+	}
+	return session.AddMetaInfo(metaInfo)
+}
+
+func readMetaInfo(path string) (*models.MetaInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return models.ParseMetaInfo(data)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"gotorrent/client"
+	"gotorrent/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepFlags restores the flag variables once the test is done, as parsing a command's flags sets them
+func keepFlags(t *testing.T) {
+	t.Helper()
+	dir, conns, maxConns, listenPort, downRate, upRate := downloadDir, connections, maxConnections, port, downloadRate, uploadRate
+	debugging, metrics, proxyURL, onlyProxy, utp, schedule, crypto := debug, metricsAddr, proxy, proxyOnly, useUTP, schedules, encryption
+	tui, format := useTUI, outputFormat
+	t.Cleanup(func() {
+		downloadDir, connections, maxConnections, port, downloadRate, uploadRate = dir, conns, maxConns, listenPort, downRate, upRate
+		debug, metricsAddr, proxy, proxyOnly, useUTP, schedules, encryption = debugging, metrics, proxyURL, onlyProxy, utp, schedule, crypto
+		useTUI, outputFormat = tui, format
+	})
+}
+
+func TestParseCommand(t *testing.T) {
+	magnetLink := "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20)
+	type testCase struct {
+		name     string
+		argv     []string
+		command  string
+		args     []string
+		debug    bool
+		port     int
+		tui      bool
+		output   string
+		expected error
+	}
+	testCases := []testCase{
+		{name: "torrent", argv: []string{magnetLink}, command: "get", args: []string{magnetLink}},
+		{name: "flag before a torrent", argv: []string{"-debug", magnetLink}, command: "get", args: []string{magnetLink}, debug: true},
+		{name: "flag before the argument", argv: []string{"get", "-debug", magnetLink}, command: "get", args: []string{magnetLink}, debug: true},
+		{name: "flag before the command", argv: []string{"-port", "6882", "get", "a.torrent"}, command: "get", args: []string{"a.torrent"}, port: 6882},
+		{name: "flag after the command", argv: []string{"get", "-port", "6882", "a.torrent"}, command: "get", args: []string{"a.torrent"}, port: 6882},
+		{name: "flags either side", argv: []string{"-debug", "info", "-port", "6882", "a.torrent"}, command: "info", args: []string{"a.torrent"}, debug: true, port: 6882},
+		{name: "several torrents", argv: []string{"-output", "json", "a.torrent", "b.torrent"}, command: "get", args: []string{"a.torrent", "b.torrent"}, output: "json"},
+		{name: "tui without torrents", argv: []string{"-tui"}, command: "get", args: []string{}, tui: true},
+		{name: "unknown command", argv: []string{"frobnicate"}, command: "get", args: []string{"frobnicate"}},
+		{name: "nothing", argv: []string{}, expected: errNoCommand},
+		{name: "only flags", argv: []string{"-debug"}, expected: errNoCommand},
+	}
+	// every command is found by name
+	for _, cmd := range commands {
+		testCases = append(testCases, testCase{name: cmd.name, argv: []string{cmd.name, "-debug", "a.torrent"}, command: cmd.name, args: []string{"a.torrent"}, debug: true})
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keepFlags(t)
+			global := flag.NewFlagSet("gotorrent", flag.ContinueOnError)
+			addSharedFlags(global)
+			addGetFlags(global)
+
+			cmd, args, err := parseCommand(global, tc.argv)
+			if err != tc.expected {
+				t.Fatalf("Expected error %v, got %v", tc.expected, err)
+			}
+			if err != nil {
+				return
+			}
+			if cmd.name != tc.command {
+				t.Fatalf("Expected the %s command, got %s", tc.command, cmd.name)
+			}
+
+			// then the command parses the rest, as runGet and the others do
+			flags := newFlagSet(cmd.name, "")
+			if cmd.name == "get" {
+				addGetFlags(flags)
+			}
+			err = flags.Parse(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(flags.Args(), tc.args) {
+				t.Errorf("Expected arguments %q, got %q", tc.args, flags.Args())
+			}
+
+			expectedPort, expectedOutput := tc.port, tc.output
+			if expectedPort == 0 {
+				expectedPort = models.DefaultListenPort
+			}
+			if expectedOutput == "" {
+				expectedOutput = "text"
+			}
+			if debug != tc.debug || port != expectedPort || useTUI != tc.tui || outputFormat != expectedOutput {
+				t.Errorf("Expected debug %v, port %d, tui %v and output %s, got %v, %d, %v and %s",
+					tc.debug, expectedPort, tc.tui, expectedOutput, debug, port, useTUI, outputFormat)
+			}
+		})
+	}
+}
+
+func TestSharedSessionConfig(t *testing.T) {
+	keepFlags(t)
+	flags := newFlagSet("magnet", "")
+	err := flags.Parse([]string{"-encryption", "required", "-utp=false", "-proxy", "socks5://127.0.0.1:1080", "-proxy-only", "-connections", "7", "-download-rate", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := sharedSessionConfig()
+	if config.Encryption != client.EncryptionRequired || !config.DisableUTP || config.Proxy != "socks5://127.0.0.1:1080" || !config.ProxyOnly {
+		t.Errorf("Expected the connection flags in the config, got %+v", config)
+	}
+	if config.MaxPeersPerTorrent != 7 || config.DownloadRate != 2*1024 {
+		t.Errorf("Expected the limit flags in the config, got %+v", config)
+	}
+}
+
+func TestWaitForMetadata(t *testing.T) {
+	session, err := models.NewSession(models.SessionConfig{ListenPort: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	magnetLink, _ := models.NewMagnet("magnet:?xt=urn:btih:" + strings.Repeat("ab", 20))
+	torr, err := session.AddMagnet(magnetLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the torrent stopping without its metadata ends the wait straight away
+	stopped := make(chan error, 1)
+	stopped <- models.ErrBadMetadata
+	if err := waitForMetadata(torr, stopped, time.Minute); err != exitStatus(exitMetadata) {
+		t.Errorf("Expected to exit with %d, got %v", exitMetadata, err)
+	}
+	if err := waitForMetadata(torr, make(chan error), time.Millisecond); err == nil {
+		t.Errorf("Expected an error once the timeout passed")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"gotorrent/client"
+	"gotorrent/metrics"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveMetrics serves c's prometheus metrics on -metrics-addr if it was given, returning a function that stops
+// serving them
+func serveMetrics(c *client.Client) (func(), error) {
+	if metricsAddr == "" {
+		return func() {}, nil
+	}
+
+	listener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metrics.Path, metrics.Handler(c))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return func() { server.Close() }, nil
+}
@@ -0,0 +1,136 @@
+// Package metrics serves the counters of a client.Client's torrents in prometheus' text exposition format, so that
+// gotorrent can be scraped without pulling in the prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"gotorrent/client"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path is where prometheus expects to find the metrics
+const Path = "/metrics"
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an http.Handler serving c's metrics
+func Handler(c *client.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		Write(w, c)
+	})
+}
+
+// torrentMetrics is a torrent's metrics along with the labels that identify it
+type torrentMetrics struct {
+	labels  string
+	metrics client.Metrics
+}
+
+// Write writes c's metrics to w in the text exposition format
+func Write(w io.Writer, c *client.Client) error {
+	var torrents []torrentMetrics
+	for _, torrent := range c.Torrents() {
+		info := torrent.Info()
+		infoHash := info.InfoHash
+		if len(infoHash) == 0 {
+			infoHash = info.InfoHashV2
+		}
+		torrents = append(torrents, torrentMetrics{
+			labels:  fmt.Sprintf(`info_hash="%s",name="%s"`, hex.EncodeToString(infoHash), escape(info.Name)),
+			metrics: torrent.Metrics(),
+		})
+	}
+	// client.Torrents is in no particular order, which makes for confusing diffs when reading the output
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].labels < torrents[j].labels })
+
+	bw := bufio.NewWriter(w)
+	header(bw, "gotorrent_torrents", "gauge", "Torrents in the client.")
+	fmt.Fprintf(bw, "gotorrent_torrents %d\n", len(torrents))
+
+	counter := func(name string, help string, value func(client.Metrics) int) {
+		header(bw, name, "counter", help)
+		for _, torrent := range torrents {
+			fmt.Fprintf(bw, "%s{%s} %d\n", name, torrent.labels, value(torrent.metrics))
+		}
+	}
+	counter("gotorrent_downloaded_bytes_total", "Payload bytes received from peers and web seeds, whether or not they verified.",
+		func(m client.Metrics) int { return m.BytesDownloaded })
+	counter("gotorrent_uploaded_bytes_total", "Bytes sent to peers.",
+		func(m client.Metrics) int { return m.BytesUploaded })
+	counter("gotorrent_pieces_verified_total", "Pieces that passed their hash check.",
+		func(m client.Metrics) int { return m.PiecesVerified })
+	counter("gotorrent_pieces_failed_total", "Pieces that failed their hash check and were downloaded again.",
+		func(m client.Metrics) int { return m.PiecesFailed })
+	counter("gotorrent_request_timeouts_total", "Peers dropped for going quiet while blocks were requested from them.",
+		func(m client.Metrics) int { return m.RequestTimeouts })
+
+	header(bw, "gotorrent_peers", "gauge", "Connected peers by whether they're choking us.")
+	for _, torrent := range torrents {
+		fmt.Fprintf(bw, "gotorrent_peers{%s,state=\"choked\"} %d\n", torrent.labels, torrent.metrics.ChokedPeers)
+		fmt.Fprintf(bw, "gotorrent_peers{%s,state=\"unchoked\"} %d\n", torrent.labels, torrent.metrics.UnchokedPeers)
+	}
+
+	// torrents that haven't fetched their metadata, or didn't need to, are left out rather than reported as 0
+	header(bw, "gotorrent_metadata_fetch_seconds", "gauge", "How long fetching the metadata from peers took.")
+	for _, torrent := range torrents {
+		if torrent.metrics.MetadataFetch > 0 {
+			fmt.Fprintf(bw, "gotorrent_metadata_fetch_seconds{%s} %s\n", torrent.labels, formatFloat(torrent.metrics.MetadataFetch.Seconds()))
+		}
+	}
+
+	header(bw, "gotorrent_storage_write_seconds", "histogram", "How long writing each file to disk took.")
+	for _, torrent := range torrents {
+		writeHistogram(bw, "gotorrent_storage_write_seconds", torrent.labels, torrent.metrics.StorageWrites)
+	}
+
+	header(bw, "gotorrent_tracker_announces_total", "counter", "Announces to each tracker by whether they succeeded.")
+	for _, torrent := range torrents {
+		for _, tracker := range torrent.metrics.Trackers {
+			labels := fmt.Sprintf(`%s,tracker="%s"`, torrent.labels, escape(tracker.URL))
+			fmt.Fprintf(bw, "gotorrent_tracker_announces_total{%s,result=\"success\"} %d\n", labels, tracker.Successes)
+			fmt.Fprintf(bw, "gotorrent_tracker_announces_total{%s,result=\"failure\"} %d\n", labels, tracker.Failures)
+		}
+	}
+
+	header(bw, "gotorrent_tracker_announce_seconds", "histogram", "How long announces to each tracker took.")
+	for _, torrent := range torrents {
+		for _, tracker := range torrent.metrics.Trackers {
+			labels := fmt.Sprintf(`%s,tracker="%s"`, torrent.labels, escape(tracker.URL))
+			writeHistogram(bw, "gotorrent_tracker_announce_seconds", labels, tracker.Latency)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func header(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeHistogram writes the cumulative buckets of h followed by its sum and count
+func writeHistogram(w io.Writer, name string, labels string, h client.Histogram) {
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape makes s safe to use as a label value
+func escape(s string) string {
+	return labelEscaper.Replace(s)
+}
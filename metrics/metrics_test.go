@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"gotorrent/client"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	c, err := client.New(t.TempDir(), client.WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	torrent, err := c.AddMagnet("magnet:?xt=urn:btih:abababababababababababababababababababab&dn=a%22quoted%22%5Cname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Pause()
+
+	server := httptest.NewServer(Handler(c))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the text exposition format, got %q", contentType)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	labels := `info_hash="abababababababababababababababababababab",name="a\"quoted\"\\name"`
+	expected := []string{
+		"# TYPE gotorrent_torrents gauge\ngotorrent_torrents 1\n",
+		"# TYPE gotorrent_downloaded_bytes_total counter\ngotorrent_downloaded_bytes_total{" + labels + "} 0\n",
+		"gotorrent_pieces_verified_total{" + labels + "} 0\n",
+		"gotorrent_peers{" + labels + `,state="choked"} 0` + "\n",
+		"# TYPE gotorrent_storage_write_seconds histogram\n",
+		"gotorrent_storage_write_seconds_bucket{" + labels + `,le="+Inf"} 0` + "\n",
+		"gotorrent_storage_write_seconds_count{" + labels + "} 0\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Expected the metrics to contain %q, got\n%s", line, body)
+		}
+	}
+	if strings.Contains(string(body), "gotorrent_metadata_fetch_seconds{") {
+		t.Errorf("Didn't expect a metadata fetch duration before the metadata was fetched")
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	var buf bytes.Buffer
+	writeHistogram(&buf, "test_seconds", `a="b"`, client.Histogram{Buckets: []float64{0.5, 1}, Counts: []int{1, 3}, Sum: 2.25, Count: 4})
+
+	expected := `test_seconds_bucket{a="b",le="0.5"} 1
+test_seconds_bucket{a="b",le="1"} 3
+test_seconds_bucket{a="b",le="+Inf"} 4
+test_seconds_sum{a="b"} 2.25
+test_seconds_count{a="b"} 4
+`
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// maxBencodeDepth limits how deeply lists and dictionaries may be nested, so that malicious input can't exhaust the stack
+const maxBencodeDepth = 64
+
+var errMalformedBencode = errors.New("malformed bencode")
+
+// bencodeEnd returns the index just past the bencoded value which starts at data[start], without decoding it
+func bencodeEnd(data []byte, start int) (int, error) {
+	return bencodeEndDepth(data, start, 0)
+}
+
+func bencodeEndDepth(data []byte, start int, depth int) (int, error) {
+	if start >= len(data) || depth > maxBencodeDepth {
+		return 0, errMalformedBencode
+	}
+
+	switch c := data[start]; {
+	case c == 'i':
+		for i := start + 1; i < len(data); i++ {
+			if data[i] == 'e' {
+				if i == start+1 {
+					return 0, errMalformedBencode
+				}
+				return i + 1, nil
+			}
+			if (data[i] < '0' || data[i] > '9') && !(data[i] == '-' && i == start+1) {
+				return 0, errMalformedBencode
+			}
+		}
+		return 0, errMalformedBencode
+	case c == 'l' || c == 'd':
+		pos := start + 1
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := bencodeEndDepth(data, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, errMalformedBencode
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := start
+		for colon < len(data) && data[colon] != ':' {
+			colon++
+		}
+		if colon >= len(data) {
+			return 0, errMalformedBencode
+		}
+		length, err := strconv.Atoi(string(data[start:colon]))
+		if err != nil || length < 0 || length > len(data)-colon-1 {
+			return 0, errMalformedBencode
+		}
+		return colon + 1 + length, nil
+	default:
+		return 0, errMalformedBencode
+	}
+}
+
+// bencodeDict splits a bencoded dictionary into its keys and their raw (still encoded) values,
+// this lets us hash values such as the info dictionary byte for byte as we received them
+func bencodeDict(data []byte) (map[string][]byte, error) {
+	end, err := bencodeEnd(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if data[0] != 'd' || end != len(data) {
+		return nil, errMalformedBencode
+	}
+
+	dict := make(map[string][]byte)
+	pos := 1
+	for data[pos] != 'e' {
+		if data[pos] < '0' || data[pos] > '9' {
+			return nil, errMalformedBencode
+		}
+		keyEnd, err := bencodeEnd(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		colon := pos
+		for data[colon] != ':' {
+			colon++
+		}
+		key := string(data[colon+1 : keyEnd])
+
+		valueEnd, err := bencodeEnd(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = data[keyEnd:valueEnd]
+		pos = valueEnd
+	}
+	return dict, nil
+}
+
+// unmarshalUntrusted is bencode.Unmarshal for data that came from peers. The library allocates strings at whatever
+// length they claim and panics when a value is the wrong type for v, so the data is checked over first
+func unmarshalUntrusted(data []byte, v any) (err error) {
+	end, err := bencodeEnd(data, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("bencode doesn't fit %T: %v", v, r)
+		}
+	}()
+	return bencode.Unmarshal(bytes.NewReader(data[:end]), v)
+}
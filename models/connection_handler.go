@@ -1,7 +1,9 @@
 package models
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
 )
@@ -14,6 +16,12 @@ type ConnectionHandler struct {
 	torrent *Torrent
 	// channel for peers to notify connection handler that they've disconnected, allows us to not just run in a ticker
 	doneChan chan *Peer
+	// wakeChan is signalled when new peers are added to the torrent so that we can connect to them
+	wakeChan chan struct{}
+	// incomingChan receives peers that connected to us through the session's listener
+	incomingChan chan *Peer
+	// set once every tracker has been asked for peers, until then running out of good peers doesn't mean we should give up
+	announced atomic.Bool
 
 	// logger *log.Logger
 }
@@ -22,44 +30,142 @@ func newConnHandler(torrent *Torrent) *ConnectionHandler {
 	var ch ConnectionHandler
 	ch.torrent = torrent
 	ch.doneChan = make(chan *Peer)
+	ch.wakeChan = make(chan struct{}, 1)
+	ch.incomingChan = make(chan *Peer)
 	// ch.logger = log.New(torrent.logFile, "[Connection Handler] ", log.Ltime|log.Lshortfile)
 	//	ch.logger.SetOutput(io.Discard)
 	return &ch
 }
 
-func (ch *ConnectionHandler) run() {
+// run connects to peers until every one of them is bad or ctx is done, at which point it disconnects from the
+// peers it's connected to, waiting for them to finish
+func (ch *ConnectionHandler) run(ctx context.Context) {
 	defer log.Info().Msg("Finished running")
 	//	defer ch.logger.Println("Finished running")
 
 	for {
+		if ctx.Err() != nil {
+			ch.closeConnections()
+			return
+		}
 		badPeers := 0
 		alivePeers := 0
+		paused := ch.torrent.paused.Load()
+		if paused {
+			// they'll come back through doneChan as they disconnect
+			ch.closeActive()
+		}
 		// attempt to fill up missing connections to reach max_peers
-		for i := 0; i < len(ch.torrent.peers); i++ {
+		ch.torrent.peersMx.Lock()
+	peers:
+		for i := 0; i < len(ch.torrent.peers) && !paused; i++ {
 			if len(ch.activeConns) >= ch.torrent.maxPeers {
 				break
 			}
-			switch ch.torrent.peers[i].status {
+			switch ch.torrent.peers[i].status.Load() {
 			case Bad:
 				badPeers++
-				if i == len(ch.torrent.peers)-1 && badPeers == len(ch.torrent.peers) {
+				// a seed waits for peers to come to it instead
+				if i == len(ch.torrent.peers)-1 && badPeers == len(ch.torrent.peers) && ch.announced.Load() && !ch.torrent.seed {
 					// all peers are bad
+					ch.torrent.peersMx.Unlock()
+					ch.closeConnections()
 					return
 				}
 			case Alive:
 				alivePeers++
 				continue
 			default:
-				ch.activeConns = append(ch.activeConns, &ch.torrent.peers[i])
-				ch.torrent.peers[i].status = Alive
+				if ch.isActive(ch.torrent.peers[i]) {
+					// they've stopped but haven't finished yet, running them again now would have two of them share the peer
+					continue
+				}
+				if !ch.torrent.acquireConn() {
+					// every connection in the session is in use, we'll be woken once one is released
+					break peers
+				}
+				ch.activeConns = append(ch.activeConns, ch.torrent.peers[i])
+				ch.torrent.peers[i].status.Store(Alive)
 				//				ch.logger.Printf(" + %s", ch.torrent.peers[i].String())
-				go ch.activeConns[len(ch.activeConns)-1].run(ch.doneChan)
+				go ch.activeConns[len(ch.activeConns)-1].run(ctx, ch.doneChan)
 			}
 		}
 		log.Info().Msg(fmt.Sprintf("Bad: %d Alive: %d Total: %d\n", badPeers, alivePeers, len(ch.torrent.peers)))
+		ch.torrent.peersMx.Unlock()
 		//		ch.logger.Printf("Bad: %d Alive: %d Total: %d\n", badPeers, alivePeers, len(ch.torrent.peers))
 		//		ch.logger.Println("------------------------")
-		ch.removeConnection(<-ch.doneChan) // block until someone disconnects
+		// seeding carries on once we've downloaded everything
+		done := ch.torrent.done
+		if ch.torrent.seed {
+			done = nil
+		}
+		// block until someone disconnects or new peers are found
+		select {
+		case peer := <-ch.doneChan:
+			ch.removeConnection(peer)
+		case <-ch.wakeChan:
+		case peer := <-ch.incomingChan:
+			ch.activeConns = append(ch.activeConns, peer)
+			go peer.run(ctx, ch.doneChan)
+		case <-done:
+			// nothing left to download, this stops us on the next loop
+			ch.torrent.stop()
+		case <-ctx.Done():
+		}
+	}
+}
+
+// addIncoming hands over a peer that connected to us, which already holds one of the session's connections
+func (ch *ConnectionHandler) addIncoming(peer *Peer) {
+	select {
+	case ch.incomingChan <- peer:
+	case <-ch.torrent.ctx.Done():
+		peer.conn.Close()
+		ch.torrent.releaseConn()
+	}
+}
+
+// isActive returns whether peer is running or has yet to tell us that it's finished
+func (ch *ConnectionHandler) isActive(peer *Peer) bool {
+	for _, active := range ch.activeConns {
+		if active == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// closeActive closes the connection of every active peer, which makes them finish running
+func (ch *ConnectionHandler) closeActive() {
+	// their connections are set under peersMx as they connect
+	ch.torrent.peersMx.Lock()
+	defer ch.torrent.peersMx.Unlock()
+	for _, peer := range ch.activeConns {
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+	}
+}
+
+// closeConnections disconnects every active peer, waiting for each of them to finish
+func (ch *ConnectionHandler) closeConnections() {
+	ch.closeActive()
+	for len(ch.activeConns) != 0 {
+		ch.removeConnection(<-ch.doneChan)
+	}
+}
+
+// doneAnnouncing is called once the trackers have all been asked for peers
+func (ch *ConnectionHandler) doneAnnouncing() {
+	ch.announced.Store(true)
+	ch.wake()
+}
+
+// wake tells the connection handler that new peers are available, without blocking if it has already been told
+func (ch *ConnectionHandler) wake() {
+	select {
+	case ch.wakeChan <- struct{}{}:
+	default:
 	}
 }
 
@@ -67,6 +173,8 @@ func (ch *ConnectionHandler) run() {
 func (ch *ConnectionHandler) removeConnection(peer *Peer) {
 	//	ch.logger.Printf(" - %s", peer.String())
 	peer.disconnect()
+	ch.torrent.releaseConn()
+	ch.torrent.requestFromIdlePeers()
 	if len(ch.activeConns) == 1 {
 		ch.activeConns = []*Peer{}
 	} else {
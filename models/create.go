@@ -0,0 +1,337 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Bounds for automatically chosen piece lengths, which aim for around targetNumPieces pieces
+const (
+	minPieceLen     = 16 * 1024
+	maxPieceLen     = 16 * 1024 * 1024
+	targetNumPieces = 1500
+)
+
+// CreateOptions describes a torrent to be created from local files
+type CreateOptions struct {
+	Path         string     // file or directory to create the torrent from
+	Name         string     // defaults to the base name of Path
+	PieceLen     int        // must be a power of two of at least 16KiB, chosen from the total size if 0
+	Trackers     [][]string // tiers of tracker urls, the first tracker is also used as the announce url
+	WebSeeds     []string   // BEP 19 url-list
+	Comment      string
+	CreatedBy    string    // defaults to "gotorrent"
+	CreationDate time.Time // defaults to now
+	Private      bool
+	Workers      int // number of goroutines hashing pieces, defaults to the number of CPUs
+}
+
+// createFile is a file found while walking CreateOptions.Path
+type createFile struct {
+	path     string // on disk
+	metadata MetadataFile
+}
+
+// CreateTorrent walks the file or directory at opts.Path and hashes it into a new torrent
+func CreateTorrent(opts CreateOptions) (*MetaInfo, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var md Metadata
+	md.Name = opts.Name
+	if md.Name == "" {
+		md.Name = filepath.Base(root)
+	}
+	if opts.Private {
+		md.Private = 1
+	}
+
+	var files []createFile
+	if stat.IsDir() {
+		files, err = walkCreateFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("directory contains no files")
+		}
+		for _, file := range files {
+			md.Files = append(md.Files, file.metadata)
+		}
+	} else {
+		files = []createFile{{path: root, metadata: MetadataFile{Length: int(stat.Size())}}}
+		md.Length = int(stat.Size())
+		if stat.Mode()&0111 != 0 {
+			md.Attr = string(AttrExecutable)
+		}
+	}
+
+	var total int64
+	for _, file := range files {
+		total += int64(file.metadata.Length)
+	}
+	if total == 0 {
+		return nil, errors.New("torrent would not contain any data")
+	}
+
+	md.PieceLen = opts.PieceLen
+	if md.PieceLen == 0 {
+		md.PieceLen = choosePieceLen(total)
+	}
+	if md.PieceLen < minPieceLen || md.PieceLen&(md.PieceLen-1) != 0 {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d bytes", minPieceLen)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	md.Pieces, err = hashFiles(files, total, md.PieceLen, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	var info bytes.Buffer
+	err = bencode.Marshal(&info, md)
+	if err != nil {
+		return nil, err
+	}
+
+	mi := &MetaInfo{
+		AnnounceList: opts.Trackers,
+		URLList:      opts.WebSeeds,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate.Unix(),
+		InfoBytes:    info.Bytes(),
+	}
+	if len(opts.Trackers) > 0 && len(opts.Trackers[0]) > 0 {
+		mi.Announce = opts.Trackers[0][0]
+	}
+	if mi.CreatedBy == "" {
+		mi.CreatedBy = "gotorrent"
+	}
+	if opts.CreationDate.IsZero() {
+		mi.CreationDate = time.Now().Unix()
+	}
+	return mi, nil
+}
+
+// walkCreateFiles lists every file under root in the order they'll appear in the torrent,
+// symlinks are kept as BEP 47 symlinks as long as they point somewhere inside root
+func walkCreateFiles(root string) ([]createFile, error) {
+	var files []createFile
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		file := createFile{path: path, metadata: MetadataFile{Path: strings.Split(filepath.ToSlash(rel), "/")}}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return err
+			}
+			targetRel, err := filepath.Rel(root, target)
+			if err != nil || strings.HasPrefix(targetRel, "..") {
+				return fmt.Errorf("%s links outside of the torrent", rel)
+			}
+			file.metadata.Attr = string(AttrSymlink)
+			file.metadata.SymlinkPath = strings.Split(filepath.ToSlash(targetRel), "/")
+			files = append(files, file)
+			return nil
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		file.metadata.Length = int(info.Size())
+		if info.Mode()&0111 != 0 {
+			file.metadata.Attr = string(AttrExecutable)
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// WalkDir is already lexical, but make the order explicit as it determines the info hash
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Join(files[i].metadata.Path, "/") < strings.Join(files[j].metadata.Path, "/")
+	})
+	return files, nil
+}
+
+// choosePieceLen picks the smallest power of two piece length which keeps the number of pieces near targetNumPieces
+func choosePieceLen(total int64) int {
+	pieceLen := minPieceLen
+	for pieceLen < maxPieceLen && (total+int64(pieceLen)-1)/int64(pieceLen) > targetNumPieces {
+		pieceLen *= 2
+	}
+	return pieceLen
+}
+
+// hashJob is a single piece waiting to be hashed
+type hashJob struct {
+	index int
+	data  []byte
+}
+
+// hashFiles reads files as one contiguous stream of total bytes and returns the concatenated sha1 hashes of each piece,
+// reading happens sequentially while hashing is spread across workers
+func hashFiles(files []createFile, total int64, pieceLen int, workers int) (string, error) {
+	hashes := make([]byte, (total+int64(pieceLen)-1)/int64(pieceLen)*sha1.Size)
+	jobs := make(chan hashJob, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				checksum := sha1.Sum(job.data)
+				copy(hashes[job.index*sha1.Size:], checksum[:])
+			}
+		}()
+	}
+
+	err := func() error {
+		defer close(jobs)
+
+		var index int
+		buf := make([]byte, 0, pieceLen)
+		for _, file := range files {
+			if file.metadata.Attr == string(AttrSymlink) {
+				continue
+			}
+			f, err := os.Open(file.path)
+			if err != nil {
+				return err
+			}
+			for read := 0; read < file.metadata.Length; {
+				n, err := io.ReadFull(f, buf[len(buf):min(cap(buf), len(buf)+file.metadata.Length-read)])
+				buf = buf[:len(buf)+n]
+				read += n
+				if err != nil {
+					f.Close()
+					return fmt.Errorf("%s changed while hashing: %w", file.path, err)
+				}
+				if len(buf) == cap(buf) {
+					jobs <- hashJob{index, buf}
+					index++
+					buf = make([]byte, 0, pieceLen)
+				}
+			}
+			f.Close()
+		}
+		if len(buf) > 0 {
+			jobs <- hashJob{index, buf}
+		}
+		return nil
+	}()
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	return string(hashes), nil
+}
+
+// Encode writes the torrent file, the info dictionary is written exactly as stored so that its hash doesn't change
+func (mi *MetaInfo) Encode(w io.Writer) error {
+	// keys must be written in sorted order, which bencode.Marshal can't do for us around the raw info dictionary
+	var b bytes.Buffer
+	writeKey := func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%d:%s", len(key), key)
+		_ = bencode.Marshal(&b, value) // only strings, ints and lists of them, which can't fail
+	}
+
+	b.WriteString("d")
+	if mi.Announce != "" {
+		writeKey("announce", mi.Announce)
+	}
+	if len(mi.AnnounceList) != 0 {
+		writeKey("announce-list", mi.AnnounceList)
+	}
+	if mi.Comment != "" {
+		writeKey("comment", mi.Comment)
+	}
+	if mi.CreatedBy != "" {
+		writeKey("created by", mi.CreatedBy)
+	}
+	if mi.CreationDate != 0 {
+		writeKey("creation date", mi.CreationDate)
+	}
+	if len(mi.HTTPSeeds) != 0 {
+		writeKey("httpseeds", mi.HTTPSeeds)
+	}
+	b.WriteString("4:info")
+	b.Write(mi.InfoBytes)
+	if len(mi.URLList) != 0 {
+		writeKey("url-list", mi.URLList)
+	}
+	b.WriteString("e")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// MagnetLink returns a magnet link for the torrent, listing its trackers and web seeds
+func (mi *MetaInfo) MagnetLink() (string, error) {
+	var md Metadata
+	err := bencode.Unmarshal(bytes.NewReader(mi.InfoBytes), &md)
+	if err != nil {
+		return "", err
+	}
+	length := md.Length
+	for _, file := range md.Files {
+		length += file.Length
+	}
+
+	infoHash := sha1.Sum(mi.InfoBytes)
+	ml := Magnet{DisplayName: md.Name, InfoHash: infoHash[:], ExactLength: length, WebSeeds: mi.URLList}
+	if md.MetaVersion == 2 {
+		ml.InfoHashV2 = v2InfoHash(mi.InfoBytes)
+	}
+	for _, trackerURL := range mi.trackerURLs() {
+		link, err := url.Parse(trackerURL)
+		if err != nil {
+			return "", err
+		}
+		ml.Trackers = append(ml.Trackers, NewTracker(*link))
+	}
+	return ml.String(), nil
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateTorrentRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "artifacts")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0770)
+
+	first := make([]byte, 3*BlockLen+17)
+	rand.Read(first)
+	os.WriteFile(filepath.Join(dir, "first"), first, 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "run.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	mi, err := CreateTorrent(CreateOptions{
+		Path:     dir,
+		PieceLen: BlockLen,
+		Trackers: [][]string{{"udp://tracker.example.com:1337/announce"}, {"https://tracker.example.com/announce"}},
+		WebSeeds: []string{"https://mirror.example.com/"},
+		Comment:  "test",
+		Private:  true,
+		Workers:  3,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+
+	var encoded bytes.Buffer
+	if err := mi.Encode(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMetaInfo(encoded.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse created torrent: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, mi) {
+		t.Errorf("Parsed torrent %+v does not match created torrent %+v", parsed, mi)
+	}
+
+	torrent, err := NewTorrentFromMetaInfo(parsed, 10)
+	if err != nil {
+		t.Fatalf("Could not load created torrent: %v", err)
+	}
+	if !torrent.isPrivate() || len(torrent.trackers) != 2 || len(torrent.webSeeds) != 1 {
+		t.Errorf("Torrent did not keep its private flag, trackers and web seeds")
+	}
+
+	expectedFiles := []MetadataFile{
+		{Length: len(first), Path: []string{"first"}},
+		{Length: 10, Path: []string{"sub", "run.sh"}, Attr: "x"},
+	}
+	if !reflect.DeepEqual(torrent.metadata.Files, expectedFiles) {
+		t.Errorf("Unexpected files %+v", torrent.metadata.Files)
+	}
+
+	data := append(append([]byte{}, first...), []byte("#!/bin/sh\n")...)
+	if torrent.metadata.Pieces != hashPieces(data, BlockLen) {
+		t.Errorf("Piece hashes do not match the data")
+	}
+
+	magnetLink, err := mi.MagnetLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	magnet, err := NewMagnet(magnetLink)
+	if err != nil {
+		t.Fatalf("Could not parse magnet link %s: %v", magnetLink, err)
+	}
+	infoHash := sha1.Sum(mi.InfoBytes)
+	if magnet.DisplayName != "artifacts" || len(magnet.Trackers) != 2 || !strings.Contains(magnetLink, hex.EncodeToString(infoHash[:])) {
+		t.Errorf("Unexpected magnet link %s", magnetLink)
+	}
+}
+
+func TestChoosePieceLen(t *testing.T) {
+	testCases := []struct {
+		total    int64
+		expected int
+	}{
+		{total: 0, expected: minPieceLen},
+		{total: 1500 * minPieceLen, expected: minPieceLen},
+		{total: 1500*minPieceLen + 1, expected: 2 * minPieceLen},
+		{total: 1 << 50, expected: maxPieceLen},
+	}
+
+	for _, tc := range testCases {
+		if got := choosePieceLen(tc.total); got != tc.expected {
+			t.Errorf("Expected piece length %d for %d bytes, got %d", tc.expected, tc.total, got)
+		}
+	}
+}
+
+func TestMalformedMetaInfo(t *testing.T) {
+	testCases := []struct {
+		name string
+		md   Metadata
+	}{
+		{name: "zero piece length", md: Metadata{Name: "x", Length: 10, Pieces: strings.Repeat("h", 20)}},
+		{name: "no data", md: Metadata{Name: "x", PieceLen: BlockLen}},
+		{name: "too few hashes", md: Metadata{Name: "x", PieceLen: BlockLen, Length: 3 * BlockLen, Pieces: strings.Repeat("h", 40)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mi := &MetaInfo{Announce: "https://tracker.example.com/announce", InfoBytes: malformedInfo(tc.md)}
+			var encoded bytes.Buffer
+			if err := mi.Encode(&encoded); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseMetaInfo(encoded.Bytes()); !errors.Is(err, ErrBadMetadata) {
+				t.Errorf("Expected parsing to fail with %v, got %v", ErrBadMetadata, err)
+			}
+			// which a MetaInfo that wasn't parsed doesn't get past either
+			if _, err := NewTorrentFromMetaInfo(mi, 10); !errors.Is(err, ErrBadMetadata) {
+				t.Errorf("Expected adding to fail with %v, got %v", ErrBadMetadata, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package models
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Types of Event
+const (
+	EventMetadataReceived = 0
+	EventPieceVerified    = 1
+	EventPieceHashFailed  = 2
+	EventFileCompleted    = 3 // the file has been written to disk
+	EventTorrentCompleted = 4
+	EventPeerConnected    = 5
+	EventPeerDisconnected = 6 // Err is the reason, nil if we hung up on them
+	EventTrackerAnnounce  = 7 // Err is set if the announce failed
+	EventStorageError     = 8
+	EventMetadataFailed   = 9 // Err is why the metadata couldn't be used, the torrent stops
+)
+
+var eventTypeNames = map[int]string{
+	EventMetadataReceived: "metadata received",
+	EventPieceVerified:    "piece verified",
+	EventPieceHashFailed:  "piece hash failed",
+	EventFileCompleted:    "file completed",
+	EventTorrentCompleted: "torrent completed",
+	EventPeerConnected:    "peer connected",
+	EventPeerDisconnected: "peer disconnected",
+	EventTrackerAnnounce:  "tracker announce",
+	EventStorageError:     "storage error",
+	EventMetadataFailed:   "metadata failed",
+}
+
+// EventName returns a human readable name for one of the Event constants
+func EventName(eventType int) string {
+	return eventTypeNames[eventType]
+}
+
+// Event is something that happened to a torrent, only the fields relevant to its Type are set
+type Event struct {
+	Type     int
+	Time     time.Time
+	InfoHash []byte // the info hash the torrent was added with
+	Name     string // the torrent's name at the time
+
+	Piece   int    // piece events
+	File    string // file and storage events, the path on disk
+	Peer    string // peer events, the peer's address
+	Tracker string // tracker events, the tracker's url with any passkeys redacted
+	Seeders int    // tracker events
+	Err     error
+
+	torrent *Torrent
+}
+
+// MaxQueuedEvents is how many events a Subscription holds for a subscriber that has fallen behind
+const MaxQueuedEvents = 4096
+
+// Subscription receives events from a torrent or session until it is closed. Events are queued if the subscriber
+// falls behind, up to MaxQueuedEvents, past which the oldest are dropped to make room and counted by Dropped
+type Subscription struct {
+	bus        *eventBus
+	infoHashes [][]byte // only events for torrents known by one of these are delivered, every event if empty
+
+	ch      chan Event
+	queue   []Event
+	dropped int
+	mx      sync.Mutex
+	wake    chan struct{}
+
+	done      chan struct{} // closed to stop delivering events
+	drain     bool          // deliver the remaining queue before closing ch
+	closeOnce sync.Once
+}
+
+// Events returns the channel events are delivered on, it's closed once the subscription is closed
+func (sub *Subscription) Events() <-chan Event {
+	return sub.ch
+}
+
+// Dropped returns how many events have been dropped because the subscriber fell too far behind
+func (sub *Subscription) Dropped() int {
+	sub.mx.Lock()
+	defer sub.mx.Unlock()
+	return sub.dropped
+}
+
+// Close stops delivering events, dropping any that haven't been received yet
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+// Drain stops delivering new events, closing the channel once every event already published has been received.
+// Use it to finish reading a torrent's events once it's done
+func (sub *Subscription) Drain() {
+	sub.bus.unsubscribe(sub)
+	sub.closeAfterDrain()
+}
+
+// closeAfterDrain stops queueing new events, closing the channel once the queue has been received
+func (sub *Subscription) closeAfterDrain() {
+	sub.mx.Lock()
+	sub.drain = true
+	sub.mx.Unlock()
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+func (sub *Subscription) wants(ev Event) bool {
+	if len(sub.infoHashes) == 0 {
+		return true
+	}
+	for _, swarmHash := range ev.torrent.swarmHashes() {
+		for _, infoHash := range sub.infoHashes {
+			if bytes.Equal(swarmHash, infoHash) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sub *Subscription) push(ev Event) {
+	sub.mx.Lock()
+	if len(sub.queue) >= MaxQueuedEvents {
+		sub.queue = sub.queue[1:]
+		sub.dropped++
+	}
+	sub.queue = append(sub.queue, ev)
+	sub.mx.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands queued events to the subscriber one at a time
+func (sub *Subscription) run() {
+	defer close(sub.ch)
+	for {
+		sub.mx.Lock()
+		if len(sub.queue) == 0 {
+			sub.mx.Unlock()
+			select {
+			case <-sub.wake:
+				continue
+			case <-sub.done:
+				if !sub.drainRemaining() {
+					return
+				}
+				continue
+			}
+		}
+		ev := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mx.Unlock()
+
+		// nothing is received after Close returns, even if the subscriber is still reading
+		select {
+		case <-sub.done:
+			if !sub.draining() {
+				return
+			}
+		default:
+		}
+		select {
+		case sub.ch <- ev:
+		case <-sub.done:
+			if !sub.draining() {
+				return
+			}
+			sub.ch <- ev
+		}
+	}
+}
+
+func (sub *Subscription) draining() bool {
+	sub.mx.Lock()
+	defer sub.mx.Unlock()
+	return sub.drain
+}
+
+// drainRemaining returns whether there are still events to deliver after the subscription was closed
+func (sub *Subscription) drainRemaining() bool {
+	sub.mx.Lock()
+	defer sub.mx.Unlock()
+	return sub.drain && len(sub.queue) != 0
+}
+
+// eventBus fans events out to subscribers, each session has one shared by its torrents
+type eventBus struct {
+	subs map[*Subscription]bool
+	mx   sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*Subscription]bool)}
+}
+
+func (bus *eventBus) subscribe(infoHashes [][]byte) *Subscription {
+	sub := &Subscription{
+		bus:  bus,
+		ch:   make(chan Event),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	// the swarm, and so the torrent's hashes, only use the first 20 bytes of a v2 hash
+	for _, infoHash := range infoHashes {
+		if len(infoHash) > 20 {
+			infoHash = infoHash[:20]
+		}
+		sub.infoHashes = append(sub.infoHashes, infoHash)
+	}
+
+	bus.mx.Lock()
+	bus.subs[sub] = true
+	bus.mx.Unlock()
+	go sub.run()
+	return sub
+}
+
+func (bus *eventBus) unsubscribe(sub *Subscription) {
+	bus.mx.Lock()
+	delete(bus.subs, sub)
+	bus.mx.Unlock()
+}
+
+func (bus *eventBus) publish(ev Event) {
+	bus.mx.Lock()
+	defer bus.mx.Unlock()
+	for sub := range bus.subs {
+		if sub.wants(ev) {
+			sub.push(ev)
+		}
+	}
+}
+
+// close ends every subscription once its subscriber has received everything already published
+func (bus *eventBus) close() {
+	bus.mx.Lock()
+	defer bus.mx.Unlock()
+	for sub := range bus.subs {
+		delete(bus.subs, sub)
+		sub.closeAfterDrain()
+	}
+}
+
+// Subscribe returns a subscription to this torrent's events
+func (torrent *Torrent) Subscribe() *Subscription {
+	return torrent.events.subscribe(torrent.swarmHashes())
+}
+
+// emit publishes an event about this torrent to its subscribers
+func (torrent *Torrent) emit(ev Event) {
+	ev.Time = torrent.clock.Now()
+	ev.Name = torrent.name
+	if hashes := torrent.swarmHashes(); len(hashes) != 0 {
+		ev.InfoHash = hashes[0]
+	}
+	ev.torrent = torrent
+	torrent.events.publish(ev)
+}
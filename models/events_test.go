@@ -0,0 +1,165 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	checkLeaks := checkGoroutineLeaks(t)
+	defer checkLeaks()
+
+	first := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{1}, 20)}, 1)
+	second := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{2}, 20)}, 1)
+	bus := newEventBus()
+	first.events = bus
+	second.events = bus
+
+	testCases := []struct {
+		name     string
+		sub      *Subscription
+		expected []int // pieces of the events we should receive, in order
+	}{
+		{
+			name:     "every torrent",
+			sub:      bus.subscribe(nil),
+			expected: []int{0, 1, 2},
+		},
+		{
+			name:     "first torrent",
+			sub:      first.Subscribe(),
+			expected: []int{0, 2},
+		},
+		{
+			name:     "second torrent by its hash",
+			sub:      bus.subscribe([][]byte{second.infoHash}),
+			expected: []int{1},
+		},
+	}
+
+	// nobody is receiving yet, so these have to be queued rather than dropped or blocking
+	first.emit(Event{Type: EventPieceVerified, Piece: 0})
+	second.emit(Event{Type: EventPieceVerified, Piece: 1})
+	first.emit(Event{Type: EventPieceHashFailed, Piece: 2})
+	// events already published are still delivered once the bus is closed
+	bus.close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var pieces []int
+			timeout := time.After(time.Second)
+		receive:
+			for {
+				select {
+				case ev, ok := <-tc.sub.Events():
+					if !ok {
+						break receive
+					}
+					if ev.torrent != first && ev.torrent != second || ev.Time.IsZero() {
+						t.Errorf("Event is missing its torrent or time: %+v", ev)
+					}
+					pieces = append(pieces, ev.Piece)
+				case <-timeout:
+					t.Fatal("Subscription was not closed")
+				}
+			}
+			if len(pieces) != len(tc.expected) {
+				t.Fatalf("Expected events for pieces %v, got %v", tc.expected, pieces)
+			}
+			for i := range pieces {
+				if pieces[i] != tc.expected[i] {
+					t.Errorf("Expected events for pieces %v, got %v", tc.expected, pieces)
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	checkLeaks := checkGoroutineLeaks(t)
+	defer checkLeaks()
+
+	torrent := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{1}, 20)}, 1)
+	sub := torrent.Subscribe()
+	torrent.emit(Event{Type: EventMetadataReceived})
+	sub.Close()
+	sub.Close()
+	torrent.emit(Event{Type: EventTorrentCompleted})
+
+	// closing drops anything not yet received
+	select {
+	case ev, ok := <-sub.Events():
+		if ok {
+			t.Errorf("Received %s after closing", EventName(ev.Type))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Events channel was not closed")
+	}
+}
+
+func TestSubscriptionDrain(t *testing.T) {
+	checkLeaks := checkGoroutineLeaks(t)
+	defer checkLeaks()
+
+	torrent := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{1}, 20)}, 1)
+	sub := torrent.Subscribe()
+	torrent.emit(Event{Type: EventFileCompleted})
+	torrent.emit(Event{Type: EventTorrentCompleted})
+	sub.Drain()
+	torrent.emit(Event{Type: EventPeerConnected})
+
+	// draining delivers what was already published, but nothing after
+	var received []int
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				if len(received) != 2 || received[0] != EventFileCompleted || received[1] != EventTorrentCompleted {
+					t.Errorf("Expected the file and torrent completed events, got %v", received)
+				}
+				return
+			}
+			received = append(received, ev.Type)
+		case <-timeout:
+			t.Fatal("Events channel was not closed")
+		}
+	}
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	checkLeaks := checkGoroutineLeaks(t)
+	defer checkLeaks()
+
+	torrent := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{1}, 20)}, 1)
+	sub := torrent.Subscribe()
+	defer sub.Close()
+	const published = MaxQueuedEvents + 10
+	for i := 0; i < published; i++ {
+		torrent.emit(Event{Type: EventPieceVerified, Piece: i})
+	}
+
+	// the oldest are dropped, bar one that may already be on its way to us
+	var received []int
+	timeout := time.After(5 * time.Second)
+	for len(received)+sub.Dropped() < published {
+		select {
+		case ev := <-sub.Events():
+			received = append(received, ev.Piece)
+		case <-timeout:
+			t.Fatalf("Expected %d events to be received or dropped, got %d and %d", published, len(received), sub.Dropped())
+		}
+	}
+	if dropped := sub.Dropped(); dropped != 9 && dropped != 10 {
+		t.Errorf("Expected 10 events to be dropped, got %d", dropped)
+	}
+	for i := 1; i < len(received); i++ {
+		if received[i] <= received[i-1] {
+			t.Fatalf("Expected events in order, got %d after %d", received[i], received[i-1])
+		}
+	}
+	if last := received[len(received)-1]; last != published-1 {
+		t.Errorf("Expected the newest event to be kept, got %d last", last)
+	}
+}
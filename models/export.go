@@ -0,0 +1,110 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MetadataReady returns a channel which is closed once the torrent's metadata is available, either from a
+// .torrent file or from peers
+func (torrent *Torrent) MetadataReady() <-chan struct{} {
+	return torrent.metadataReady
+}
+
+// MetaInfo returns a complete .torrent for this torrent, with the trackers and web seeds we know of
+func (torrent *Torrent) MetaInfo() (*MetaInfo, error) {
+	if !torrent.hasMetadata.Load() {
+		return nil, errors.New("torrent does not have its metadata yet")
+	}
+
+	mi := MetaInfo{
+		CreatedBy:    "gotorrent",
+		CreationDate: time.Now().Unix(),
+		InfoBytes:    torrent.metadataRaw,
+	}
+	// keep what the original .torrent said about itself
+	if torrent.metaInfo != nil {
+		mi.Comment = torrent.metaInfo.Comment
+		mi.CreatedBy = torrent.metaInfo.CreatedBy
+		mi.CreationDate = torrent.metaInfo.CreationDate
+		// along with its tiers of trackers, which we'd lose going by torrent.trackers
+		mi.Announce = torrent.metaInfo.Announce
+		for _, tier := range torrent.metaInfo.AnnounceList {
+			mi.AnnounceList = append(mi.AnnounceList, append([]string(nil), tier...))
+		}
+	} else {
+		// magnet links don't order their trackers, so each becomes its own tier
+		for _, tracker := range torrent.trackers {
+			mi.AnnounceList = append(mi.AnnounceList, []string{tracker.link.String()})
+		}
+		if len(mi.AnnounceList) != 0 {
+			mi.Announce = mi.AnnounceList[0][0]
+		}
+	}
+
+	for _, ws := range torrent.webSeeds {
+		if ws.style == HoffmanStyle {
+			mi.HTTPSeeds = append(mi.HTTPSeeds, ws.url)
+		} else {
+			mi.URLList = append(mi.URLList, ws.url)
+		}
+	}
+	return &mi, nil
+}
+
+// ExportTorrentFile writes a complete .torrent for this torrent to path
+func (torrent *Torrent) ExportTorrentFile(path string) error {
+	mi, err := torrent.MetaInfo()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that we never leave a partial .torrent behind
+	file, err := os.CreateTemp(filepath.Dir(path), ".gotorrent-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = mi.Encode(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// ExportFileName is <name>.torrent, made safe to use as a file name as the name comes from the metadata or magnet
+// link. It's where a .torrent is exported to by default
+func (torrent *Torrent) ExportFileName() string {
+	return safePathElement(torrent.name) + ".torrent"
+}
+
+// MagnetLink returns a canonical magnet link for this torrent, including its exact length once the metadata is known
+func (torrent *Torrent) MagnetLink() string {
+	ml := Magnet{
+		DisplayName: torrent.name,
+		Trackers:    torrent.trackers,
+		InfoHash:    torrent.infoHash,
+		InfoHashV2:  torrent.infoHashV2,
+	}
+	if torrent.magnet != nil {
+		ml.ExactTopic = torrent.magnet.ExactTopic
+	}
+	if torrent.hasMetadata.Load() {
+		ml.ExactLength = torrent.metadata.Length
+	}
+	for _, ws := range torrent.webSeeds {
+		// only GetRight-style seeds can be given in a magnet link
+		if ws.style == GetRightStyle {
+			ml.WebSeeds = append(ml.WebSeeds, ws.url)
+		}
+	}
+	return ml.String()
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestExportFromMagnet(t *testing.T) {
+	data := bytes.Repeat([]byte("gotorrent"), 5000)
+	var info bytes.Buffer
+	bencode.Marshal(&info, Metadata{Name: "export", PieceLen: BlockLen, Pieces: hashPieces(data, BlockLen), Length: len(data)})
+	infoHash := sha1.Sum(info.Bytes())
+
+	first, _ := url.Parse("udp://tracker.example.com:1337/announce")
+	second, _ := url.Parse("https://tracker.example.com/announce?passkey=abc")
+	torrent := NewTorrent(&Magnet{
+		DisplayName: "export",
+		Trackers:    []*Tracker{NewTracker(*first), NewTracker(*second)},
+		WebSeeds:    []string{"https://mirror.example.com/export"},
+	}, 10)
+	torrent.infoHash = infoHash[:]
+
+	if _, err := torrent.MetaInfo(); err == nil {
+		t.Errorf("Expected an error exporting a torrent without metadata")
+	}
+
+	// pretend the metadata arrived from peers
+	torrent.metadataRaw = info.Bytes()
+	if err := torrent.parseMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	torrent.hasMetadata.Store(true)
+
+	path := filepath.Join(t.TempDir(), "export.torrent")
+	if err := torrent.ExportTorrentFile(path); err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	exported, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := ParseMetaInfo(exported)
+	if err != nil {
+		t.Fatalf("Exported torrent could not be parsed: %v", err)
+	}
+
+	if !bytes.Equal(mi.InfoBytes, info.Bytes()) {
+		t.Errorf("Exported info dictionary does not match the metadata")
+	}
+	expectedTrackers := [][]string{{first.String()}, {second.String()}}
+	if mi.Announce != first.String() || !reflect.DeepEqual(mi.AnnounceList, expectedTrackers) {
+		t.Errorf("Unexpected trackers %s %v", mi.Announce, mi.AnnounceList)
+	}
+	if !reflect.DeepEqual(mi.URLList, []string{"https://mirror.example.com/export"}) {
+		t.Errorf("Unexpected web seeds %v", mi.URLList)
+	}
+
+	expectedMagnet := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&xl=45000&dn=export" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A1337%2Fannounce&tr=https%3A%2F%2Ftracker.example.com%2Fannounce%3Fpasskey%3Dabc" +
+		"&ws=https%3A%2F%2Fmirror.example.com%2Fexport"
+	if got := torrent.MagnetLink(); got != expectedMagnet {
+		t.Errorf("Expected magnet link %s, got %s", expectedMagnet, got)
+	}
+}
+
+func TestExportKeepsTiers(t *testing.T) {
+	mi := newSeedData(t, t.TempDir())
+	mi.Announce = "udp://backup.example.com:1337/announce"
+	mi.AnnounceList = [][]string{
+		{"https://first.example.com/announce", "https://second.example.com/announce"},
+		{"udp://backup.example.com:1337/announce"},
+	}
+	torrent, err := NewTorrentFromMetaInfo(mi, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := torrent.MetaInfo()
+	if err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if exported.Announce != mi.Announce || !reflect.DeepEqual(exported.AnnounceList, mi.AnnounceList) {
+		t.Errorf("Expected the original trackers %s %v, got %s %v", mi.Announce, mi.AnnounceList, exported.Announce, exported.AnnounceList)
+	}
+}
+
+func TestExportFileName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "ubuntu.iso", expected: "ubuntu.iso.torrent"},
+		{name: "../../.bashrc", expected: ".._.._.bashrc.torrent"},
+		{name: "/etc/passwd", expected: "_etc_passwd.torrent"},
+		{name: "..", expected: "_.torrent"},
+		{name: "", expected: "_.torrent"},
+	}
+
+	for _, tc := range testCases {
+		torrent := NewTorrent(&Magnet{DisplayName: tc.name}, 10)
+		if got := torrent.ExportFileName(); got != tc.expected {
+			t.Errorf("Expected %q for %q, got %q", tc.expected, tc.name, got)
+		}
+	}
+}
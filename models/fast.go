@@ -0,0 +1,169 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	allowedFastCount = 10 // pieces we let each peer request while we're choking them
+	maxAllowedFast   = 64 // that we keep track of from a peer, so one can't make us remember every piece
+	maxSuggestions   = 32
+)
+
+// allowedFastSet returns the k pieces that a peer at ip may request while choked, generated from its /24 and the
+// info hash as BEP 6 describes, so that every client picks the same ones and they can't be had more of by
+// reconnecting. It's empty for IPv6 addresses, which BEP 6 doesn't cover
+func allowedFastSet(ip string, infoHash []byte, numPieces int, k int) []int {
+	ipv4 := net.ParseIP(ip).To4()
+	k = min(k, numPieces)
+	if ipv4 == nil || k == 0 {
+		return nil
+	}
+	x := append([]byte{ipv4[0], ipv4[1], ipv4[2], 0}, infoHash...)
+	var set []int
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[4*i:]) % uint32(numPieces))
+			if !containsPiece(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+func containsPiece(pieces []int, index int) bool {
+	for _, piece := range pieces {
+		if piece == index {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsFast returns whether a handshake's reserved bytes have the fast extension's bit set
+func supportsFast(reserved []byte) bool {
+	return reserved[7]&0x04 != 0
+}
+
+// sendHaves tells a peer that supports the fast extension which pieces we have, which has to be HAVE ALL or HAVE
+// NONE if we have everything or nothing, followed by the pieces they can request before we unchoke them
+func (peer *Peer) sendHaves() error {
+	torrent := peer.torrent
+	bits := torrent.bitfield()
+	var message Message
+	switch {
+	case bits == nil:
+		message = haveNoneMessage{}.encode()
+	case int(torrent.numPiecesDownloaded.Load()) == len(torrent.pieces):
+		message = haveAllMessage{}.encode()
+	default:
+		message = bitfieldMessage{bits}.encode()
+	}
+	packet := message.marshall()
+
+	if bits != nil {
+		peer.grantedFast = make(map[int]bool)
+		for _, index := range allowedFastSet(peer.ip, peer.infoHash, len(torrent.pieces), allowedFastCount) {
+			// there's no point letting them request what we can't send
+			if !torrent.hasPiece(index) {
+				continue
+			}
+			peer.grantedFast[index] = true
+			allowed := allowedFastMessage{index}.encode()
+			packet = append(packet, allowed.marshall()...)
+		}
+	}
+	_, err := peer.conn.Write(packet)
+	return err
+}
+
+// rejectRequest tells a peer that supports the fast extension that we won't send the block they requested, other
+// peers are left to time out
+func (peer *Peer) rejectRequest(request blockRequest) {
+	if peer.fast {
+		peer.pw.write(rejectMessage(request).encode())
+	}
+}
+
+// setHaveAll handles HAVE ALL or HAVE NONE, which replace the bitfield of peers that support the fast extension
+func (peer *Peer) setHaveAll(hasAll bool) {
+	peer.hasAll = hasAll
+	peer.bitfield = nil
+}
+
+// suggest remembers a piece they suggested, which we download from them before any other
+func (peer *Peer) suggest(index int) {
+	peer.fastMx.Lock()
+	defer peer.fastMx.Unlock()
+	if len(peer.suggested) == maxSuggestions {
+		peer.suggested = peer.suggested[1:]
+	}
+	peer.suggested = append(peer.suggested, index)
+}
+
+// allowFast remembers a piece they'll let us request while they're choking us, returning whether it's worth
+// requesting pieces because of it
+func (peer *Peer) allowFast(index int) bool {
+	peer.fastMx.Lock()
+	defer peer.fastMx.Unlock()
+	if len(peer.allowedFast) == maxAllowedFast {
+		return false
+	}
+	if peer.allowedFast == nil {
+		peer.allowedFast = make(map[int]bool)
+	}
+	peer.allowedFast[index] = true
+	return peer.choked.Load() && peer.torrent.hasMetadata.Load()
+}
+
+// hasAllowedFast returns whether they've allowed us to request any pieces while they're choking us
+func (peer *Peer) hasAllowedFast() bool {
+	peer.fastMx.Lock()
+	defer peer.fastMx.Unlock()
+	return len(peer.allowedFast) > 0
+}
+
+// releaseRequest handles a REJECT REQUEST for a block. They won't send it, so it no longer counts against their
+// requests, and its piece goes back on the queue so that someone else can download it. Rejecting something we never
+// asked for is an error
+func (peer *Peer) releaseRequest(request blockRequest) error {
+	index := request.index
+	peer.requestsMX.Lock()
+	if !peer.requested[request] {
+		peer.requestsMX.Unlock()
+		return errInvalidMessage
+	}
+	delete(peer.requested, request)
+	peer.requestsMX.Unlock()
+
+	// any of its blocks that still arrive are skipped when it's requested again
+	torrent := peer.torrent
+	if peer.pieceQueue.remove(index) && !torrent.hasPiece(index) && !torrent.pieceQueue.contains(index) {
+		torrent.pieceQueue.push(index)
+	}
+	return nil
+}
+
+// pickPiece takes a piece off the torrent's queue for us to download from them, preferring one they suggested.
+// While they're choking us it has to be one they've allowed us to request anyway
+func (peer *Peer) pickPiece() (int, bool) {
+	peer.fastMx.Lock()
+	defer peer.fastMx.Unlock()
+	canRequest := func(index int) bool {
+		hasPiece, _ := peer.hasPiece(index)
+		return hasPiece && (!peer.choked.Load() || peer.allowedFast[index])
+	}
+	for len(peer.suggested) > 0 {
+		index := peer.suggested[len(peer.suggested)-1]
+		peer.suggested = peer.suggested[:len(peer.suggested)-1]
+		if canRequest(index) && peer.torrent.pieceQueue.remove(index) {
+			return index, true
+		}
+	}
+	return peer.torrent.pieceQueue.popFirst(canRequest)
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+
+	// the examples from BEP 6
+	testCases := []struct {
+		name      string
+		ip        string
+		numPieces int
+		k         int
+		expected  []int
+	}{
+		{name: "7 pieces", ip: "80.4.4.200", numPieces: 1313, k: 7, expected: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{name: "9 pieces", ip: "80.4.4.200", numPieces: 1313, k: 9, expected: []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{name: "same /24", ip: "80.4.4.1", numPieces: 1313, k: 7, expected: []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{name: "fewer pieces than k", ip: "80.4.4.200", numPieces: 3, k: 10, expected: []int{1, 2, 0}},
+		{name: "ipv6", ip: "2001:db8::1", numPieces: 1313, k: 7, expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if set := allowedFastSet(tc.ip, infoHash, tc.numPieces, tc.k); !reflect.DeepEqual(set, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, set)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileEntry is a file from the metadata along with where its data lives in the torrent's contiguous byte stream
+type fileEntry struct {
+	path        string   // path on disk, including the download directory
+	torrentPath []string // path within the torrent as given by the metadata, empty for single file torrents
+	offset      int      // offset of the first byte of this file within the torrent
+	length      int
+	attr        string
+	symlinkPath []string // only set for symlinks, relative to the torrent's root directory
+	priority    int
+}
+
+func (entry *fileEntry) hasAttr(flag byte) bool {
+	return strings.IndexByte(entry.attr, flag) != -1
+}
+
+// fileEntries lays out every file of the torrent, including padding files, in the order their data appears
+func (torrent *Torrent) fileEntries() []fileEntry {
+	md := torrent.metadata
+	if len(md.Files) == 0 {
+		return []fileEntry{{path: filepath.Join(torrent.downloadDir, safePathElement(md.Name)), length: md.Length, attr: md.Attr, priority: torrent.filePriorities[0]}}
+	}
+
+	root := filepath.Join(torrent.downloadDir, safePathElement(md.Name))
+	entries := make([]fileEntry, 0, len(md.Files))
+	var offset int
+	for i, file := range md.Files {
+		entries = append(entries, fileEntry{
+			path:        filepath.Join(root, safePath(file.Path)),
+			torrentPath: file.Path,
+			offset:      offset,
+			length:      file.Length,
+			attr:        file.Attr,
+			symlinkPath: file.SymlinkPath,
+			priority:    torrent.filePriorities[i],
+		})
+		offset += file.Length
+	}
+	return entries
+}
+
+// DeleteFiles removes every file of the torrent that has been written to the download directory, along with the
+// torrent's directory for multi-file torrents
+func (torrent *Torrent) DeleteFiles() error {
+	if !torrent.hasMetadata.Load() {
+		return nil
+	}
+
+	// don't race with the files being written
+	torrent.downloadedMx.Lock()
+	defer torrent.downloadedMx.Unlock()
+	if len(torrent.metadata.Files) != 0 {
+		return os.RemoveAll(torrent.rootDir())
+	}
+	err := os.Remove(torrent.fileEntries()[0].path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// rootDir returns the directory that a multi-file torrent's files live in, symlink paths are relative to it
+func (torrent *Torrent) rootDir() string {
+	return filepath.Join(torrent.downloadDir, safePathElement(torrent.metadata.Name))
+}
+
+// safePath joins the path elements of a file from the metadata, making sure a malicious torrent can't escape the download directory
+func safePath(elements []string) string {
+	cleaned := make([]string, len(elements))
+	for i, element := range elements {
+		cleaned[i] = safePathElement(element)
+	}
+	return filepath.Join(cleaned...)
+}
+
+func safePathElement(element string) string {
+	element = strings.ReplaceAll(element, "/", "_")
+	element = strings.ReplaceAll(element, string(filepath.Separator), "_")
+	if element == "" || element == "." || element == ".." {
+		return "_"
+	}
+	return element
+}
+
+// readAt copies len(buf) bytes of downloaded data starting at offset (within the whole torrent) into buf
+func (torrent *Torrent) readAt(buf []byte, offset int) error {
+	if offset < 0 || offset+len(buf) > torrent.metadata.Length {
+		return errors.New("read is out of the torrent's bounds")
+	}
+
+	for copied := 0; copied < len(buf); {
+		pos := offset + copied
+		pieceIndex := pos / torrent.metadata.PieceLen
+		blockIndex := pos % torrent.metadata.PieceLen / BlockLen
+		blockOffset := pos % torrent.metadata.PieceLen % BlockLen
+
+		data := torrent.pieces[pieceIndex].blocks[blockIndex].data
+		if blockOffset >= len(data) {
+			return errors.New("block has not been downloaded")
+		}
+		copied += copy(buf[copied:], data[blockOffset:])
+	}
+	return nil
+}
+
+// writeFile writes a single file to disk, padding files are skipped entirely and symlinks are created rather than written
+func (torrent *Torrent) writeFile(entry fileEntry) error {
+	if entry.hasAttr(AttrPadding) {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(entry.path), 0770)
+	if err != nil {
+		return err
+	}
+
+	if entry.hasAttr(AttrSymlink) {
+		target, err := filepath.Rel(filepath.Dir(entry.path), filepath.Join(torrent.rootDir(), safePath(entry.symlinkPath)))
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(entry.path)
+		return os.Symlink(target, entry.path)
+	}
+
+	file, err := os.Create(entry.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// write in piece sized chunks so we don't need to hold a second copy of the file in memory
+	buf := make([]byte, torrent.metadata.PieceLen)
+	for written := 0; written < entry.length; {
+		chunk := buf[:min(len(buf), entry.length-written)]
+		err = torrent.readAt(chunk, entry.offset+written)
+		if err != nil {
+			return err
+		}
+		n, err := file.Write(chunk)
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+
+	return applyFileAttributes(entry)
+}
+
+// applyFileAttributes applies the executable and hidden attributes to a file that has been written
+func applyFileAttributes(entry fileEntry) error {
+	if entry.hasAttr(AttrExecutable) {
+		err := os.Chmod(entry.path, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if entry.hasAttr(AttrHidden) {
+		return setHidden(entry.path)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package models
+
+// setHidden is a no-op outside of windows, where hidden files are only a naming convention and
+// renaming the file would break the torrent's layout
+func setHidden(path string) error {
+	return nil
+}
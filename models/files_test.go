@@ -0,0 +1,128 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTorrent returns a torrent with md as its metadata and every block already downloaded from data
+func newTestTorrent(t *testing.T, md Metadata, data []byte) *Torrent {
+	t.Helper()
+
+	torrent := &Torrent{downloadDir: t.TempDir(), metadata: md, events: newEventBus(), clock: SystemClock}
+	torrent.metadata.Length = len(data)
+	for offset := 0; offset < len(data); offset += md.PieceLen {
+		torrent.pieces = append(torrent.pieces, Piece{})
+		piece := &torrent.pieces[len(torrent.pieces)-1]
+		for block := offset; block < min(offset+md.PieceLen, len(data)); block += BlockLen {
+			piece.blocks = append(piece.blocks, Block{data[block:min(block+BlockLen, offset+md.PieceLen, len(data))]})
+		}
+	}
+	torrent.initFilePriorities()
+	torrent.setOutput(io.Discard)
+	return torrent
+}
+
+func TestBuildFileWithAttributes(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, BlockLen+100)
+	padding := make([]byte, 2*BlockLen-100)
+	second := bytes.Repeat([]byte{2}, 500)
+
+	md := Metadata{
+		Name:     "hybrid",
+		PieceLen: 2 * BlockLen,
+		Files: []MetadataFile{
+			{Length: len(first), Path: []string{"bin", "run"}, Attr: "x"},
+			{Length: len(padding), Path: []string{".pad", "32668"}, Attr: "p"},
+			{Length: len(second), Path: []string{"data"}},
+			{Length: 0, Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"data"}},
+		},
+	}
+	torrent := newTestTorrent(t, md, append(append(append([]byte{}, first...), padding...), second...))
+	torrent.buildFile()
+
+	root := filepath.Join(torrent.downloadDir, "hybrid")
+
+	got, err := os.ReadFile(filepath.Join(root, "bin", "run"))
+	if err != nil || !bytes.Equal(got, first) {
+		t.Errorf("bin/run was not written correctly: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(root, "bin", "run"))
+	if err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("bin/run is not executable")
+	}
+
+	got, err = os.ReadFile(filepath.Join(root, "data"))
+	if err != nil || !bytes.Equal(got, second) {
+		t.Errorf("data was not written correctly: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("padding file was written to disk")
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "link"))
+	if err != nil || target != "data" {
+		t.Errorf("expected link to point to data, got %q (%v)", target, err)
+	}
+}
+
+func TestCheckHybrid(t *testing.T) {
+	testCases := []struct {
+		md           Metadata
+		expectsError bool
+	}{
+		{
+			md: Metadata{
+				Files:    []MetadataFile{{Length: 10, Path: []string{"a"}}, {Length: 6, Path: []string{".pad", "6"}, Attr: "p"}, {Length: 3, Path: []string{"b", "c"}}},
+				FileTree: []MetadataFile{{Length: 10, Path: []string{"a"}}, {Length: 3, Path: []string{"b", "c"}}},
+			},
+			expectsError: false,
+		},
+		{
+			md: Metadata{
+				Files:    []MetadataFile{{Length: 10, Path: []string{"a"}}},
+				FileTree: []MetadataFile{{Length: 11, Path: []string{"a"}}},
+			},
+			expectsError: true,
+		},
+		{
+			md: Metadata{
+				Name:     "single",
+				Length:   5,
+				FileTree: []MetadataFile{{Length: 5, Path: []string{"single"}}, {Length: 1, Path: []string{"extra"}}},
+			},
+			expectsError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := tc.md.checkHybrid()
+		if tc.expectsError && err == nil {
+			t.Errorf("Expected error but got nil")
+		}
+		if !tc.expectsError && err != nil {
+			t.Errorf("Expected no error but got: %v", err)
+		}
+	}
+}
+
+func TestParseFileTree(t *testing.T) {
+	tree := map[string]interface{}{
+		"b": map[string]interface{}{"": map[string]interface{}{"length": int64(3)}},
+		"a": map[string]interface{}{
+			"c": map[string]interface{}{"": map[string]interface{}{"length": int64(1)}},
+		},
+	}
+
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	if len(files) != 2 || filepath.Join(files[0].Path...) != filepath.Join("a", "c") || files[1].Length != 3 {
+		t.Errorf("Unexpected files %+v", files)
+	}
+}
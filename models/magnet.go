@@ -1,15 +1,58 @@
 package models
 
 import (
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
+// Errors wrapped by MagnetError, to be checked with errors.Is
+var (
+	ErrNotMagnet        = errors.New("not a magnet link")
+	ErrMissingTopic     = errors.New("magnet is missing a supported xt param")
+	ErrInvalidTopic     = errors.New("xt param is not a urn")
+	ErrInvalidInfoHash  = errors.New("invalid info hash")
+	ErrInvalidLength    = errors.New("invalid exact length")
+	ErrInvalidPeer      = errors.New("invalid peer address")
+	ErrInvalidSelection = errors.New("invalid file selection")
+	ErrInvalidURL       = errors.New("invalid url")
+)
+
+// MagnetError is returned when a magnet link can't be parsed, Param is the parameter that was rejected
+type MagnetError struct {
+	Param string
+	Value string
+	Err   error
+}
+
+func (err *MagnetError) Error() string {
+	if err.Param == "" {
+		return err.Err.Error()
+	}
+	return fmt.Sprintf("magnet param %s=%q: %s", err.Param, err.Value, err.Err)
+}
+
+func (err *MagnetError) Unwrap() error {
+	return err.Err
+}
+
 type Magnet struct {
-	DisplayName string
-	Trackers    []*Tracker
-	ExactTopic  string
+	DisplayName       string
+	Trackers          []*Tracker
+	ExactTopic        string   // the first xt param, without its "urn:" prefix
+	WebSeeds          []string // BEP 19 web seeds given by ws params
+	InfoHash          []byte   // v1 (sha1) info hash
+	InfoHashV2        []byte   // v2 (sha256) info hash
+	ExactLength       int      // total size of the torrent in bytes, 0 if unknown
+	PeerAddresses     []string // x.pe, host:port pairs of peers to connect to directly
+	ExactSources      []string // xs, urls of the .torrent file
+	AcceptableSources []string // as, fallback urls of the .torrent file
+	SelectOnly        []int    // so, indices of the files to download (BEP 53), empty means all of them
 }
 
 func NewMagnet(linkRaw string) (*Magnet, error) {
@@ -17,52 +60,244 @@ func NewMagnet(linkRaw string) (*Magnet, error) {
 
 	link, err := url.Parse(linkRaw)
 	if err != nil {
-		return nil, err
+		return nil, &MagnetError{Err: fmt.Errorf("%w: %s", ErrNotMagnet, err)}
 	}
 
 	if link.Scheme != "magnet" {
-		return nil, errors.New("not a magnet link")
+		return nil, &MagnetError{Err: ErrNotMagnet}
 	}
 
-	params := link.Query()
-
-	// all params can be found here: https://en.wikipedia.org/wiki/Magnet_URI_scheme
-	xt, ok := params["xt"]
-	if !ok {
-		return nil, errors.New("magnet is missing xt param")
-	}
-	if len(xt) != 1 {
-		return nil, errors.New(fmt.Sprintf("xt has wrong number of values, 1 expected, %d received", len(xt)))
-	}
-	xtParsed, err := url.Parse(xt[0])
+	params, err := url.ParseQuery(link.RawQuery)
 	if err != nil {
-		return nil, err
+		return nil, &MagnetError{Err: fmt.Errorf("%w: %s", ErrNotMagnet, err)}
 	}
 
-	if xtParsed.Scheme != "urn" {
-		return nil, errors.New("magnet xt param missing urn")
+	// all params can be found here: https://en.wikipedia.org/wiki/Magnet_URI_scheme
+	for _, xt := range params["xt"] {
+		err = ml.parseExactTopic(xt)
+		if err != nil {
+			return nil, &MagnetError{"xt", xt, err}
+		}
+	}
+	if len(ml.InfoHash) == 0 && len(ml.InfoHashV2) == 0 {
+		return nil, &MagnetError{Err: ErrMissingTopic}
 	}
-	ml.ExactTopic = xtParsed.Opaque
 
 	displayNames := params["dn"]
-	if len(displayNames) == 1 {
+	if len(displayNames) >= 1 {
 		ml.DisplayName = displayNames[0]
 	}
 
+	if xl := params.Get("xl"); xl != "" {
+		ml.ExactLength, err = strconv.Atoi(xl)
+		if err != nil || ml.ExactLength < 0 {
+			return nil, &MagnetError{"xl", xl, ErrInvalidLength}
+		}
+	}
+
 	trackers := params["tr"]
 	ml.Trackers = make([]*Tracker, 0)
 	for _, trackerUrl := range trackers {
 		// convert raw url string to url.URL
 		url, err := url.Parse(trackerUrl)
 		if err != nil {
-			return nil, err
+			return nil, &MagnetError{"tr", trackerUrl, ErrInvalidURL}
 		}
 		ml.Trackers = append(ml.Trackers, NewTracker(*url))
 	}
 
-	for _, t := range ml.Trackers {
-		fmt.Println(t)
+	for _, peer := range params["x.pe"] {
+		_, port, err := net.SplitHostPort(peer)
+		if err != nil || port == "0" {
+			return nil, &MagnetError{"x.pe", peer, ErrInvalidPeer}
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, &MagnetError{"x.pe", peer, ErrInvalidPeer}
+		}
+		ml.PeerAddresses = append(ml.PeerAddresses, peer)
+	}
+
+	ml.WebSeeds, err = parseMagnetURLs(params, "ws")
+	if err != nil {
+		return nil, err
+	}
+	ml.ExactSources, err = parseMagnetURLs(params, "xs")
+	if err != nil {
+		return nil, err
+	}
+	ml.AcceptableSources, err = parseMagnetURLs(params, "as")
+	if err != nil {
+		return nil, err
+	}
+
+	if so := params.Get("so"); so != "" {
+		ml.SelectOnly, err = parseSelectOnly(so)
+		if err != nil {
+			return nil, &MagnetError{"so", so, err}
+		}
 	}
 
 	return &ml, nil
 }
+
+// parseExactTopic reads an xt param, which may be a v1 (btih) or v2 (btmh) info hash
+func (ml *Magnet) parseExactTopic(xt string) error {
+	topic, ok := strings.CutPrefix(xt, "urn:")
+	if !ok {
+		return ErrInvalidTopic
+	}
+	if ml.ExactTopic == "" {
+		ml.ExactTopic = topic
+	}
+
+	scheme, hash, _ := strings.Cut(topic, ":")
+	switch scheme {
+	case "btih":
+		infoHash, err := decodeInfoHash(hash)
+		if err != nil {
+			return err
+		}
+		ml.InfoHash = infoHash
+	case "btmh":
+		// a multihash, of which only sha256 (0x12) with a length of 32 (0x20) is used by BEP 52
+		multihash, err := hex.DecodeString(hash)
+		if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+			return ErrInvalidInfoHash
+		}
+		ml.InfoHashV2 = multihash[2:]
+	}
+	// other urns (ed2k, sha1...) are for other networks and ignored
+	return nil
+}
+
+// decodeInfoHash decodes a v1 info hash, which is either 40 hex characters or 32 base32 characters
+func decodeInfoHash(hash string) ([]byte, error) {
+	var decoded []byte
+	var err error
+
+	switch len(hash) {
+	case 40:
+		decoded, err = hex.DecodeString(hash)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+	default:
+		return nil, ErrInvalidInfoHash
+	}
+	if err != nil || len(decoded) != 20 {
+		return nil, ErrInvalidInfoHash
+	}
+	return decoded, nil
+}
+
+// parseMagnetURLs returns every value of param, making sure each is an absolute url
+func parseMagnetURLs(params url.Values, param string) ([]string, error) {
+	var urls []string
+	for _, raw := range params[param] {
+		link, err := url.Parse(raw)
+		if err != nil || !link.IsAbs() {
+			return nil, &MagnetError{param, raw, ErrInvalidURL}
+		}
+		urls = append(urls, raw)
+	}
+	return urls, nil
+}
+
+// maxSelectOnly is how many file indices an so param may list, counting those its ranges cover, and is past the
+// highest index it may list
+const maxSelectOnly = 1 << 16
+
+// parseSelectOnly parses a BEP 53 file selection, a comma separated list of indices and inclusive ranges, eg "0,2,4-6"
+func parseSelectOnly(so string) ([]int, error) {
+	var selection []int
+	seen := map[int]bool{}
+	total := 0
+
+	for _, part := range strings.Split(so, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 {
+			return nil, ErrInvalidSelection
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(to)
+			if err != nil || last < first {
+				return nil, ErrInvalidSelection
+			}
+		}
+		// guard against a huge range like 0-999999999, or the same range over and over, taking forever. No torrent
+		// has that many files. Checked before adding so that a range up to MaxInt can't overflow total
+		if last >= maxSelectOnly || last-first >= maxSelectOnly-total {
+			return nil, ErrInvalidSelection
+		}
+		total += last - first + 1
+
+		for i := first; i <= last; i++ {
+			if !seen[i] {
+				seen[i] = true
+				selection = append(selection, i)
+			}
+		}
+	}
+	return selection, nil
+}
+
+// formatSelectOnly is the inverse of parseSelectOnly, collapsing consecutive indices into ranges
+func formatSelectOnly(selection []int) string {
+	var parts []string
+	for i := 0; i < len(selection); {
+		j := i
+		for j+1 < len(selection) && selection[j+1] == selection[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, strconv.Itoa(selection[i])+"-"+strconv.Itoa(selection[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(selection[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// String returns the magnet link, with the trackers' urls kept intact
+func (ml *Magnet) String() string {
+	var topics []string
+	if len(ml.InfoHash) != 0 {
+		topics = append(topics, "btih:"+hex.EncodeToString(ml.InfoHash))
+	}
+	if len(ml.InfoHashV2) != 0 {
+		// BEP 52 - v2 hashes are given as multihashes, where 0x12 0x20 denotes a 32 byte sha256 hash
+		topics = append(topics, "btmh:1220"+hex.EncodeToString(ml.InfoHashV2))
+	}
+	if len(topics) == 0 {
+		topics = append(topics, ml.ExactTopic)
+	}
+
+	link := "magnet:?xt=urn:" + strings.Join(topics, "&xt=urn:")
+	if ml.ExactLength != 0 {
+		link += "&xl=" + strconv.Itoa(ml.ExactLength)
+	}
+	if ml.DisplayName != "" {
+		link += "&dn=" + url.QueryEscape(ml.DisplayName)
+	}
+	for _, tracker := range ml.Trackers {
+		link += "&tr=" + url.QueryEscape(tracker.link.String())
+	}
+	for _, webSeed := range ml.WebSeeds {
+		link += "&ws=" + url.QueryEscape(webSeed)
+	}
+	for _, source := range ml.ExactSources {
+		link += "&xs=" + url.QueryEscape(source)
+	}
+	for _, source := range ml.AcceptableSources {
+		link += "&as=" + url.QueryEscape(source)
+	}
+	for _, peer := range ml.PeerAddresses {
+		link += "&x.pe=" + url.QueryEscape(peer)
+	}
+	if len(ml.SelectOnly) != 0 {
+		link += "&so=" + formatSelectOnly(ml.SelectOnly)
+	}
+	return link
+}
@@ -1,34 +1,177 @@
 package models
 
-// func TestNewMagnet(t *testing.T) {
-// 	testCases := []struct {
-// 		testLink     string
-// 		expected     Magnet
-// 		expectsError bool
-// 	}{
-// 		{
-// 			testLink:     "magnet:?xt=urn:btih:fffffffffffffffffffffffffffffffffffffff&dn=example&tr=https://example.com",
-// 			expected:     Magnet{DisplayName: "example", Trackers: []string{"https://example.com"}, ExactTopic: "btih:fffffffffffffffffffffffffffffffffffffff"},
-// 			expectsError: false,
-// 		},
-// 	}
-//
-// 	for _, tc := range testCases {
-// 		magnet, err := NewMagnet(tc.testLink)
-//
-// 		if tc.expectsError {
-// 			if err == nil {
-// 				t.Errorf("Expected error but got nil")
-// 			}
-// 		} else {
-// 			if err != nil {
-// 				t.Errorf("Expected no error but got: %v", err)
-// 			}
-//
-// 			// Compare the returned Magnet with the expected Magnet
-// 			if !reflect.DeepEqual(magnet, &tc.expected) {
-// 				t.Errorf("Returned Magnet %+v does not match expected %+v", magnet, tc.expected)
-// 			}
-// 		}
-// 	}
-// }
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestNewMagnet(t *testing.T) {
+	infoHash, _ := hex.DecodeString("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	infoHashV2, _ := hex.DecodeString("d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb")
+
+	testCases := []struct {
+		testLink    string
+		expected    Magnet
+		expectedErr error
+	}{
+		{
+			testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=example",
+			expected: Magnet{DisplayName: "example", ExactTopic: "btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", InfoHash: infoHash},
+		},
+		{
+			// base32 encoded info hash
+			testLink: "magnet:?xt=urn:btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek",
+			expected: Magnet{ExactTopic: "btih:yex6dqdlxisuvhoj6um3gnnkpqjwpkek", InfoHash: infoHash},
+		},
+		{
+			// hybrid torrent
+			testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb",
+			expected: Magnet{ExactTopic: "btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", InfoHash: infoHash, InfoHashV2: infoHashV2},
+		},
+		{
+			testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xl=1024&x.pe=10.0.0.1:6881&x.pe=[::1]:51413" +
+				"&ws=https://mirror.example.com/file&xs=https://example.com/file.torrent&as=https://backup.example.com/file.torrent&so=0,2,4-6",
+			expected: Magnet{
+				ExactTopic:        "btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+				InfoHash:          infoHash,
+				ExactLength:       1024,
+				PeerAddresses:     []string{"10.0.0.1:6881", "[::1]:51413"},
+				WebSeeds:          []string{"https://mirror.example.com/file"},
+				ExactSources:      []string{"https://example.com/file.torrent"},
+				AcceptableSources: []string{"https://backup.example.com/file.torrent"},
+				SelectOnly:        []int{0, 2, 4, 5, 6},
+			},
+		},
+		{testLink: "https://example.com", expectedErr: ErrNotMagnet},
+		{testLink: "magnet:?xt=btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", expectedErr: ErrInvalidTopic},
+		{testLink: "magnet:?dn=example", expectedErr: ErrMissingTopic},
+		{testLink: "magnet:?xt=urn:btih:fffffffffffffffffffffffffffffffffffffff", expectedErr: ErrInvalidInfoHash},
+		{testLink: "magnet:?xt=urn:btih:zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz", expectedErr: ErrInvalidInfoHash},
+		{testLink: "magnet:?xt=urn:btmh:1114c12fe1c06bba254a9dc9f519b335aa7c1367a88a", expectedErr: ErrInvalidInfoHash},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xl=-1", expectedErr: ErrInvalidLength},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=10.0.0.1", expectedErr: ErrInvalidPeer},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=10.0.0.1:99999", expectedErr: ErrInvalidPeer},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1", expectedErr: ErrInvalidSelection},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=0-999999999", expectedErr: ErrInvalidSelection},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=0-9223372036854775807", expectedErr: ErrInvalidSelection},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=1,9223372036854775807", expectedErr: ErrInvalidSelection},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=" + strings.Repeat("0-60000,", 2) + "1", expectedErr: ErrInvalidSelection},
+		{testLink: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xs=file.torrent", expectedErr: ErrInvalidURL},
+	}
+
+	for _, tc := range testCases {
+		magnet, err := NewMagnet(tc.testLink)
+
+		if tc.expectedErr != nil {
+			if !errors.Is(err, tc.expectedErr) {
+				t.Errorf("Expected error %v for %s but got %v", tc.expectedErr, tc.testLink, err)
+			}
+			var magnetErr *MagnetError
+			if err != nil && !errors.As(err, &magnetErr) {
+				t.Errorf("Expected a *MagnetError but got %T", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error but got: %v", err)
+			continue
+		}
+
+		// Compare the returned Magnet with the expected Magnet
+		tc.expected.Trackers = []*Tracker{}
+		if !reflect.DeepEqual(magnet, &tc.expected) {
+			t.Errorf("Returned Magnet %+v does not match expected %+v", magnet, tc.expected)
+		}
+	}
+}
+
+func TestMagnetRoundTrip(t *testing.T) {
+	links := []string{
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xl=1024&dn=example+file&tr=udp%3A%2F%2Ftracker.example.com%3A1337%2Fannounce",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&xt=urn:btmh:1220d8dd32ac93357c368556af3ac1d95c9d76bd0dff6fa9833ecdac3d53134efabb",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&ws=https%3A%2F%2Fmirror.example.com%2F&xs=https%3A%2F%2Fexample.com%2Fa.torrent" +
+			"&as=https%3A%2F%2Fexample.org%2Fa.torrent&x.pe=10.0.0.1%3A6881&so=0-2%2C5",
+	}
+
+	for _, link := range links {
+		magnet, err := NewMagnet(link)
+		if err != nil {
+			t.Fatalf("Expected no error but got: %v", err)
+		}
+		// so is written unescaped
+		expected := link
+		expected = string(bytes.ReplaceAll([]byte(expected), []byte("%2C"), []byte(",")))
+		if got := magnet.String(); got != expected {
+			t.Errorf("Expected %s to round trip, got %s", expected, got)
+		}
+	}
+}
+
+func TestMagnetTorrent(t *testing.T) {
+	data := bytes.Repeat([]byte("magnet"), 10000)
+	md := Metadata{
+		Name:     "selected",
+		PieceLen: BlockLen,
+		Pieces:   hashPieces(data, BlockLen),
+		Files: []MetadataFile{
+			{Length: 30000, Path: []string{"a"}},
+			{Length: 20000, Path: []string{"b"}},
+			{Length: 10000, Path: []string{"c"}},
+		},
+	}
+	var info bytes.Buffer
+	bencode.Marshal(&info, md)
+	infoHash := sha1.Sum(info.Bytes())
+
+	var served bytes.Buffer
+	(&MetaInfo{InfoBytes: info.Bytes()}).Encode(&served)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/wrong.torrent" {
+			(&MetaInfo{InfoBytes: []byte("d4:name5:wronge")}).Encode(w)
+			return
+		}
+		w.Write(served.Bytes())
+	}))
+	defer server.Close()
+
+	magnet, err := NewMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&x.pe=10.0.0.1:6881&so=2" +
+		"&xs=" + server.URL + "/wrong.torrent&as=" + server.URL + "/right.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := NewTorrent(magnet, 10)
+	torrent.downloadDir = t.TempDir()
+
+	if !bytes.Equal(torrent.infoHash, infoHash[:]) {
+		t.Errorf("Torrent did not take its info hash from the magnet link")
+	}
+	if len(torrent.peers) != 1 || torrent.peers[0].ip != "10.0.0.1" || torrent.peers[0].source != PeerSourceMagnet {
+		t.Errorf("Torrent did not add the magnet link's peers: %v", torrent.peers)
+	}
+
+	// the metadata is also written to the working directory
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	torrent.fetchSources()
+	if !torrent.hasMetadata.Load() {
+		t.Fatalf("Torrent did not fetch its metadata from the magnet link's sources")
+	}
+
+	// only the pieces overlapping the third file (bytes 50000-59999) are wanted
+	expected := []bool{false, false, false, true}
+	if !reflect.DeepEqual(torrent.wantedPieces, expected) || len(torrent.pieceQueue.pieces) != 1 {
+		t.Errorf("Expected wanted pieces %v, got %v", expected, torrent.wantedPieces)
+	}
+}
@@ -2,7 +2,6 @@ package models
 
 import (
 	"bytes"
-	"encoding/binary"
 
 	bencode "github.com/jackpal/bencode-go"
 )
@@ -16,13 +15,15 @@ const (
 	Have          = 4
 	Bitfield      = 5
 	Request       = 6
-	PIECE         = 7 //TODO
+	PIECE         = 7 // in capitals as the Piece type has the name
 	Cancel        = 8
 	Port          = 9
+	Suggest       = 13 // the fast extension's (BEP 6)
+	HaveAll       = 14
+	HaveNone      = 15
+	Reject        = 16
+	AllowedFast   = 17
 	Extended      = 20
-
-	// Stop is for internal use only, and sent to the peer_writer when it should shut down
-	Stop = 99
 )
 
 // Message is what is marshalled and sent/received from the peer of the form <length prefix><message ID><payload>
@@ -64,44 +65,21 @@ type MetadataResponse struct {
 	TotalSize int `bencode:"total_size"`
 }
 
-func (message *Message) marshall() []byte {
-	packet := make([]byte, 4) // len_prefix (4) + id (1)
-	binary.BigEndian.PutUint32(packet[0:], message.lengthPrefix)
-	packet = append(packet, uint8(message.id))
-	if message.payload != nil {
-		packet = append(packet, message.payload...)
-	}
-	return packet
-}
-
-func (message *ExtendedMessage) marshall() []byte {
-	packet := make([]byte, 4) // lengthPrefix (4) + id (1) + extended_id (1) + remaining payload
-	lengthPrefix := uint32(len(message.payload) + 2)
-	binary.BigEndian.PutUint32(packet[0:], lengthPrefix)
-	packet = append(packet, uint8(message.id))
-	packet = append(packet, uint8(message.extendedID))
-	packet = append(packet, message.payload...)
-
-	return packet
-}
-
 func encodeMetadataRequest(pieceNumber int) string {
 	var b bytes.Buffer
 	var data MetadataRequest
-	data.MsgType = 0
+	data.MsgType = metadataRequest
 	data.Piece = pieceNumber
 	err := bencode.Marshal(&b, data)
 	if err != nil {
 		panic(err)
 	}
-	//fmt.Println(b.String())
 	return b.String()
 }
 
 func decodeMetadataRequest(payload []byte) (MetadataResponse, error) {
 	var result = MetadataResponse{0, 0, 0}
-	reader := bytes.NewReader([]byte(payload))
-	err := bencode.Unmarshal(reader, &result)
+	err := unmarshalUntrusted(payload, &result)
 	if err != nil {
 		return MetadataResponse{0, 0, 0}, err
 	}
@@ -110,40 +88,35 @@ func decodeMetadataRequest(payload []byte) (MetadataResponse, error) {
 
 func decodeHandshake(payload []byte) (*ExtendedHandshakePayload, error) {
 	var result = ExtendedHandshakePayload{nil, "v", 0, 0, 0, "", ""}
-	reader := bytes.NewReader([]byte(payload))
-	err := bencode.Unmarshal(reader, &result)
+	err := unmarshalUntrusted(payload, &result)
 	if err != nil {
 		return nil, err
 	}
 	return &result, nil
 }
 
-func getHandshakeMessage(torrent *Torrent) []byte {
-	pstrlen := 19
-	pstr := "BitTorrent protocol"
-
-	packet := make([]byte, 49+pstrlen)
-	copy(packet[0:], []uint8{uint8(pstrlen)})
-	copy(packet[1:], []byte(pstr))
-	packet[25] = 16
-	copy(packet[28:], torrent.infoHash)
-	peerID := "GoLangTorrent_v0.0.1" // TODO: generate a random peer_id?
-	copy(packet[48:], []byte(peerID))
-
-	return packet
+// discoveryExtensions are the extension messages which share peers between clients, these must never be used for private torrents
+var discoveryExtensions = map[string]bool{
+	"ut_pex": true,
+	"lt_tex": true,
 }
 
-func getExtendedHandshakeMessage() []byte {
-	// <message_len><message_id == 20><handshake_identifier == 0><payload>
-	payloadRaw := "d11:ut_metadatai1ee" // bencoded dict setting metadata to 1, as this is the only thing we should support
-	payload := []byte(payloadRaw)
-	messageLen := uint32(len(payload) + 2)
-
-	packet := make([]byte, messageLen+4)
-	binary.BigEndian.PutUint32(packet[0:], messageLen)
-	copy(packet[4:], []byte([]uint8{uint8(Extended)}))
-	copy(packet[5:], []byte([]uint8{uint8(0)}))
-	copy(packet[6:], payload)
-
-	return packet
+// utMetadataID is the extended message id peers send us ut_metadata (BEP 9) messages with
+const utMetadataID = 1
+
+// supportedExtensions returns the extension messages we advertise in our extended handshake
+func supportedExtensions(allowDiscovery bool) map[string]int {
+	extensions := map[string]int{"ut_metadata": utMetadataID}
+	if !allowDiscovery {
+		for name := range extensions {
+			if discoveryExtensions[name] {
+				delete(extensions, name)
+			}
+		}
+	}
+	return extensions
 }
+
+// maxPeerRequests is how many requests we let a peer have outstanding, which we tell them as reqq in our extended
+// handshake. It's also what we assume of peers that don't say, as libtorrent does
+const maxPeerRequests = 250
@@ -5,112 +5,179 @@ import (
 	"fmt"
 	"gotorrent/utils"
 	"math"
-	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+)
+
+// File attribute flags from BEP 47, which may appear in any order in a file's attr string
+const (
+	AttrPadding    = 'p' // padding file, only used to align the next file to a piece boundary
+	AttrExecutable = 'x'
+	AttrHidden     = 'h'
+	AttrSymlink    = 'l' // the file is a symlink to symlink path, and has no data of its own
 )
 
 // Metadata stores the torrent's metadata, since we don't deal with .torrent files
 type Metadata struct {
 	Name     string `bencode:"name"`
-	NameUtf  string `bencode:"name.utf-8"`
+	NameUtf  string `bencode:"name.utf-8,omitempty"`
 	PieceLen int    `bencode:"piece length"`
 	Pieces   string `bencode:"pieces"`
 	// contains one of the following, where 'length' means there is one file, and 'files' means there are multiple, only single file downloads will be allowed for the moment
-	Length int            `bencode:"length"`
-	Files  []MetadataFile `bencode:"files"`
+	Length int            `bencode:"length,omitempty"`
+	Files  []MetadataFile `bencode:"files,omitempty"`
+	Attr   string         `bencode:"attr,omitempty"` // BEP 47 attributes of a single file torrent
+
+	// BEP 27, when set to 1 peers may only be obtained from the torrent's trackers
+	Private int `bencode:"private,omitempty"`
+
+	// v2 (BEP 52) fields, a hybrid torrent has these along with the v1 fields above
+	MetaVersion int            `bencode:"meta version,omitempty"`
+	FileTree    []MetadataFile `bencode:"-"` // flattened "file tree", which can't be unmarshalled directly
 }
 
 // MetadataFile is a subset of Metadata for use in bencoding, since a torrent can contain multiple files
 type MetadataFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
 }
 
-func (md *Metadata) String() string {
-	s := "Name: " + md.Name + "\nPiece length: " + strconv.Itoa(md.PieceLen) + "\nLength: " + strconv.Itoa(md.Length)
-	return s
+func (file *MetadataFile) hasAttr(flag byte) bool {
+	return strings.IndexByte(file.Attr, flag) != -1
 }
 
-func (torrent *Torrent) numMetadataPieces() int {
-	return int(math.Ceil(float64(torrent.metadataSize) / float64(BlockLen)))
+// isHybrid returns whether the metadata describes both a v1 and a v2 torrent
+func (md *Metadata) isHybrid() bool {
+	return md.MetaVersion == 2 && md.Pieces != ""
 }
 
-func (torrent *Torrent) hasAllMetadata() (bool, error) {
-	if torrent.numMetadataPieces() == 0 {
-		return false, nil
+// parseFileTree flattens a v2 "file tree" dictionary into a list of files in bencoded (sorted) key order
+func parseFileTree(tree map[string]interface{}, path []string) ([]MetadataFile, error) {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	for i := 0; i < torrent.numMetadataPieces(); i++ {
-		isSet, err := utils.BitIsSet(torrent.metadataPieces, i)
-		if err != nil {
-			return false, err
+	var files []MetadataFile
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("malformed file tree")
+		}
+
+		// a file is a dictionary with a single empty key, which maps to its properties
+		if key == "" {
+			length, ok := node["length"].(int64)
+			if !ok {
+				return nil, errors.New("file tree entry is missing its length")
+			}
+			attr, _ := node["attr"].(string)
+			files = append(files, MetadataFile{Length: int(length), Path: path, Attr: attr})
+			continue
 		}
 
-		if !isSet {
-			return false, nil
+		childPath := make([]string, len(path), len(path)+1)
+		copy(childPath, path)
+		children, err := parseFileTree(node, append(childPath, key))
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, children...)
 	}
-	return true, nil
+	return files, nil
 }
 
-func (torrent *Torrent) getRandMetadataPiece() (int, error) {
-	hasAllMetadata, err := torrent.hasAllMetadata()
-	if err != nil {
-		return -1, err
-	}
-	if hasAllMetadata {
-		return -1, nil
+// checkHybrid makes sure that the v1 and v2 parts of a hybrid torrent describe the same files,
+// ignoring the padding files that are only present in the v1 file list
+func (md *Metadata) checkHybrid() error {
+	v1Files := md.Files
+	if len(v1Files) == 0 {
+		v1Files = []MetadataFile{{Length: md.Length, Path: []string{md.Name}}}
 	}
 
-	for {
-		testPiece := rand.Intn(torrent.numMetadataPieces())
-		hasPiece, err := torrent.hasMetadataPiece(testPiece)
-		if err != nil {
-			return -1, err
+	var i int
+	for _, file := range v1Files {
+		if file.hasAttr(AttrPadding) {
+			continue
 		}
-		if !hasPiece {
-			return testPiece, nil
+		if i >= len(md.FileTree) {
+			return errors.New("hybrid torrent has more v1 files than v2 files")
 		}
+		v2File := md.FileTree[i]
+		if v2File.Length != file.Length || strings.Join(v2File.Path, "/") != strings.Join(file.Path, "/") {
+			return errors.New("hybrid torrent's v1 and v2 file lists do not match")
+		}
+		i++
 	}
-}
-
-func (torrent *Torrent) hasMetadataPiece(pieceNum int) (bool, error) {
-	if len(torrent.metadataPieces) == 0 {
-		return false, nil
+	if i != len(md.FileTree) {
+		return errors.New("hybrid torrent has more v2 files than v1 files")
 	}
-	return utils.BitIsSet(torrent.metadataPieces, pieceNum)
+	return nil
 }
 
-func (torrent *Torrent) setMetadataPiece(pieceNum int, metadataPiece []byte) error {
-	hasAll, err := torrent.hasAllMetadata()
-	if err != nil {
-		return err
+// maxAcceptedPieceLen is the longest piece we download, longer than we'd ever choose (maxPieceLen) as a piece is
+// held in memory whole while it's checked
+const maxAcceptedPieceLen = 128 * 1024 * 1024
+
+// check makes sure the v1 fields lay out pieces that match the hashes, before any are allocated. The metadata may
+// have come from a peer and only be known to match the info hash
+func (md *Metadata) check() error {
+	if md.PieceLen <= 0 || md.PieceLen > maxAcceptedPieceLen {
+		return fmt.Errorf("invalid piece length %d", md.PieceLen)
 	}
-	if hasAll {
-		return nil
+	length := md.Length
+	if length < 0 {
+		return fmt.Errorf("invalid length %d", length)
+	}
+	for _, file := range md.Files {
+		if file.Length < 0 || file.Length > math.MaxInt-length {
+			return fmt.Errorf("invalid length %d for file %s", file.Length, strings.Join(file.Path, "/"))
+		}
+		length += file.Length
 	}
-	// insert into raw byte array
-	startIndex := pieceNum * BlockLen
-	if startIndex > len(torrent.metadataRaw) {
-		return errors.New("metadata piece is out of bounds")
+	if length == 0 {
+		return errors.New("torrent has no data")
 	}
+	numPieces := (length-1)/md.PieceLen + 1
+	if len(md.Pieces)%20 != 0 || len(md.Pieces)/20 != numPieces {
+		return fmt.Errorf("expected %d piece hashes, got %d bytes of them", numPieces, len(md.Pieces))
+	}
+	return nil
+}
 
-	temp := torrent.metadataRaw[pieceNum*BlockLen+len(metadataPiece):]
-	torrent.metadataRaw = append(torrent.metadataRaw[0:pieceNum*BlockLen], metadataPiece...)
-	torrent.metadataRaw = append(torrent.metadataRaw, temp...)
+func (md *Metadata) String() string {
+	s := "Name: " + md.Name + "\nPiece length: " + strconv.Itoa(md.PieceLen) + "\nLength: " + strconv.Itoa(md.Length)
+	return s
+}
 
-	// set as "have"
-	utils.SetBit(&torrent.metadataPieces, pieceNum)
+func (torrent *Torrent) numMetadataPieces() int {
+	return int(math.Ceil(float64(torrent.metadataSize) / float64(BlockLen)))
+}
 
-	return nil
+// hasAllMetadata returns whether every piece of the metadata has arrived, the caller holds metadataFetchMx
+func (torrent *Torrent) hasAllMetadata() bool {
+	if torrent.numMetadataPieces() == 0 {
+		return false
+	}
+	for i := 0; i < torrent.numMetadataPieces(); i++ {
+		if isSet, _ := utils.BitIsSet(torrent.metadataPieces, i); !isSet {
+			return false
+		}
+	}
+	return true
 }
 
+// buildMetadataFile saves the raw metadata to metadata.torrent in the metadata directory, if one was configured
 func (torrent *Torrent) buildMetadataFile() error {
-	err := os.WriteFile("metadata.torrent", torrent.metadataRaw, 0644)
-	fmt.Println("Received metadata")
-	if err != nil {
-		panic(err)
+	fmt.Fprintln(torrent.output, "Received metadata")
+	if torrent.metadataDir == "" {
+		return nil
 	}
-	return nil
+	return os.WriteFile(filepath.Join(torrent.metadataDir, "metadata.torrent"), torrent.metadataRaw, 0644)
 }
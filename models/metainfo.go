@@ -0,0 +1,224 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/rs/zerolog/log"
+)
+
+// MetaInfo is the contents of a .torrent file, ie the info dictionary along with everything that isn't covered by the info hash
+type MetaInfo struct {
+	Announce     string
+	AnnounceList [][]string // BEP 12 tiers of trackers
+	URLList      []string   // BEP 19 (GetRight-style) web seeds
+	HTTPSeeds    []string   // BEP 17 (Hoffman-style) web seeds
+	Comment      string
+	CreatedBy    string
+	CreationDate int64
+
+	InfoBytes []byte // the raw info dictionary, exactly as it was encoded
+}
+
+// ParseMetaInfo parses the contents of a .torrent file
+func ParseMetaInfo(data []byte) (*MetaInfo, error) {
+	raw, err := bencodeDict(data)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := raw["info"]
+	if !ok || info[0] != 'd' {
+		return nil, errors.New("torrent file is missing its info dictionary")
+	}
+	// refuse an info dictionary we couldn't download here, rather than when the torrent is added
+	var md Metadata
+	err = unmarshalUntrusted(info, &md)
+	if err == nil {
+		err = md.check()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadMetadata, err)
+	}
+
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	root := decoded.(map[string]interface{})
+
+	var mi MetaInfo
+	mi.InfoBytes = info
+	mi.Announce, _ = root["announce"].(string)
+	mi.Comment, _ = root["comment"].(string)
+	mi.CreatedBy, _ = root["created by"].(string)
+	mi.CreationDate, _ = root["creation date"].(int64)
+	mi.URLList = stringList(root["url-list"])
+	mi.HTTPSeeds = stringList(root["httpseeds"])
+	if tiers, ok := root["announce-list"].([]interface{}); ok {
+		for _, tier := range tiers {
+			if trackers := stringList(tier); len(trackers) != 0 {
+				mi.AnnounceList = append(mi.AnnounceList, trackers)
+			}
+		}
+	}
+	return &mi, nil
+}
+
+// stringList converts a bencoded string or list of strings into a slice, as url-list may be either
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// trackerURLs returns every tracker in the announce-list, or the announce url if there is no list (per BEP 12)
+func (mi *MetaInfo) trackerURLs() []string {
+	if len(mi.AnnounceList) == 0 {
+		if mi.Announce == "" {
+			return nil
+		}
+		return []string{mi.Announce}
+	}
+
+	seen := map[string]bool{}
+	var urls []string
+	for _, tier := range mi.AnnounceList {
+		for _, tracker := range tier {
+			if !seen[tracker] {
+				seen[tracker] = true
+				urls = append(urls, tracker)
+			}
+		}
+	}
+	return urls
+}
+
+// NewTorrentFromMetaInfo creates a torrent from a parsed .torrent file, which unlike a magnet link already has its metadata
+func NewTorrentFromMetaInfo(mi *MetaInfo, maxPeers int) (*Torrent, error) {
+	var ml Magnet
+	for _, trackerURL := range mi.trackerURLs() {
+		link, err := url.Parse(trackerURL)
+		if err != nil {
+			log.Debug().Err(err).Msg("Skipping invalid tracker url")
+			continue
+		}
+		ml.Trackers = append(ml.Trackers, NewTracker(*link))
+	}
+	ml.WebSeeds = mi.URLList
+
+	torrent := NewTorrent(&ml, maxPeers)
+	torrent.metaInfo = mi
+	for _, seed := range mi.HTTPSeeds {
+		torrent.addWebSeed(seed, HoffmanStyle)
+	}
+
+	torrent.metadataRaw = mi.InfoBytes
+	torrent.metadataSize = len(mi.InfoBytes)
+	v1Hash := sha1.Sum(mi.InfoBytes)
+	torrent.infoHash = v1Hash[:]
+
+	// set the v2 hash up front for hybrid torrents, as we can announce both from the start
+	var version struct {
+		MetaVersion int `bencode:"meta version"`
+	}
+	err := unmarshalUntrusted(mi.InfoBytes, &version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadMetadata, err)
+	}
+	if version.MetaVersion == 2 {
+		torrent.infoHashV2 = v2InfoHash(mi.InfoBytes)
+	}
+
+	err = torrent.parseMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadMetadata, err)
+	}
+	torrent.hasMetadata.Store(true)
+	close(torrent.metadataReady)
+
+	return torrent, nil
+}
+
+// maxMetaInfoSize limits how much we'll download when fetching a .torrent file over HTTP
+const maxMetaInfoSize = 32 * 1024 * 1024
+
+// fetchSources tries to download the .torrent file from the magnet link's exact (xs) and acceptable (as) sources,
+// which is much quicker than fetching the metadata from peers. The metadata must still match the info hash.
+func (torrent *Torrent) fetchSources() {
+	if torrent.magnet == nil {
+		return
+	}
+	client := http.Client{Timeout: 30 * time.Second, Transport: torrent.httpTransport}
+
+	for _, source := range append(append([]string{}, torrent.magnet.ExactSources...), torrent.magnet.AcceptableSources...) {
+		if torrent.hasMetadata.Load() || torrent.ctx.Err() != nil {
+			return
+		}
+		if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+			continue
+		}
+
+		mi, err := fetchMetaInfo(torrent.ctx, &client, source)
+		if err != nil {
+			log.Debug().Err(err).Msg("Could not fetch torrent from " + source)
+			continue
+		}
+		if !torrent.verifyMetadata(mi.InfoBytes) {
+			log.Debug().Msg("Torrent from " + source + " does not match the info hash")
+			continue
+		}
+
+		err = torrent.setMetadata(mi.InfoBytes)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not parse metadata from " + source)
+			continue
+		}
+		return
+	}
+}
+
+func fetchMetaInfo(ctx context.Context, client *http.Client, source string) (*MetaInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("source responded with " + resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetaInfoSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetaInfoSize {
+		return nil, errors.New("torrent file is too large")
+	}
+	return ParseMetaInfo(data)
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of a histogram in seconds, from a write to a fast disk up to a tracker that
+// is about to time out
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Histogram is a snapshot of how long something took, in the cumulative form prometheus expects
+type Histogram struct {
+	Buckets []float64 // upper bounds in seconds
+	Counts  []int     // observations at or below each bound
+	Sum     float64   // seconds
+	Count   int
+}
+
+// histogram counts durations into latencyBuckets
+type histogram struct {
+	mx     sync.Mutex
+	counts [len(latencyBuckets)]int // observations within each bucket, not cumulative, anything over the last bound is only in total
+	sum    time.Duration
+	total  int
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.sum += d
+	h.total++
+	for i, bound := range latencyBuckets {
+		if d.Seconds() <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	snapshot := Histogram{Buckets: append([]float64(nil), latencyBuckets[:]...), Counts: make([]int, len(latencyBuckets)), Sum: h.sum.Seconds(), Count: h.total}
+	cumulative := 0
+	for i := range latencyBuckets {
+		cumulative += h.counts[i]
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+// torrentMetrics counts what happens to a torrent for monitoring, alongside the state the rest of the torrent keeps
+type torrentMetrics struct {
+	piecesVerified  atomic.Int64
+	piecesFailed    atomic.Int64
+	requestTimeouts atomic.Int64
+	metadataFetch   atomic.Int64 // nanoseconds
+	storageWrites   histogram
+}
+
+// TorrentMetrics is a snapshot of a torrent's counters, which only ever increase apart from the peer counts
+type TorrentMetrics struct {
+	BytesDownloaded int // payload received from peers and web seeds, whether or not it verified
+	BytesUploaded   int
+	PiecesVerified  int
+	PiecesFailed    int // pieces that failed their hash check and were downloaded again
+	RequestTimeouts int // peers dropped for going quiet while we were waiting on blocks from them
+	ChokedPeers     int // connected peers that are choking us
+	UnchokedPeers   int
+	MetadataFetch   time.Duration // how long fetching the metadata from peers took, zero until then or if we didn't need to
+	StorageWrites   Histogram     // how long writing each file took
+	Trackers        []TrackerMetrics
+}
+
+// TrackerMetrics counts the announces to one of a torrent's trackers
+type TrackerMetrics struct {
+	URL       string // with any passkeys redacted
+	Successes int
+	Failures  int
+	Latency   Histogram
+}
+
+// Metrics returns a snapshot of the torrent's counters
+func (torrent *Torrent) Metrics() TorrentMetrics {
+	metrics := TorrentMetrics{
+		BytesDownloaded: int(torrent.downloadMeter.bytes()),
+		BytesUploaded:   int(torrent.uploadMeter.bytes()),
+		PiecesVerified:  int(torrent.metrics.piecesVerified.Load()),
+		PiecesFailed:    int(torrent.metrics.piecesFailed.Load()),
+		RequestTimeouts: int(torrent.metrics.requestTimeouts.Load()),
+		MetadataFetch:   time.Duration(torrent.metrics.metadataFetch.Load()),
+		StorageWrites:   torrent.metrics.storageWrites.snapshot(),
+	}
+
+	for _, peer := range torrent.Peers() {
+		if peer.Choked {
+			metrics.ChokedPeers++
+		} else {
+			metrics.UnchokedPeers++
+		}
+	}
+
+	for _, tracker := range torrent.trackers {
+		tracker.statusMx.Lock()
+		metrics.Trackers = append(metrics.Trackers, TrackerMetrics{
+			URL:       tracker.String(),
+			Successes: tracker.successes,
+			Failures:  tracker.failures,
+		})
+		tracker.statusMx.Unlock()
+		metrics.Trackers[len(metrics.Trackers)-1].Latency = tracker.latency.snapshot()
+	}
+	return metrics
+}
+
+// isTimeout returns whether err is a connection's deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, d := range []time.Duration{time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+	snapshot := h.snapshot()
+
+	testCases := []struct {
+		bound    float64
+		expected int
+	}{
+		{bound: 0.005, expected: 1},
+		{bound: 0.01, expected: 1},
+		{bound: 0.025, expected: 3},
+		{bound: 30, expected: 3}, // a minute is only counted in +Inf
+	}
+	for _, tc := range testCases {
+		for i, bound := range snapshot.Buckets {
+			if bound == tc.bound && snapshot.Counts[i] != tc.expected {
+				t.Errorf("Expected %d observations at or below %gs, got %d", tc.expected, tc.bound, snapshot.Counts[i])
+			}
+		}
+	}
+	if snapshot.Count != 4 || snapshot.Sum != 60.041 {
+		t.Errorf("Expected 4 observations totalling 60.041s, got %d totalling %gs", snapshot.Count, snapshot.Sum)
+	}
+}
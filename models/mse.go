@@ -0,0 +1,380 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+// How connections to peers use message stream encryption (MSE, also known as protocol encryption), which hides the
+// BitTorrent handshake from networks that throttle it
+const (
+	EncryptionDisabled  = 0 // plaintext only, peers that connect to us encrypted are refused
+	EncryptionPreferred = 1 // encrypt when the peer can, falling back to plaintext when they can't
+	EncryptionRequired  = 2 // only encrypted connections, in both directions
+)
+
+var encryptionNames = []string{"disabled", "preferred", "required"}
+
+// EncryptionName returns the name of one of the Encryption constants
+func EncryptionName(encryption int) string {
+	if encryption < 0 || encryption >= len(encryptionNames) {
+		return "unknown"
+	}
+	return encryptionNames[encryption]
+}
+
+// ParseEncryption returns the Encryption constant named disabled, preferred or required
+func ParseEncryption(s string) (int, error) {
+	for i, name := range encryptionNames {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("encryption must be disabled, preferred or required, not " + s)
+}
+
+// the 768 bit prime and generator that both sides use for the Diffie-Hellman exchange
+var (
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+)
+
+const (
+	mseKeyLen = 96  // bytes in a public key or shared secret
+	mseMaxPad = 512 // most random padding either side may send
+
+	// crypto_provide and crypto_select bits
+	cryptoPlaintext = 0x01 // just the handshake is obfuscated
+	cryptoRC4       = 0x02
+)
+
+var (
+	errMSESync      = errors.New("peer didn't send a valid encryption handshake")
+	errMSEKey       = errors.New("peer sent an invalid public key")
+	errMSETorrent   = errors.New("peer asked for a torrent we don't have")
+	errMSECrypto    = errors.New("peer and us have no encryption method in common")
+	errMSEPlaintext = errors.New("peer connected in plaintext but encryption is required")
+	errMSEDisabled  = errors.New("peer connected encrypted but encryption is disabled")
+)
+
+// mseConn is a connection after an MSE handshake, which is RC4 encrypted unless plaintext was selected
+type mseConn struct {
+	net.Conn
+	reader  io.Reader
+	writer  io.Writer
+	writeMx sync.Mutex // the cipher has to be used in the same order as the bytes go out
+	rc4     bool
+}
+
+func (mc *mseConn) Read(b []byte) (int, error) {
+	return mc.reader.Read(b)
+}
+
+func (mc *mseConn) Write(b []byte) (int, error) {
+	mc.writeMx.Lock()
+	defer mc.writeMx.Unlock()
+	return mc.writer.Write(b)
+}
+
+// isEncrypted returns whether conn went through an MSE handshake which selected RC4
+func isEncrypted(conn net.Conn) bool {
+	mc, ok := conn.(*mseConn)
+	return ok && mc.rc4
+}
+
+// newMSEConn wraps conn once the handshake has selected a method. Anything read past the handshake is in reader,
+// and initial is what the peer already sent as part of it, which comes first
+func newMSEConn(conn net.Conn, reader io.Reader, initial []byte, selected uint32, encrypt *rc4.Cipher, decrypt *rc4.Cipher) *mseConn {
+	if selected == cryptoPlaintext {
+		return &mseConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initial), reader), writer: conn}
+	}
+	return &mseConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(initial), cipher.StreamReader{S: decrypt, R: reader}),
+		writer: cipher.StreamWriter{S: encrypt, W: conn},
+		rc4:    true,
+	}
+}
+
+// mseHash is the SHA1 of everything in parts, one after the other
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// newMSECipher returns the RC4 cipher for one direction of the connection, keyA for the initiator's and keyB for
+// the receiver's. The first 1024 bytes of the key stream are thrown away
+func newMSECipher(name string, secret []byte, infoHash []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// newMSEKey returns a random private key and our public key with random padding after it, ready to send
+func newMSEKey() (*big.Int, []byte, error) {
+	private, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
+	if err != nil {
+		return nil, nil, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+	public := new(big.Int).Exp(mseG, private, mseP).FillBytes(make([]byte, mseKeyLen))
+	return private, append(public, pad...), nil
+}
+
+// mseSecret returns the secret shared between us and the peer whose public key is theirs
+func mseSecret(private *big.Int, theirs []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(theirs)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(mseP, big.NewInt(1))) >= 0 {
+		return nil, errMSEKey
+	}
+	return new(big.Int).Exp(y, private, mseP).FillBytes(make([]byte, mseKeyLen)), nil
+}
+
+// randomPad returns up to mseMaxPad random bytes
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// syncTo reads up to and including pattern, which comes after at most mseMaxPad bytes of the peer's padding
+func syncTo(reader *bufio.Reader, pattern []byte) error {
+	window := make([]byte, 0, len(pattern))
+	for i := 0; i < mseMaxPad+len(pattern); i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			copy(window, window[1:])
+			window = window[:len(window)-1]
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return errMSESync
+}
+
+// readDecrypted reads n bytes and decrypts them
+func readDecrypted(reader io.Reader, decrypt *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// selectCrypto picks RC4 over plaintext out of what the peer provided, if encryption allows
+func selectCrypto(provided uint32, encryption int) uint32 {
+	if provided&cryptoRC4 != 0 {
+		return cryptoRC4
+	}
+	if provided&cryptoPlaintext != 0 && encryption == EncryptionPreferred {
+		return cryptoPlaintext
+	}
+	return 0
+}
+
+// encryptOutgoing performs the initiator's side of the MSE handshake on a connection we dialed, for the torrent
+// with infoHash. RC4 is required unless encryption is EncryptionPreferred, in which case the peer may also pick an
+// obfuscated handshake followed by plaintext
+func encryptOutgoing(conn net.Conn, infoHash []byte, encryption int) (net.Conn, error) {
+	private, public, err := newMSEKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(public); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	theirs := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(reader, theirs); err != nil {
+		return nil, err
+	}
+	secret, err := mseSecret(private, theirs)
+	if err != nil {
+		return nil, err
+	}
+	encrypt := newMSECipher("keyA", secret, infoHash)
+	decrypt := newMSECipher("keyB", secret, infoHash)
+
+	provide := uint32(cryptoRC4)
+	if encryption == EncryptionPreferred {
+		provide |= cryptoPlaintext
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	// VC (8 zeroes), crypto_provide, len(PadC), PadC and len(IA), which is 0 as our handshake follows separately
+	plain := make([]byte, 14, 16+len(pad))
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	binary.BigEndian.PutUint16(plain[12:], uint16(len(pad)))
+	plain = append(plain, pad...)
+	plain = append(plain, 0, 0)
+	encrypt.XORKeyStream(plain, plain)
+
+	obfuscated := mseHash([]byte("req2"), infoHash)
+	for i, b := range mseHash([]byte("req3"), secret) {
+		obfuscated[i] ^= b
+	}
+	message := append(mseHash([]byte("req1"), secret), obfuscated...)
+	if _, err := conn.Write(append(message, plain...)); err != nil {
+		return nil, err
+	}
+
+	// their VC comes after their padding, we find it by what it encrypts to
+	vc := make([]byte, 8)
+	newMSECipher("keyB", secret, infoHash).XORKeyStream(vc, vc)
+	if err := syncTo(reader, vc); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(vc, vc)
+
+	reply, err := readDecrypted(reader, decrypt, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(reply)
+	if selected != cryptoRC4 && (selected != cryptoPlaintext || provide&cryptoPlaintext == 0) {
+		return nil, errMSECrypto
+	}
+	padLen := int(binary.BigEndian.Uint16(reply[4:]))
+	if padLen > mseMaxPad {
+		return nil, errMSESync
+	}
+	if _, err := readDecrypted(reader, decrypt, padLen); err != nil {
+		return nil, err
+	}
+	return newMSEConn(conn, reader, nil, selected, encrypt, decrypt), nil
+}
+
+// encryptIncoming performs the receiver's side of the MSE handshake on a connection that didn't start with a
+// plaintext handshake. reader has whatever was peeked at, and infoHashes are the torrents the peer may ask for.
+// It returns the connection along with the info hash they asked for
+func encryptIncoming(conn net.Conn, reader *bufio.Reader, infoHashes [][]byte, encryption int) (net.Conn, []byte, error) {
+	theirs := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(reader, theirs); err != nil {
+		return nil, nil, err
+	}
+	private, public, err := newMSEKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	// sent while we read on, as a net.Pipe won't take it until they've finished writing their padding. If we give
+	// up, closing the connection stops the write
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(public)
+		written <- err
+	}()
+
+	secret, err := mseSecret(private, theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syncTo(reader, mseHash([]byte("req1"), secret)); err != nil {
+		return nil, nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		req2 := mseHash([]byte("req2"), candidate)
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+		if bytes.Equal(req2, obfuscated) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, errMSETorrent
+	}
+	encrypt := newMSECipher("keyB", secret, infoHash)
+	decrypt := newMSECipher("keyA", secret, infoHash)
+
+	request, err := readDecrypted(reader, decrypt, 14)
+	if err != nil {
+		return nil, nil, err
+	}
+	padLen := int(binary.BigEndian.Uint16(request[12:]))
+	if !bytes.Equal(request[:8], make([]byte, 8)) || padLen > mseMaxPad {
+		return nil, nil, errMSESync
+	}
+	selected := selectCrypto(binary.BigEndian.Uint32(request[8:]), encryption)
+	if selected == 0 {
+		return nil, nil, errMSECrypto
+	}
+	// their padding, then the length of the initial payload, usually their handshake
+	rest, err := readDecrypted(reader, decrypt, padLen+2)
+	if err != nil {
+		return nil, nil, err
+	}
+	initial, err := readDecrypted(reader, decrypt, int(binary.BigEndian.Uint16(rest[padLen:])))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := <-written; err != nil {
+		return nil, nil, err
+	}
+	// VC, crypto_select and len(PadD), we don't pad
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, nil, err
+	}
+	return newMSEConn(conn, reader, initial, selected, encrypt, decrypt), infoHash, nil
+}
+
+// acceptConn sets up a connection from a peer, which either starts with a plaintext handshake or an MSE one. It
+// returns the connection to read their handshake from, along with the info hash they asked for if it was encrypted
+func acceptConn(conn net.Conn, infoHashes func() [][]byte, encryption int) (net.Conn, []byte, error) {
+	reader := bufio.NewReader(conn)
+	header, err := reader.Peek(20)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header[0] == 19 && string(header[1:]) == "BitTorrent protocol" {
+		if encryption == EncryptionRequired {
+			return nil, nil, errMSEPlaintext
+		}
+		return &bufferedConn{Conn: conn, reader: reader}, nil, nil
+	}
+	if encryption == EncryptionDisabled {
+		return nil, nil, errMSEDisabled
+	}
+	return encryptIncoming(conn, reader, infoHashes(), encryption)
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMSEHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	otherHash := bytes.Repeat([]byte{0xcd}, 20)
+
+	testCases := []struct {
+		name       string
+		initiator  int
+		receiver   int
+		infoHashes [][]byte // the receiver's torrents
+		expectErr  bool
+	}{
+		{name: "preferred", initiator: EncryptionPreferred, receiver: EncryptionPreferred, infoHashes: [][]byte{otherHash, infoHash}},
+		{name: "required", initiator: EncryptionRequired, receiver: EncryptionRequired, infoHashes: [][]byte{infoHash}},
+		{name: "required by receiver", initiator: EncryptionPreferred, receiver: EncryptionRequired, infoHashes: [][]byte{infoHash}},
+		{name: "disabled by receiver", initiator: EncryptionRequired, receiver: EncryptionDisabled, infoHashes: [][]byte{infoHash}, expectErr: true},
+		{name: "unknown torrent", initiator: EncryptionRequired, receiver: EncryptionPreferred, infoHashes: [][]byte{otherHash}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ours, theirs := net.Pipe()
+			defer ours.Close()
+			defer theirs.Close()
+			ours.SetDeadline(time.Now().Add(5 * time.Second))
+			theirs.SetDeadline(time.Now().Add(5 * time.Second))
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			outgoing := make(chan result, 1)
+			go func() {
+				conn, err := encryptOutgoing(ours, infoHash, tc.initiator)
+				outgoing <- result{conn, err}
+			}()
+			incoming, gotHash, err := acceptConn(theirs, func() [][]byte { return tc.infoHashes }, tc.receiver)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatal("Expected the receiver to refuse the connection")
+				}
+				// which unblocks the initiator
+				theirs.Close()
+				if r := <-outgoing; r.err == nil {
+					t.Error("Expected the initiator to fail too")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the receiver to accept, got %v", err)
+			}
+			r := <-outgoing
+			if r.err != nil {
+				t.Fatalf("Expected the initiator to succeed, got %v", r.err)
+			}
+			if !bytes.Equal(gotHash, infoHash) {
+				t.Errorf("Expected the receiver to find info hash %x, got %x", infoHash, gotHash)
+			}
+			if !isEncrypted(r.conn) || !isEncrypted(incoming) {
+				t.Errorf("Expected RC4 to be selected")
+			}
+
+			// both directions at once, as peers do
+			message := bytes.Repeat([]byte("hello "), 1000)
+			go r.conn.Write(message)
+			go incoming.Write(message)
+			for _, conn := range []net.Conn{incoming, r.conn} {
+				buf := make([]byte, len(message))
+				if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, message) {
+					t.Errorf("Expected the message to arrive intact, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMSEPlaintextFallback(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	ours.SetDeadline(time.Now().Add(5 * time.Second))
+	theirs.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := getHandshakeMessage(bytes.Repeat([]byte{0xab}, 20), bytes.Repeat([]byte{1}, 20))
+	go ours.Write(handshake)
+	conn, gotHash, err := acceptConn(theirs, nil, EncryptionPreferred)
+	if err != nil || gotHash != nil {
+		t.Fatalf("Expected a plaintext connection, got %v", err)
+	}
+	if isEncrypted(conn) {
+		t.Errorf("Expected the connection not to be encrypted")
+	}
+	infoHash, _, err := readHandshake(conn)
+	if err != nil || !bytes.Equal(infoHash, handshake[28:48]) {
+		t.Errorf("Expected the peeked handshake to be read back, got %v", err)
+	}
+
+	go ours.Write(handshake)
+	if _, _, err := acceptConn(theirs, nil, EncryptionRequired); err != errMSEPlaintext {
+		t.Errorf("Expected a plaintext connection to be refused, got %v", err)
+	}
+}
+
+// sniffDialer records everything written to the connections it makes
+type sniffDialer struct {
+	net.Dialer
+	mx      sync.Mutex
+	written bytes.Buffer
+}
+
+type sniffConn struct {
+	net.Conn
+	dialer *sniffDialer
+}
+
+func (sd *sniffDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := sd.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, dialer: sd}, nil
+}
+
+func (sc *sniffConn) Write(b []byte) (int, error) {
+	sc.dialer.mx.Lock()
+	sc.dialer.written.Write(b)
+	sc.dialer.mx.Unlock()
+	return sc.Conn.Write(b)
+}
+
+func (sd *sniffDialer) sent(s string) bool {
+	sd.mx.Lock()
+	defer sd.mx.Unlock()
+	return bytes.Contains(sd.written.Bytes(), []byte(s))
+}
+
+func TestEncryptedDownload(t *testing.T) {
+	testCases := []struct {
+		name      string
+		seed      int
+		leecher   int
+		encrypted bool
+		expectErr bool
+	}{
+		{name: "both required", seed: EncryptionRequired, leecher: EncryptionRequired, encrypted: true},
+		{name: "both preferred", seed: EncryptionPreferred, leecher: EncryptionPreferred, encrypted: true},
+		{name: "fall back to plaintext", seed: EncryptionDisabled, leecher: EncryptionPreferred},
+		{name: "seed requires encryption", seed: EncryptionRequired, leecher: EncryptionDisabled, expectErr: true},
+		{name: "leecher requires encryption", seed: EncryptionDisabled, leecher: EncryptionRequired, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seedDir := t.TempDir()
+			mi := newSeedData(t, seedDir)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+
+			seedSession, err := NewSession(SessionConfig{ListenPort: port, DownloadDir: seedDir, Seed: true, Encryption: tc.seed})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer seedSession.Close()
+			seed, err := seedSession.AddMetaInfo(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go seed.StartDownload(context.Background())
+			for seed.state() != StateSeeding {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			dialer := &sniffDialer{}
+			leechDir := t.TempDir()
+			session, err := NewSession(SessionConfig{ListenPort: -1, DownloadDir: leechDir, Dialer: dialer, Encryption: tc.leecher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			leecher, err := session.AddMetaInfo(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leecher.addPeer(newPeer("127.0.0.1", strconv.Itoa(port), leecher.infoHash, leecher), PeerSourceMagnet)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go leecher.StartDownload(ctx)
+			err = leecher.Wait(ctx)
+			if tc.expectErr {
+				if err == nil {
+					t.Error("Expected the download to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the download to succeed, got %v", err)
+			}
+			expected, _ := os.ReadFile(filepath.Join(seedDir, "data", "first"))
+			actual, err := os.ReadFile(filepath.Join(leechDir, "data", "first"))
+			if err != nil || !bytes.Equal(actual, expected) {
+				t.Errorf("Expected the data to match the seed's copy, got error %v", err)
+			}
+			if plaintext := dialer.sent("BitTorrent protocol"); plaintext == tc.encrypted {
+				t.Errorf("Expected the handshake to be sent in plaintext: %v, got %v", !tc.encrypted, plaintext)
+			}
+		})
+	}
+}
@@ -1,13 +1,15 @@
 package models
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"gotorrent/utils"
-	"io"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,24 +21,64 @@ const (
 	Alive   = 2  // currently connected
 )
 
+// Where a peer was discovered, private torrents (BEP 27) may only use peers from their trackers
+const (
+	PeerSourceTracker  = 0
+	PeerSourceMagnet   = 1 // given directly in a magnet link
+	PeerSourceIncoming = 2 // connected to us
+	PeerSourcePEX      = 3 // peer exchange
+	PeerSourceDHT      = 4
+	PeerSourceLSD      = 5 // local service discovery
+)
+
+var errNoMetadataSupport = errors.New("peer can't send us the metadata")
+
 // Peer is a connection that we read/write to to download files from, discovered through the Tracker
 type Peer struct {
 	ip           string
 	port         string
+	source       int
+	infoHash     []byte        // which of the torrent's info hashes this peer knows it by, these differ between the v1 and v2 swarms of a hybrid torrent
+	reserved     []byte        // reserved bytes from the peer's handshake, denoting which extensions they support
+	incoming     bool          // set when the peer connected to us and we have already read their handshake
+	reader       *bufio.Reader // everything after the handshake is read through this, to avoid short reads
+	tcpOnly      bool          // set once connecting over uTP has failed, so that we don't wait for it again
 	conn         net.Conn
 	usesExtended bool // false by default
 	extensions   map[string]int
-	choked       bool // whether we are choked by this peer or not, will likely need a name change upon seed support
+	choked       atomic.Bool // whether we are choked by this peer or not, will likely need a name change upon seed support
+	unchoked     bool        // whether we've unchoked them, letting them request pieces from us
 	bitfield     []byte
-	status       int
-
-	requests    int // number of pieces that have been requested and not yet fulfilled
+	status       atomic.Int32 // Unknown, Bad, Dead or Alive, which the connection handler reads while we run
+
+	// the fast extension (BEP 6)
+	fast        bool         // whether they support it
+	hasAll      bool         // they sent HAVE ALL, so they have every piece without a bitfield
+	grantedFast map[int]bool // pieces we let them request while we're choking them
+	fastMx      sync.Mutex   // guards the rest, which the reader and requestPieces share
+	suggested   []int        // pieces they suggested we download from them
+	allowedFast map[int]bool // pieces they let us request while they're choking us
+
+	metadataLimiter *rateLimiter // metadata pieces we'll send them, beyond which their requests are rejected
+
+	// fetching the metadata from them, guarded by the torrent's metadataFetchMx
+	metadataSize     int       // from their extended handshake, 0 if they don't have it or it's out of bounds
+	metadataRequests int       // pieces of the metadata we're waiting on from them
+	metadataBackoff  time.Time // they rejected or ignored a request, so we don't ask them again until then
+	metadataStrikes  int       // times metadata they sent pieces of has failed the hash check
+	distrusted       bool      // they sent bad metadata, so we never ask them for it again
+
+	requested   map[blockRequest]bool // blocks we've asked them for and not yet got, anything else they send is ignored
 	requestsMX  sync.Mutex
 	maxRequests int
 	pieceQueue  *PieceQueue
 
 	torrent *Torrent // associated torrent
 
+	client        string    // the client they're running, from their extended handshake
+	downloadMeter rateMeter // block payload received from them
+	uploadMeter   rateMeter // everything we've sent them
+
 	// wrapped io.Reader/io.Writer interfaces
 	pw *PeerWriter
 	pr *PeerReader
@@ -46,65 +88,99 @@ func (peer *Peer) setExtensions(extensions map[string]int) {
 	peer.extensions = extensions
 }
 
-func newPeer(ip string, port string, torrent *Torrent) *Peer {
+func newPeer(ip string, port string, infoHash []byte, torrent *Torrent) *Peer {
 	var peer Peer
 
 	peer.ip = ip
 	peer.port = port
+	peer.infoHash = infoHash
 	peer.torrent = torrent
-	peer.choked = true
-	peer.status = Unknown // implied by default
+	peer.choked.Store(true)
+	peer.status.Store(Unknown) // implied by default
 	peer.pieceQueue = newPieceQueue(0, false)
+	peer.requested = make(map[blockRequest]bool)
 
 	// rand.Seed(time.Now().UnixNano())
 	return &peer
 }
 
 func (peer *Peer) String() string {
-	return peer.ip + " " + strconv.Itoa(peer.status)
+	return peer.ip + " " + strconv.Itoa(int(peer.status.Load()))
 }
 
-func (peer *Peer) run(doneCh chan *Peer) {
+// run connects to the peer and exchanges messages with them until either side disconnects or ctx is done
+func (peer *Peer) run(ctx context.Context, doneCh chan *Peer) {
 	defer func() { doneCh <- peer }()
 
 	// if we are reconnecting to this peer we need to reset some variables
-	peer.status = Alive
-	peer.choked = true
-	peer.requests = 0
-
-	err := peer.connect()
-	if err != nil {
-		peer.status = Bad
-		return
+	peer.status.Store(Alive)
+	peer.choked.Store(true)
+	peer.unchoked = false
+	peer.requestsMX.Lock()
+	peer.requested = make(map[blockRequest]bool)
+	peer.requestsMX.Unlock()
+	peer.hasAll = false
+	peer.grantedFast = nil
+	peer.metadataLimiter = newRateLimiter(metadataRequestRate, peer.torrent.clock)
+	peer.fastMx.Lock()
+	peer.suggested, peer.allowedFast = nil, nil
+	peer.fastMx.Unlock()
+
+	var err error
+	if !peer.incoming {
+		err = peer.connect(ctx)
+		if err != nil {
+			peer.status.Store(Bad)
+			return
+		}
 	}
+	// closing the connection makes every read and write fail, which is how we stop the reader and handshake
+	stopClosing := context.AfterFunc(ctx, func() { peer.conn.Close() })
+	defer stopClosing()
 
 	err = peer.performHandshake()
+	peer.incoming = false // if we reconnect later it'll be as the initiator
 	if err != nil {
-		peer.status = Bad
+		peer.status.Store(Bad)
 		return
 	}
 
-	err = peer.getBitfield()
-	if err != nil {
-		peer.status = Bad
-		return
+	// a peer with nothing to offer may not send a bitfield, which is only a problem if we need something from them
+	if !peer.torrent.isDownloaded.Load() {
+		err = peer.getBitfield()
+		if err != nil {
+			peer.status.Store(Bad)
+			return
+		}
 	}
 
+	address := net.JoinHostPort(peer.ip, peer.port)
+	peer.torrent.emit(Event{Type: EventPeerConnected, Peer: address})
+	defer func() {
+		// we hung up on them, rather than the other way around
+		if ctx.Err() != nil || peer.torrent.paused.Load() {
+			err = nil
+		}
+		peer.torrent.emit(Event{Type: EventPeerDisconnected, Peer: address, Err: err})
+	}()
+
 	// Drop this peer if we don't have metadata yet and they aren't equipped to send it
-	if !peer.supportsMetadataRequests() && !peer.torrent.hasMetadata {
+	if !peer.supportsMetadataRequests() && !peer.torrent.hasMetadata.Load() {
+		err = errNoMetadataSupport
 		return
 	}
 
 	var wg sync.WaitGroup
 
 	wg.Add(2)
-	go peer.pr.run(&wg)
-	go peer.pw.run(&wg)
+	go peer.pr.run(ctx, &wg)
+	go peer.pw.run(ctx, &wg)
 
-	if peer.torrent.hasMetadata {
+	if peer.torrent.hasMetadata.Load() && !peer.torrent.isDownloaded.Load() {
 		peer.sendInterested()
 	}
 	wg.Wait()
+	err = peer.pr.err
 }
 
 func (peer *Peer) supportsMetadataRequests() bool {
@@ -117,8 +193,13 @@ func (peer *Peer) supportsMetadataRequests() bool {
 
 // TODO: ensure read/write are closed
 func (peer *Peer) disconnect() {
-	for i := 0; i < len(peer.pieceQueue.pieces); i++ {
-		p, _ := peer.pieceQueue.pop()
+	peer.torrent.releaseMetadataRequests(peer)
+	// hand back every piece we were downloading from them so that someone else can
+	for {
+		p, err := peer.pieceQueue.pop()
+		if err != nil {
+			break
+		}
 		peer.torrent.pieceQueue.push(p)
 	}
 	if peer.conn != nil { // need to look into this, also keeping it open
@@ -131,18 +212,122 @@ func (peer *Peer) disconnect() {
 }
 
 // Connect to peer via TCP and create a peer_reader over connection
-func (peer *Peer) connect() error {
-	timeout := time.Second * 10
-	conn, err := net.DialTimeout("tcp", peer.ip+":"+peer.port, timeout)
+func (peer *Peer) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	address := net.JoinHostPort(peer.ip, peer.port)
+	conn, err := peer.dial(ctx, address)
 
 	if err != nil {
 		return err
 	}
 
+	if peer.torrent.encryption != EncryptionDisabled {
+		var encrypted net.Conn
+		stopClosing := context.AfterFunc(ctx, func() { conn.Close() })
+		encrypted, err = encryptOutgoing(conn, peer.infoHash, peer.torrent.encryption)
+		if stopClosing() && err == nil {
+			peer.setConn(encrypted)
+			return nil
+		}
+		conn.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if peer.torrent.encryption == EncryptionRequired || ctx.Err() != nil {
+			return err
+		}
+		// they may not know MSE at all, so try again in plaintext
+		conn, err = peer.dial(ctx, address)
+		if err != nil {
+			return err
+		}
+	}
+
+	peer.setConn(conn)
+	return nil
+}
+
+// dial connects to the peer over uTP if the session uses it, or TCP. uTP gets a head start, after which whichever
+// connects first is used
+func (peer *Peer) dial(ctx context.Context, address string) (net.Conn, error) {
+	var socket *utpSocket
+	if peer.torrent.session != nil && !peer.tcpOnly {
+		socket = peer.torrent.session.utp()
+	}
+	if socket == nil {
+		return peer.torrent.dialer.DialContext(ctx, "tcp", address)
+	}
+
+	type dialed struct {
+		conn net.Conn
+		err  error
+		utp  bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialed, 2)
+	go func() {
+		conn, err := socket.DialContext(ctx, address)
+		results <- dialed{conn, err, true}
+	}()
+	dialTCP := func() {
+		go func() {
+			conn, err := peer.torrent.dialer.DialContext(ctx, "tcp", address)
+			results <- dialed{conn, err, false}
+		}()
+	}
+	// real time, like the uTP socket's own timers
+	headStart := time.NewTimer(utpHeadStart)
+	defer headStart.Stop()
+
+	pending, triedTCP := 1, false
+	var err error
+	for pending > 0 {
+		select {
+		case <-headStart.C:
+			if !triedTCP {
+				triedTCP = true
+				pending++
+				dialTCP()
+			}
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				err = result.err
+				if result.utp && !triedTCP {
+					triedTCP = true
+					pending++
+					dialTCP()
+				}
+				continue
+			}
+			// they don't speak uTP or it doesn't get through to them, so don't wait for it next time
+			peer.tcpOnly = !result.utp
+			// the other is cancelled, but may have connected already
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if other := <-results; other.err == nil {
+						other.conn.Close()
+					}
+				}
+			}(pending)
+			return result.conn, nil
+		}
+	}
+	return nil, err
+}
+
+// setConn wraps an established connection, either one we dialed or one that was accepted by the session
+func (peer *Peer) setConn(conn net.Conn) {
+	// the torrent looks for peers to request from and closes their connections under peersMx, which may be while we
+	// reconnect
+	peer.torrent.peersMx.Lock()
 	peer.conn = conn
+	peer.reader = bufio.NewReader(conn)
 	peer.pr = newPeerReader(peer)
 	peer.pw = newPeerWriter(peer)
-	return nil
+	peer.torrent.peersMx.Unlock()
 }
 
 // Sends an INTERESTED message about the given torrent so that we can be unchoked
@@ -150,7 +335,7 @@ func (peer *Peer) sendInterested() {
 	if peer.pw == nil {
 		return
 	}
-	peer.pw.write(Message{1, Interested, nil})
+	peer.pw.write(interestedMessage{}.encode())
 }
 
 func (peer *Peer) performHandshake() error {
@@ -158,148 +343,148 @@ func (peer *Peer) performHandshake() error {
 		return errors.New("peer's connection is nil")
 	}
 
-	outgoingHandshake := getHandshakeMessage(peer.torrent)
+	outgoingHandshake := getHandshakeMessage(peer.infoHash, peer.torrent.peerID)
 	_, err := peer.conn.Write(outgoingHandshake)
 	if err != nil {
 		return errors.New("unable to write to peer")
 	}
 
-	// Read from peer
-	pstrlenBuf := make([]byte, 1)
-	_, err = peer.conn.Read(pstrlenBuf)
-	if err != nil {
-		return errors.New("could not read from peer")
-	}
-
-	pstrlen := int(pstrlenBuf[0])
-
-	buf := make([]byte, 48+pstrlen)
-	_, err = peer.conn.Read(buf)
-	if err != nil {
-		return errors.New("could not read from peer")
+	// incoming peers have already sent their handshake, as we needed it to know which torrent they want
+	if !peer.incoming {
+		infoHash, reserved, err := readHandshake(peer.reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(infoHash, peer.infoHash) {
+			return errors.New("peer responded with a different info hash")
+		}
+		peer.reserved = reserved
 	}
 
 	// TODO: confirm that peerid is the same as supplied on tracker
 
+	// until they tell us otherwise in their extended handshake, if they even send one
+	peer.maxRequests = maxPeerRequests
+	peer.fast = supportsFast(peer.reserved)
+
 	// if the peer utilizes extended messages (most likely), we next need to send an extended handshake, mostly just for getting metadata
-	if buf[24]&0x10 == 16 {
+	if peer.reserved[5]&0x10 == 16 {
 		peer.usesExtended = true
-		outgoingExtendedHandshake := getExtendedHandshakeMessage()
+		metadataSize := 0
+		if peer.torrent.hasMetadata.Load() {
+			metadataSize = len(peer.torrent.metadataRaw)
+		}
+		outgoingExtendedHandshake := getExtendedHandshakeMessage(supportedExtensions(peer.torrent.allowsDiscovery()), metadataSize)
 
 		bytesWritten, err := peer.conn.Write(outgoingExtendedHandshake)
 		if err != nil || bytesWritten < len(outgoingExtendedHandshake) {
 			return errors.New("unable to write to peer in extended handshake")
 		}
 
-		lengthPrefixBuf := make([]byte, 4)
-		_, err = peer.conn.Read(lengthPrefixBuf)
+		message, err := peer.readMessage()
 		if err != nil {
 			return err
 		}
-
-		lengthPrefix := binary.BigEndian.Uint32(lengthPrefixBuf[0:])
-		buf = make([]byte, int(lengthPrefix))
-
-		_, err = io.ReadFull(peer.conn, buf)
-		if err != nil {
-			return err
+		if message.id != Extended || message.extended().extendedID != 0 {
+			return errors.New("got unexpected message from peer, expecting an extended handshake")
 		}
 
-		result, err := decodeHandshake(buf[2:])
+		result, err := decodeHandshake(message.extended().payload)
 		if err != nil {
-			peer.status = Bad
+			peer.status.Store(Bad)
 			return err
 		}
 
+		if !peer.torrent.allowsDiscovery() {
+			for name := range result.Extensions {
+				if discoveryExtensions[name] {
+					delete(result.Extensions, name)
+				}
+			}
+		}
 		peer.setExtensions(result.Extensions)
-		peer.maxRequests = result.Requests
-
-		if result.MetadataSize != 0 && peer.torrent.metadataSize == 0 { // make sure they attached metadata size, also no reason to overwrite if we already set
-			peer.torrent.metadataSize = result.MetadataSize
-			peer.torrent.metadataRaw = make([]byte, result.MetadataSize)
-			peer.torrent.metadataPieces = make([]byte, (peer.torrent.numMetadataPieces()+7)/8)
+		if result.Requests != 0 {
+			peer.maxRequests = result.Requests
 		}
+		peer.client = result.Client
+
+		peer.setMetadataSize(result.MetadataSize)
 	}
-	return nil
+	if peer.fast {
+		return peer.sendHaves()
+	}
+	return peer.sendBitfield()
 }
 
 // Read the bitfield, should be called directly after a handshake
 func (peer *Peer) getBitfield() error {
-	lengthPrefixBuf := make([]byte, 4)
-	messageIDBuf := make([]byte, 1)
-
-	_, err := peer.conn.Read(lengthPrefixBuf)
+	message, err := peer.readMessage()
 	if err != nil {
 		return err
 	}
 
-	_, err = peer.conn.Read(messageIDBuf)
-	if err != nil {
-		return err
+	// which peers that support the fast extension may replace with HAVE ALL or HAVE NONE
+	if peer.fast && (message.id == HaveAll || message.id == HaveNone) {
+		peer.setHaveAll(message.id == HaveAll)
+		return nil
 	}
-
-	lengthPrefix := int(binary.BigEndian.Uint32(lengthPrefixBuf[0:]))
-	messageID := int(messageIDBuf[0])
-
-	if messageID != Bitfield {
+	if message.id != Bitfield {
 		return errors.New("got unexpected message from peer, expecting BITFIELD")
 	}
+	peer.bitfield = message.payload
+	return nil
+}
 
-	bitfieldBuf := make([]byte, lengthPrefix-1)
-	_, err = io.ReadFull(peer.conn, bitfieldBuf)
-	if err != nil {
-		return err
+// readMessage reads the peer's next message, holding bitfields to the number of pieces once we know it
+func (peer *Peer) readMessage() (Message, error) {
+	numPieces := 0
+	if peer.torrent.hasMetadata.Load() {
+		numPieces = len(peer.torrent.pieces)
 	}
-	peer.bitfield = bitfieldBuf
-	return nil
+	return readMessage(peer.reader, numPieces)
 }
 
 // Send a request block message to this peer asking for a random non-downloaded block
 func (peer *Peer) requestPieces() error {
 	// Make sure it's a good idea to request blocks
-	if !peer.torrent.hasMetadata {
+	if !peer.torrent.hasMetadata.Load() {
 		return errors.New("block requested before metadata was downloaded")
 	}
 
 	peer.torrent.checkDownloadStatus()
-	if peer.torrent.isDownloaded {
-		panic("torrent is downloaded, no need to queue more blocks")
+	if peer.torrent.isDownloaded.Load() {
+		// we're about to disconnect anyway
+		return nil
 	}
 
 	peer.updatePieceQueue()
 
+	// the blocks of a piece that arrived just as they disconnected may get us here after they've handed back their
+	// pieces, and anything we queued for them then would never be downloaded
+	peer.torrent.peersMx.Lock()
+	pw := peer.pw
+	peer.torrent.peersMx.Unlock()
+
 	// Request as many pieces as we can without exceeding the peer's maxRequests
 	for {
 		peer.requestsMX.Lock()
-		if peer.requests+peer.torrent.getNumBlocksInPiece() > peer.maxRequests {
+		if len(peer.requested)+peer.torrent.getNumBlocksInPiece() > peer.maxRequests {
 			peer.requestsMX.Unlock()
 			break
 		}
 		peer.requestsMX.Unlock()
 
-		// Get a new random piece
-
-		piece, err := peer.torrent.pieceQueue.pop()
-		//		offset := rand.Intn(len(peer.torrent.pieces[piece].blocks))
-
-		for {
-			if err != nil {
-				return err
-			}
-
-			hasPiece, err := peer.hasPiece(piece)
-			if err != nil {
-				return err
-			}
-			if hasPiece {
-				peer.pieceQueue.push(piece)
-				break
+		piece, ok := peer.pickPiece()
+		if !ok {
+			// nothing they have that we can ask them for
+			return nil
+		}
+		peer.pieceQueue.push(piece)
+		if pw.stopped() {
+			if peer.pieceQueue.remove(piece) {
+				peer.torrent.pieceQueue.push(piece)
 			}
-
-			peer.torrent.pieceQueue.push(piece)
-			piece, err = peer.torrent.pieceQueue.pop()
-			//piece = rand.Intn(len(peer.torrent.pieces))
-			//offset = rand.Intn(len(peer.torrent.pieces[piece].blocks))
+			return nil
 		}
 
 		for offset := 0; offset < len(peer.torrent.pieces[piece].blocks); offset++ {
@@ -312,29 +497,14 @@ func (peer *Peer) requestPieces() error {
 				continue
 			}
 
-			// Create message
-			payload := make([]byte, 12)
-			binary.BigEndian.PutUint32(payload[0:], uint32(piece))
-			binary.BigEndian.PutUint32(payload[4:], uint32(offset*BlockLen))
-
-			// if this is the last blocks, we need to request the correct len
-			if offset == len(peer.torrent.pieces[piece].blocks)-1 {
-				// if last piece
-				if piece == len(peer.torrent.pieces)-1 {
-					binary.BigEndian.PutUint32(payload[8:], uint32(peer.torrent.metadata.Length%BlockLen))
-				} else {
-					// if last block in piece
-					binary.BigEndian.PutUint32(payload[8:], uint32(peer.torrent.metadata.PieceLen%BlockLen))
-				}
-			} else {
-				binary.BigEndian.PutUint32(payload[8:], uint32(BlockLen))
-			}
-
-			peer.pw.write(Message{13, Request, payload})
-
+			// the last block of a piece may be shorter
+			length := min(BlockLen, peer.torrent.pieceLength(piece)-offset*BlockLen)
+			request := blockRequest{piece, offset * BlockLen, length}
+			// before it's sent, as the block may arrive before we'd get to it after
 			peer.requestsMX.Lock()
-			peer.requests++
+			peer.requested[request] = true
 			peer.requestsMX.Unlock()
+			pw.write(requestMessage(request).encode())
 		}
 	}
 	return nil
@@ -357,8 +527,11 @@ func (peer *Peer) updatePieceQueue() {
 	return
 }
 
-// Return true if peer's bitfield indicates that they have the inputed piece
+// Return true if peer's bitfield indicates that they have the inputed piece, or they sent HAVE ALL
 func (peer *Peer) hasPiece(pieceNum int) (bool, error) {
+	if peer.hasAll {
+		return true, nil
+	}
 	return utils.BitIsSet(peer.bitfield, pieceNum)
 	//	return (peer.bitfield[(pieceNum/int(8))]>>(7-(pieceNum%8)))&1 == 1
 }
@@ -1,28 +1,44 @@
 package models
 
 import (
-	"bytes"
-	"encoding/binary"
-	"io"
+	"context"
+	"errors"
+	"net"
 	"sync"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 // PeerReader reads from the peer's connection and parses the messages
 type PeerReader struct {
 	peer *Peer
+	err  error // why the reader stopped, set once run returns
 }
 
+var errInvalidMessage = errors.New("peer sent an invalid message")
+
+// maxMessageLen is the longest message we'll read, well over a block or the bitfield of any reasonable torrent
+const maxMessageLen = 1 << 20
+
 func newPeerReader(peer *Peer) *PeerReader {
 	var pr PeerReader
 	pr.peer = peer
 	return &pr
 }
 
-func (pr *PeerReader) run(wg *sync.WaitGroup) {
+// run reads messages until the connection is closed, ctx is only used to stop handing blocks to the torrent
+func (pr *PeerReader) run(ctx context.Context, wg *sync.WaitGroup) {
+	var err error
 	defer func() {
-		if pr.peer.status != Bad {
-			pr.peer.status = Dead
+		pr.err = err
+		pr.peer.requestsMX.Lock()
+		if isTimeout(err) && len(pr.peer.requested) > 0 {
+			pr.peer.torrent.metrics.requestTimeouts.Add(1)
+		}
+		pr.peer.requestsMX.Unlock()
+		if pr.peer.status.Load() != Bad {
+			pr.peer.status.Store(Dead)
 		}
 		pr.peer.pw.stop()
 		wg.Done()
@@ -30,164 +46,142 @@ func (pr *PeerReader) run(wg *sync.WaitGroup) {
 
 	for {
 		// disconnect if we don't receive a KEEP ALIVE (or any message) for 2 minutes
-		err := pr.peer.conn.SetReadDeadline(time.Now().Add(time.Minute * time.Duration(2)))
+		err = pr.peer.conn.SetReadDeadline(time.Now().Add(time.Minute * time.Duration(2)))
 		if err != nil {
-			panic(err)
+			// the connection was closed under us
+			return
 		}
 
-		lengthPrefixBuf := make([]byte, 4)
-		_, err = io.ReadFull(pr.peer.conn, lengthPrefixBuf)
+		var message Message
+		message, err = pr.peer.readMessage()
 		if err != nil {
 			// NOTE: most of these erros end up being EOF, not entirely sure why
 			return
 		}
-
-		lengthPrefix := int(binary.BigEndian.Uint32(lengthPrefixBuf))
-
-		if lengthPrefix == 0 {
+		if message.lengthPrefix == 0 {
 			continue
 		}
-
-		messageIDBuf := make([]byte, 1)
-		_, err = pr.peer.conn.Read(messageIDBuf)
+		err = pr.dispatch(ctx, message)
 		if err != nil {
 			return
 		}
+	}
+}
 
-		messageID := int(messageIDBuf[0])
-
-		switch int(messageID) {
-		// no payload
-		case Choke:
-			pr.peer.choked = true
-			continue
-		case Unchoke:
-			pr.peer.choked = false
-			if pr.peer.torrent.hasMetadata {
-				go pr.peer.requestPieces()
-			}
-			continue
-		case Interested:
-			continue
-		case NotInterested:
-			continue
-		case Have:
-			pieceIndexBuf := make([]byte, 4)
-			_, err = io.ReadFull(pr.peer.conn, pieceIndexBuf)
-			if err != nil {
-				return
-			}
-			// A malicious peer may send a HAVE message with a piece we'll never download
-			//setBit(&pr.peer.bitfield, int(binary.BigEndian.Uint32(pieceIndexBuf)))
-		case Bitfield:
-			bitfieldBuf := make([]byte, lengthPrefix-1)
-			_, err = pr.peer.conn.Read(bitfieldBuf)
-			if err != nil {
-				return
-			}
-			pr.peer.bitfield = bitfieldBuf
-		case Request:
-			// index, begin, length
-			payloadBuf := make([]byte, 12)
-
-			_, err = pr.peer.conn.Read(payloadBuf)
-			if err != nil {
-				return
-			}
-		case PIECE:
-			if lengthPrefix > BlockLen+9 {
-				continue
-			}
-
-			indexBuf := make([]byte, 4)
-			beginBuf := make([]byte, 4)
-
-			_, err = pr.peer.conn.Read(indexBuf)
-			if err != nil {
-				return
-			}
-
-			_, err = pr.peer.conn.Read(beginBuf)
-			if err != nil {
-				return
-			}
-
-			index := int(binary.BigEndian.Uint32(indexBuf))
-			offset := int(binary.BigEndian.Uint32(beginBuf))
-
-			if offset/BlockLen > pr.peer.torrent.getNumBlocksInPiece() {
-				// got bad data
-				return
-			}
-
-			blockBuf := make([]byte, lengthPrefix-9)
-			_, err = io.ReadFull(pr.peer.conn, blockBuf)
-			if err != nil {
-				return
-			}
+// dispatch acts on a message that readMessage has checked is the right length for its id, returning an error if the
+// peer should be disconnected
+func (pr *PeerReader) dispatch(ctx context.Context, message Message) error {
+	decoded, err := decodeMessage(message)
+	if err != nil {
+		return err
+	}
 
-			block := TorrentBlock{index, offset, blockBuf}
-			pr.peer.torrent.torrentBlockCH <- block
-			//			pr.peer.torrent.setBlock(index, offset, blockBuf)
-			pr.peer.requestsMX.Lock()
-			pr.peer.requests--
-			pr.peer.requestsMX.Unlock()
+	switch msg := decoded.(type) {
+	case chokeMessage:
+		pr.peer.choked.Store(true)
+	case unchokeMessage:
+		pr.peer.choked.Store(false)
+		if pr.peer.torrent.hasMetadata.Load() {
 			go pr.peer.requestPieces()
-		case Cancel:
-
-			// index, begin, length
-			payloadBuf := make([]byte, 12)
-
-			_, err = pr.peer.conn.Read(payloadBuf)
-			if err != nil {
-				return
-			}
-		case Port:
-			listenPortBuf := make([]byte, 2)
-			_, err = pr.peer.conn.Read(listenPortBuf)
-			if err != nil {
-				return
-			}
-		case Extended:
-			extendedIDBuf := make([]byte, 1)
-			_, err = pr.peer.conn.Read(extendedIDBuf)
-			if err != nil {
-				return
-			}
-
-			if extendedIDBuf[0] != uint8(0) {
-				// Unsupported message type
-				continue
-			}
-
-			payloadBuf := make([]byte, lengthPrefix-2)
-			_, err = io.ReadFull(pr.peer.conn, payloadBuf)
-			if err != nil {
-				return
-			}
-
-			bencodeEnd := bytes.Index(payloadBuf, []byte("ee")) + 2
-			bencode := payloadBuf[0:bencodeEnd]
-
-			response, err := decodeMetadataRequest(bencode)
-			if err != nil {
-				return
-			}
-
-			if response.MsgType == 2 || response.MsgType == 0 { // reject || request
-				continue
-			}
+		}
+	case interestedMessage:
+		pr.peer.unchoke()
+	case notInterestedMessage:
+	case haveMessage:
+		// A malicious peer may send a HAVE message with a piece we'll never download
+		//setBit(&pr.peer.bitfield, msg.index)
+	case bitfieldMessage:
+		pr.peer.bitfield = msg.bitfield
+	case requestMessage:
+		// requests that cross with a choke or a piece we lost are ignored rather than a reason to disconnect
+		requestErr := pr.peer.serveRequest(blockRequest(msg))
+		if requestErr != nil {
+			log.Debug().Err(requestErr).Msg("Could not serve request")
+			pr.peer.rejectRequest(blockRequest(msg))
+		}
+	case pieceMessage:
+		pieces := pr.peer.torrent.pieces
+		if msg.index >= len(pieces) || msg.begin/BlockLen >= len(pieces[msg.index].blocks) {
+			return &wireError{id: message.id, length: int(message.lengthPrefix), reason: "block out of range"}
+		}
 
-			metadataPiece := payloadBuf[bencodeEnd:]
+		pr.peer.downloadMeter.add(len(msg.block))
+		pr.peer.torrent.waitDownload(len(msg.block))
+
+		request := blockRequest{msg.index, msg.begin, len(msg.block)}
+		pr.peer.requestsMX.Lock()
+		requested := pr.peer.requested[request]
+		delete(pr.peer.requested, request)
+		pr.peer.requestsMX.Unlock()
+		if !requested {
+			// we never asked for it, or they've already sent it or rejected it
+			log.Debug().Str("peer", net.JoinHostPort(pr.peer.ip, pr.peer.port)).Int("piece", msg.index).Int("begin", msg.begin).Msg("Ignoring block that wasn't requested")
+			return nil
+		}
 
-			pr.peer.torrent.metadataPieceCH <- MetadataPiece{response.Piece, metadataPiece}
+		block := TorrentBlock{msg.index, msg.begin, msg.block, nil}
+		select {
+		case pr.peer.torrent.torrentBlockCH <- block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		go pr.peer.requestPieces()
+	case cancelMessage, portMessage:
+	case haveAllMessage, haveNoneMessage:
+		if !pr.peer.fast {
+			return errInvalidMessage
+		}
+		pr.peer.setHaveAll(msg == haveAllMessage{})
+	case suggestMessage:
+		if !pr.peer.fast {
+			return errInvalidMessage
+		}
+		pr.peer.suggest(msg.index)
+	case allowedFastMessage:
+		if !pr.peer.fast {
+			return errInvalidMessage
+		}
+		if pr.peer.allowFast(msg.index) {
+			// they're choking us, but there may be something we can ask for anyway
+			go pr.peer.requestPieces()
+		}
+	case rejectMessage:
+		if !pr.peer.fast {
+			return errInvalidMessage
+		}
+		err := pr.peer.releaseRequest(blockRequest(msg))
+		if err != nil {
+			return err
+		}
+		// whoever is free to, including them if they've nothing else outstanding, asks for it again
+		pr.peer.torrent.requestFromIdlePeers()
+	case ExtendedMessage:
+		if msg.extendedID != utMetadataID {
+			// a later extended handshake, or an extension we didn't advertise
+			return nil
+		}
 
-			if !pr.peer.torrent.hasMetadata {
-				pr.peer.pw.sendMetadataRequest()
-			}
-		default:
-			return
+		dict, metadataPiece, err := splitExtended(msg.payload)
+		if err != nil {
+			return err
+		}
+		response, err := decodeMetadataRequest(dict)
+		if err != nil {
+			return err
 		}
 
+		switch response.MsgType {
+		case metadataRequest:
+			pr.peer.serveMetadata(response.Piece)
+		case metadataData:
+			select {
+			case pr.peer.torrent.metadataPieceCH <- MetadataPiece{response.Piece, metadataPiece, response.TotalSize, pr.peer}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case metadataReject:
+			pr.peer.metadataRejected(response.Piece)
+		}
 	}
+	return nil
 }
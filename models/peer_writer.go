@@ -2,6 +2,8 @@ package models
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
@@ -9,17 +11,19 @@ import (
 // KeepAlive messages are 4 byte, 0 values to signal to the peer we are still connected
 const KeepAlive = uint8(0)
 
+const keepAliveInterval = time.Minute
+
+var errWriterStopped = errors.New("peer writer stopped")
+
 // PeerWriter is how we write to a peer over the connection
 type PeerWriter struct {
 	writer  *bufio.Writer
 	bufSize int
 	peer    *Peer
 
-	messageCh chan []byte // probably need to initialize this?
-
-	// for scheduling purposes
-	keepAliveTicker       *time.Ticker
-	metadataRequestTicker *time.Ticker
+	messageCh chan []byte
+	done      chan struct{} // closed by stop, after which writes are dropped rather than blocking
+	stopOnce  sync.Once
 }
 
 func newPeerWriter(peer *Peer) *PeerWriter {
@@ -28,74 +32,116 @@ func newPeerWriter(peer *Peer) *PeerWriter {
 	pw.bufSize = 6 // len + id + (extension id if id == 20)
 	pw.writer = bufio.NewWriterSize(pw.peer.conn, pw.bufSize)
 	pw.messageCh = make(chan []byte)
+	pw.done = make(chan struct{})
 	return &pw
 }
 
 func (pw *PeerWriter) write(message Message) {
-	// TODO: investigate crash happening here
-	if pw.messageCh == nil {
-		return
-	}
-	pw.messageCh <- message.marshall()
+	pw.send(message.marshall())
 }
 
 func (pw *PeerWriter) writeExtended(message ExtendedMessage) {
-	pw.messageCh <- message.marshall()
+	pw.write(message.encode())
 }
 
-func (pw *PeerWriter) stop() {
-	pw.write(Message{1, Stop, nil})
-	if pw.keepAliveTicker != nil {
-		pw.keepAliveTicker.Stop()
-	}
-	if pw.metadataRequestTicker != nil {
-		pw.metadataRequestTicker.Stop()
+// send queues a marshalled message, dropping it if the writer has stopped
+func (pw *PeerWriter) send(packet []byte) {
+	select {
+	case pw.messageCh <- packet:
+	case <-pw.done:
 	}
 }
 
-// request specified metadata piece
-func (pw *PeerWriter) sendMetadataRequest() error {
-	piece, err := pw.peer.torrent.getRandMetadataPiece()
-	if err != nil {
-		return err
-	}
-	payload := encodeMetadataRequest(piece)
-	// marshall will ensure the length_prefix is set, we don't need to specify it here
-	pw.writeExtended(ExtendedMessage{0, 20, uint8(pw.peer.extensions["ut_metadata"]), []byte(payload)})
+// stop makes run return, it is safe to call more than once and never blocks
+func (pw *PeerWriter) stop() {
+	pw.stopOnce.Do(func() { close(pw.done) })
+}
 
-	return nil
+// stopped returns whether stop has been called, after which the connection is on its way out
+func (pw *PeerWriter) stopped() bool {
+	select {
+	case <-pw.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (pw *PeerWriter) keepAliveScheduler() {
-	pw.keepAliveTicker = time.NewTicker(1 * time.Minute)
-	for range pw.keepAliveTicker.C {
-		_, err := pw.peer.conn.Write([]byte{0, 0, 0, 0})
-		if err != nil {
+	ticker := pw.peer.torrent.clock.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			pw.send([]byte{0, 0, 0, 0})
+		case <-pw.done:
 			return
 		}
 	}
-	pw.keepAliveTicker.Stop()
 }
 
-func (pw *PeerWriter) run(wg *sync.WaitGroup) {
+// run writes queued messages until stop is called, ctx is done or the connection fails
+func (pw *PeerWriter) run(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer pw.stop()
 
 	go pw.keepAliveScheduler()
 
-	if !pw.peer.torrent.hasMetadata {
-		go pw.sendMetadataRequest()
+	if !pw.peer.torrent.hasMetadata.Load() {
+		go pw.peer.requestMetadata()
 	}
 
 	for {
-		msg := <-pw.messageCh
-
-		if int(msg[4]) == Stop {
+		var msg []byte
+		select {
+		case msg = <-pw.messageCh:
+		case <-pw.done:
+			return
+		case <-ctx.Done():
 			return
 		}
 
-		_, err := pw.peer.conn.Write(msg)
+		pw.peer.uploadMeter.add(len(msg))
+		pw.peer.torrent.uploadMeter.add(len(msg))
+		var err error
+		// only blocks count against the upload limits, everything else is tiny and often urgent
+		if len(msg) > 4 && msg[4] == PIECE {
+			err = pw.throttle(ctx, pw.peer.torrent.reserveUpload(len(msg)))
+		}
+		if err == nil {
+			_, err = pw.peer.conn.Write(msg)
+		}
 		if err != nil {
+			// make sure the reader notices too
+			pw.peer.conn.Close()
 			return
 		}
 	}
 }
+
+// throttle waits out delay before sending a block. With a low limit shared by many peers that can take a while, so
+// keep alives carry on meanwhile
+func (pw *PeerWriter) throttle(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := pw.peer.torrent.clock.NewTimer(delay)
+	defer timer.Stop()
+	ticker := pw.peer.torrent.clock.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timer.C():
+			return nil
+		case <-ticker.C():
+			_, err := pw.peer.conn.Write([]byte{0, 0, 0, 0})
+			if err != nil {
+				return err
+			}
+		case <-pw.done:
+			return errWriterStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -3,14 +3,15 @@ package models
 import (
 	"bytes"
 	"crypto/sha1"
+	"sync/atomic"
 )
 
 // Piece stores a collection of blocks, so that a torrent file can be easily written
 type Piece struct {
 	blocks     []Block
-	hash       []byte // sha1 hash of len 20
-	isVerified bool   // whether this piece has been verified via sha1 hash
-	numSet     int    // number of blocks that currently have data in them
+	hash       []byte      // sha1 hash of len 20
+	isVerified atomic.Bool // whether this piece has been verified via sha1 hash, which peers check without a lock
+	numSet     int         // number of blocks that currently have data in them
 }
 
 func (piece *Piece) verify() bool {
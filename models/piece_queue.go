@@ -47,6 +47,53 @@ func (pq *PieceQueue) contains(pieceIndex int) bool {
 	return in
 }
 
+// remove takes a piece out of the queue, returning whether it was there
+func (pq *PieceQueue) remove(pieceIndex int) bool {
+	pq.piecesMX.Lock()
+	defer pq.piecesMX.Unlock()
+	if _, in := pq.pieceMap[pieceIndex]; !in {
+		return false
+	}
+	for i, piece := range pq.pieces {
+		if piece == pieceIndex {
+			pq.pieces = append(pq.pieces[:i], pq.pieces[i+1:]...)
+			break
+		}
+	}
+	delete(pq.pieceMap, pieceIndex)
+	return true
+}
+
+// popFirst removes and returns the first piece in the queue for which match returns true
+func (pq *PieceQueue) popFirst(match func(pieceIndex int) bool) (int, bool) {
+	pq.piecesMX.Lock()
+	defer pq.piecesMX.Unlock()
+	for i, piece := range pq.pieces {
+		if match(piece) {
+			pq.pieces = append(pq.pieces[:i], pq.pieces[i+1:]...)
+			delete(pq.pieceMap, piece)
+			return piece, true
+		}
+	}
+	return -1, false
+}
+
+// filter removes every piece from the queue for which keep returns false
+func (pq *PieceQueue) filter(keep func(pieceIndex int) bool) {
+	pq.piecesMX.Lock()
+	defer pq.piecesMX.Unlock()
+
+	kept := pq.pieces[:0]
+	for _, pieceIndex := range pq.pieces {
+		if keep(pieceIndex) {
+			kept = append(kept, pieceIndex)
+		} else {
+			delete(pq.pieceMap, pieceIndex)
+		}
+	}
+	pq.pieces = kept
+}
+
 func newPieceQueue(size int, shuffle bool) *PieceQueue {
 	pq := new(PieceQueue)
 	pq.pieces = make([]int, size)
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"slices"
+)
+
+// File priorities, files with PrioritySkip are not downloaded unless they share a piece with a file we want
+const (
+	PrioritySkip   = 0
+	PriorityNormal = 1
+)
+
+// initFilePriorities sets every file to PriorityNormal, unless the magnet link selected only some of them (BEP 53)
+func (torrent *Torrent) initFilePriorities() {
+	numFiles := max(len(torrent.metadata.Files), 1)
+	torrent.filePriorities = make([]int, numFiles)
+
+	var selectOnly []int
+	if torrent.magnet != nil {
+		selectOnly = torrent.magnet.SelectOnly
+	}
+	for _, i := range selectOnly {
+		if i < numFiles {
+			torrent.filePriorities[i] = PriorityNormal
+		}
+	}
+	// selecting nothing that exists is treated the same as not selecting anything
+	if !slices.Contains(torrent.filePriorities, PriorityNormal) {
+		for i := range torrent.filePriorities {
+			torrent.filePriorities[i] = PriorityNormal
+		}
+	}
+
+	torrent.updateWantedPieces()
+}
+
+// updateWantedPieces works out which pieces overlap a file that isn't skipped
+func (torrent *Torrent) updateWantedPieces() {
+	torrent.wantedPieces = make([]bool, len(torrent.pieces))
+	torrent.numWantedPieces = 0
+
+	for _, entry := range torrent.fileEntries() {
+		if entry.priority == PrioritySkip || entry.hasAttr(AttrPadding) || entry.length == 0 {
+			continue
+		}
+		first := entry.offset / torrent.metadata.PieceLen
+		last := (entry.offset + entry.length - 1) / torrent.metadata.PieceLen
+		for i := first; i <= last; i++ {
+			if !torrent.wantedPieces[i] {
+				torrent.wantedPieces[i] = true
+				torrent.numWantedPieces++
+			}
+		}
+	}
+}
+
+var errMetadataRequired = errors.New("torrent does not have its metadata yet")
+
+// SetFilePriority changes the priority of the file at fileIndex (in the order given by Files), queueing any pieces it
+// now needs and dropping any that no file wants anymore
+func (torrent *Torrent) SetFilePriority(fileIndex int, priority int) error {
+	if !torrent.hasMetadata.Load() {
+		return errMetadataRequired
+	}
+	if priority != PrioritySkip && priority != PriorityNormal {
+		return errors.New("unknown file priority")
+	}
+
+	torrent.downloadedMx.Lock()
+	defer torrent.downloadedMx.Unlock()
+	if fileIndex < 0 || fileIndex >= len(torrent.filePriorities) {
+		return errors.New("file index is out of range")
+	}
+	if torrent.filePriorities[fileIndex] == priority {
+		return nil
+	}
+	if torrent.isDownloaded.Load() && priority != PrioritySkip {
+		return errors.New("torrent has already been downloaded")
+	}
+
+	torrent.filePriorities[fileIndex] = priority
+	torrent.updateWantedPieces()
+	torrent.pieceQueue.filter(torrent.isPieceWanted)
+	for i := range torrent.pieces {
+		if torrent.wantedPieces[i] && !torrent.pieces[i].isVerified.Load() && !torrent.pieceQueue.contains(i) {
+			torrent.pieceQueue.push(i)
+		}
+	}
+	torrent.progressBar.newOption(torrent.numPiecesDownloaded.Load(), int64(torrent.numWantedPieces))
+
+	// skipping the last file we were waiting on finishes the torrent
+	if priority == PrioritySkip {
+		torrent.background(torrent.checkDownloadStatus)
+	}
+	return nil
+}
+
+func (torrent *Torrent) isPieceWanted(pieceIndex int) bool {
+	return torrent.wantedPieces[pieceIndex]
+}
@@ -1,6 +1,9 @@
 package models
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
 // Shamelessly stolen from https://www.pixelstech.net/article/1596946473-A-simple-example-on-implementing-progress-bar-in-GoLang
 
@@ -11,6 +14,7 @@ type Bar struct {
 	total   int64  // total value for progress
 	rate    string // the actual progress bar to be printed
 	graph   string // the fill value for progress bar
+	out     io.Writer
 }
 
 func (bar *Bar) newOption(start, total int64) {
@@ -20,6 +24,7 @@ func (bar *Bar) newOption(start, total int64) {
 		bar.graph = "#"
 	}
 	bar.percent = bar.getPercent()
+	bar.rate = "" // the total may have changed since we were last set up
 	for i := 0; i < int(bar.percent); i += 2 {
 		bar.rate += bar.graph // initial progress position
 	}
@@ -36,9 +41,9 @@ func (bar *Bar) play(cur int64) {
 	if bar.percent != last && bar.percent%2 == 0 {
 		bar.rate += bar.graph
 	}
-	fmt.Printf("\r[%-50s]%3d%% %8d/%d", bar.rate, bar.percent, bar.cur, bar.total)
+	fmt.Fprintf(bar.out, "\r[%-50s]%3d%% %8d/%d", bar.rate, bar.percent, bar.cur, bar.total)
 }
 
 func (bar *Bar) finish() {
-	fmt.Println()
+	fmt.Fprintln(bar.out)
 }
@@ -0,0 +1,422 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// socks5 constants from RFC 1928 and RFC 1929
+const (
+	socksVersion        = 5
+	socksMethodNoAuth   = 0
+	socksMethodPassword = 2
+	socksNoMethods      = 0xff
+	socksCmdConnect     = 1
+	socksCmdAssociate   = 3
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+var (
+	errProxyUnavailable = errors.New("proxy is unavailable and direct connections aren't allowed")
+	errProxyAuth        = errors.New("proxy rejected our credentials")
+	errProxyUDP         = errors.New("udp can only go through a socks5 proxy")
+	errInvalidSocks     = errors.New("invalid socks5 response")
+)
+
+// proxyDialer dials through a SOCKS5 or HTTP CONNECT proxy. If the proxy can't be reached it dials directly,
+// unless only is set
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer // how we reach the proxy
+	only    bool
+}
+
+// newProxyDialer parses proxy, a socks5://[user:password@]host[:port] or http://[user:password@]host[:port] url
+func newProxyDialer(proxy string, forward Dialer, only bool) (*proxyDialer, error) {
+	link, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	defaultPort := "1080"
+	switch link.Scheme {
+	case "socks5", "socks5h":
+	case "http":
+		defaultPort = "8080"
+	default:
+		return nil, errors.New("unsupported proxy scheme " + strconv.Quote(link.Scheme) + ", expected socks5 or http")
+	}
+	if link.Hostname() == "" {
+		return nil, errors.New("proxy url has no host")
+	}
+	if link.Port() == "" {
+		link.Host = net.JoinHostPort(link.Hostname(), defaultPort)
+	}
+	return &proxyDialer{proxy: link, forward: forward, only: only}, nil
+}
+
+func (pd *proxyDialer) isSocks() bool {
+	return pd.proxy.Scheme != "http"
+}
+
+// dialProxy connects to the proxy itself, returning errProxyUnavailable if it can't be reached and we mustn't go
+// around it, or a nil conn if we should
+func (pd *proxyDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	conn, err := pd.forward.DialContext(ctx, "tcp", pd.proxy.Host)
+	if err == nil {
+		return conn, nil
+	}
+	if pd.only {
+		return nil, errors.Join(errProxyUnavailable, err)
+	}
+	log.Debug().Err(err).Msg("Could not reach proxy " + redactURL(*pd.proxy) + ", connecting directly")
+	return nil, nil
+}
+
+func (pd *proxyDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := pd.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return pd.forward.DialContext(ctx, network, address)
+	}
+
+	// the handshake has as long as the dial did
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if pd.isSocks() {
+		_, err = pd.socksRequest(conn, socksCmdConnect, address)
+	} else {
+		conn, err = pd.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksRequest authenticates with the proxy and sends it cmd, returning the address the proxy bound for it
+func (pd *proxyDialer) socksRequest(conn net.Conn, cmd byte, address string) (*net.UDPAddr, error) {
+	methods := []byte{socksMethodNoAuth}
+	if pd.proxy.User != nil {
+		methods = append(methods, socksMethodPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		return nil, errInvalidSocks
+	}
+
+	switch reply[1] {
+	case socksMethodNoAuth:
+	case socksMethodPassword:
+		if pd.proxy.User == nil {
+			return nil, errInvalidSocks
+		}
+		err = pd.socksAuthenticate(conn)
+		if err != nil {
+			return nil, err
+		}
+	case socksNoMethods:
+		return nil, errProxyAuth
+	default:
+		return nil, errInvalidSocks
+	}
+
+	target, err := encodeSocksAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append([]byte{socksVersion, cmd, 0}, target...))
+	if err != nil {
+		return nil, err
+	}
+	reply = make([]byte, 3)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		return nil, errInvalidSocks
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksReplies) {
+			return nil, errors.New("proxy could not connect to " + address + ": " + socksReplies[reply[1]])
+		}
+		return nil, errors.New("proxy could not connect to " + address)
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAuthenticate sends our username and password, as in RFC 1929
+func (pd *proxyDialer) socksAuthenticate(conn net.Conn) error {
+	username := pd.proxy.User.Username()
+	password, _ := pd.proxy.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("proxy username and password can be at most 255 bytes")
+	}
+	request := append([]byte{1, byte(len(username))}, username...)
+	request = append(append(request, byte(len(password))), password...)
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errProxyAuth
+	}
+	return nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to address. The returned conn must be used in place of conn, in case
+// the proxy sent anything after its response
+func (pd *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if pd.proxy.User != nil {
+		password, _ := pd.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(pd.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return conn, errProxyAuth
+	case resp.StatusCode != http.StatusOK:
+		return conn, errors.New("proxy could not connect to " + address + ": " + resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads whatever was buffered before carrying on with the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.reader.Read(b)
+}
+
+// encodeSocksAddr encodes a host:port as the address type, address and port of a socks5 request. Host names are
+// sent as they are, so that the proxy resolves them
+func encodeSocksAddr(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		encoded = append([]byte{socksAddrIPv4}, ip.To4()...)
+	case ip != nil:
+		encoded = append([]byte{socksAddrIPv6}, ip.To16()...)
+	case len(host) > 255:
+		return nil, errors.New("host name is too long for socks5: " + host)
+	default:
+		encoded = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(encoded, uint16(port)), nil
+}
+
+// readSocksAddr reads an address type, address and port. A host name can't be resolved here so comes back as an
+// unspecified ip, which is only ever the case for a proxy's bound address
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	switch atyp[0] {
+	case socksAddrIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksAddrIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(r, make([]byte, length[0]))
+		if err != nil {
+			return nil, err
+		}
+		ip = net.IPv4zero
+	default:
+		return nil, errInvalidSocks
+	}
+	if atyp[0] != socksAddrDomain {
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// proxyListenConfig sends UDP through a socks5 proxy's UDP ASSOCIATE. Listening for peers is left to the
+// ListenConfig it wraps, the session doesn't listen at all if direct connections aren't allowed
+type proxyListenConfig struct {
+	ListenConfig
+	dialer *proxyDialer
+}
+
+func (plc *proxyListenConfig) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	if !plc.dialer.isSocks() {
+		if plc.dialer.only {
+			return nil, errProxyUDP
+		}
+		return plc.ListenConfig.ListenPacket(ctx, network, address)
+	}
+
+	control, err := plc.dialer.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if control == nil {
+		return plc.ListenConfig.ListenPacket(ctx, network, address)
+	}
+	control.SetDeadline(time.Now().Add(30 * time.Second))
+	// we don't know which address we'll send from, as far as the proxy is concerned
+	relay, err := plc.dialer.socksRequest(control, socksCmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	control.SetDeadline(time.Time{})
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	conn, err := plc.ListenConfig.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	pc := &socksPacketConn{PacketConn: conn, control: control, relay: relay}
+	// the association only lasts as long as the control connection
+	go func() {
+		io.Copy(io.Discard, control)
+		conn.Close()
+	}()
+	return pc, nil
+}
+
+// socksPacketConn sends datagrams through a socks5 proxy's relay, each one prefixed with where it's going or where
+// it came from
+type socksPacketConn struct {
+	net.PacketConn
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (pc *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target, err := encodeSocksAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	header := append([]byte{0, 0, 0}, target...) // reserved and fragment number, we never fragment
+	_, err = pc.PacketConn.WriteTo(append(header, b...), pc.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262) // room for the longest header
+	for {
+		n, from, err := pc.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// anything that isn't from the relay, or is a fragment, is dropped
+		if udpFrom, ok := from.(*net.UDPAddr); !ok || !udpFrom.IP.Equal(pc.relay.IP) {
+			continue
+		}
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		header := bytes.NewReader(buf[3:n])
+		source, err := readSocksAddr(header)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-header.Len():n]), source, nil
+	}
+}
+
+func (pc *socksPacketConn) Close() error {
+	pc.control.Close()
+	return pc.PacketConn.Close()
+}
@@ -0,0 +1,368 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProxy is a minimal SOCKS5 (CONNECT and UDP ASSOCIATE) or HTTP CONNECT proxy, which wants username and
+// password if they're set
+type testProxy struct {
+	listener net.Listener
+	socks    bool
+	username string
+	password string
+	tunnels  atomic.Int32 // connections and associations made
+}
+
+func newTestProxy(t *testing.T, socks bool, username string, password string) *testProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &testProxy{listener: listener, socks: socks, username: username, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if socks {
+					proxy.serveSocks(conn)
+				} else {
+					proxy.serveHTTP(conn)
+				}
+			}()
+		}
+	}()
+	return proxy
+}
+
+func (proxy *testProxy) url() string {
+	scheme := "http://"
+	if proxy.socks {
+		scheme = "socks5://"
+	}
+	if proxy.username != "" {
+		scheme += proxy.username + ":" + proxy.password + "@"
+	}
+	return scheme + proxy.listener.Addr().String()
+}
+
+func (proxy *testProxy) serveSocks(conn net.Conn) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socksMethodNoAuth)
+	if proxy.username != "" {
+		method = socksMethodPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return
+	}
+	conn.Write([]byte{socksVersion, method})
+
+	if method == socksMethodPassword {
+		reader := bufio.NewReader(conn)
+		credentials := make([]string, 2)
+		reader.ReadByte()
+		for i := range credentials {
+			length, _ := reader.ReadByte()
+			buf := make([]byte, length)
+			io.ReadFull(reader, buf)
+			credentials[i] = string(buf)
+		}
+		if credentials[0] != proxy.username || credentials[1] != proxy.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch request[1] {
+	case socksCmdConnect:
+		upstream, err := net.Dial("tcp", target.String())
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		proxy.tunnels.Add(1)
+		bound, _ := encodeSocksAddr(upstream.LocalAddr().String())
+		conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	case socksCmdAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		proxy.tunnels.Add(1)
+		bound, _ := encodeSocksAddr(relay.LocalAddr().String())
+		conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+		go relayUDP(relay)
+		io.Copy(io.Discard, conn)
+	default:
+		conn.Write([]byte{socksVersion, 7, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// relayUDP forwards datagrams from the client to wherever their header says, and wraps the replies for the client
+func relayUDP(relay net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			header := bytes.NewReader(buf[3:n])
+			target, err := readSocksAddr(header)
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(buf[n-header.Len():n], target)
+			continue
+		}
+		source, _ := encodeSocksAddr(from.String())
+		relay.WriteTo(append(append([]byte{0, 0, 0}, source...), buf[:n]...), client)
+	}
+}
+
+func (proxy *testProxy) serveHTTP(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if proxy.username != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.username+":"+proxy.password))
+		if req.Header.Get("Proxy-Authorization") != expected {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+	upstream, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstream.Close()
+	proxy.tunnels.Add(1)
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(upstream, reader)
+	io.Copy(conn, upstream)
+}
+
+// newEchoServer returns the address of a TCP server that echoes whatever it's sent
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// unusedAddress returns an address nothing is listening on
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestProxyDialer(t *testing.T) {
+	echo := newEchoServer(t)
+	socks := newTestProxy(t, true, "", "")
+	socksAuth := newTestProxy(t, true, "user", "pa:ss")
+	httpProxy := newTestProxy(t, false, "", "")
+	httpAuth := newTestProxy(t, false, "user", "pa:ss")
+
+	testCases := []struct {
+		name      string
+		proxyURL  string
+		only      bool
+		proxy     *testProxy // should have made a tunnel, nil if we should have connected directly
+		expectErr bool
+	}{
+		{name: "socks5", proxyURL: socks.url(), proxy: socks},
+		{name: "socks5 with password", proxyURL: "socks5://user:pa%3Ass@" + socksAuth.listener.Addr().String(), proxy: socksAuth},
+		{name: "socks5 wrong password", proxyURL: "socks5://user:wrong@" + socksAuth.listener.Addr().String(), expectErr: true},
+		{name: "socks5 no password", proxyURL: "socks5://" + socksAuth.listener.Addr().String(), expectErr: true},
+		{name: "http connect", proxyURL: httpProxy.url(), proxy: httpProxy},
+		{name: "http connect with password", proxyURL: "http://user:pa%3Ass@" + httpAuth.listener.Addr().String(), proxy: httpAuth},
+		{name: "http connect wrong password", proxyURL: "http://user:wrong@" + httpAuth.listener.Addr().String(), expectErr: true},
+		{name: "unavailable proxy", proxyURL: "socks5://" + unusedAddress(t)},
+		{name: "unavailable proxy only", proxyURL: "socks5://" + unusedAddress(t), only: true, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer, err := newProxyDialer(tc.proxyURL, &net.Dialer{}, tc.only)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tunnels int32
+			if tc.proxy != nil {
+				tunnels = tc.proxy.tunnels.Load()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialer.DialContext(ctx, "tcp", echo)
+			if tc.expectErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected to connect, got %v", err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte("hello"))
+			reply := make([]byte, 5)
+			if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+				t.Errorf("Expected hello to be echoed, got %q %v", reply, err)
+			}
+			if tc.proxy != nil && tc.proxy.tunnels.Load() != tunnels+1 {
+				t.Errorf("Expected the connection to go through the proxy")
+			}
+		})
+	}
+}
+
+func TestProxyUDPAssociate(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// echoes packets back, so that the response has the same transaction id as the request
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	socks := newTestProxy(t, true, "user", "secret")
+	testCases := []struct {
+		name      string
+		proxyURL  string
+		only      bool
+		viaProxy  bool
+		expectErr bool
+	}{
+		{name: "socks5", proxyURL: socks.url(), viaProxy: true},
+		{name: "http only", proxyURL: "http://" + unusedAddress(t), only: true, expectErr: true},
+		{name: "unavailable proxy only", proxyURL: "socks5://" + unusedAddress(t), only: true, expectErr: true},
+		{name: "unavailable proxy", proxyURL: "socks5://" + unusedAddress(t)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer, err := newProxyDialer(tc.proxyURL, &net.Dialer{}, tc.only)
+			if err != nil {
+				t.Fatal(err)
+			}
+			socket, err := newUDPTrackerSocket(&proxyListenConfig{ListenConfig: &net.ListenConfig{}, dialer: dialer}, SystemClock)
+			if tc.expectErr {
+				if err == nil {
+					socket.close()
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer socket.close()
+
+			// shaped like a response, with the action then transaction id
+			packet := binary.BigEndian.AppendUint32(nil, 0)
+			packet = binary.BigEndian.AppendUint32(packet, 7)
+			packet = binary.BigEndian.AppendUint64(packet, 0x41727101980)
+			response, err := socket.roundTrip(context.Background(), server.LocalAddr(), packet, 7, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Expected a response, got %v", err)
+			}
+			if !bytes.Equal(response, packet) {
+				t.Errorf("Expected %x back, got %x", packet, response)
+			}
+			if tc.viaProxy && socks.tunnels.Load() == 0 {
+				t.Errorf("Expected the packet to go through the proxy")
+			}
+		})
+	}
+}
+
+func TestSessionProxyOnly(t *testing.T) {
+	session, err := NewSession(SessionConfig{ListenPort: DefaultListenPort + 100, Proxy: "http://" + unusedAddress(t), ProxyOnly: true})
+	if err != nil {
+		t.Fatalf("Expected the session to start without a proxy for udp, got %v", err)
+	}
+	defer session.Close()
+	if session.ListenPort() != 0 {
+		t.Errorf("Expected the session not to accept connections from peers")
+	}
+
+	_, err = NewSession(SessionConfig{ListenPort: -1, Proxy: "ftp://proxy.example.com"})
+	if err == nil {
+		t.Errorf("Expected an unsupported proxy to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket which allows bursts of up to a second's worth of bytes
+type rateLimiter struct {
+	mx     sync.Mutex
+	rate   int // bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+func newRateLimiter(rate int, clock Clock) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: float64(rate), last: clock.Now(), clock: clock}
+}
+
+// wait blocks until n bytes may be transferred, a nil limiter never blocks
+func (rl *rateLimiter) wait(n int) {
+	if delay := rl.reserve(n); delay > 0 {
+		sleep(context.Background(), rl.clock, delay)
+	}
+}
+
+// reserve takes n bytes' worth of tokens, returning how long to wait before transferring them. Tokens are taken up
+// front, going into debt if need be, so that concurrent callers queue up behind each other
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	if rl.rate <= 0 {
+		return 0
+	}
+	now := rl.clock.Now()
+	rl.tokens = min(rl.tokens+now.Sub(rl.last).Seconds()*float64(rl.rate), float64(rl.rate))
+	rl.last = now
+
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / float64(rl.rate) * float64(time.Second))
+}
+
+// take takes n tokens if there are that many, returning whether it did. Unlike reserve it never goes into debt, so
+// it suits refusing things outright rather than delaying them
+func (rl *rateLimiter) take(n int) bool {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	if rl.rate <= 0 {
+		return true
+	}
+	now := rl.clock.Now()
+	rl.tokens = min(rl.tokens+now.Sub(rl.last).Seconds()*float64(rl.rate), float64(rl.rate))
+	rl.last = now
+
+	if rl.tokens < float64(n) {
+		return false
+	}
+	rl.tokens -= float64(n)
+	return true
+}
+
+// setRate changes the limit, taking effect for the next call to wait
+func (rl *rateLimiter) setRate(rate int) {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	rl.rate = rate
+	rl.tokens = min(rl.tokens, float64(rate))
+}
+
+// limit returns the current rate in bytes per second, 0 if unlimited
+func (rl *rateLimiter) limit() int {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	return max(rl.rate, 0)
+}
+
+// rateMeterWindow is how many seconds a rateMeter averages over
+const rateMeterWindow = 5
+
+// rateMeter measures throughput over the last few seconds, along with the total ever transferred
+type rateMeter struct {
+	mx      sync.Mutex
+	total   int64
+	buckets [rateMeterWindow]int64 // bytes transferred in each of the last few seconds
+	second  int64                  // unix time of the most recent bucket
+}
+
+func (rm *rateMeter) add(n int) {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	rm.advance(time.Now().Unix())
+	rm.buckets[rm.second%rateMeterWindow] += int64(n)
+	rm.total += int64(n)
+}
+
+// advance clears out any buckets that are too old to count, must be called with mx held
+func (rm *rateMeter) advance(now int64) {
+	for second := max(rm.second+1, now-rateMeterWindow+1); second <= now; second++ {
+		rm.buckets[second%rateMeterWindow] = 0
+	}
+	rm.second = max(rm.second, now)
+}
+
+// rate returns the average bytes per second over the window
+func (rm *rateMeter) rate() int {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	rm.advance(time.Now().Unix())
+	var sum int64
+	for _, n := range rm.buckets {
+		sum += n
+	}
+	return int(sum / rateMeterWindow)
+}
+
+// bytes returns the total ever transferred
+func (rm *rateMeter) bytes() int64 {
+	rm.mx.Lock()
+	defer rm.mx.Unlock()
+	return rm.total
+}
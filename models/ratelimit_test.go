@@ -0,0 +1,127 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTorrentRateLimits(t *testing.T) {
+	testCases := []struct {
+		name          string
+		torrentRate   int
+		sessionRate   int
+		expectedDelay time.Duration // before 3000 bytes may be sent
+	}{
+		{name: "unlimited", expectedDelay: 0},
+		// the torrent's limit is set afterwards, so it has no burst to spend yet
+		{name: "torrent", torrentRate: 1000, expectedDelay: 3 * time.Second},
+		{name: "session", sessionRate: 1000, expectedDelay: 2 * time.Second},
+		{name: "stricter torrent", torrentRate: 500, sessionRate: 1000, expectedDelay: 6 * time.Second},
+		{name: "stricter session", torrentRate: 2000, sessionRate: 500, expectedDelay: 5 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			session, err := NewSession(SessionConfig{ListenPort: -1, Clock: clock, UploadRate: tc.sessionRate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			torrent, err := session.AddMagnet(&Magnet{InfoHash: bytes.Repeat([]byte{0xab}, 20)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			torrent.SetRateLimits(0, tc.torrentRate)
+			if _, upload := torrent.RateLimits(); upload != tc.torrentRate {
+				t.Errorf("Expected a torrent limit of %d, got %d", tc.torrentRate, upload)
+			}
+			if delay := torrent.reserveUpload(3000); delay != tc.expectedDelay {
+				t.Errorf("Expected to wait %s, got %s", tc.expectedDelay, delay)
+			}
+		})
+	}
+}
+
+func TestWaitDownload(t *testing.T) {
+	clock := newFakeClock()
+	session, err := NewSession(SessionConfig{ListenPort: -1, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	torrent, err := session.AddMagnet(&Magnet{InfoHash: bytes.Repeat([]byte{0xab}, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.SetRateLimits(1000, 0)
+
+	done := make(chan struct{})
+	go func() {
+		torrent.waitDownload(1500)
+		close(done)
+	}()
+	clock.waitForTimers(t, 2) // the session's schedule and our wait
+	clock.advance(time.Second)
+	select {
+	case <-done:
+		t.Fatal("Expected to wait a second and a half")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.advance(500 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to stop waiting after a second and a half")
+	}
+}
+
+func TestThrottledWriterKeepsAlive(t *testing.T) {
+	clock := newFakeClock()
+	torrent := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{0xab}, 20)}, 10)
+	torrent.clock = clock
+	torrent.hasMetadata.Store(true)
+	torrent.uploadLimiter = newRateLimiter(1000, clock)
+
+	ours, theirs := net.Pipe()
+	peer := newPeer("192.0.2.1", "6881", torrent.infoHash, torrent)
+	peer.setConn(ours)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go peer.pw.run(context.Background(), &wg)
+	defer wg.Wait()
+	defer theirs.Close()
+	defer peer.pw.stop()
+
+	// a block far larger than the limit, which has to wait for 2 minutes and a bit after the first second's burst
+	block := make([]byte, 121495)
+	go peer.pw.write(Message{uint32(1 + len(block)), PIECE, block})
+	clock.waitForTimers(t, 3) // our keep alive ticker, and the throttle's timer and ticker
+
+	read := func(n int) []byte {
+		t.Helper()
+		theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(theirs, buf); err != nil {
+			t.Fatalf("Expected %d bytes, got %v", n, err)
+		}
+		return buf
+	}
+	for i := 0; i < 2; i++ {
+		clock.advance(keepAliveInterval)
+		if got := read(4); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+			t.Fatalf("Expected a keep alive while throttled, got %v", got)
+		}
+	}
+	clock.advance(time.Second)
+	if got := read(5); binary.BigEndian.Uint32(got) != uint32(1+len(block)) || got[4] != PIECE {
+		t.Fatalf("Expected the block once the limit allows, got %v", got)
+	}
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateSchedule is a time of the week when the session's rate limits are different, for example to slow down
+// during working hours
+type RateSchedule struct {
+	Days         []time.Weekday // every day if empty
+	Start        time.Duration  // since midnight, local time
+	End          time.Duration  // since midnight, before Start to carry on past midnight or the same as it for all day
+	DownloadRate int            // bytes per second, 0 for unlimited
+	UploadRate   int
+}
+
+// covers returns whether the schedule applies at t
+func (rs RateSchedule) covers(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	day := t.Weekday()
+
+	switch {
+	case rs.Start == rs.End:
+	case rs.Start < rs.End:
+		if since < rs.Start || since >= rs.End {
+			return false
+		}
+	case since < rs.End:
+		// the early hours belong to the day that the period started on
+		day = (day + 6) % 7
+	case since < rs.Start:
+		return false
+	}
+
+	if len(rs.Days) == 0 {
+		return true
+	}
+	for _, d := range rs.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+var errInvalidSchedule = errors.New(`invalid schedule, expected "[days] HH:MM-HH:MM [down=KiB/s] [up=KiB/s]", e.g. "mon-fri 09:00-17:00 down=512 up=64"`)
+
+// ParseRateSchedule parses a schedule from the command line, such as "mon-fri 09:00-17:00 down=512 up=64". Days
+// are a range or a comma separated list and may be left out for every day, the rates are in KiB/s and are
+// unlimited if left out
+func ParseRateSchedule(s string) (RateSchedule, error) {
+	var rs RateSchedule
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return rs, err
+		}
+		rs.Days = days
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return rs, errInvalidSchedule
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return rs, errInvalidSchedule
+	}
+	var err error
+	rs.Start, err = parseTimeOfDay(start)
+	if err != nil {
+		return rs, err
+	}
+	rs.End, err = parseTimeOfDay(end)
+	if err != nil {
+		return rs, err
+	}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		rate, err := strconv.Atoi(value)
+		if err != nil || rate < 0 {
+			return rs, errInvalidSchedule
+		}
+		switch key {
+		case "down":
+			rs.DownloadRate = rate * 1024
+		case "up":
+			rs.UploadRate = rate * 1024
+		default:
+			return rs, errInvalidSchedule
+		}
+	}
+	return rs, nil
+}
+
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+		from, to := parseWeekday(first), parseWeekday(last)
+		if from < 0 || to < 0 {
+			return nil, errInvalidSchedule
+		}
+		// ranges may wrap around the weekend, e.g. fri-mon
+		for day := from; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseWeekday(s string) time.Weekday {
+	for i, day := range weekdays {
+		if s == day {
+			return time.Weekday(i)
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay parses HH:MM into the time since midnight, 24:00 being the end of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err := strconv.Atoi(hours)
+	if !ok || err != nil || h < 0 || h > 24 {
+		return 0, errInvalidSchedule
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errInvalidSchedule
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// SetRateSchedule replaces the session's schedules. Whenever one applies, its limits are used instead of those set
+// with SetRateLimits, the first that applies winning if several do
+func (session *Session) SetRateSchedule(schedules []RateSchedule) {
+	session.limitsMx.Lock()
+	session.config.Schedule = append([]RateSchedule{}, schedules...)
+	session.limitsMx.Unlock()
+	session.applyRateLimits()
+}
+
+// RateLimits returns the download and upload limits in force right now, in bytes per second, 0 for unlimited
+func (session *Session) RateLimits() (int, int) {
+	return session.downloadLimiter.limit(), session.uploadLimiter.limit()
+}
+
+// applyRateLimits sets the limiters to the schedule that applies right now, or the configured limits if none do
+func (session *Session) applyRateLimits() {
+	session.limitsMx.Lock()
+	defer session.limitsMx.Unlock()
+	downloadRate, uploadRate := session.config.DownloadRate, session.config.UploadRate
+	now := session.config.Clock.Now()
+	for _, schedule := range session.config.Schedule {
+		if schedule.covers(now) {
+			downloadRate, uploadRate = schedule.DownloadRate, schedule.UploadRate
+			break
+		}
+	}
+	session.downloadLimiter.setRate(downloadRate)
+	session.uploadLimiter.setRate(uploadRate)
+}
+
+// runSchedule checks the schedules at the start of every minute, as none can start or end in between
+func (session *Session) runSchedule() {
+	defer session.wg.Done()
+	for {
+		now := session.config.Clock.Now()
+		timer := session.config.Clock.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-timer.C():
+			session.applyRateLimits()
+		case <-session.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	testCases := []struct {
+		schedule  string
+		expected  RateSchedule
+		expectErr bool
+	}{
+		{
+			schedule: "mon-fri 09:00-17:00 down=512 up=64",
+			expected: RateSchedule{
+				Days:         []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+				Start:        9 * time.Hour,
+				End:          17 * time.Hour,
+				DownloadRate: 512 * 1024,
+				UploadRate:   64 * 1024,
+			},
+		},
+		{
+			schedule: "22:30-6:00 up=10",
+			expected: RateSchedule{Start: 22*time.Hour + 30*time.Minute, End: 6 * time.Hour, UploadRate: 10 * 1024},
+		},
+		{
+			schedule: "Sat,Sun,fri-mon 00:00-24:00",
+			expected: RateSchedule{
+				Days: []time.Weekday{time.Saturday, time.Sunday, time.Friday, time.Saturday, time.Sunday, time.Monday},
+				End:  24 * time.Hour,
+			},
+		},
+		{schedule: "", expectErr: true},
+		{schedule: "weekdays 09:00-17:00", expectErr: true},
+		{schedule: "mon", expectErr: true},
+		{schedule: "09:00", expectErr: true},
+		{schedule: "09:00-25:00", expectErr: true},
+		{schedule: "09:60-17:00", expectErr: true},
+		{schedule: "09:00-17:00 down=-1", expectErr: true},
+		{schedule: "09:00-17:00 sideways=1", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParseRateSchedule(tc.schedule)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got %+v", tc.schedule, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to parse, got %v", tc.schedule, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %q to parse to %+v, got %+v", tc.schedule, tc.expected, got)
+		}
+	}
+}
+
+func TestRateScheduleCovers(t *testing.T) {
+	workdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	office := RateSchedule{Days: workdays, Start: 9 * time.Hour, End: 17 * time.Hour}
+	night := RateSchedule{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+	allDay := RateSchedule{Days: []time.Weekday{time.Sunday}}
+
+	// 2024-01-01 was a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		name     string
+		schedule RateSchedule
+		time     time.Time
+		expected bool
+	}{
+		{name: "office start", schedule: office, time: at(1, 9, 0), expected: true},
+		{name: "office before", schedule: office, time: at(1, 8, 59), expected: false},
+		{name: "office end", schedule: office, time: at(5, 17, 0), expected: false},
+		{name: "office weekend", schedule: office, time: at(6, 12, 0), expected: false},
+		{name: "night friday", schedule: night, time: at(5, 23, 0), expected: true},
+		{name: "night early saturday", schedule: night, time: at(6, 5, 59), expected: true},
+		{name: "night early friday", schedule: night, time: at(5, 1, 0), expected: false},
+		{name: "night saturday evening", schedule: night, time: at(6, 23, 0), expected: false},
+		{name: "all day sunday", schedule: allDay, time: at(7, 0, 0), expected: true},
+		{name: "all day monday", schedule: allDay, time: at(8, 0, 0), expected: false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.schedule.covers(tc.time); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestSessionRateSchedule(t *testing.T) {
+	clock := newFakeClock() // midnight on a monday
+	schedule := RateSchedule{Start: 9 * time.Hour, End: 17 * time.Hour, DownloadRate: 1000, UploadRate: 500}
+	session, err := NewSession(SessionConfig{ListenPort: -1, Clock: clock, DownloadRate: 5000, Schedule: []RateSchedule{schedule}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	expectLimits := func(download int, upload int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if d, u := session.RateLimits(); d == download && u == upload {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		d, u := session.RateLimits()
+		t.Fatalf("Expected limits of %d and %d at %s, got %d and %d", download, upload, clock.Now().Format(time.Kitchen), d, u)
+	}
+
+	expectLimits(5000, 0)
+	clock.waitForTimers(t, 1)
+	clock.advance(9 * time.Hour)
+	expectLimits(1000, 500)
+
+	// the configured limits change underneath the schedule
+	session.SetRateLimits(8000, 100)
+	expectLimits(1000, 500)
+	if config := session.Config(); config.DownloadRate != 8000 || config.UploadRate != 100 || len(config.Schedule) != 1 {
+		t.Errorf("Expected the configured limits and schedule back, got %+v", config)
+	}
+
+	clock.waitForTimers(t, 1)
+	clock.advance(8 * time.Hour)
+	expectLimits(8000, 100)
+
+	session.SetRateSchedule([]RateSchedule{{DownloadRate: 1}})
+	expectLimits(1, 0)
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"gotorrent/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errBadRequest = errors.New("peer requested a block we can't send")
+
+// bitfield returns which pieces we have as the payload of a BITFIELD message, or nil if we don't have any
+func (torrent *Torrent) bitfield() []byte {
+	if !torrent.hasMetadata.Load() || torrent.numPiecesDownloaded.Load() == 0 {
+		return nil
+	}
+	bits := make([]byte, (len(torrent.pieces)+7)/8)
+	for i := range torrent.pieces {
+		if torrent.pieces[i].isVerified.Load() {
+			utils.SetBit(&bits, i)
+		}
+	}
+	return bits
+}
+
+// verifyExisting hash checks what's already on disk before a seeding torrent starts, so that it's seeded rather
+// than downloaded again
+func (torrent *Torrent) verifyExisting() {
+	result, err := torrent.VerifyData()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not verify existing data")
+		return
+	}
+	fmt.Fprintf(torrent.output, "Found %d of %d pieces on disk\n", result.Verified, result.Pieces)
+}
+
+// sendBitfield tells a peer which pieces we have once we've handshaked. Like most clients we send it after the
+// extended handshake, which is the order getBitfield expects of peers too
+func (peer *Peer) sendBitfield() error {
+	bits := peer.torrent.bitfield()
+	if bits == nil {
+		return nil
+	}
+	message := bitfieldMessage{bits}.encode()
+	_, err := peer.conn.Write(message.marshall())
+	return err
+}
+
+// unchoke lets an interested peer request pieces from us, there's no choking algorithm so everyone who asks is
+// unchoked and the upload rate limit shares out the bandwidth
+func (peer *Peer) unchoke() {
+	if peer.unchoked || peer.torrent.bitfield() == nil {
+		return
+	}
+	peer.unchoked = true
+	peer.pw.write(unchokeMessage{}.encode())
+}
+
+// serveRequest sends the block a peer asked for in a REQUEST message, which it may only ask for while we're choking
+// it if we allowed it to with the fast extension
+func (peer *Peer) serveRequest(request blockRequest) error {
+	index, begin, length := request.index, request.begin, request.length
+
+	torrent := peer.torrent
+	if (!peer.unchoked && !peer.grantedFast[index]) || !torrent.hasMetadata.Load() || index >= len(torrent.pieces) || !torrent.hasPiece(index) {
+		return errBadRequest
+	}
+	if length <= 0 || length > BlockLen || begin+length > torrent.pieceLength(index) {
+		return errBadRequest
+	}
+
+	block := make([]byte, length)
+	err := torrent.readAt(block, index*torrent.metadata.PieceLen+begin)
+	if err != nil {
+		return err
+	}
+	peer.pw.write(pieceMessage{index, begin, block}.encode())
+	return nil
+}
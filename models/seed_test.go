@@ -0,0 +1,134 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newSeedData writes two files into dir/data and returns a .torrent for them with BlockLen pieces
+func newSeedData(t *testing.T, dir string) *MetaInfo {
+	t.Helper()
+	os.MkdirAll(filepath.Join(dir, "data"), 0770)
+	first := make([]byte, 3*BlockLen+100)
+	rand.Read(first)
+	os.WriteFile(filepath.Join(dir, "data", "first"), first, 0644)
+	os.WriteFile(filepath.Join(dir, "data", "second"), bytes.Repeat([]byte{2}, BlockLen), 0644)
+
+	mi, err := CreateTorrent(CreateOptions{Path: filepath.Join(dir, "data"), PieceLen: BlockLen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mi
+}
+
+func TestVerifyData(t *testing.T) {
+	testCases := []struct {
+		name     string
+		damage   func(dir string)
+		expected VerifyResult
+	}{
+		{name: "complete", damage: func(string) {}, expected: VerifyResult{Pieces: 5, Verified: 5}},
+		{
+			name:     "missing file",
+			damage:   func(dir string) { os.Remove(filepath.Join(dir, "data", "second")) },
+			expected: VerifyResult{Pieces: 5, Verified: 3, Missing: []int{3, 4}},
+		},
+		{
+			name: "corrupt piece",
+			damage: func(dir string) {
+				file, _ := os.OpenFile(filepath.Join(dir, "data", "first"), os.O_WRONLY, 0)
+				file.WriteAt([]byte("corrupt"), BlockLen)
+				file.Close()
+			},
+			expected: VerifyResult{Pieces: 5, Verified: 4, Missing: []int{1}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mi := newSeedData(t, dir)
+			tc.damage(dir)
+
+			torrent, err := NewTorrentFromMetaInfo(mi, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			torrent.downloadDir = dir
+			result, err := torrent.VerifyData()
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+			if int(torrent.numPiecesDownloaded.Load()) != tc.expected.Verified || len(torrent.pieceQueue.pieces) != len(tc.expected.Missing) {
+				t.Errorf("Expected %d pieces downloaded and %d queued, got %d and %d", tc.expected.Verified,
+					len(tc.expected.Missing), int(torrent.numPiecesDownloaded.Load()), len(torrent.pieceQueue.pieces))
+			}
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	seedDir := t.TempDir()
+	mi := newSeedData(t, seedDir)
+
+	// find a free port for the seed to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	session, err := NewSession(SessionConfig{ListenPort: port, DownloadDir: seedDir, Seed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	seed, err := session.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go seed.StartDownload(context.Background())
+	// the seed checks its data before accepting peers
+	for seed.state() != StateSeeding {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	leecher, err := NewTorrentFromMetaInfo(mi, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher.downloadDir = t.TempDir()
+	leecher.addPeer(newPeer("127.0.0.1", strconv.Itoa(port), leecher.infoHash, leecher), PeerSourceMagnet)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go leecher.StartDownload(ctx)
+	if err := leecher.Wait(ctx); err != nil {
+		t.Fatalf("Expected the download from the seed to succeed, got %v", err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		expected, _ := os.ReadFile(filepath.Join(seedDir, "data", name))
+		actual, err := os.ReadFile(filepath.Join(leecher.downloadDir, "data", name))
+		if err != nil || !bytes.Equal(actual, expected) {
+			t.Errorf("Expected %s to match the seed's copy, got error %v", name, err)
+		}
+	}
+	if state := seed.state(); state != StateSeeding {
+		t.Errorf("Expected the seed to still be seeding, got %s", StateName(state))
+	}
+	if sent := seed.Stats().BytesSent; sent < 4*BlockLen+100 {
+		t.Errorf("Expected the seed to have sent every piece, got %d bytes", sent)
+	}
+}
@@ -0,0 +1,469 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gotorrent/utils"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultListenPort is the port peers connect to us on when none is configured
+const DefaultListenPort = 6881
+
+// ErrDuplicateTorrent is returned when adding a torrent that is already in the session
+var ErrDuplicateTorrent = errors.New("torrent has already been added")
+
+// SessionConfig configures the resources shared by every torrent in a Session
+type SessionConfig struct {
+	ListenPort         int       // port for incoming peer connections, DefaultListenPort if 0, -1 to not listen at all
+	MaxConnections     int       // peer connections across all torrents, unlimited if 0
+	MaxPeersPerTorrent int       // peer connections per torrent, 50 if 0
+	DownloadRate       int       // bytes per second across all torrents, unlimited if 0
+	UploadRate         int       // bytes per second across all torrents, unlimited if 0
+	DownloadDir        string    // "downloads" if empty
+	MetadataDir        string    // where metadata fetched from peers is saved as metadata.torrent, not saved if empty
+	Output             io.Writer // progress and status messages, discarded if nil
+	Seed               bool      // keep torrents running once downloaded, uploading to peers. Data already in DownloadDir is verified first, so it's seeded rather than downloaded again
+
+	Dialer       Dialer       // for every outgoing connection, a net.Dialer if nil
+	ListenConfig ListenConfig // for the peer listener and the UDP tracker socket, a net.ListenConfig if nil
+	Clock        Clock        // SystemClock if nil
+
+	Schedule []RateSchedule // times when DownloadRate and UploadRate are replaced, see Session.SetRateSchedule
+
+	Encryption int // one of the Encryption constants for connections to and from peers, EncryptionDisabled if 0
+
+	Proxy     string // socks5://[user:password@]host[:port] or http://[user:password@]host[:port] for peers and trackers, UDP trackers need socks5
+	ProxyOnly bool   // never go around the proxy if it's unavailable. Peers can't connect to us either, as that would be direct
+
+	DisableUTP bool // only connect to peers and accept them over TCP. uTP is never used with a Dialer or Proxy, which it can't go through
+}
+
+// Session runs many torrents at once, sharing a listening port, peer id, connection cap, rate limits and UDP tracker socket
+type Session struct {
+	config SessionConfig
+	peerID []byte
+
+	listener      net.Listener
+	udpSocket     *udpTrackerSocket
+	useUTP        bool
+	utpSocket     *utpSocket // on ListenPort when listening, otherwise opened by the first uTP connection we make
+	utpMx         sync.Mutex
+	httpTransport http.RoundTripper // dials through config.Dialer, shared so that connections are reused
+
+	connSlots       chan struct{} // semaphore of MaxConnections connections, nil when unlimited
+	downloadLimiter *rateLimiter
+	uploadLimiter   *rateLimiter
+	limitsMx        sync.Mutex // guards the rate limits and schedule in config
+
+	torrents   map[string]*Torrent // keyed by every (20 byte) info hash a torrent is known by
+	torrentsMx sync.Mutex
+
+	events *eventBus // shared by every torrent
+
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // accept loop and incoming handshakes
+}
+
+// NewSession starts listening for peers and opens the shared tracker socket
+func NewSession(config SessionConfig) (*Session, error) {
+	var session Session
+	var err error
+
+	if config.MaxPeersPerTorrent == 0 {
+		config.MaxPeersPerTorrent = 50
+	}
+	if config.DownloadDir == "" {
+		config.DownloadDir = "downloads"
+	}
+	if config.ListenPort == 0 {
+		config.ListenPort = DefaultListenPort
+	}
+	session.useUTP = !config.DisableUTP && config.Dialer == nil && config.Proxy == ""
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{}
+	}
+	if config.ListenConfig == nil {
+		config.ListenConfig = &net.ListenConfig{}
+	}
+	if config.Clock == nil {
+		config.Clock = SystemClock
+	}
+	if config.Proxy != "" {
+		dialer, err := newProxyDialer(config.Proxy, config.Dialer, config.ProxyOnly)
+		if err != nil {
+			return nil, err
+		}
+		config.ListenConfig = &proxyListenConfig{ListenConfig: config.ListenConfig, dialer: dialer}
+		config.Dialer = dialer
+		if config.ProxyOnly {
+			config.ListenPort = -1
+		}
+	}
+	session.config = config
+	session.torrents = make(map[string]*Torrent)
+	session.events = newEventBus()
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+
+	session.peerID, err = utils.GeneratePeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.MaxConnections > 0 {
+		session.connSlots = make(chan struct{}, config.MaxConnections)
+	}
+	session.downloadLimiter = newRateLimiter(config.DownloadRate, config.Clock)
+	session.uploadLimiter = newRateLimiter(config.UploadRate, config.Clock)
+	session.applyRateLimits()
+	session.httpTransport = newHTTPTransport(config.Dialer)
+
+	session.udpSocket, err = newUDPTrackerSocket(config.ListenConfig, config.Clock)
+	if err != nil && config.Proxy == "" {
+		return nil, err
+	}
+	if err != nil {
+		// udp trackers will try again with sockets of their own, and fail their announces if they can't either
+		log.Warn().Err(err).Msg("Could not reach udp trackers through the proxy")
+	}
+
+	if config.ListenPort > 0 {
+		session.listener, err = config.ListenConfig.Listen(session.ctx, "tcp", ":"+strconv.Itoa(config.ListenPort))
+		if err != nil {
+			session.udpSocket.close()
+			return nil, err
+		}
+		session.wg.Add(1)
+		go session.acceptLoop(session.listener)
+	}
+	if config.ListenPort > 0 && session.useUTP {
+		conn, err := config.ListenConfig.ListenPacket(session.ctx, "udp", ":"+strconv.Itoa(config.ListenPort))
+		if err != nil {
+			// peers can still reach us over tcp
+			log.Warn().Err(err).Msg("Could not listen for uTP connections")
+		} else {
+			session.utpSocket = newUTPSocket(conn, SystemClock, true)
+			session.wg.Add(1)
+			go session.acceptLoop(session.utpSocket)
+		}
+	}
+	session.wg.Add(1)
+	go session.runSchedule()
+
+	return &session, nil
+}
+
+// Close stops every torrent, waiting for them to disconnect from their peers and tell their trackers that
+// they've left, then stops listening and closes the shared tracker socket
+func (session *Session) Close() error {
+	session.cancel()
+	var err error
+	if session.listener != nil {
+		err = session.listener.Close()
+	}
+	// which resets any uTP connections, rather than waiting for the peers to ack them being closed
+	session.utpMx.Lock()
+	if session.utpSocket != nil {
+		err = errors.Join(err, session.utpSocket.Close())
+	}
+	session.utpMx.Unlock()
+
+	torrents := session.Torrents()
+	for _, torrent := range torrents {
+		session.Remove(torrent.swarmHashes()[0])
+	}
+	for _, torrent := range torrents {
+		if torrent.started.Load() {
+			<-torrent.finished
+		}
+	}
+	session.wg.Wait()
+	session.events.close()
+
+	// the trackers have all been told we've stopped by now, so their socket can go
+	return errors.Join(err, session.udpSocket.close())
+}
+
+// ListenPort returns the port we accept peer connections on, or 0 if we aren't listening
+func (session *Session) ListenPort() int {
+	if session.listener == nil {
+		return 0
+	}
+	return session.listener.Addr().(*net.TCPAddr).Port
+}
+
+// SetRateLimits changes the download and upload limits (in bytes per second, 0 for unlimited) shared by every
+// torrent, which apply whenever none of the schedules do
+func (session *Session) SetRateLimits(downloadRate int, uploadRate int) {
+	session.limitsMx.Lock()
+	session.config.DownloadRate = downloadRate
+	session.config.UploadRate = uploadRate
+	session.limitsMx.Unlock()
+	session.applyRateLimits()
+}
+
+// HTTPTransport returns the transport trackers and web seeds are fetched over, which goes through the session's
+// dialer and proxy
+func (session *Session) HTTPTransport() http.RoundTripper {
+	return session.httpTransport
+}
+
+// Config returns the session's configuration with any defaults filled in and the current rate limits and schedules
+func (session *Session) Config() SessionConfig {
+	session.limitsMx.Lock()
+	defer session.limitsMx.Unlock()
+	config := session.config
+	config.Schedule = append([]RateSchedule{}, config.Schedule...)
+	return config
+}
+
+// AddMagnet adds a torrent from a magnet link, it doesn't start downloading until StartDownload is called. If the
+// torrent is already in the session it's returned along with ErrDuplicateTorrent
+func (session *Session) AddMagnet(magnet *Magnet) (*Torrent, error) {
+	return session.add(NewTorrent(magnet, session.config.MaxPeersPerTorrent))
+}
+
+// AddMetaInfo adds a torrent from a .torrent file, it doesn't start downloading until StartDownload is called. If the
+// torrent is already in the session it's returned along with ErrDuplicateTorrent
+func (session *Session) AddMetaInfo(mi *MetaInfo) (*Torrent, error) {
+	torrent, err := NewTorrentFromMetaInfo(mi, session.config.MaxPeersPerTorrent)
+	if err != nil {
+		return nil, err
+	}
+	return session.add(torrent)
+}
+
+func (session *Session) add(torrent *Torrent) (*Torrent, error) {
+	session.torrentsMx.Lock()
+	defer session.torrentsMx.Unlock()
+
+	for _, infoHash := range torrent.swarmHashes() {
+		if existing, ok := session.torrents[string(infoHash)]; ok {
+			return existing, fmt.Errorf("%w: %s", ErrDuplicateTorrent, hex.EncodeToString(infoHash))
+		}
+	}
+
+	torrent.session = session
+	torrent.events = session.events
+	torrent.peerID = session.peerID
+	torrent.downloadDir = session.config.DownloadDir
+	torrent.metadataDir = session.config.MetadataDir
+	torrent.seed = session.config.Seed
+	torrent.dialer = session.config.Dialer
+	torrent.listenConfig = session.config.ListenConfig
+	torrent.clock = session.config.Clock
+	torrent.downloadLimiter = newRateLimiter(torrent.downloadLimiter.limit(), torrent.clock)
+	torrent.uploadLimiter = newRateLimiter(torrent.uploadLimiter.limit(), torrent.clock)
+	torrent.httpTransport = session.httpTransport
+	torrent.encryption = session.config.Encryption
+	if session.config.Output != nil {
+		torrent.setOutput(session.config.Output)
+	}
+	for _, tracker := range torrent.trackers {
+		tracker.socket = session.udpSocket
+	}
+
+	for _, infoHash := range torrent.swarmHashes() {
+		session.torrents[string(infoHash)] = torrent
+	}
+	return torrent, nil
+}
+
+// Subscribe returns a subscription to the events of the torrents with the given info hashes, or of every torrent if
+// none are given. It's closed along with the session
+func (session *Session) Subscribe(infoHashes ...[]byte) *Subscription {
+	return session.events.subscribe(infoHashes)
+}
+
+// index makes a torrent reachable by any info hashes it learned after being added, ie the other hash of a hybrid torrent
+func (session *Session) index(torrent *Torrent) {
+	session.torrentsMx.Lock()
+	defer session.torrentsMx.Unlock()
+
+	for _, infoHash := range torrent.swarmHashes() {
+		session.torrents[string(infoHash)] = torrent
+	}
+}
+
+// Get returns the torrent with the given v1 or v2 info hash, or nil if there is none
+func (session *Session) Get(infoHash []byte) *Torrent {
+	// the swarm (and so our index) only uses the first 20 bytes of a v2 hash
+	if len(infoHash) > 20 {
+		infoHash = infoHash[:20]
+	}
+
+	session.torrentsMx.Lock()
+	defer session.torrentsMx.Unlock()
+	return session.torrents[string(infoHash)]
+}
+
+// infoHashes returns every (20 byte) info hash that peers may ask us for
+func (session *Session) infoHashes() [][]byte {
+	session.torrentsMx.Lock()
+	defer session.torrentsMx.Unlock()
+
+	infoHashes := make([][]byte, 0, len(session.torrents))
+	for infoHash := range session.torrents {
+		infoHashes = append(infoHashes, []byte(infoHash))
+	}
+	return infoHashes
+}
+
+// Torrents returns every torrent in the session
+func (session *Session) Torrents() []*Torrent {
+	session.torrentsMx.Lock()
+	defer session.torrentsMx.Unlock()
+
+	seen := map[*Torrent]bool{}
+	var torrents []*Torrent
+	for _, torrent := range session.torrents {
+		if !seen[torrent] {
+			seen[torrent] = true
+			torrents = append(torrents, torrent)
+		}
+	}
+	return torrents
+}
+
+// Remove stops the torrent with the given info hash and removes it from the session
+func (session *Session) Remove(infoHash []byte) error {
+	torrent := session.Get(infoHash)
+	if torrent == nil {
+		return errors.New("torrent " + hex.EncodeToString(infoHash) + " is not in the session")
+	}
+
+	session.torrentsMx.Lock()
+	for key, t := range session.torrents {
+		if t == torrent {
+			delete(session.torrents, key)
+		}
+	}
+	session.torrentsMx.Unlock()
+
+	torrent.stop()
+	return nil
+}
+
+// acquireConn reserves one of the session's connections, returning false if they are all in use
+func (session *Session) acquireConn() bool {
+	if session.connSlots == nil {
+		return true
+	}
+	select {
+	case session.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseConn frees a connection reserved with acquireConn and lets every torrent know that it can connect to another peer
+func (session *Session) releaseConn() {
+	if session.connSlots == nil {
+		return
+	}
+	<-session.connSlots
+	for _, torrent := range session.Torrents() {
+		torrent.connHandler.wake()
+	}
+}
+
+// utp returns the socket that uTP connections to peers are made from, opening one if we aren't listening for them,
+// or nil if uTP isn't used
+func (session *Session) utp() *utpSocket {
+	session.utpMx.Lock()
+	defer session.utpMx.Unlock()
+	if session.utpSocket != nil || !session.useUTP || session.ctx.Err() != nil {
+		return session.utpSocket
+	}
+	conn, err := session.config.ListenConfig.ListenPacket(session.ctx, "udp", ":0")
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not open a socket for uTP, only using TCP")
+		session.useUTP = false
+		return nil
+	}
+	// the timers are the transport's own, like TCP's are the OS's, so they aren't simulated
+	session.utpSocket = newUTPSocket(conn, SystemClock, false)
+	return session.utpSocket
+}
+
+// acceptLoop hands every connection from listener to handleIncoming, until it's closed
+func (session *Session) acceptLoop(listener net.Listener) {
+	defer session.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		session.wg.Add(1)
+		go session.handleIncoming(conn)
+	}
+}
+
+// handleIncoming reads the handshake of a peer that connected to us and hands them to the torrent they asked for
+func (session *Session) handleIncoming(conn net.Conn) {
+	defer session.wg.Done()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	stopClosing := context.AfterFunc(session.ctx, func() { conn.Close() })
+	peerConn, encryptedHash, err := acceptConn(conn, session.infoHashes, session.config.Encryption)
+	var infoHash, reserved []byte
+	if err == nil {
+		infoHash, reserved, err = readHandshake(peerConn)
+	}
+	// an encrypted handshake has to be for the torrent that the encryption was keyed with
+	if err == nil && encryptedHash != nil && !bytes.Equal(infoHash, encryptedHash) {
+		err = errMSETorrent
+	}
+	if !stopClosing() || err != nil {
+		if err != nil {
+			log.Debug().Err(err).Msg("Refused connection from " + conn.RemoteAddr().String())
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	torrent := session.Get(infoHash)
+	if torrent == nil || !torrent.isRunning() {
+		conn.Close()
+		return
+	}
+
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	peer := newPeer(host, port, infoHash, torrent)
+	peer.reserved = reserved
+	peer.incoming = true
+	peer.status.Store(Alive) // so that the connection handler doesn't also try to dial them
+	peer.setConn(peerConn)
+
+	if !session.acquireConn() {
+		conn.Close()
+		return
+	}
+	if !torrent.addPeer(peer, PeerSourceIncoming) {
+		conn.Close()
+		session.releaseConn()
+		return
+	}
+	log.Debug().Msg("Incoming connection from " + conn.RemoteAddr().String())
+	torrent.connHandler.addIncoming(peer)
+}
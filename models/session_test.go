@@ -0,0 +1,139 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionAddGetRemove(t *testing.T) {
+	session, err := NewSession(SessionConfig{ListenPort: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	hashes := []string{strings.Repeat("ab", 20), strings.Repeat("cd", 20)}
+	for _, hash := range hashes {
+		magnet, err := NewMagnet("magnet:?xt=urn:btih:" + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrent, err := session.AddMagnet(magnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(torrent.peerID, session.peerID) {
+			t.Errorf("Torrent does not share the session's peer id")
+		}
+	}
+
+	magnet, _ := NewMagnet("magnet:?xt=urn:btih:" + hashes[0])
+	if _, err := session.AddMagnet(magnet); err == nil {
+		t.Errorf("Expected adding the same torrent twice to fail")
+	}
+
+	if len(session.Torrents()) != 2 {
+		t.Errorf("Expected 2 torrents, got %d", len(session.Torrents()))
+	}
+	torrent := session.Get(bytes.Repeat([]byte{0xcd}, 20))
+	if torrent == nil {
+		t.Fatal("Could not look up torrent by info hash")
+	}
+
+	err = session.Remove(torrent.infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Get(torrent.infoHash) != nil {
+		t.Errorf("Torrent is still in the session after being removed")
+	}
+	if session.Remove(torrent.infoHash) == nil {
+		t.Errorf("Expected removing a torrent twice to fail")
+	}
+}
+
+func TestUDPTrackerSocketRoundTrip(t *testing.T) {
+	// fake tracker which echoes every request back, after a delay so that requests are in flight at once
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			response := append([]byte{}, buf[:n]...)
+			go func() {
+				time.Sleep(time.Duration(response[8]) * 10 * time.Millisecond)
+				server.WriteTo(response, addr)
+			}()
+		}
+	}()
+
+	socket, err := newUDPTrackerSocket(&net.ListenConfig{}, SystemClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			packet := make([]byte, 16)
+			binary.BigEndian.PutUint32(packet[4:], uint32(1000+i))
+			packet[8] = byte(5 - i) // earlier requests are answered last
+
+			response, err := socket.roundTrip(context.Background(), server.LocalAddr(), packet, uint32(1000+i), time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(response, packet) {
+				t.Errorf("Request %d got the response to another request", i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	packet := make([]byte, 16)
+	packet[8] = 5
+	if _, err := socket.roundTrip(context.Background(), server.LocalAddr(), packet, 1, time.Millisecond); err == nil {
+		t.Errorf("Expected a timeout")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	testCases := []struct {
+		rate     int
+		bytes    []int
+		minDelay time.Duration
+	}{
+		{rate: 0, bytes: []int{1 << 20, 1 << 20}, minDelay: 0},
+		{rate: 1000, bytes: []int{1000}, minDelay: 0}, // the first second's worth is a burst
+		{rate: 1000, bytes: []int{1000, 200}, minDelay: 200 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		limiter := newRateLimiter(tc.rate, SystemClock)
+		start := time.Now()
+		for _, n := range tc.bytes {
+			limiter.wait(n)
+		}
+		elapsed := time.Since(start)
+		if elapsed < tc.minDelay || elapsed > tc.minDelay+150*time.Millisecond {
+			t.Errorf("Rate %d for %v took %s, expected about %s", tc.rate, tc.bytes, elapsed, tc.minDelay)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// checkGoroutineLeaks fails the test if there are more goroutines running when the returned function is called than
+// there were to begin with, giving them a few seconds to finish
+func checkGoroutineLeaks(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// fakeSeed accepts a single peer connection, completes the handshake and then sends nothing else, closing connected
+// once the peer is ready to exchange pieces
+func fakeSeed(t *testing.T, infoHash []byte, numPieces int) (net.Listener, chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := readHandshake(conn); err != nil {
+			return
+		}
+		handshake := getHandshakeMessage(infoHash, bytes.Repeat([]byte{'s'}, 20))
+		handshake[25] = 0 // no extensions
+		conn.Write(handshake)
+
+		bitfield := make([]byte, (numPieces+7)/8)
+		message := make([]byte, 5)
+		binary.BigEndian.PutUint32(message, uint32(len(bitfield)+1))
+		message[4] = Bitfield
+		conn.Write(append(message, bitfield...))
+		close(connected)
+
+		// wait for the client to hang up
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return listener, connected
+}
+
+func TestShutdown(t *testing.T) {
+	testCases := []struct {
+		name string
+		stop func(cancel context.CancelFunc, session *Session)
+	}{
+		{
+			name: "context cancelled",
+			stop: func(cancel context.CancelFunc, session *Session) { cancel() },
+		},
+		{
+			name: "session closed",
+			stop: func(cancel context.CancelFunc, session *Session) { session.Close() },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkLeaks := checkGoroutineLeaks(t)
+			defer checkLeaks()
+
+			data := make([]byte, 4*BlockLen)
+			rand.Read(data)
+			var info bytes.Buffer
+			bencode.Marshal(&info, Metadata{Name: "file", Length: len(data), PieceLen: 2 * BlockLen, Pieces: hashPieces(data, 2*BlockLen)})
+			mi := &MetaInfo{InfoBytes: info.Bytes()}
+			checksum := sha1.Sum(mi.InfoBytes)
+			infoHash := checksum[:]
+
+			seed, connected := fakeSeed(t, infoHash, 2)
+			defer seed.Close()
+			seedAddr := seed.Addr().(*net.TCPAddr)
+
+			var events []string
+			var eventsMx sync.Mutex
+			tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				eventsMx.Lock()
+				events = append(events, r.URL.Query().Get("event"))
+				eventsMx.Unlock()
+				peer := append(seedAddr.IP.To4(), byte(seedAddr.Port>>8), byte(seedAddr.Port))
+				bencode.Marshal(w, map[string]interface{}{"interval": 1800, "peers": string(peer)})
+			}))
+			defer tracker.Close()
+			mi.Announce = tracker.URL + "/announce"
+
+			session, err := NewSession(SessionConfig{ListenPort: -1, DownloadDir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			torrent, err := session.AddMetaInfo(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := make(chan error)
+			go func() { result <- torrent.StartDownload(ctx) }()
+
+			select {
+			case <-connected:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Never connected to the seed")
+			}
+
+			tc.stop(cancel, session)
+			select {
+			case err := <-result:
+				if err == nil {
+					t.Errorf("Expected an error as the torrent wasn't downloaded")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("StartDownload did not return promptly after being stopped")
+			}
+
+			eventsMx.Lock()
+			defer eventsMx.Unlock()
+			if len(events) == 0 || events[len(events)-1] != "stopped" {
+				t.Errorf("Expected the last announce to be stopped, got %q", events)
+			}
+		})
+	}
+}
+
+func TestStartDownloadReturnsOnceDownloaded(t *testing.T) {
+	checkLeaks := checkGoroutineLeaks(t)
+	defer checkLeaks()
+
+	data := make([]byte, 3*BlockLen)
+	rand.Read(data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	var info bytes.Buffer
+	bencode.Marshal(&info, Metadata{Name: "file", Length: len(data), PieceLen: BlockLen, Pieces: hashPieces(data, BlockLen)})
+	torrent, err := NewTorrentFromMetaInfo(&MetaInfo{URLList: []string{server.URL + "/file"}, InfoBytes: info.Bytes()}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = t.TempDir()
+
+	result := make(chan error)
+	go func() { result <- torrent.StartDownload(context.Background()) }()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected no error but got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartDownload did not return after the torrent was downloaded")
+	}
+	if err := torrent.Wait(context.Background()); err != nil {
+		t.Errorf("Expected Wait to succeed, got %v", err)
+	}
+}
+
+func TestPeerWriterStopNeverBlocks(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	torrent := NewTorrent(&Magnet{}, 1)
+	torrent.hasMetadata.Store(true) // so that the writer doesn't ask for any
+	peer := newPeer("127.0.0.1", "6881", nil, torrent)
+	peer.setConn(client)
+
+	// nothing is running to receive these, so they must be dropped once stopped rather than blocking forever
+	done := make(chan struct{})
+	go func() {
+		peer.pw.stop()
+		peer.pw.stop()
+		peer.pw.write(Message{1, Interested, nil})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Writing to a stopped peer writer blocked")
+	}
+
+	// and a running writer returns as soon as its context is done
+	peer.setConn(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go peer.pw.run(ctx, &wg)
+	cancel()
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Peer writer did not stop when its context was cancelled")
+	}
+}
@@ -0,0 +1,320 @@
+package models
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// States a torrent can be in, as reported by Stats
+const (
+	StateQueued           = 0 // added but not started
+	StateFetchingMetadata = 1
+	StateDownloading      = 2
+	StatePaused           = 3
+	StateDone             = 4
+	StateStopped          = 5 // dropped, or gave up after running out of peers
+	StateSeeding          = 6 // downloaded and still uploading to peers
+)
+
+var stateNames = map[int]string{
+	StateQueued:           "queued",
+	StateFetchingMetadata: "fetching metadata",
+	StateDownloading:      "downloading",
+	StatePaused:           "paused",
+	StateDone:             "done",
+	StateStopped:          "stopped",
+	StateSeeding:          "seeding",
+}
+
+// StateName returns a human readable name for one of the State constants
+func StateName(state int) string {
+	return stateNames[state]
+}
+
+// TorrentInfo describes a torrent, most of which is only known once we have its metadata
+type TorrentInfo struct {
+	Name        string
+	InfoHash    []byte // v1 (sha1) info hash, may be empty for a v2 magnet link until we have the metadata
+	InfoHashV2  []byte // v2 (sha256) info hash, only set for hybrid torrents
+	HasMetadata bool
+	Length      int // total size in bytes, including padding files
+	PieceLength int
+	NumPieces   int
+	Private     bool
+	Comment     string // only set when added from a .torrent file
+	CreatedBy   string
+}
+
+// FileInfo is one file within a torrent
+type FileInfo struct {
+	Path     string // slash separated path within the torrent, just the torrent's name for single file torrents
+	Offset   int    // of the file's first byte within the torrent's data
+	Length   int
+	Priority int // one of PrioritySkip or PriorityNormal
+	Padding  bool
+
+	BytesCompleted int // bytes of the file within verified pieces
+}
+
+// TorrentStats is a snapshot of a torrent's progress
+type TorrentStats struct {
+	State            int // one of the State constants
+	PiecesDownloaded int
+	PiecesWanted     int // pieces overlapping a file that isn't skipped
+	BytesDownloaded  int // verified bytes, so this only increases a piece at a time
+	BytesWanted      int
+	KnownPeers       int
+	ConnectedPeers   int
+
+	DownloadRate  int // bytes per second over the last few seconds
+	UploadRate    int
+	BytesReceived int // every byte of payload ever received, including any that failed verification
+	BytesSent     int
+}
+
+// PeerInfo describes a peer we're connected to
+type PeerInfo struct {
+	Address      string
+	Client       string // from their extended handshake, empty if they didn't send one
+	Source       int    // one of the PeerSource constants
+	Choked       bool   // whether they're choking us
+	Extended     bool   // whether they support the extension protocol (BEP 10)
+	Encrypted    bool   // whether the connection is RC4 encrypted (MSE)
+	UTP          bool   // whether the connection is over uTP rather than TCP
+	Requests     int    // blocks we've requested from them that haven't arrived yet
+	DownloadRate int    // bytes per second over the last few seconds
+	UploadRate   int
+}
+
+// TrackerInfo describes one of the torrent's trackers as of its last announce
+type TrackerInfo struct {
+	URL          string    // with any passkeys redacted
+	LastAnnounce time.Time // zero if we haven't announced yet
+	NextAnnounce time.Time
+	Err          error // why the last announce failed, nil if it succeeded
+	Seeders      int
+	Leechers     int
+}
+
+// Info returns what we know about the torrent so far
+func (torrent *Torrent) Info() TorrentInfo {
+	info := TorrentInfo{
+		Name:        torrent.name,
+		InfoHash:    torrent.infoHash,
+		InfoHashV2:  torrent.infoHashV2,
+		HasMetadata: torrent.hasMetadata.Load(),
+	}
+	if torrent.metaInfo != nil {
+		info.Comment = torrent.metaInfo.Comment
+		info.CreatedBy = torrent.metaInfo.CreatedBy
+	}
+	if torrent.hasMetadata.Load() {
+		info.Length = torrent.metadata.Length
+		info.PieceLength = torrent.metadata.PieceLen
+		info.NumPieces = len(torrent.pieces)
+		info.Private = torrent.isPrivate()
+	}
+	return info
+}
+
+// Files returns every file in the torrent in the order their data appears, or nil if we don't have the metadata yet
+func (torrent *Torrent) Files() []FileInfo {
+	if !torrent.hasMetadata.Load() {
+		return nil
+	}
+
+	var files []FileInfo
+	for _, entry := range torrent.fileEntries() {
+		path := torrent.metadata.Name
+		if len(entry.torrentPath) != 0 {
+			path += "/" + strings.Join(entry.torrentPath, "/")
+		}
+		files = append(files, FileInfo{
+			Path:           path,
+			Offset:         entry.offset,
+			Length:         entry.length,
+			Priority:       entry.priority,
+			Padding:        entry.hasAttr(AttrPadding),
+			BytesCompleted: torrent.bytesCompleted(entry.offset, entry.length),
+		})
+	}
+	return files
+}
+
+// Stats returns a snapshot of the torrent's progress
+func (torrent *Torrent) Stats() TorrentStats {
+	var stats TorrentStats
+
+	torrent.peersMx.Lock()
+	stats.KnownPeers = len(torrent.peers)
+	for _, peer := range torrent.peers {
+		if peer.status.Load() == Alive {
+			stats.ConnectedPeers++
+		}
+	}
+	torrent.peersMx.Unlock()
+
+	if torrent.hasMetadata.Load() {
+		stats.PiecesDownloaded = int(torrent.numPiecesDownloaded.Load())
+		stats.PiecesWanted = torrent.numWantedPieces
+		for i := range torrent.pieces {
+			if !torrent.wantedPieces[i] {
+				continue
+			}
+			length := torrent.pieceLength(i)
+			stats.BytesWanted += length
+			if torrent.pieces[i].isVerified.Load() {
+				stats.BytesDownloaded += length
+			}
+		}
+	}
+
+	stats.DownloadRate = torrent.downloadMeter.rate()
+	stats.UploadRate = torrent.uploadMeter.rate()
+	stats.BytesReceived = int(torrent.downloadMeter.bytes())
+	stats.BytesSent = int(torrent.uploadMeter.bytes())
+
+	stats.State = torrent.state()
+	return stats
+}
+
+// Peers returns every peer we're currently connected to
+func (torrent *Torrent) Peers() []PeerInfo {
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+
+	var peers []PeerInfo
+	for _, peer := range torrent.peers {
+		if peer.status.Load() != Alive || peer.conn == nil {
+			continue
+		}
+		peer.requestsMX.Lock()
+		requests := len(peer.requested)
+		peer.requestsMX.Unlock()
+		peers = append(peers, PeerInfo{
+			Address:      net.JoinHostPort(peer.ip, peer.port),
+			Client:       peer.client,
+			Source:       peer.source,
+			Choked:       peer.choked.Load(),
+			Extended:     peer.usesExtended,
+			Encrypted:    isEncrypted(peer.conn),
+			UTP:          isUTP(peer.conn),
+			Requests:     requests,
+			DownloadRate: peer.downloadMeter.rate(),
+			UploadRate:   peer.uploadMeter.rate(),
+		})
+	}
+	return peers
+}
+
+// Trackers returns the state of every tracker the torrent announces to
+func (torrent *Torrent) Trackers() []TrackerInfo {
+	var trackers []TrackerInfo
+	for _, tracker := range torrent.trackers {
+		tracker.statusMx.Lock()
+		trackers = append(trackers, TrackerInfo{
+			URL:          tracker.String(),
+			LastAnnounce: tracker.lastAnnounce,
+			NextAnnounce: tracker.nextAnnounce,
+			Err:          tracker.lastErr,
+			Seeders:      tracker.seeders,
+			Leechers:     tracker.leechers,
+		})
+		tracker.statusMx.Unlock()
+	}
+	return trackers
+}
+
+// bytesCompleted returns how many of the length bytes starting at offset are within verified pieces
+func (torrent *Torrent) bytesCompleted(offset int, length int) int {
+	if length == 0 {
+		return 0
+	}
+	var completed int
+	first := offset / torrent.metadata.PieceLen
+	last := (offset + length - 1) / torrent.metadata.PieceLen
+	for i := first; i <= last && i < len(torrent.pieces); i++ {
+		if !torrent.pieces[i].isVerified.Load() {
+			continue
+		}
+		start := max(offset, i*torrent.metadata.PieceLen)
+		end := min(offset+length, (i+1)*torrent.metadata.PieceLen)
+		completed += end - start
+	}
+	return completed
+}
+
+// pieceLength returns the size of piece pieceIndex in bytes, the last piece may be shorter than the rest
+func (torrent *Torrent) pieceLength(pieceIndex int) int {
+	return min(torrent.metadata.PieceLen, torrent.metadata.Length-pieceIndex*torrent.metadata.PieceLen)
+}
+
+func (torrent *Torrent) state() int {
+	stopped := false
+	select {
+	case <-torrent.ctx.Done():
+		stopped = true
+	case <-torrent.finished:
+		stopped = true
+	default:
+	}
+	select {
+	case <-torrent.done:
+		if torrent.seed && torrent.started.Load() && !stopped && !torrent.paused.Load() {
+			return StateSeeding
+		}
+		return StateDone
+	default:
+	}
+	if stopped {
+		return StateStopped
+	}
+
+	switch {
+	case torrent.paused.Load():
+		return StatePaused
+	case !torrent.started.Load():
+		return StateQueued
+	case !torrent.hasMetadata.Load():
+		return StateFetchingMetadata
+	default:
+		return StateDownloading
+	}
+}
+
+// Wait blocks until the torrent has been downloaded and written to disk, returning an error if it is stopped
+// first or ctx is done
+func (torrent *Torrent) Wait(ctx context.Context) error {
+	select {
+	case <-torrent.done:
+		return nil
+	case <-torrent.ctx.Done():
+	case <-torrent.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// we may have finished at the same time as being stopped
+	select {
+	case <-torrent.done:
+		return nil
+	default:
+		return torrent.stoppedErr()
+	}
+}
+
+// Pause disconnects from every peer and web seed until Resume is called, keeping everything downloaded so far
+func (torrent *Torrent) Pause() {
+	if torrent.paused.CompareAndSwap(false, true) {
+		torrent.connHandler.wake()
+	}
+}
+
+// Resume reconnects to peers and web seeds after Pause
+func (torrent *Torrent) Resume() {
+	if torrent.paused.CompareAndSwap(true, false) {
+		torrent.connHandler.wake()
+	}
+}
@@ -2,14 +2,22 @@ package models
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 
 	"gotorrent/utils"
 	"math"
-	"os"
+	"net"
+	"net/http"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	bencode "github.com/jackpal/bencode-go"
 	"github.com/rs/zerolog/log"
@@ -17,40 +25,93 @@ import (
 
 // Torrent stores all data about a torrent generated from a magnet link
 type Torrent struct {
-	magLink  string
-	name     string
-	infoHash []byte // Sha1 hash with const size 20
+	magLink    string
+	name       string
+	infoHash   []byte // Sha1 hash with const size 20
+	infoHashV2 []byte // Sha256 hash with const size 32, only set for hybrid torrents -- the swarm uses the first 20 bytes
 
 	trackers []*Tracker
-	peers    []Peer // all peers collected by the tracker, not necessarily connected
+	peers    []*Peer // all peers collected by the tracker, not necessarily connected
+	peersMx  sync.Mutex
 	maxPeers int
 
+	downloadDir string    // where finished files are written, "downloads" by default
+	metadataDir string    // where metadata fetched from peers is saved as metadata.torrent, not saved if empty
+	output      io.Writer // progress and status messages, discarded by default
+
+	peerID   []byte             // ours, shared by every torrent in a session
+	session  *Session           // nil when the torrent is run on its own
+	started  atomic.Bool        // set by StartDownload, incoming peers are turned away until then
+	ctx      context.Context    // cancelled by stop, every goroutine of the torrent returns once it's done
+	cancel   context.CancelFunc // stops the torrent
+	wg       sync.WaitGroup     // background goroutines, which StartDownload waits on before returning
+	paused   atomic.Bool        // while set we don't connect to peers or web seeds, but keep what we've downloaded
+	seed     bool               // keep running once downloaded, uploading to peers, see SessionConfig.Seed
+	finished chan struct{}      // closed once StartDownload returns
+	events   *eventBus          // subscribers to the torrent's events, shared by every torrent in a session
+
+	// how we connect and tell the time, see SessionConfig
+	dialer        Dialer
+	listenConfig  ListenConfig
+	clock         Clock
+	httpTransport http.RoundTripper
+	encryption    int // one of the Encryption constants
+
+	downloadLimiter *rateLimiter // the torrent's own limits, on top of the session's
+	uploadLimiter   *rateLimiter
+
+	downloadMeter rateMeter // payload bytes received from peers and web seeds, whether or not they verify
+	uploadMeter   rateMeter // bytes sent to peers
+	metrics       torrentMetrics
+	startedAt     time.Time // when StartDownload was called
+	doneAtStart   bool      // we had everything before StartDownload, so trackers aren't told that we completed
+
 	// Metadata-specific
-	metadataSize int // in bytes, given by first extended handshake
+	metadataSize int // in bytes, given by the extended handshake of the first peer we ask for it
 	metadataRaw  []byte
 	// NOTE: not sure if metadataPieces and obtainedBlocks are overcomplications or not yet
 	metadataPieces []byte // array of [1/0, 1/0,...] denoting whether we have the piece or not
 	metadata       Metadata
 	metadataMx     sync.Mutex // to ensure that that we only trigger "building" the metadata once
+	metadataErr    error      // set if the metadata we fetched couldn't be used, before stopping the torrent
+
+	// fetching the metadata from peers (BEP 9)
+	metadataFetchMx  sync.Mutex                   // guards the rest, and the above until we have the metadata
+	metadataPending  map[int]pendingMetadataPiece // pieces we've asked for and are waiting on
+	metadataSources  map[int]*Peer                // who sent each piece we have, blamed if they fail the hash check
+	metadataAvoid    map[int]pendingMetadataPiece // who sent each piece the last time they failed the hash check
+	metadataSizeFrom *Peer                        // whose metadata_size we went with
 
 	pieces              []Piece
 	obtainedBlocks      []byte // similar to 'metadata pieces', allows for quick bitwise checking which pieces we have, if the ith bit is set to 1 we have that block
 	numBlocksDownloaded int
-	numPiecesDownloaded int
+	numPiecesDownloaded atomic.Int64
 
 	pieceQueue *PieceQueue // all outstanding pieces that have no requests
 
-	isDownloaded bool // set to true when torrent has all blocks downloaded
-	hasMetadata  bool // set to true once metadata is built
+	filePriorities  []int  // priority of each file in the metadata, in order
+	wantedPieces    []bool // pieces overlapping at least one file we want
+	numWantedPieces int
+
+	isDownloaded atomic.Bool // set to true when torrent has all blocks downloaded, which peers check without a lock
+	hasMetadata  atomic.Bool // set to true once metadata is built, which peers check without a lock
 	downloadedMx sync.Mutex
 
 	connHandler *ConnectionHandler
 	progressBar Bar
 
+	webSeeds        []*WebSeed
+	webSeedsOnce    sync.Once
+	webSeedsDropped chan struct{} // closed once every web seed has been dropped for sending bad data
+	droppedWebSeeds atomic.Int32
+	done            chan struct{} // closed once the torrent has been downloaded and written to disk
+
 	torrentBlockCH  chan TorrentBlock
 	metadataPieceCH chan MetadataPiece
 
-	magnet *Magnet
+	magnet        *Magnet
+	metaInfo      *MetaInfo     // set if the torrent was created from a .torrent file
+	metadataReady chan struct{} // closed once hasMetadata is set
 }
 
 // TODO: update names to avoid confusion
@@ -59,12 +120,15 @@ type TorrentBlock struct {
 	pieceIndex int
 	offset     int
 	data       []byte
+	webSeed    *WebSeed // set if a web seed sent it, which hears if the piece it completes fails the hash check
 }
 
 // MetadataPiece is the type which is sent through a metadataPieceCH when a peer sends a metadata piece
 type MetadataPiece struct {
 	pieceIndex int
 	data       []byte
+	totalSize  int   // the metadata's size according to them
+	peer       *Peer // who sent it
 }
 
 // for simplicity, only magnet links will be supportd for no
@@ -74,34 +138,84 @@ func NewTorrent(magnet *Magnet, maxPeers int) *Torrent {
 
 	torrent.name = magnet.DisplayName
 	torrent.trackers = magnet.Trackers
+	torrent.magnet = magnet
+	torrent.infoHash = magnet.InfoHash
+	torrent.infoHashV2 = magnet.InfoHashV2
+	torrent.downloadDir = "downloads"
+	torrent.setOutput(io.Discard)
+	torrent.dialer = &net.Dialer{}
+	torrent.listenConfig = &net.ListenConfig{}
+	torrent.clock = SystemClock
+	torrent.httpTransport = http.DefaultTransport
+	torrent.downloadLimiter = newRateLimiter(0, torrent.clock)
+	torrent.uploadLimiter = newRateLimiter(0, torrent.clock)
+
+	peerID, err := utils.GeneratePeerID()
+	if err != nil {
+		panic(err)
+	}
+	torrent.peerID = peerID
 
 	torrent.connHandler = newConnHandler(&torrent)
 
 	torrent.torrentBlockCH = make(chan TorrentBlock)
 	torrent.metadataPieceCH = make(chan MetadataPiece)
+	torrent.done = make(chan struct{})
+	torrent.webSeedsDropped = make(chan struct{})
+	torrent.metadataReady = make(chan struct{})
+	torrent.ctx, torrent.cancel = context.WithCancel(context.Background())
+	torrent.finished = make(chan struct{})
+	torrent.events = newEventBus()
+
+	for _, webSeed := range magnet.WebSeeds {
+		torrent.addWebSeed(webSeed, GetRightStyle)
+	}
+
+	// peers given in the magnet link are dialed as soon as we start, without waiting for the trackers
+	if hashes := torrent.swarmHashes(); len(hashes) != 0 {
+		for _, address := range magnet.PeerAddresses {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
+			}
+			torrent.addPeer(newPeer(host, port, hashes[0], &torrent), PeerSourceMagnet)
+		}
+	}
 
 	return &torrent
 }
 
+// Name returns the torrent's name, from the metadata if we have it or otherwise the magnet link's display name
+func (torrent *Torrent) Name() string {
+	return torrent.name
+}
+
+// setOutput sets where progress and status messages are written
+func (torrent *Torrent) setOutput(w io.Writer) {
+	torrent.output = w
+	torrent.progressBar.out = w
+}
+
 func (torrent *Torrent) String() {
-	fmt.Println("Name: " + torrent.name)
-	fmt.Println("Magnet: " + torrent.magLink)
-	fmt.Println("Trackers:")
+	out := torrent.output
+	fmt.Fprintln(out, "Name: "+torrent.name)
+	fmt.Fprintln(out, "Magnet: "+torrent.magLink)
+	fmt.Fprintln(out, "Trackers:")
 	for i := 0; i < len(torrent.trackers); i++ {
-		fmt.Println(" -- " + torrent.trackers[i].link.Host)
+		fmt.Fprintln(out, " -- "+torrent.trackers[i].link.Host)
 	}
-	fmt.Println("Known peers:")
+	fmt.Fprintln(out, "Known peers:")
 	if len(torrent.peers) == 0 {
-		fmt.Println(" -- None")
+		fmt.Fprintln(out, " -- None")
 	} else {
 		for i := 0; i < len(torrent.peers); i++ {
-			fmt.Println(" -- " + torrent.peers[i].ip)
+			fmt.Fprintln(out, " -- "+torrent.peers[i].ip)
 		}
 	}
 	if torrent.metadata.Length != 0 {
-		fmt.Println("Metadata info (" + strconv.Itoa(torrent.metadataSize) + " bytes with " + strconv.Itoa(torrent.numMetadataPieces()) + " pieces)")
-		fmt.Println("-------------")
-		fmt.Println(torrent.metadata.String())
+		fmt.Fprintln(out, "Metadata info ("+strconv.Itoa(torrent.metadataSize)+" bytes with "+strconv.Itoa(torrent.numMetadataPieces())+" pieces)")
+		fmt.Fprintln(out, "-------------")
+		fmt.Fprintln(out, torrent.metadata.String())
 	}
 }
 
@@ -112,20 +226,140 @@ func (torrent *Torrent) findPeers() {
 
 	log.Info().Msg(fmt.Sprintf("Contacting %d trackers...", len(torrent.trackers)))
 
+	hashes := torrent.swarmHashes()
 	for _, tracker := range torrent.trackers {
 		wg.Add(1)
-		go tracker.FindPeers(torrent, &wg)
+		go tracker.FindPeers(torrent.ctx, torrent, hashes, &wg)
 	}
 	wg.Wait()
 
 	torrent.removeDuplicatePeers()
-	fmt.Printf("%d peers in swarm\n", len(torrent.peers))
+	fmt.Fprintf(torrent.output, "%d peers in swarm\n", len(torrent.peers))
+
+	for _, tracker := range torrent.trackers {
+		torrent.background(func() { tracker.reannounce(torrent) })
+	}
+}
+
+// findPeersForHash announces a single info hash to all trackers, used to join the second swarm of a hybrid torrent
+// once its metadata tells us the other info hash
+func (torrent *Torrent) findPeersForHash(infoHash []byte) {
+	var wg sync.WaitGroup
+	for _, tracker := range torrent.trackers {
+		wg.Add(1)
+		go tracker.FindPeers(torrent.ctx, torrent, [][]byte{infoHash}, &wg)
+	}
+	wg.Wait()
+	torrent.connHandler.wake()
+}
+
+// swarmHashes returns every info hash that peers may know this torrent by, ie both the v1 and (truncated) v2 hashes of a hybrid torrent
+func (torrent *Torrent) swarmHashes() [][]byte {
+	var hashes [][]byte
+	if len(torrent.infoHash) != 0 {
+		hashes = append(hashes, torrent.infoHash)
+	}
+	if len(torrent.infoHashV2) != 0 {
+		hashes = append(hashes, torrent.infoHashV2[:20])
+	}
+	return hashes
+}
+
+// addPeer adds a peer to the pool if we don't already know about its ip address, and the torrent allows peers from source
+func (torrent *Torrent) addPeer(peer *Peer, source int) bool {
+	// peers connecting to us found us through somewhere, which for a private torrent can only be its trackers
+	if source != PeerSourceTracker && source != PeerSourceIncoming && torrent.isPrivate() {
+		return false
+	}
+	peer.source = source
+
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+
+	for _, known := range torrent.peers {
+		if known.ip == peer.ip {
+			return false
+		}
+	}
+	torrent.peers = append(torrent.peers, peer)
+	torrent.connHandler.wake()
+	return true
+}
+
+// requestFromIdlePeers gets unchoked peers that have nothing outstanding to request again. Peers only request more
+// as blocks arrive, so this is needed when pieces go back in the queue after a peer disconnects or a piece fails its
+// hash check, or no one would download them
+func (torrent *Torrent) requestFromIdlePeers() {
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+	for _, peer := range torrent.peers {
+		if peer.status.Load() != Alive || (peer.choked.Load() && !peer.hasAllowedFast()) || peer.pw == nil {
+			continue
+		}
+		peer.requestsMX.Lock()
+		idle := len(peer.requested) == 0
+		peer.requestsMX.Unlock()
+		if idle {
+			go peer.requestPieces()
+		}
+	}
+}
+
+// sendInterestedToPeers tells the peers we connected to while fetching the metadata that we're interested, which
+// peers that connect once we have it are told straight away
+func (torrent *Torrent) sendInterestedToPeers() {
+	torrent.peersMx.Lock()
+	var peers []*Peer
+	for _, peer := range torrent.peers {
+		if peer.status.Load() == Alive && peer.pw != nil {
+			peers = append(peers, peer)
+		}
+	}
+	torrent.peersMx.Unlock()
+	for _, peer := range peers {
+		peer.sendInterested()
+	}
+	// any that let us request pieces while choking us needn't wait to be unchoked
+	torrent.requestFromIdlePeers()
+}
+
+// isPrivate returns whether this is a private torrent (BEP 27), which we only know once we have the metadata
+func (torrent *Torrent) isPrivate() bool {
+	return torrent.hasMetadata.Load() && torrent.metadata.Private == 1
+}
+
+// allowsDiscovery returns whether peers may be found through anything other than the trackers, ie PEX, DHT or LSD,
+// and whether we may advertise support for those extensions to peers
+func (torrent *Torrent) allowsDiscovery() bool {
+	return !torrent.isPrivate()
+}
+
+// dropUntrackedPeers removes any peers that we found before learning that the torrent is private, and disconnects from them
+func (torrent *Torrent) dropUntrackedPeers() {
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+
+	trimmed := []*Peer{}
+	for _, peer := range torrent.peers {
+		if peer.source == PeerSourceTracker || peer.source == PeerSourceIncoming {
+			trimmed = append(trimmed, peer)
+			continue
+		}
+		peer.status.Store(Bad)
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+	}
+	torrent.peers = trimmed
 }
 
 // remove all instances of repeating peer ip addresses from torrent.peers
 func (torrent *Torrent) removeDuplicatePeers() {
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+
 	seen := map[string]bool{}
-	trimmed := []Peer{}
+	trimmed := []*Peer{}
 
 	for i := range torrent.peers {
 		if !seen[torrent.peers[i].ip] {
@@ -136,20 +370,27 @@ func (torrent *Torrent) removeDuplicatePeers() {
 	torrent.peers = trimmed
 }
 
-// assumes the filename is "metadata.torrent",whichof course will not be valid in the future if there are multiple torrents
-func (torrent *Torrent) parseMetadataFile() error {
-	data, err := os.ReadFile("metadata.torrent")
+// parse the raw info dictionary into torrent.metadata and lay out the pieces we need to download
+func (torrent *Torrent) parseMetadata() error {
+	var result Metadata
+	// it may have come from peers
+	err := unmarshalUntrusted(torrent.metadataRaw, &result)
 	if err != nil {
 		return err
 	}
 
-	var result = Metadata{"", "", 0, "", 0, nil}
-	reader := bytes.NewReader(data)
-	err = bencode.Unmarshal(reader, &result)
+	err = result.check()
 	if err != nil {
 		return err
 	}
 
+	if result.MetaVersion == 2 {
+		err = torrent.parseV2Metadata(&result)
+		if err != nil {
+			return err
+		}
+	}
+
 	torrent.metadata = result
 
 	if len(result.Files) >= 1 {
@@ -170,121 +411,406 @@ func (torrent *Torrent) parseMetadataFile() error {
 
 	torrent.obtainedBlocks = make([]byte, (len(torrent.pieces)-1)*torrent.getNumBlocksInPiece()+len(torrent.pieces[len(torrent.pieces)-1].blocks))
 
+	torrent.initFilePriorities()
 	torrent.pieceQueue = newPieceQueue(len(torrent.pieces), true)
+	torrent.pieceQueue.filter(torrent.isPieceWanted)
 
-	torrent.progressBar.newOption(0, int64(len(torrent.pieces)))
+	torrent.progressBar.newOption(0, int64(torrent.numWantedPieces))
 
 	return nil
 }
 
-// "main" function of a torrent
-func (torrent *Torrent) StartDownload() {
-	// get num_want peers and store in masterlist of peers
-	torrent.findPeers()
+// v2 metadata is only supported as part of a hybrid torrent, in which case the v1 piece layout is used to download
+// and we join the swarms of both info hashes
+func (torrent *Torrent) parseV2Metadata(result *Metadata) error {
+	raw, err := bencode.Decode(bytes.NewReader(torrent.metadataRaw))
+	if err != nil {
+		return err
+	}
+	info, ok := raw.(map[string]interface{})
+	if !ok {
+		return errors.New("metadata is not a dictionary")
+	}
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return errors.New("v2 metadata is missing its file tree")
+	}
+	result.FileTree, err = parseFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+
+	if !result.isHybrid() {
+		return errors.New("v2-only torrents are not supported")
+	}
+	err = result.checkHybrid()
+	if err != nil {
+		return err
+	}
+
+	// we only knew one of the info hashes if we started from a magnet link, so join the other swarm as well
+	v1Hash := sha1.Sum(torrent.metadataRaw)
+	if len(torrent.infoHash) == 0 {
+		torrent.infoHash = v1Hash[:]
+		torrent.background(func() { torrent.findPeersForHash(torrent.infoHash) })
+	}
+	if len(torrent.infoHashV2) == 0 {
+		torrent.infoHashV2 = v2InfoHash(torrent.metadataRaw)
+		torrent.background(func() { torrent.findPeersForHash(torrent.infoHashV2[:20]) })
+	}
+	if torrent.session != nil {
+		torrent.session.index(torrent)
+	}
+	return nil
+}
+
+// v2InfoHash returns the full sha256 info hash of a v2 torrent's raw info dictionary
+func v2InfoHash(metadataRaw []byte) []byte {
+	checksum := sha256.Sum256(metadataRaw)
+	return checksum[:]
+}
+
+// listenPort returns the port we tell trackers that peers can reach us on
+func (torrent *Torrent) listenPort() int {
+	if torrent.session != nil && torrent.session.ListenPort() != 0 {
+		return torrent.session.ListenPort()
+	}
+	return DefaultListenPort
+}
+
+// acquireConn reserves one of the session's peer connections, always succeeding if the torrent isn't part of a session
+func (torrent *Torrent) acquireConn() bool {
+	if torrent.session == nil {
+		return true
+	}
+	return torrent.session.acquireConn()
+}
+
+func (torrent *Torrent) releaseConn() {
+	if torrent.session != nil {
+		torrent.session.releaseConn()
+	}
+}
+
+// waitDownload blocks until both the torrent's and the session's download rate limits allow n more bytes, or the
+// torrent is stopped
+func (torrent *Torrent) waitDownload(n int) {
+	torrent.downloadMeter.add(n)
+	delay := torrent.downloadLimiter.reserve(n)
+	if torrent.session != nil {
+		delay = max(delay, torrent.session.downloadLimiter.reserve(n))
+	}
+	if delay > 0 {
+		sleep(torrent.ctx, torrent.clock, delay)
+	}
+}
+
+// reserveUpload counts n bytes against both the torrent's and the session's upload rate limits, returning how long
+// to wait before sending them
+func (torrent *Torrent) reserveUpload(n int) time.Duration {
+	delay := torrent.uploadLimiter.reserve(n)
+	if torrent.session != nil {
+		delay = max(delay, torrent.session.uploadLimiter.reserve(n))
+	}
+	return delay
+}
+
+// SetRateLimits changes the torrent's own download and upload limits, in bytes per second and 0 for unlimited.
+// The session's limits still apply on top
+func (torrent *Torrent) SetRateLimits(downloadRate int, uploadRate int) {
+	torrent.downloadLimiter.setRate(downloadRate)
+	torrent.uploadLimiter.setRate(uploadRate)
+}
+
+// RateLimits returns the torrent's own download and upload limits, in bytes per second and 0 for unlimited
+func (torrent *Torrent) RateLimits() (int, int) {
+	return torrent.downloadLimiter.limit(), torrent.uploadLimiter.limit()
+}
+
+// isRunning returns whether the torrent has been started and is neither paused nor stopped
+func (torrent *Torrent) isRunning() bool {
+	return torrent.ctx.Err() == nil && torrent.started.Load() && !torrent.paused.Load()
+}
+
+// stop disconnects from every peer and stops connecting to new ones, StartDownload returns shortly after
+func (torrent *Torrent) stop() {
+	torrent.cancel()
+}
+
+// background runs fn in a goroutine which StartDownload waits for before returning, fn should return once
+// torrent.ctx is done
+func (torrent *Torrent) background(fn func()) {
+	torrent.wg.Add(1)
+	go func() {
+		defer torrent.wg.Done()
+		fn()
+	}()
+}
+
+// errNotFinished is returned when a torrent is stopped before it has been downloaded
+var errNotFinished = errors.New("torrent stopped before it finished downloading")
+
+// ErrBadMetadata is returned when a torrent is stopped because the metadata it fetched matched the info hash, yet
+// couldn't be parsed. Every peer would send us the same, so there's no use fetching it again
+var ErrBadMetadata = errors.New("metadata could not be parsed")
+
+// stoppedErr returns why a torrent that was stopped before it finished didn't finish
+func (torrent *Torrent) stoppedErr() error {
+	if torrent.metadataErr != nil {
+		return torrent.metadataErr
+	}
+	return errNotFinished
+}
+
+// stoppedAnnounceTimeout is how long we give trackers to hear that we're leaving the swarm
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// announceStopped tells every tracker we announced to that we've left the swarm
+func (torrent *Torrent) announceStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, tracker := range torrent.trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.announceStopped(ctx, torrent)
+		}()
+	}
+	wg.Wait()
+}
+
+// "main" function of a torrent, returns once the torrent has been downloaded, it has run out of peers or ctx is done.
+// Either way every connection is closed and the trackers are told that we've left before returning
+func (torrent *Torrent) StartDownload(ctx context.Context) error {
+	if torrent.seed && torrent.hasMetadata.Load() {
+		torrent.verifyExisting()
+	}
+	torrent.startedAt = torrent.clock.Now()
+	torrent.doneAtStart = torrent.isDownloaded.Load()
+	torrent.started.Store(true)
+	defer close(torrent.finished)
+	stopWithParent := context.AfterFunc(ctx, torrent.stop)
+	defer stopWithParent()
 
 	// prepare listeners
-	go torrent.metadataPieceHandler()
-	go torrent.torrentBlockHandler()
+	torrent.background(torrent.metadataPieceHandler)
+	torrent.background(torrent.torrentBlockHandler)
+
+	if torrent.hasMetadata.Load() {
+		torrent.startWebSeeds()
+	} else {
+		torrent.background(torrent.fetchSources)
+	}
+
+	// get num_want peers and store in masterlist of peers, in the background so that we can connect
+	// to any peers from the magnet link straight away
+	torrent.background(func() {
+		torrent.findPeers()
+		torrent.connHandler.doneAnnouncing()
+	})
 
 	// eventually this will be backgrounded but ok to just connect for now
-	torrent.connHandler.run()
+	torrent.connHandler.run(torrent.ctx)
+
+	// web seeds can carry on without any peers
+	if len(torrent.webSeeds) != 0 {
+		select {
+		case <-torrent.done:
+		case <-torrent.ctx.Done():
+		case <-torrent.webSeedsDropped:
+		}
+	}
+
+	torrent.stop()
+	torrent.wg.Wait()
+	torrent.announceStopped()
+	// wait for the files to be written if we finished just as we were stopped
+	torrent.downloadedMx.Lock()
+	torrent.downloadedMx.Unlock()
 
 	torrent.String()
+
+	// a session's subscribers outlive its torrents, but nothing more will be published for a torrent run on its own
+	if torrent.session == nil {
+		torrent.events.close()
+	}
+
+	select {
+	case <-torrent.done:
+		return nil
+	default:
+	}
+	if torrent.metadataErr != nil {
+		return torrent.metadataErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errNotFinished
 }
 
 func (torrent *Torrent) torrentBlockHandler() {
 	for {
-		ch := <-torrent.torrentBlockCH
-		hasBlock, err := torrent.hasBlock(ch.pieceIndex, ch.offset)
-		if err != nil {
-			fmt.Println(err)
+		var ch TorrentBlock
+		select {
+		case ch = <-torrent.torrentBlockCH:
+		case <-torrent.ctx.Done():
 			return
 		}
-		if hasBlock {
-			continue
-		}
 
-		if ch.pieceIndex >= len(torrent.pieces) || ch.offset/BlockLen >= len(torrent.pieces[ch.pieceIndex].blocks) {
-			// bad data
-			continue
+		complete, verified := torrent.storeBlock(ch)
+		if complete && !verified && ch.webSeed != nil {
+			ch.webSeed.hashFailed()
 		}
-
-		// Set this data and update this piece's number of blocks
-		torrent.pieces[ch.pieceIndex].blocks[ch.offset/BlockLen].data = ch.data
-		torrent.pieces[ch.pieceIndex].numSet++
-
-		// Mark this block as 'have'
-		blockIndex := (ch.pieceIndex*torrent.getNumBlocksInPiece() + (ch.offset / BlockLen))
-		utils.SetBit(&torrent.obtainedBlocks, blockIndex)
-
-		torrent.numBlocksDownloaded++
-
-		// Verify the block if need be
-		if torrent.pieces[ch.pieceIndex].numSet == len(torrent.pieces[ch.pieceIndex].blocks) {
-			if !torrent.pieces[ch.pieceIndex].verify() {
-				// redownload this entire piece
-				for i := 0; i < len(torrent.pieces[ch.pieceIndex].blocks); i++ {
-					utils.UnsetBit(&torrent.obtainedBlocks, ch.pieceIndex*torrent.getNumBlocksInPiece()+i)
-				}
-				// reset numSet and total numBlocksDownloaded, add back to pieceQueue
-				torrent.pieces[ch.pieceIndex].numSet = 0
-				torrent.numBlocksDownloaded -= len(torrent.pieces[ch.pieceIndex].blocks)
-				torrent.pieceQueue.push(ch.pieceIndex)
-			} else {
-				torrent.pieces[ch.pieceIndex].isVerified = true
-				torrent.numPiecesDownloaded++
-			}
+		if complete && !verified {
+			// redownload this entire piece
+			torrent.pieceQueue.push(ch.pieceIndex)
+			torrent.requestFromIdlePeers()
+			torrent.metrics.piecesFailed.Add(1)
+			torrent.emit(Event{Type: EventPieceHashFailed, Piece: ch.pieceIndex})
+		} else if complete {
+			torrent.metrics.piecesVerified.Add(1)
+			torrent.emit(Event{Type: EventPieceVerified, Piece: ch.pieceIndex})
+			torrent.background(torrent.checkDownloadStatus)
 		}
 
 		// Update progress bar
-		torrent.progressBar.play(int64(torrent.numPiecesDownloaded))
+		torrent.progressBar.play(torrent.numPiecesDownloaded.Load())
+	}
+}
+
+// storeBlock sets a block's data, hash checking its piece once every block of it is set. It returns whether the
+// block completed its piece, and whether the piece passed the check. It holds downloadedMx, so that checking the
+// download status or verifying the data on disk doesn't see a piece half updated
+func (torrent *Torrent) storeBlock(ch TorrentBlock) (bool, bool) {
+	torrent.downloadedMx.Lock()
+	defer torrent.downloadedMx.Unlock()
+
+	hasBlock, err := torrent.blockIsSet(ch.pieceIndex, ch.offset)
+	if err != nil {
+		// a block we can't have asked for, which mustn't stop the rest from being handled
+		log.Error().Err(err).Msg("Could not check block")
+		return false, false
+	}
+	if hasBlock {
+		return false, false
+	}
+
+	if ch.pieceIndex >= len(torrent.pieces) || ch.offset/BlockLen >= len(torrent.pieces[ch.pieceIndex].blocks) {
+		// bad data
+		return false, false
+	}
+
+	// Set this data and update this piece's number of blocks
+	piece := &torrent.pieces[ch.pieceIndex]
+	piece.blocks[ch.offset/BlockLen].data = ch.data
+	piece.numSet++
+
+	// Mark this block as 'have'
+	blockIndex := (ch.pieceIndex*torrent.getNumBlocksInPiece() + (ch.offset / BlockLen))
+	utils.SetBit(&torrent.obtainedBlocks, blockIndex)
+
+	torrent.numBlocksDownloaded++
+
+	// Verify the block if need be
+	if piece.numSet < len(piece.blocks) {
+		return false, false
 	}
+	if !piece.verify() {
+		for i := 0; i < len(piece.blocks); i++ {
+			utils.UnsetBit(&torrent.obtainedBlocks, ch.pieceIndex*torrent.getNumBlocksInPiece()+i)
+		}
+		// reset numSet and total numBlocksDownloaded
+		piece.numSet = 0
+		torrent.numBlocksDownloaded -= len(piece.blocks)
+		return true, false
+	}
+	piece.isVerified.Store(true)
+	torrent.numPiecesDownloaded.Add(1)
+	return true, true
 }
 
+// metadataPieceHandler stores the pieces of metadata peers send us, and keeps asking peers for the rest until we
+// have it, giving pieces they're slow to send to someone else
 func (torrent *Torrent) metadataPieceHandler() {
+	ticker := torrent.clock.NewTicker(metadataRetryInterval)
+	defer ticker.Stop()
 	for {
-		ch := <-torrent.metadataPieceCH
-		if torrent.hasMetadata {
-			continue
-		}
-		hasMetadataPiece, err := torrent.hasMetadataPiece(ch.pieceIndex)
-		if err != nil {
-			fmt.Println(err)
+		select {
+		case ch := <-torrent.metadataPieceCH:
+			torrent.receiveMetadataPiece(ch)
+		case <-ticker.C():
+			torrent.expireMetadataRequests()
+		case <-torrent.ctx.Done():
 			return
 		}
-		if hasMetadataPiece {
-			continue
+		if !torrent.hasMetadata.Load() {
+			torrent.requestMetadataFromPeers()
 		}
+	}
+}
 
-		torrent.setMetadataPiece(ch.pieceIndex, ch.data)
-
-		hasAllMetadata, err := torrent.hasAllMetadata()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		if !hasAllMetadata {
-			continue
-		}
+// setMetadata is called with the verified raw info dictionary once we've obtained it, either from peers or a .torrent file
+func (torrent *Torrent) setMetadata(metadataRaw []byte) error {
+	torrent.metadataMx.Lock()
+	defer torrent.metadataMx.Unlock()
+	if torrent.hasMetadata.Load() {
+		return nil
+	}
 
-		// check sha1 infohash
-		checksum := sha1.Sum(torrent.metadataRaw)
-		if bytes.Compare(checksum[:], torrent.infoHash) != 0 {
-			fmt.Println("Metadata failed infohash check, retrying")
-			for i := 0; i < torrent.numMetadataPieces(); i++ {
-				utils.UnsetBit(&torrent.metadataRaw, i)
-			}
-			continue
-		}
+	torrent.metadataRaw = metadataRaw
+	torrent.metadataSize = len(metadataRaw)
+	err := torrent.buildMetadataFile()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not save metadata")
+		torrent.emit(Event{Type: EventStorageError, File: filepath.Join(torrent.metadataDir, "metadata.torrent"), Err: err})
+	}
+	err = torrent.parseMetadata()
+	if err != nil {
+		return err
+	}
+	torrent.hasMetadata.Store(true)
+	close(torrent.metadataReady)
+	// metadata from a .torrent file is set before we start, anything after that was fetched
+	if !torrent.startedAt.IsZero() {
+		torrent.metrics.metadataFetch.Store(int64(torrent.clock.Now().Sub(torrent.startedAt)))
+	}
+	if torrent.isPrivate() {
+		log.Info().Msg("Torrent is private, only using peers from its trackers")
+		torrent.dropUntrackedPeers()
+	}
+	torrent.startWebSeeds()
+	if !torrent.isDownloaded.Load() {
+		torrent.background(torrent.sendInterestedToPeers)
+	}
+	torrent.emit(Event{Type: EventMetadataReceived})
+	return nil
+}
 
-		torrent.buildMetadataFile()
-		torrent.parseMetadataFile()
-		torrent.hasMetadata = true
+// verifyMetadata checks raw metadata against the sha1 (v1) info hash, or the sha256 (v2) info hash if we only know that one
+func (torrent *Torrent) verifyMetadata(metadataRaw []byte) bool {
+	if len(torrent.infoHash) != 0 {
+		checksum := sha1.Sum(metadataRaw)
+		return bytes.Equal(checksum[:], torrent.infoHash)
+	}
+	if len(torrent.infoHashV2) != 0 {
+		checksum := sha256.Sum256(metadataRaw)
+		return bytes.Equal(checksum[:], torrent.infoHashV2)
 	}
+	return false
 }
 
 // hasBlock returns whether block at pieceIndex (zero indexed piece) with offset offset in bytes is set
 func (torrent *Torrent) hasBlock(pieceIndex int, offset int) (bool, error) {
+	torrent.downloadedMx.Lock()
+	defer torrent.downloadedMx.Unlock()
+	return torrent.blockIsSet(pieceIndex, offset)
+}
+
+// blockIsSet is hasBlock for callers that hold downloadedMx
+func (torrent *Torrent) blockIsSet(pieceIndex int, offset int) (bool, error) {
 	if torrent.obtainedBlocks == nil {
 		return false, nil
 	}
@@ -298,7 +824,7 @@ func (torrent *Torrent) hasPiece(pieceIndex int) bool {
 		return false
 	}
 
-	return torrent.pieces[pieceIndex].isVerified
+	return torrent.pieces[pieceIndex].isVerified.Load()
 }
 
 // Get total number of blocks with with given block length size
@@ -316,86 +842,46 @@ func (torrent *Torrent) getNumBlocksInPiece() int {
 
 func (torrent *Torrent) checkDownloadStatus() {
 	torrent.downloadedMx.Lock()
-	if torrent.hasAllData() && !torrent.isDownloaded {
-		torrent.isDownloaded = true
-		fmt.Println(torrent.obtainedBlocks)
+	if torrent.hasAllData() && !torrent.isDownloaded.Load() {
+		torrent.isDownloaded.Store(true)
 		torrent.buildFile()
+		close(torrent.done)
+		torrent.emit(Event{Type: EventTorrentCompleted})
 	}
 	torrent.downloadedMx.Unlock()
 }
 
+// hasAllData returns whether every piece of the files we want has been downloaded and verified
 func (torrent *Torrent) hasAllData() bool {
-	return torrent.numBlocksDownloaded == torrent.getNumBlocks()
+	if int(torrent.numPiecesDownloaded.Load()) < torrent.numWantedPieces {
+		return false
+	}
+	// pieces we've since stopped wanting may have been verified too
+	for i := range torrent.pieces {
+		if torrent.wantedPieces[i] && !torrent.pieces[i].isVerified.Load() {
+			return false
+		}
+	}
+	return true
 }
 
 func (torrent *Torrent) buildFile() {
 	torrent.progressBar.finish()
-	if len(torrent.metadata.Files) > 1 {
-		// Create new directory
-		path := "downloads/" + torrent.name + "/"
-		err := os.MkdirAll("downloads/"+torrent.name, 0770)
-		if err != nil {
-			fmt.Println(err)
-		}
 
-		var bytesWritten int
-		for i := 0; i < len(torrent.metadata.Files); i++ {
-			torrent.createFile(bytesWritten, torrent.metadata.Files[i].Length, path, torrent.metadata.Files[i].Path[0])
-			bytesWritten += torrent.metadata.Files[i].Length
+	for _, entry := range torrent.fileEntries() {
+		if entry.priority == PrioritySkip {
+			continue
 		}
-	} else {
-		// Single files
-		file, _ := os.Create("downloads/" + torrent.metadata.Name)
-		for i := 0; i < len(torrent.pieces); i++ {
-			for j := 0; j < len(torrent.pieces[i].blocks); j++ {
-				_, _ = file.Write(torrent.pieces[i].blocks[j].data)
-			}
+		started := torrent.clock.Now()
+		err := torrent.writeFile(entry)
+		if !entry.hasAttr(AttrPadding) {
+			torrent.metrics.storageWrites.observe(torrent.clock.Now().Sub(started))
 		}
-	}
-}
-
-// Writes one file to given directory (util function for build_file)
-func (torrent *Torrent) createFile(offset int, fileSize int, path string, name string) {
-	file, _ := os.Create(path + name)
-
-	// write data spilling into front block, ie block 1 here [  xx] [xxxx] [xx  ]
-
-	startPiece := offset / BlockLen / torrent.getNumBlocksInPiece()
-	startBlock := offset / BlockLen % torrent.getNumBlocksInPiece()
-
-	bytesWritten, _ := file.Write(torrent.pieces[startPiece].blocks[startBlock].data[offset%BlockLen:])
-
-	// finish this piece for easy iteration -- this assumes that there is > BLOCK_LEN * torrent.get_num_blocks_in_piece() data left to write
-	for i := startBlock + 1; i < len(torrent.pieces[startPiece].blocks); i++ {
-		b, err := file.Write(torrent.pieces[startPiece].blocks[i].data)
 		if err != nil {
-			panic(err)
-		}
-		bytesWritten += b
-	}
-	startPiece++
-
-	blocksToWrite := (fileSize - bytesWritten) / BlockLen
-
-	for i := startPiece; i < startPiece+(blocksToWrite/torrent.getNumBlocksInPiece()); i++ {
-		for j := 0; j < torrent.getNumBlocksInPiece(); j++ {
-			if i == startPiece+(blocksToWrite/torrent.getNumBlocksInPiece())-1 && j == (blocksToWrite%torrent.getNumBlocksInPiece()) {
-				break
-			}
-			b, _ := file.Write(torrent.pieces[i].blocks[j].data)
-			bytesWritten += b
-		}
-
-	}
-
-	// write data spilling into back block
-	lastPiece := (fileSize + offset) / BlockLen / torrent.getNumBlocksInPiece()
-	lastBlock := (fileSize + offset) / BlockLen % torrent.getNumBlocksInPiece()
-	_, _ = file.Write(torrent.pieces[lastPiece].blocks[lastBlock].data[:fileSize%BlockLen])
-
-	for i := 0; i < len(torrent.pieces); i++ {
-		for j := 0; j < len(torrent.pieces[i].blocks); j++ {
-			_, _ = file.Write(torrent.pieces[i].blocks[j].data)
+			log.Error().Err(err).Msg("Could not write " + entry.path)
+			torrent.emit(Event{Type: EventStorageError, File: entry.path, Err: err})
+		} else if !entry.hasAttr(AttrPadding) {
+			torrent.emit(Event{Type: EventFileCompleted, File: entry.path})
 		}
 	}
 }
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,10 +20,61 @@ import (
 // Tracker is a database which returns peers in a swarm when given a torrent hash
 type Tracker struct {
 	link         url.URL
-	conn         net.Conn
-	timeout      time.Duration // default is 15 seconds
+	addr         net.Addr          // resolved address of a udp tracker
+	socket       *udpTrackerSocket // shared with other trackers when part of a session
+	ownsSocket   bool              // whether we created the socket ourselves and must close it
+	timeout      time.Duration     // default is 15 seconds
 	connectionID uint64
 	retries      int
+
+	announced   [][]byte // info hashes we've announced, which we tell the tracker we're leaving when stopped
+	announcedMx sync.Mutex
+
+	// what we know from the last announce, see TrackerInfo
+	lastAnnounce time.Time
+	nextAnnounce time.Time
+	lastErr      error
+	interval     time.Duration // how often the tracker wants to hear from us
+	seeders      int
+	leechers     int
+	successes    int
+	failures     int
+	latency      histogram // of each announce
+	statusMx     sync.Mutex
+}
+
+const (
+	minAnnounceInterval   = time.Minute // trackers asking for less are ignored, as are ones that don't say
+	announceRetryInterval = 5 * time.Minute
+)
+
+// UDP announce events from BEP 15, http trackers use their names instead
+const (
+	eventNone      = 0
+	eventCompleted = 1
+	eventStarted   = 2
+	eventStopped   = 3
+)
+
+var eventNames = map[int]string{
+	eventCompleted: "completed",
+	eventStarted:   "started",
+	eventStopped:   "stopped",
+}
+
+// transferStats returns the bytes we've uploaded and downloaded, and how many more we want, for announces. Until
+// we have the metadata we don't know how much is left, but it can't be 0 or we'd be counted as a seed
+func (torrent *Torrent) transferStats() (int64, int64, int64) {
+	left := int64(BlockLen)
+	if torrent.hasMetadata.Load() {
+		left = 0
+		for i := range torrent.pieces {
+			if torrent.isPieceWanted(i) && !torrent.pieces[i].isVerified.Load() {
+				left += int64(torrent.pieceLength(i))
+			}
+		}
+	}
+	return torrent.uploadMeter.bytes(), torrent.downloadMeter.bytes(), left
 }
 
 // return a new tracker from a string representing the link
@@ -30,32 +83,63 @@ func NewTracker(link url.URL) *Tracker {
 	return &Tracker{link: link, timeout: 15 * time.Second, retries: 1}
 }
 
-// send 2x announce requests to all trackers, the first to find out how many peers they have,
+// String returns the tracker's url with any passkeys redacted, use this rather than link when logging
+func (tracker *Tracker) String() string {
+	return redactURL(tracker.link)
+}
+
+// send 2x announce requests per info hash, the first to find out how many peers they have,
 // the second to request that many, so that we have a large pool to pull from
-func (tracker *Tracker) FindPeers(torrent *Torrent, wg *sync.WaitGroup) {
+func (tracker *Tracker) FindPeers(ctx context.Context, torrent *Torrent, infoHashes [][]byte, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	err := tracker.connect()
-
-	if err != nil {
+	if tracker.isHTTP() {
+		for _, infoHash := range infoHashes {
+			started := torrent.clock.Now()
+			seeders, err := tracker.announceHTTP(ctx, torrent, infoHash, tracker.nextEvent(infoHash))
+			tracker.recordAnnounce(torrent, seeders, started, err)
+			if err != nil {
+				log.Debug().Err(err).Msg(fmt.Sprintf("tracker %s announce failed", tracker))
+				return
+			}
+			tracker.setAnnounced(infoHash)
+			log.Info().Msg(fmt.Sprintf("tracker %s has %d seeders", tracker, seeders))
+		}
 		return
 	}
 
-	err = tracker.setConnectionID()
+	started := torrent.clock.Now()
+	err := tracker.connect(torrent)
+
 	if err != nil {
+		tracker.recordAnnounce(torrent, 0, started, err)
 		return
 	}
 
-	seeders, err := tracker.announce(torrent, 0)
+	err = tracker.setConnectionID(ctx)
 	if err != nil {
+		tracker.recordAnnounce(torrent, 0, started, err)
+		tracker.disconnect()
 		return
 	}
 
-	numSeeders, err := tracker.announce(torrent, seeders)
-	if err != nil {
-		return
+	for _, infoHash := range infoHashes {
+		// both requests count as one announce
+		started = torrent.clock.Now()
+		seeders, err := tracker.announce(ctx, torrent, infoHash, 0, tracker.nextEvent(infoHash))
+		if err != nil {
+			tracker.recordAnnounce(torrent, 0, started, err)
+			break
+		}
+		tracker.setAnnounced(infoHash)
+
+		numSeeders, err := tracker.announce(ctx, torrent, infoHash, seeders, eventNone)
+		tracker.recordAnnounce(torrent, numSeeders, started, err)
+		if err != nil {
+			break
+		}
+		log.Info().Msg(fmt.Sprintf("tracker %s has %d seeders", tracker, numSeeders))
 	}
-	log.Info().Msg(fmt.Sprintf("tracker %s has %d seeders", tracker.link.String(), numSeeders))
 
 	err = tracker.disconnect()
 	if err != nil {
@@ -63,41 +147,204 @@ func (tracker *Tracker) FindPeers(torrent *Torrent, wg *sync.WaitGroup) {
 	}
 }
 
-// for now, only works for udp links, which seem to be standard
-func (tracker *Tracker) connect() error {
-	var connectionMethod string
+// recordAnnounce records how an announce that began at started went, scheduling the next one, and tells the
+// torrent's subscribers
+func (tracker *Tracker) recordAnnounce(torrent *Torrent, seeders int, started time.Time, err error) {
+	now := torrent.clock.Now()
+	tracker.latency.observe(now.Sub(started))
+
+	tracker.statusMx.Lock()
+	tracker.lastAnnounce = now
+	tracker.lastErr = err
+	if err != nil {
+		tracker.failures++
+		tracker.nextAnnounce = now.Add(announceRetryInterval)
+	} else {
+		tracker.successes++
+		tracker.nextAnnounce = now.Add(max(tracker.interval, minAnnounceInterval))
+	}
+	tracker.statusMx.Unlock()
+
+	torrent.emit(Event{Type: EventTrackerAnnounce, Tracker: tracker.String(), Seeders: seeders, Err: err})
+}
+
+// setSwarm records what the tracker told us about the swarm in its last response
+func (tracker *Tracker) setSwarm(seeders int, leechers int, interval time.Duration) {
+	tracker.statusMx.Lock()
+	defer tracker.statusMx.Unlock()
+	tracker.seeders = seeders
+	tracker.leechers = leechers
+	if interval > 0 {
+		tracker.interval = interval
+	}
+}
+
+// reannounce keeps announcing at the interval the tracker asked for, so that it knows we're still here and we hear
+// about new peers, until the torrent is stopped or downloaded (unless it's being seeded). The tracker hears that we
+// completed once the download finishes
+func (tracker *Tracker) reannounce(torrent *Torrent) {
+	done := torrent.done
+	if torrent.doneAtStart {
+		done = nil
+	}
+	for {
+		tracker.statusMx.Lock()
+		wait := max(tracker.nextAnnounce.Sub(torrent.clock.Now()), minAnnounceInterval)
+		tracker.statusMx.Unlock()
+
+		timer := torrent.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-torrent.ctx.Done():
+		case <-done:
+		}
+		timer.Stop()
+
+		// finishing stops the torrent, which mustn't keep the tracker from hearing about it
+		select {
+		case <-done:
+			tracker.announceCompleted(torrent)
+			if !torrent.seed {
+				return
+			}
+			done = nil
+			continue
+		default:
+		}
+		if torrent.ctx.Err() != nil {
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		tracker.FindPeers(torrent.ctx, torrent, torrent.swarmHashes(), &wg)
+		torrent.connHandler.wake()
+	}
+}
+
+// nextEvent returns the event for our next announce of infoHash, which is started unless the tracker already knows
+// we're in its swarm
+func (tracker *Tracker) nextEvent(infoHash []byte) int {
+	tracker.announcedMx.Lock()
+	defer tracker.announcedMx.Unlock()
+	for _, known := range tracker.announced {
+		if bytes.Equal(known, infoHash) {
+			return eventNone
+		}
+	}
+	return eventStarted
+}
+
+func (tracker *Tracker) setAnnounced(infoHash []byte) {
+	tracker.announcedMx.Lock()
+	defer tracker.announcedMx.Unlock()
+	for _, known := range tracker.announced {
+		if bytes.Equal(known, infoHash) {
+			return
+		}
+	}
+	tracker.announced = append(tracker.announced, infoHash)
+}
+
+// announceStopped tells the tracker that we've left the swarm of every info hash we announced
+func (tracker *Tracker) announceStopped(ctx context.Context, torrent *Torrent) {
+	tracker.announcedMx.Lock()
+	infoHashes := tracker.announced
+	tracker.announced = nil
+	tracker.announcedMx.Unlock()
+	tracker.announceEvent(ctx, torrent, infoHashes, eventStopped)
+}
+
+// announceCompleted tells the tracker that we've finished downloading, in every swarm we announced to
+func (tracker *Tracker) announceCompleted(torrent *Torrent) {
+	tracker.announcedMx.Lock()
+	infoHashes := append([][]byte{}, tracker.announced...)
+	tracker.announcedMx.Unlock()
+
+	// the torrent is usually stopped by now, so it gets as long as stopping does
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+	tracker.announceEvent(ctx, torrent, infoHashes, eventCompleted)
+}
+
+// announceEvent announces event for each of infoHashes, which only the tracker needs to hear about
+func (tracker *Tracker) announceEvent(ctx context.Context, torrent *Torrent, infoHashes [][]byte, event int) {
+	if len(infoHashes) == 0 {
+		return
+	}
 
-	switch tracker.link.Scheme {
-	case "http", "https":
-		connectionMethod = "tcp"
-	case "udp":
-		connectionMethod = "udp"
-	default:
+	if tracker.isHTTP() {
+		for _, infoHash := range infoHashes {
+			_, err := tracker.announceHTTP(ctx, torrent, infoHash, event)
+			if err != nil {
+				log.Debug().Err(err).Msg(fmt.Sprintf("tracker %s %s announce failed", tracker, eventNames[event]))
+			}
+		}
+		return
+	}
+
+	if tracker.connect(torrent) != nil {
+		return
+	}
+	defer tracker.disconnect()
+	// our connection id has most likely expired by now
+	if tracker.setConnectionID(ctx) != nil {
+		return
+	}
+	for _, infoHash := range infoHashes {
+		_, err := tracker.announce(ctx, torrent, infoHash, 0, event)
+		if err != nil {
+			log.Debug().Err(err).Msg(fmt.Sprintf("tracker %s %s announce failed", tracker, eventNames[event]))
+		}
+	}
+}
+
+// connect to a udp tracker, http trackers don't need a connection as each announce is a separate request
+func (tracker *Tracker) connect(torrent *Torrent) error {
+	if tracker.link.Scheme != "udp" {
 		return errors.New("unsupported tracker protocol")
 	}
 
-	conn, err := net.DialTimeout(connectionMethod, tracker.link.Host, tracker.timeout)
+	addr, err := net.ResolveUDPAddr("udp", tracker.link.Host)
 	if err != nil {
 		return err
 	}
-	tracker.conn = conn
+	tracker.addr = addr
+
+	// trackers outside of a session get a socket of their own
+	if tracker.socket == nil {
+		tracker.socket, err = newUDPTrackerSocket(torrent.listenConfig, torrent.clock)
+		if err != nil {
+			return err
+		}
+		tracker.ownsSocket = true
+	}
 
 	return nil
 }
 
 func (tracker *Tracker) disconnect() error {
-	err := tracker.conn.Close()
-	if err != nil {
-		return err
+	if !tracker.ownsSocket {
+		return nil
 	}
-	return nil
+	err := tracker.socket.close()
+	tracker.socket = nil
+	tracker.ownsSocket = false
+	return err
+}
+
+// Per BitTorrent.org specificiations, "If a response is not recieved after 15 * 2 ^ n seconds, client should retransmit, where n increases to 8 from 0
+func (tracker *Tracker) retryTimeout(attempt int) time.Duration {
+	return time.Second * time.Duration(int(15*math.Pow(2, float64(attempt))))
 }
 
 // the first step in getting peers from the tracker is getting a connection_id, which is valid for 2 minutes
-func (tracker *Tracker) setConnectionID() error {
+func (tracker *Tracker) setConnectionID(ctx context.Context) error {
+	var err error
 	for i := 0; i <= tracker.retries; i++ {
 		// Create a new Connection_Request with a new transactionID
-		transactionID, err := utils.GetTransactionID()
+		var transactionID uint32
+		transactionID, err = utils.GetTransactionID()
 		if err != nil {
 			return (err)
 		}
@@ -112,63 +359,45 @@ func (tracker *Tracker) setConnectionID() error {
 		binary.BigEndian.PutUint32(packet[8:], 0)
 		binary.BigEndian.PutUint32(packet[12:], transactionID)
 
-		// Set a write deadline of 15 seconds and connect
-		err = tracker.conn.SetWriteDeadline(time.Now().Add(tracker.timeout))
-		if err != nil {
-			panic(err)
-		}
-		bytesWritten, err := tracker.conn.Write(packet)
-		if err != nil {
-			continue
-		}
-		if bytesWritten < len(packet) {
-			return (errors.New("did not write 16 bytes"))
-		}
-
-		// Per BitTorrent.org specificiations, "If a response is not recieved after 15 * 2 ^ n seconds, client should retransmit, where n increases to 8 from 0
-		err = tracker.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(int(15*math.Pow(2, float64(i))))))
-		if err != nil {
-			panic(err)
-		}
-
 		// Expecting a 16 byte response where
 		// Offset	Name		Value
 		// 0		action		0 - connect
 		// 4		transaction_id	should be same that was sent
 		// 8		connection_id
-		buf := make([]byte, 16)
-
-		bytesRead, err := tracker.conn.Read(buf)
+		var buf []byte
+		buf, err = tracker.socket.roundTrip(ctx, tracker.addr, packet, transactionID, tracker.retryTimeout(i))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
-			if i == tracker.retries {
-				return (err)
-			}
 			continue
 		}
-		if bytesRead != 16 {
+		if len(buf) != 16 {
 			return errors.New("did not read 16 bytes") // try again?
 		}
 
-		// Make sure the response has the connect action and the same transaction id that we sent
-		if binary.BigEndian.Uint32(buf[0:]) != 0 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+		// Make sure the response has the connect action
+		if binary.BigEndian.Uint32(buf[0:]) != 0 {
 			return errors.New("received bad connect data from tracker")
 		}
 
 		tracker.connectionID = binary.BigEndian.Uint64(buf[8:])
 		return nil
 	}
-	return nil
+	return err
 }
 
-// announce to a tracker requesting num_peers ip addresses
+// announce infoHash to a tracker requesting num_peers ip addresses
 // returns # of seeders
-func (tracker *Tracker) announce(torrent *Torrent, numWant int) (int, error) {
+func (tracker *Tracker) announce(ctx context.Context, torrent *Torrent, infoHash []byte, numWant int, event int) (int, error) {
 	for i := 0; i <= tracker.retries; i++ {
 		transactionID, err := utils.GetTransactionID()
 		if err != nil {
 			return 0, err
 		}
 
+		uploaded, downloaded, left := torrent.transferStats()
+
 		// Create announce packet
 		packet := make([]byte, 98)
 		// connection_id
@@ -178,18 +407,17 @@ func (tracker *Tracker) announce(torrent *Torrent, numWant int) (int, error) {
 		// transaction_id
 		binary.BigEndian.PutUint32(packet[12:], transactionID)
 		// info_hash
-		copy(packet[16:], torrent.infoHash)
+		copy(packet[16:], infoHash)
 		// peerID (20 bytes)
-		peerID := "GoLangTorrent_v0.0.1" // should be randomly set
-		copy(packet[36:], []byte(peerID))
+		copy(packet[36:], torrent.peerID)
 		// downloaded
-		binary.BigEndian.PutUint64(packet[56:], 0)
+		binary.BigEndian.PutUint64(packet[56:], uint64(downloaded))
 		// left
-		binary.BigEndian.PutUint64(packet[64:], 0)
+		binary.BigEndian.PutUint64(packet[64:], uint64(left))
 		// uploaded
-		binary.BigEndian.PutUint64(packet[72:], 0)
+		binary.BigEndian.PutUint64(packet[72:], uint64(uploaded))
 		// event
-		binary.BigEndian.PutUint32(packet[80:], 0)
+		binary.BigEndian.PutUint32(packet[80:], uint32(event))
 		// ip_address
 		binary.BigEndian.PutUint32(packet[84:], 0)
 		// key
@@ -197,32 +425,22 @@ func (tracker *Tracker) announce(torrent *Torrent, numWant int) (int, error) {
 		// num_want
 		binary.BigEndian.PutUint32(packet[92:], uint32(numWant))
 		// port
-		binary.BigEndian.PutUint16(packet[96:], 6881)
-
-		// Set timeout
-		//tracker.conn.SetWriteDeadline(time.Now().Add(tracker.timeout))
-
-		bytesWritten, err := tracker.conn.Write(packet)
-		if err != nil || bytesWritten < len(packet) {
-			return 0, errors.New("could not write announce request")
-		}
-
-		buf := make([]byte, 20+(6*numWant))
-		err = tracker.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(int(15*math.Pow(2, float64(i)))))) // BEP 15 - If a response is not received after 15 * 2 ^ n seconds, the client should retransmit the request, where n starts at 0 and is increased up to 8 (3840 seconds) after every retransmission
-		if err != nil {
-			panic(err)
-		}
+		binary.BigEndian.PutUint16(packet[96:], uint16(torrent.listenPort()))
 
-		bytesRead, err := tracker.conn.Read(buf)
-		if bytesRead < 20 || err != nil {
-			if i >= tracker.retries {
+		// BEP 15 - If a response is not received after 15 * 2 ^ n seconds, the client should retransmit the request, where n starts at 0 and is increased up to 8 (3840 seconds) after every retransmission
+		buf, err := tracker.socket.roundTrip(ctx, tracker.addr, packet, transactionID, tracker.retryTimeout(i))
+		if len(buf) < 20 || err != nil {
+			if i >= tracker.retries || ctx.Err() != nil {
 				return 0, err
 			}
 			continue
 		}
 
+		interval := time.Duration(binary.BigEndian.Uint32(buf[8:])) * time.Second
+		leechers := int(binary.BigEndian.Uint32(buf[12:]))
 		seeders := int(binary.BigEndian.Uint32(buf[16:]))
-		for j := 0; j < int(math.Min(float64(numWant), float64(seeders))); j++ {
+		tracker.setSwarm(seeders, leechers, interval)
+		for j := 0; j < int(math.Min(float64(numWant), float64(seeders))) && 26+(6*j) <= len(buf); j++ {
 			ipAddressRaw := binary.BigEndian.Uint32(buf[20+(6*j):])
 			port := binary.BigEndian.Uint16(buf[24+(6*j):])
 
@@ -230,7 +448,7 @@ func (tracker *Tracker) announce(torrent *Torrent, numWant int) (int, error) {
 			ipAddress := make(net.IP, 4)
 			binary.BigEndian.PutUint32(ipAddress, ipAddressRaw)
 
-			torrent.peers = append(torrent.peers, *newPeer(ipAddress.String(), strconv.Itoa(int(port)), torrent))
+			torrent.addPeer(newPeer(ipAddress.String(), strconv.Itoa(int(port)), infoHash, torrent), PeerSourceTracker)
 		}
 		return seeders, nil
 	}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// httpNumWant is how many peers we ask an http tracker for, they don't report swarm sizes up front like udp trackers do
+const httpNumWant = 200
+
+func (tracker *Tracker) isHTTP() bool {
+	return tracker.link.Scheme == "http" || tracker.link.Scheme == "https"
+}
+
+// announceHTTP announces infoHash to an http tracker (BEP 3/BEP 23), returning the number of seeders
+func (tracker *Tracker) announceHTTP(ctx context.Context, torrent *Torrent, infoHash []byte, event int) (int, error) {
+	uploaded, downloaded, left := torrent.transferStats()
+	params := url.Values{}
+	params.Set("info_hash", string(infoHash))
+	params.Set("peer_id", string(torrent.peerID))
+	params.Set("port", strconv.Itoa(torrent.listenPort()))
+	params.Set("uploaded", strconv.FormatInt(uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(downloaded, 10))
+	params.Set("left", strconv.FormatInt(left, 10))
+	params.Set("compact", "1")
+	params.Set("numwant", strconv.Itoa(httpNumWant))
+	if event != eventNone {
+		params.Set("event", eventNames[event])
+	}
+	if event == eventStopped {
+		params.Set("numwant", "0")
+	}
+
+	// append to the raw query rather than re-encoding it, so that passkeys and the like are sent exactly as given
+	link := tracker.link
+	if link.RawQuery != "" {
+		link.RawQuery += "&"
+	}
+	link.RawQuery += params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
+	if err != nil {
+		return 0, tracker.redactError(err)
+	}
+	client := http.Client{Timeout: tracker.timeout, Transport: torrent.httpTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, tracker.redactError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New("tracker responded with " + resp.Status)
+	}
+
+	decoded, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	response, ok := decoded.(map[string]interface{})
+	if !ok {
+		return 0, errors.New("tracker response is not a dictionary")
+	}
+	if reason, ok := response["failure reason"].(string); ok {
+		return 0, errors.New("tracker failure: " + reason)
+	}
+
+	for _, addr := range parseHTTPPeers(response["peers"], 4) {
+		torrent.addPeer(newPeer(addr.IP.String(), strconv.Itoa(addr.Port), infoHash, torrent), PeerSourceTracker)
+	}
+	for _, addr := range parseHTTPPeers(response["peers6"], 16) {
+		torrent.addPeer(newPeer(addr.IP.String(), strconv.Itoa(addr.Port), infoHash, torrent), PeerSourceTracker)
+	}
+
+	seeders, _ := response["complete"].(int64)
+	leechers, _ := response["incomplete"].(int64)
+	interval, _ := response["interval"].(int64)
+	tracker.setSwarm(int(seeders), int(leechers), time.Duration(interval)*time.Second)
+	return int(seeders), nil
+}
+
+// parseHTTPPeers reads either the compact (BEP 23) or dictionary form of a tracker's peer list
+func parseHTTPPeers(value interface{}, ipLen int) []net.TCPAddr {
+	var addrs []net.TCPAddr
+
+	switch peers := value.(type) {
+	case string:
+		raw := []byte(peers)
+		for i := 0; i+ipLen+2 <= len(raw); i += ipLen + 2 {
+			ip := make(net.IP, ipLen)
+			copy(ip, raw[i:i+ipLen])
+			addrs = append(addrs, net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(raw[i+ipLen:]))})
+		}
+	case []interface{}:
+		for _, item := range peers {
+			peer, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ipRaw, _ := peer["ip"].(string)
+			port, _ := peer["port"].(int64)
+			ip := net.ParseIP(ipRaw)
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			addrs = append(addrs, net.TCPAddr{IP: ip, Port: int(port)})
+		}
+	}
+	return addrs
+}
+
+// secretPathElement matches path elements which are likely to be passkeys, ie long runs of hex or base64-ish characters
+var secretPathElement = regexp.MustCompile(`^[A-Za-z0-9_\-]{16,}$`)
+
+// redactURL returns link as a string with anything that might identify the user (passkeys, credentials) removed,
+// so that it is safe to log
+func redactURL(link url.URL) string {
+	if link.User != nil {
+		link.User = url.User("REDACTED")
+	}
+
+	elements := strings.Split(link.Path, "/")
+	for i, element := range elements {
+		if secretPathElement.MatchString(element) {
+			elements[i] = "REDACTED"
+		}
+	}
+	link.Path = strings.Join(elements, "/")
+	link.RawPath = ""
+
+	if link.RawQuery != "" {
+		query := link.Query()
+		for key := range query {
+			query.Set(key, "REDACTED")
+		}
+		link.RawQuery = query.Encode()
+	}
+	return link.String()
+}
+
+// redactError strips the tracker's url out of errors returned by net/http, which include it verbatim
+func (tracker *Tracker) redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &url.Error{Op: urlErr.Op, URL: tracker.String(), Err: urlErr.Err}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpTrackerSocket is a single UDP socket shared by all udp trackers, responses are matched to requests by their transaction id
+type udpTrackerSocket struct {
+	conn    net.PacketConn
+	clock   Clock // for timeouts
+	pending map[uint32]chan []byte
+	mx      sync.Mutex
+}
+
+func newUDPTrackerSocket(listenConfig ListenConfig, clock Clock) (*udpTrackerSocket, error) {
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	socket := &udpTrackerSocket{conn: conn, clock: clock, pending: make(map[uint32]chan []byte)}
+	go socket.readLoop()
+	return socket, nil
+}
+
+// readLoop hands every response to whoever is waiting on its transaction id, until the socket is closed
+func (socket *udpTrackerSocket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < 8 {
+			continue
+		}
+
+		transactionID := binary.BigEndian.Uint32(buf[4:])
+		socket.mx.Lock()
+		ch, ok := socket.pending[transactionID]
+		socket.mx.Unlock()
+		if !ok {
+			continue
+		}
+
+		response := make([]byte, n)
+		copy(response, buf[:n])
+		select {
+		case ch <- response:
+		default:
+		}
+	}
+}
+
+// roundTrip sends packet to addr and waits up to timeout for the response with the same transaction id
+func (socket *udpTrackerSocket) roundTrip(ctx context.Context, addr net.Addr, packet []byte, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	socket.mx.Lock()
+	socket.pending[transactionID] = ch
+	socket.mx.Unlock()
+	defer func() {
+		socket.mx.Lock()
+		delete(socket.pending, transactionID)
+		socket.mx.Unlock()
+	}()
+
+	bytesWritten, err := socket.conn.WriteTo(packet, addr)
+	if err != nil {
+		return nil, err
+	}
+	if bytesWritten < len(packet) {
+		return nil, errors.New("could not write entire packet to tracker")
+	}
+
+	timer := socket.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-timer.C():
+		return nil, errors.New("tracker timed out")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// close closes the socket, a nil socket is already closed
+func (socket *udpTrackerSocket) close() error {
+	if socket == nil {
+		return nil
+	}
+	return socket.conn.Close()
+}
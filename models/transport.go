@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Dialer makes outgoing connections to peers, HTTP trackers, web seeds and .torrent sources. *net.Dialer is one,
+// a custom one could bind to a VPN's interface or connect over net.Pipe in tests
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// ListenConfig opens the socket that peers connect to us on and the one we talk to UDP trackers over.
+// *net.ListenConfig is one
+type ListenConfig interface {
+	Listen(ctx context.Context, network string, address string) (net.Listener, error)
+	ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error)
+}
+
+// Clock tells the time and schedules everything we wait for: announces, retries, back offs, keep alives and rate
+// limits. Tests can use a simulated one. Deadlines on connections always use the real time, as the OS enforces them
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a Clock's version of time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a Clock's version of time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the real time, and the default
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (st systemTimer) C() <-chan time.Time {
+	return st.timer.C
+}
+
+func (st systemTimer) Stop() bool {
+	return st.timer.Stop()
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (st systemTicker) C() <-chan time.Time {
+	return st.ticker.C
+}
+
+func (st systemTicker) Stop() {
+	st.ticker.Stop()
+}
+
+// sleep waits for d on clock, returning early if ctx is done
+func sleep(ctx context.Context, clock Clock, d time.Duration) {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-ctx.Done():
+	}
+}
+
+// newHTTPTransport returns the transport for everything we fetch over HTTP, which dials through dialer but is
+// otherwise the same as http.DefaultTransport, including the proxy settings from the environment unless we have
+// a proxy of our own
+func newHTTPTransport(dialer Dialer) http.RoundTripper {
+	if _, ok := dialer.(*net.Dialer); ok {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if _, ok := dialer.(*proxyDialer); ok {
+		transport.Proxy = nil
+	}
+	return transport
+}
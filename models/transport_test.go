@@ -0,0 +1,220 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// fakeClock only moves when advanced, firing any timers and tickers that have come due
+type fakeClock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	period time.Duration // non-zero for tickers
+	c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), timers: make(map[*fakeTimer]struct{})}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) NewTimer(d time.Duration) Timer {
+	return clock.add(d, 0)
+}
+
+func (clock *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{clock.add(d, d)}
+}
+
+func (clock *fakeClock) add(d time.Duration, period time.Duration) *fakeTimer {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	timer := &fakeTimer{clock: clock, when: clock.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		timer.c <- clock.now
+		return timer
+	}
+	clock.timers[timer] = struct{}{}
+	return timer
+}
+
+// advance moves the time forward by d
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	clock.now = clock.now.Add(d)
+	for timer := range clock.timers {
+		if timer.when.After(clock.now) {
+			continue
+		}
+		select {
+		case timer.c <- clock.now:
+		default:
+		}
+		if timer.period == 0 {
+			delete(clock.timers, timer)
+		} else {
+			for !timer.when.After(clock.now) {
+				timer.when = timer.when.Add(timer.period)
+			}
+		}
+	}
+}
+
+// waitForTimers waits until n timers are pending, so that we know whatever we're testing is waiting on the clock
+func (clock *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		clock.mx.Lock()
+		pending := len(clock.timers)
+		clock.mx.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d timers to be pending", n)
+}
+
+func (timer *fakeTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.mx.Lock()
+	defer timer.clock.mx.Unlock()
+	_, pending := timer.clock.timers[timer]
+	delete(timer.clock.timers, timer)
+	return pending
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (ticker fakeTicker) Stop() {
+	ticker.fakeTimer.Stop()
+}
+
+// pipeDialer connects to a handler over net.Pipe rather than the network, recording every address dialed
+type pipeDialer struct {
+	handle func(conn net.Conn)
+	mx     sync.Mutex
+	dialed []string
+}
+
+func (dialer *pipeDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer.mx.Lock()
+	dialer.dialed = append(dialer.dialed, address)
+	dialer.mx.Unlock()
+	client, server := net.Pipe()
+	go dialer.handle(server)
+	return client, nil
+}
+
+func TestRateLimiterSimulatedTime(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newRateLimiter(1000, clock)
+	limiter.wait(1000) // the first second's worth is a burst
+
+	done := make(chan struct{})
+	go func() {
+		limiter.wait(200)
+		close(done)
+	}()
+	clock.waitForTimers(t, 1)
+
+	clock.advance(100 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Expected the limiter to wait 200ms")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.advance(100 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the limiter to stop waiting after 200ms")
+	}
+}
+
+func TestReannounceSimulatedTime(t *testing.T) {
+	var announces atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces.Add(1)
+		bencode.Marshal(w, map[string]interface{}{"interval": 1800, "complete": 0, "peers": ""})
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	link, _ := url.Parse(server.URL + "/announce")
+	tracker := NewTracker(*link)
+	torrent := NewTorrent(&Magnet{Trackers: []*Tracker{tracker}, InfoHash: bytes.Repeat([]byte{0xab}, 20)}, 10)
+	torrent.clock = clock
+	defer torrent.cancel()
+	tracker.nextAnnounce = clock.Now().Add(30 * time.Minute)
+
+	go tracker.reannounce(torrent)
+	start := clock.Now()
+	testCases := []struct {
+		advance   time.Duration
+		announces int32
+	}{
+		{advance: 29 * time.Minute, announces: 0},
+		{advance: time.Minute, announces: 1},
+		{advance: 29 * time.Minute, announces: 1},
+		{advance: time.Minute, announces: 2}, // the tracker asked for 30 minutes
+	}
+	for _, tc := range testCases {
+		clock.waitForTimers(t, 1)
+		clock.advance(tc.advance)
+		if tc.announces > 0 {
+			deadline := time.Now().Add(5 * time.Second)
+			for announces.Load() < tc.announces && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if got := announces.Load(); got != tc.announces {
+			t.Fatalf("Expected %d announces after %s, got %d", tc.announces, clock.Now().Sub(start), got)
+		}
+	}
+	if info := torrent.Trackers(); len(info) != 1 || !info[0].LastAnnounce.Equal(clock.Now()) {
+		t.Errorf("Expected the last announce to be at the simulated time, got %v", info)
+	}
+}
+
+func TestPeerConnectUsesDialer(t *testing.T) {
+	torrent := NewTorrent(&Magnet{InfoHash: bytes.Repeat([]byte{0xab}, 20)}, 10)
+	dialer := &pipeDialer{handle: func(conn net.Conn) { conn.Close() }}
+	torrent.dialer = dialer
+
+	peer := newPeer("192.0.2.1", "6881", torrent.infoHash, torrent)
+	if err := peer.connect(context.Background()); err != nil {
+		t.Fatalf("Expected the pipe to connect, got %v", err)
+	}
+	if len(dialer.dialed) != 1 || dialer.dialed[0] != "192.0.2.1:6881" {
+		t.Errorf("Expected 192.0.2.1:6881 to be dialed, got %v", dialer.dialed)
+	}
+}
@@ -0,0 +1,262 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"gotorrent/utils"
+	"net"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/rs/zerolog/log"
+)
+
+// Types of ut_metadata (BEP 9) message
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+const (
+	maxMetadataSize         = 16 << 20 // far bigger than any real info dictionary, a peer claiming more isn't asked for it
+	metadataRequestsPerPeer = 2        // pieces of the metadata we wait on from a peer at once, the rest go to other peers
+	metadataRequestTimeout  = 10 * time.Second
+	metadataPeerBackoff     = 5 * time.Second // that we leave a peer be after they reject or ignore a request
+	metadataRetryInterval   = time.Second
+	maxMetadataStrikes      = 2 // failed hash checks a peer can have sent pieces towards before we distrust them
+)
+
+// pendingMetadataPiece is a piece of the metadata that we asked a peer for
+type pendingMetadataPiece struct {
+	peer *Peer
+	at   time.Time // when we asked, or when it failed the hash check
+}
+
+// metadataRequestRate is how many metadata pieces a second we send each peer, in bursts of up to as many. Requests
+// beyond that are rejected, otherwise a peer could have us send the info dictionary over and over
+const metadataRequestRate = 16
+
+// serveMetadata answers a peer's request for a piece of the info dictionary, with the piece if we have the metadata
+// and they haven't asked for too much of it lately, otherwise with a reject
+func (peer *Peer) serveMetadata(index int) {
+	id, ok := peer.extensions["ut_metadata"]
+	if !ok {
+		// they didn't tell us how to answer
+		return
+	}
+
+	torrent := peer.torrent
+	var b bytes.Buffer
+	var piece []byte
+	if torrent.hasMetadata.Load() && index >= 0 && index < torrent.numMetadataPieces() && peer.metadataLimiter.take(1) {
+		piece = torrent.metadataRaw[index*BlockLen : min((index+1)*BlockLen, len(torrent.metadataRaw))]
+		bencode.Marshal(&b, MetadataResponse{metadataData, index, len(torrent.metadataRaw)})
+	} else {
+		bencode.Marshal(&b, MetadataRequest{metadataReject, index})
+	}
+	peer.pw.writeExtended(ExtendedMessage{0, Extended, uint8(id), append(b.Bytes(), piece...)})
+}
+
+// setMetadataSize remembers the metadata_size from their extended handshake, as long as it's within reason
+func (peer *Peer) setMetadataSize(size int) {
+	torrent := peer.torrent
+	torrent.metadataFetchMx.Lock()
+	defer torrent.metadataFetchMx.Unlock()
+	if size < 0 || size > maxMetadataSize {
+		size = 0
+	}
+	peer.metadataSize = size
+}
+
+// requestMetadata asks a peer for pieces of the metadata that nobody else has been asked for
+func (peer *Peer) requestMetadata() {
+	if !peer.supportsMetadataRequests() || peer.pw == nil {
+		return
+	}
+	for _, index := range peer.torrent.assignMetadataPieces(peer) {
+		payload := encodeMetadataRequest(index)
+		// marshall will ensure the length_prefix is set, we don't need to specify it here
+		peer.pw.writeExtended(ExtendedMessage{0, Extended, uint8(peer.extensions["ut_metadata"]), []byte(payload)})
+	}
+}
+
+// requestMetadataFromPeers gives the pieces of metadata nobody is sending us to whoever can take them
+func (torrent *Torrent) requestMetadataFromPeers() {
+	torrent.peersMx.Lock()
+	defer torrent.peersMx.Unlock()
+	for _, peer := range torrent.peers {
+		if peer.status.Load() == Alive && peer.pw != nil {
+			go peer.requestMetadata()
+		}
+	}
+}
+
+// assignMetadataPieces picks up to metadataRequestsPerPeer pieces of the metadata for peer to send us, skipping
+// any they sent last time if it failed the hash check recently. The first peer we ask settles the metadata's size,
+// after that only peers that agree with it are asked
+func (torrent *Torrent) assignMetadataPieces(peer *Peer) []int {
+	torrent.metadataFetchMx.Lock()
+	defer torrent.metadataFetchMx.Unlock()
+	now := torrent.clock.Now()
+	if torrent.hasMetadata.Load() || peer.distrusted || peer.metadataSize == 0 || now.Before(peer.metadataBackoff) {
+		return nil
+	}
+	if torrent.metadataSize == 0 {
+		torrent.metadataSize = peer.metadataSize
+		torrent.metadataRaw = make([]byte, peer.metadataSize)
+		torrent.metadataPieces = make([]byte, (torrent.numMetadataPieces()+7)/8)
+		torrent.metadataPending = make(map[int]pendingMetadataPiece)
+		torrent.metadataSources = make(map[int]*Peer)
+		torrent.metadataSizeFrom = peer
+	}
+	if peer.metadataSize != torrent.metadataSize {
+		return nil
+	}
+
+	var pieces []int
+	for i := 0; i < torrent.numMetadataPieces() && peer.metadataRequests < metadataRequestsPerPeer; i++ {
+		if isSet, _ := utils.BitIsSet(torrent.metadataPieces, i); isSet {
+			continue
+		}
+		if _, ok := torrent.metadataPending[i]; ok {
+			continue
+		}
+		if avoid, ok := torrent.metadataAvoid[i]; ok && avoid.peer == peer && now.Sub(avoid.at) < metadataRequestTimeout {
+			continue
+		}
+		torrent.metadataPending[i] = pendingMetadataPiece{peer, now}
+		peer.metadataRequests++
+		pieces = append(pieces, i)
+	}
+	return pieces
+}
+
+// finishMetadataRequest forgets that we asked peer for a piece, the caller holds metadataFetchMx
+func (torrent *Torrent) finishMetadataRequest(peer *Peer, index int) {
+	if pending, ok := torrent.metadataPending[index]; ok && pending.peer == peer {
+		delete(torrent.metadataPending, index)
+		peer.metadataRequests--
+	}
+}
+
+// metadataRejected handles a peer rejecting our request for a piece of the metadata. It goes to someone else, and
+// they're left be for a while in case they're just limiting how much they send
+func (peer *Peer) metadataRejected(index int) {
+	torrent := peer.torrent
+	torrent.metadataFetchMx.Lock()
+	torrent.finishMetadataRequest(peer, index)
+	peer.metadataBackoff = torrent.clock.Now().Add(metadataPeerBackoff)
+	torrent.metadataFetchMx.Unlock()
+	torrent.requestMetadataFromPeers()
+}
+
+// expireMetadataRequests gives up on pieces of the metadata that peers haven't sent in time, so that someone else
+// can be asked for them
+func (torrent *Torrent) expireMetadataRequests() {
+	torrent.metadataFetchMx.Lock()
+	defer torrent.metadataFetchMx.Unlock()
+	now := torrent.clock.Now()
+	for index, pending := range torrent.metadataPending {
+		if now.Sub(pending.at) >= metadataRequestTimeout {
+			torrent.finishMetadataRequest(pending.peer, index)
+			pending.peer.metadataBackoff = now.Add(metadataPeerBackoff)
+		}
+	}
+}
+
+// releaseMetadataRequests forgets the pieces of metadata we were waiting on from a peer that has disconnected
+func (torrent *Torrent) releaseMetadataRequests(peer *Peer) {
+	torrent.metadataFetchMx.Lock()
+	defer torrent.metadataFetchMx.Unlock()
+	for index := range torrent.metadataPending {
+		torrent.finishMetadataRequest(peer, index)
+	}
+}
+
+// receiveMetadataPiece stores a piece of the metadata, and once we have all of it checks it against the info hash
+// before using it
+func (torrent *Torrent) receiveMetadataPiece(piece MetadataPiece) {
+	if !torrent.storeMetadataPiece(piece) {
+		return
+	}
+	err := torrent.setMetadata(torrent.metadataRaw)
+	if err != nil {
+		// it matched the info hash, so asking again would only get us the same
+		log.Error().Err(err).Msg("Could not parse metadata")
+		// set before stopping, which is what StartDownload and Wait wait on
+		torrent.metadataErr = fmt.Errorf("%w: %s", ErrBadMetadata, err)
+		torrent.emit(Event{Type: EventMetadataFailed, Err: torrent.metadataErr})
+		torrent.stop()
+	}
+}
+
+// storeMetadataPiece stores a piece of the metadata that's the right size and that we don't already have, returning
+// whether that completed metadata which passed the hash check
+func (torrent *Torrent) storeMetadataPiece(piece MetadataPiece) bool {
+	torrent.metadataFetchMx.Lock()
+	defer torrent.metadataFetchMx.Unlock()
+	index := piece.pieceIndex
+	torrent.finishMetadataRequest(piece.peer, index)
+	if torrent.hasMetadata.Load() || torrent.metadataSize == 0 || index < 0 || index >= torrent.numMetadataPieces() {
+		return false
+	}
+	if isSet, _ := utils.BitIsSet(torrent.metadataPieces, index); isSet {
+		return false
+	}
+	// every piece is a whole block bar the last
+	if piece.totalSize != torrent.metadataSize || len(piece.data) != min(BlockLen, torrent.metadataSize-index*BlockLen) {
+		return false
+	}
+	copy(torrent.metadataRaw[index*BlockLen:], piece.data)
+	utils.SetBit(&torrent.metadataPieces, index)
+	torrent.metadataSources[index] = piece.peer
+
+	if !torrent.hasAllMetadata() {
+		return false
+	}
+	// check the infohash we know the torrent by
+	if torrent.verifyMetadata(torrent.metadataRaw) {
+		return true
+	}
+	log.Info().Msg("Metadata failed infohash check, retrying")
+	torrent.blameMetadataSources()
+	return false
+}
+
+// blameMetadataSources is called when the metadata fails the hash check, and starts fetching it again. A peer that
+// sent all of it certainly sent something bad, otherwise each peer that sent some of it gets a strike, and is no
+// longer trusted after maxMetadataStrikes. Each piece goes to someone other than its last sender if possible. The
+// caller holds metadataFetchMx
+func (torrent *Torrent) blameMetadataSources() {
+	sources := make(map[*Peer]bool)
+	for _, peer := range torrent.metadataSources {
+		sources[peer] = true
+	}
+	for peer := range sources {
+		peer.metadataStrikes++
+		if len(sources) == 1 || peer.metadataStrikes >= maxMetadataStrikes {
+			peer.distrusted = true
+			log.Info().Str("peer", net.JoinHostPort(peer.ip, peer.port)).Msg("Not trusting peer with metadata after it failed the hash check")
+		}
+	}
+
+	now := torrent.clock.Now()
+	torrent.metadataAvoid = make(map[int]pendingMetadataPiece)
+	for index, peer := range torrent.metadataSources {
+		torrent.metadataAvoid[index] = pendingMetadataPiece{peer, now}
+		utils.UnsetBit(&torrent.metadataPieces, index)
+	}
+	torrent.metadataSources = make(map[int]*Peer)
+
+	// the size may have been a lie too, in which case it's settled again by the next peer we ask
+	if torrent.metadataSizeFrom.distrusted {
+		for index, pending := range torrent.metadataPending {
+			torrent.finishMetadataRequest(pending.peer, index)
+		}
+		torrent.metadataSize = 0
+		torrent.metadataRaw = nil
+		torrent.metadataPieces = nil
+		torrent.metadataSizeFrom = nil
+	}
+}
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// startSeed seeds newSeedData from a session listening on loopback, returning the port it listens on
+func startSeed(t *testing.T, dir string, mi *MetaInfo) int {
+	t.Helper()
+	_, portString, _ := net.SplitHostPort(unusedAddress(t))
+	port, _ := strconv.Atoi(portString)
+	session, err := NewSession(SessionConfig{ListenPort: port, DownloadDir: dir, Seed: true, DisableUTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	seed, err := session.AddMetaInfo(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go seed.StartDownload(context.Background())
+	for seed.state() != StateSeeding {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return port
+}
+
+func TestServeMetadata(t *testing.T) {
+	seedDir := t.TempDir()
+	mi := newSeedData(t, seedDir)
+	port := startSeed(t, seedDir, mi)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	infoHash := sha1.Sum(mi.InfoBytes)
+	handshake := getHandshakeMessage(infoHash[:], bytes.Repeat([]byte{1}, 20))
+	handshake[27] = 0 // just the extension protocol
+	conn.Write(handshake)
+	conn.Write(getExtendedHandshakeMessage(map[string]int{"ut_metadata": 3}, 0))
+
+	r := bufio.NewReader(conn)
+	if _, _, err := readHandshake(r); err != nil {
+		t.Fatal(err)
+	}
+	// the requests are sent up front so that they arrive together, more than the seed will answer at once
+	const requests = metadataRequestRate + 4
+	for i := 0; i < requests; i++ {
+		conn.Write((&ExtendedMessage{0, Extended, utMetadataID, []byte(encodeMetadataRequest(0))}).marshall())
+	}
+	conn.Write((&ExtendedMessage{0, Extended, utMetadataID, []byte(encodeMetadataRequest(1))}).marshall())
+
+	var data, rejects int
+	for answered := 0; answered < requests+1; {
+		message, err := readMessage(r, 0)
+		if err != nil {
+			t.Fatalf("Expected every request to be answered, got %v after %d", err, answered)
+		}
+		if message.id != Extended {
+			continue
+		}
+		extended := message.extended()
+		if extended.extendedID == 0 {
+			result, err := decodeHandshake(extended.payload)
+			if err != nil || result.MetadataSize != len(mi.InfoBytes) {
+				t.Errorf("Expected a metadata_size of %d, got %+v %v", len(mi.InfoBytes), result, err)
+			}
+			continue
+		}
+		if extended.extendedID != 3 {
+			t.Fatalf("Expected the answer on our ut_metadata id, got %d", extended.extendedID)
+		}
+		dict, piece, err := splitExtended(extended.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, _ := decodeMetadataRequest(dict)
+		answered++
+		switch {
+		case response.MsgType == metadataData && response.Piece == 0:
+			data++
+			if response.TotalSize != len(mi.InfoBytes) || !bytes.Equal(piece, mi.InfoBytes) {
+				t.Errorf("Expected the info dictionary, got total size %d and %d bytes", response.TotalSize, len(piece))
+			}
+		case response.MsgType == metadataReject:
+			rejects++
+		default:
+			t.Errorf("Unexpected answer %+v", response)
+		}
+	}
+	// the piece that doesn't exist is always rejected, a moment's refill may let one more request through
+	if data < metadataRequestRate || data > metadataRequestRate+1 || data+rejects != requests+1 {
+		t.Errorf("Expected %d pieces to be sent and the rest rejected, got %d and %d rejects", metadataRequestRate, data, rejects)
+	}
+}
+
+func TestMagnetFromSeed(t *testing.T) {
+	seedDir := t.TempDir()
+	mi := newSeedData(t, seedDir)
+	port := startSeed(t, seedDir, mi)
+
+	leechDir := t.TempDir()
+	session, err := NewSession(SessionConfig{ListenPort: -1, DownloadDir: leechDir, DisableUTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	infoHash := sha1.Sum(mi.InfoBytes)
+	leecher, err := session.AddMagnet(&Magnet{InfoHash: infoHash[:], PeerAddresses: []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go leecher.StartDownload(ctx)
+	if err := leecher.Wait(ctx); err != nil {
+		t.Fatalf("Expected the metadata and then the data to come from the seed, got %v", err)
+	}
+	expected, _ := os.ReadFile(filepath.Join(seedDir, "data", "first"))
+	actual, err := os.ReadFile(filepath.Join(leechDir, "data", "first"))
+	if err != nil || !bytes.Equal(actual, expected) {
+		t.Errorf("Expected the data to match the seed's copy, got error %v", err)
+	}
+}
+
+// newFetchingTorrent returns a torrent from a magnet link for an info dictionary that takes three pieces to send,
+// along with the dictionary
+func newFetchingTorrent(t *testing.T) (*Torrent, []byte, *fakeClock) {
+	t.Helper()
+	md := Metadata{Name: "fetched", PieceLen: BlockLen, Length: 2000 * BlockLen, Pieces: strings.Repeat("01234567890123456789", 2000)}
+	var info bytes.Buffer
+	bencode.Marshal(&info, md)
+	if n := (info.Len() + BlockLen - 1) / BlockLen; n != 3 {
+		t.Fatalf("Expected the metadata to take 3 pieces, got %d", n)
+	}
+	infoHash := sha1.Sum(info.Bytes())
+	torrent := NewTorrent(&Magnet{InfoHash: infoHash[:]}, 10)
+	torrent.downloadDir = t.TempDir()
+	clock := newFakeClock()
+	torrent.clock = clock
+	return torrent, info.Bytes(), clock
+}
+
+// newMetadataPeer returns a peer that says the metadata is size bytes
+func newMetadataPeer(torrent *Torrent, ip string, size int) *Peer {
+	peer := newPeer(ip, "6881", torrent.infoHash, torrent)
+	peer.setMetadataSize(size)
+	return peer
+}
+
+// metadataPiece returns piece index of info as peer would send it
+func metadataPiece(info []byte, index int, peer *Peer) MetadataPiece {
+	return MetadataPiece{index, info[index*BlockLen : min((index+1)*BlockLen, len(info))], len(info), peer}
+}
+
+func TestMetadataFetch(t *testing.T) {
+	torrent, info, clock := newFetchingTorrent(t)
+	a := newMetadataPeer(torrent, "10.0.0.1", len(info))
+	b := newMetadataPeer(torrent, "10.0.0.2", len(info))
+	c := newMetadataPeer(torrent, "10.0.0.3", len(info))
+	huge := newMetadataPeer(torrent, "10.0.0.4", maxMetadataSize+1)
+
+	expectAssigned := func(peer *Peer, expected []int) {
+		t.Helper()
+		if got := torrent.assignMetadataPieces(peer); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %s to be asked for %v, got %v", peer.ip, expected, got)
+		}
+	}
+
+	// different pieces from several peers at once
+	expectAssigned(a, []int{0, 1})
+	expectAssigned(b, []int{2})
+	expectAssigned(c, nil)
+	expectAssigned(huge, nil)
+
+	// a reject goes to someone else, and the peer is left be for a while
+	a.metadataRejected(1)
+	expectAssigned(a, nil)
+	clock.advance(metadataPeerBackoff)
+	expectAssigned(c, []int{1})
+
+	// as is a request that isn't answered in time
+	clock.advance(metadataRequestTimeout - metadataPeerBackoff)
+	torrent.expireMetadataRequests()
+	expectAssigned(c, []int{0})
+	expectAssigned(a, nil)
+	expectAssigned(b, nil)
+	clock.advance(metadataPeerBackoff)
+	expectAssigned(a, []int{2})
+
+	// a piece that's the wrong size is dropped
+	bad := metadataPiece(info, 0, c)
+	bad.totalSize++
+	torrent.receiveMetadataPiece(bad)
+	expectAssigned(c, []int{0})
+
+	// which fails the hash check with pieces from c and a, who are asked for each other's pieces next time
+	corrupt := metadataPiece(info, 0, c)
+	corrupt.data = bytes.Repeat([]byte{'x'}, BlockLen)
+	torrent.receiveMetadataPiece(corrupt)
+	torrent.receiveMetadataPiece(metadataPiece(info, 1, c))
+	torrent.receiveMetadataPiece(metadataPiece(info, 2, a))
+	if torrent.hasMetadata.Load() || a.distrusted || c.distrusted {
+		t.Fatalf("Expected the metadata to fail the hash check without singling anyone out")
+	}
+	expectAssigned(a, []int{0, 1})
+	expectAssigned(c, []int{2})
+
+	torrent.receiveMetadataPiece(metadataPiece(info, 0, a))
+	torrent.receiveMetadataPiece(metadataPiece(info, 1, a))
+	torrent.receiveMetadataPiece(metadataPiece(info, 2, c))
+	if !torrent.hasMetadata.Load() || torrent.metadata.Name != "fetched" {
+		t.Fatalf("Expected the metadata to be set once it passed the hash check")
+	}
+	expectAssigned(b, nil)
+}
+
+func TestMetadataFetchDistrust(t *testing.T) {
+	torrent, info, _ := newFetchingTorrent(t)
+	// the first peer we ask settles the size, which is a lie
+	liar := newMetadataPeer(torrent, "10.0.0.1", 100)
+	honest := newMetadataPeer(torrent, "10.0.0.2", len(info))
+	if pieces := torrent.assignMetadataPieces(liar); !reflect.DeepEqual(pieces, []int{0}) {
+		t.Fatalf("Expected the liar to be asked for the only piece, got %v", pieces)
+	}
+	if pieces := torrent.assignMetadataPieces(honest); pieces != nil {
+		t.Fatalf("Expected a peer that disagrees on the size not to be asked, got %v", pieces)
+	}
+
+	torrent.receiveMetadataPiece(MetadataPiece{0, bytes.Repeat([]byte{'x'}, 100), 100, liar})
+	if !liar.distrusted || honest.distrusted {
+		t.Fatalf("Expected only the peer that sent all of the bad metadata to be distrusted")
+	}
+	if pieces := torrent.assignMetadataPieces(liar); pieces != nil {
+		t.Errorf("Expected the liar not to be asked again, got %v", pieces)
+	}
+	// the size is settled again
+	if pieces := torrent.assignMetadataPieces(honest); !reflect.DeepEqual(pieces, []int{0, 1}) {
+		t.Fatalf("Expected the honest peer to be asked instead, got %v", pieces)
+	}
+	torrent.receiveMetadataPiece(metadataPiece(info, 0, honest))
+	torrent.receiveMetadataPiece(metadataPiece(info, 1, honest))
+	torrent.assignMetadataPieces(honest)
+	torrent.receiveMetadataPiece(metadataPiece(info, 2, honest))
+	if !torrent.hasMetadata.Load() {
+		t.Errorf("Expected the metadata from the honest peer to be set")
+	}
+}
+
+// malformedInfo bencodes md, which matches the info hash it's given but describes pieces that can't be laid out
+func malformedInfo(md Metadata) []byte {
+	var b bytes.Buffer
+	bencode.Marshal(&b, md)
+	return b.Bytes()
+}
+
+func TestMetadataUnparseable(t *testing.T) {
+	hashes := func(n int) string { return strings.Repeat("h", 20*n) }
+	testCases := []struct {
+		name string
+		info []byte
+	}{
+		{name: "not a dictionary", info: []byte("i1e")},
+		{name: "zero piece length", info: malformedInfo(Metadata{Name: "x", Length: 10, Pieces: hashes(1)})},
+		{name: "negative piece length", info: malformedInfo(Metadata{Name: "x", PieceLen: -BlockLen, Length: 10, Pieces: hashes(1)})},
+		{name: "huge piece length", info: malformedInfo(Metadata{Name: "x", PieceLen: 1 << 40, Length: 10, Pieces: hashes(1)})},
+		{name: "no data", info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen})},
+		{name: "negative length", info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Length: -1, Pieces: hashes(1)})},
+		{name: "too few hashes", info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Length: 3 * BlockLen, Pieces: hashes(2)})},
+		{name: "too many hashes", info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Length: 3 * BlockLen, Pieces: hashes(4)})},
+		{name: "partial hash", info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Length: 10, Pieces: hashes(1) + "h"})},
+		{
+			name: "negative file length",
+			info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Pieces: hashes(1), Files: []MetadataFile{
+				{Length: BlockLen, Path: []string{"a"}}, {Length: -10, Path: []string{"b"}},
+			}}),
+		},
+		{
+			name: "file lengths overflow",
+			info: malformedInfo(Metadata{Name: "x", PieceLen: BlockLen, Pieces: hashes(1), Files: []MetadataFile{
+				{Length: math.MaxInt, Path: []string{"a"}}, {Length: math.MaxInt, Path: []string{"b"}},
+			}}),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// matches its info hash, but can't be used
+			infoHash := sha1.Sum(tc.info)
+			torrent := NewTorrent(&Magnet{InfoHash: infoHash[:]}, 10)
+			torrent.downloadDir = t.TempDir()
+			sub := torrent.Subscribe()
+			defer sub.Close()
+			peer := newMetadataPeer(torrent, "10.0.0.1", len(tc.info))
+			if pieces := torrent.assignMetadataPieces(peer); !reflect.DeepEqual(pieces, []int{0}) {
+				t.Fatalf("Expected the peer to be asked for the only piece, got %v", pieces)
+			}
+
+			torrent.receiveMetadataPiece(MetadataPiece{0, tc.info, len(tc.info), peer})
+			if torrent.hasMetadata.Load() || torrent.ctx.Err() == nil {
+				t.Fatalf("Expected the torrent to stop without metadata")
+			}
+			select {
+			case ev := <-sub.Events():
+				if ev.Type != EventMetadataFailed || !errors.Is(ev.Err, ErrBadMetadata) {
+					t.Errorf("Expected a metadata failed event, got %s %v", EventName(ev.Type), ev.Err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected a metadata failed event")
+			}
+			if err := torrent.Wait(context.Background()); !errors.Is(err, ErrBadMetadata) {
+				t.Errorf("Expected Wait to return %v, got %v", ErrBadMetadata, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,842 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP (BEP 29) packet types
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2 // just an ack
+	utpReset = 3
+	utpSyn   = 4
+
+	utpSelectiveAck = 1 // extension with a bitmask of the packets that arrived after a lost one
+)
+
+const (
+	utpVersion    = 1
+	utpHeaderLen  = 20
+	utpMaxPayload = 1200 // small enough to get through most tunnels without fragmenting
+
+	utpInitialRTO     = time.Second
+	utpMinRTO         = 500 * time.Millisecond
+	utpMaxRTO         = 8 * time.Second
+	utpMaxRetransmits = 8 // of the same packet before giving up on the connection
+	utpSynRetransmits = 2
+	utpTick           = 50 * time.Millisecond // how often retransmit timeouts are checked
+
+	// LEDBAT congestion control, which backs off as soon as our packets start queueing anywhere so that other
+	// traffic on the link doesn't suffer
+	utpTargetDelay  = 100 * time.Millisecond
+	utpBaseDelayAge = 2 * time.Minute // how long the lowest delay seen is trusted for
+	utpMinWindow    = utpMaxPayload
+	utpMaxWindow    = 1 << 20
+	utpRecvWindow   = 1 << 20 // how much we buffer before the reader catches up
+
+	utpMaxOutOfOrder = 4096                   // packets buffered while waiting for one that was lost
+	utpHeadStart     = 300 * time.Millisecond // that connecting over uTP gets before we try TCP too, as Go gives IPv6 over IPv4
+)
+
+var (
+	errUTPTimeout = os.ErrDeadlineExceeded
+	errUTPReset   = errors.New("utp connection reset by peer")
+	errUTPGaveUp  = errors.New("utp peer stopped acknowledging packets")
+)
+
+// utpPacket is a uTP header and its payload
+type utpPacket struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32 // microseconds
+	timestampDiff uint32 // between the sender receiving our last packet and it being sent, in microseconds
+	wnd           uint32 // bytes the sender will still buffer
+	seq           uint16
+	ack           uint16
+	sack          []byte // bit i is set if packet ack+2+i has arrived, nil if none are missing
+	payload       []byte
+}
+
+func (p *utpPacket) marshall() []byte {
+	packet := make([]byte, utpHeaderLen, utpHeaderLen+2+len(p.sack)+len(p.payload))
+	packet[0] = p.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(packet[2:], p.connID)
+	binary.BigEndian.PutUint32(packet[4:], p.timestamp)
+	binary.BigEndian.PutUint32(packet[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(packet[12:], p.wnd)
+	binary.BigEndian.PutUint16(packet[16:], p.seq)
+	binary.BigEndian.PutUint16(packet[18:], p.ack)
+	if p.sack != nil {
+		packet[1] = utpSelectiveAck
+		packet = append(packet, 0, uint8(len(p.sack)))
+		packet = append(packet, p.sack...)
+	}
+	return append(packet, p.payload...)
+}
+
+// parseUTPPacket parses a packet, skipping any extensions other than selective acks
+func parseUTPPacket(b []byte) (*utpPacket, error) {
+	if len(b) < utpHeaderLen || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return nil, errors.New("not a utp packet")
+	}
+	p := utpPacket{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:]),
+		timestamp:     binary.BigEndian.Uint32(b[4:]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:           binary.BigEndian.Uint32(b[12:]),
+		seq:           binary.BigEndian.Uint16(b[16:]),
+		ack:           binary.BigEndian.Uint16(b[18:]),
+	}
+	i := utpHeaderLen
+	for extension := b[1]; extension != 0; {
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return nil, errors.New("truncated utp extension")
+		}
+		length := int(b[i+1])
+		if extension == utpSelectiveAck {
+			p.sack = b[i+2 : i+2+length]
+		}
+		extension = b[i]
+		i += 2 + length
+	}
+	p.payload = b[i:]
+	return &p, nil
+}
+
+// seqBefore compares sequence numbers, which wrap around
+func seqBefore(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// isUTP returns whether conn is a uTP connection, encrypted or not
+func isUTP(conn net.Conn) bool {
+	if mc, ok := conn.(*mseConn); ok {
+		conn = mc.Conn
+	}
+	_, ok := conn.(*utpConn)
+	return ok
+}
+
+type utpKey struct {
+	addr   string
+	connID uint16 // what the peer sends to us with
+}
+
+// utpSocket runs uTP connections, both ours and peers', over one UDP socket. It's a net.Listener for the
+// connections peers make to us
+type utpSocket struct {
+	conn  net.PacketConn
+	clock Clock
+
+	mx       sync.Mutex
+	conns    map[utpKey]*utpConn
+	acceptCh chan *utpConn // nil if we don't accept connections
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// newUTPSocket runs uTP over conn, accepting connections from peers if accept is set
+func newUTPSocket(conn net.PacketConn, clock Clock, accept bool) *utpSocket {
+	socket := &utpSocket{conn: conn, clock: clock, conns: make(map[utpKey]*utpConn), closed: make(chan struct{})}
+	if accept {
+		socket.acceptCh = make(chan *utpConn, 16)
+	}
+	socket.wg.Add(2)
+	go socket.readLoop()
+	go socket.tickLoop()
+	return socket
+}
+
+// Accept returns the next connection a peer made to us
+func (socket *utpSocket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.acceptCh:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (socket *utpSocket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+// Close resets every connection and closes the UDP socket
+func (socket *utpSocket) Close() error {
+	var err error
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+		socket.mx.Lock()
+		conns := make([]*utpConn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mx.Unlock()
+		for _, conn := range conns {
+			conn.send(utpReset, nil)
+			conn.fail(net.ErrClosed)
+		}
+		err = socket.conn.Close()
+		socket.wg.Wait()
+	})
+	return err
+}
+
+// DialContext connects to a peer at address over uTP
+func (socket *utpSocket) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	socket.mx.Lock()
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Intn(1 << 16))
+		if _, ok := socket.conns[utpKey{addr.String(), recvID}]; !ok {
+			break
+		}
+	}
+	conn := newUTPConn(socket, addr, recvID, recvID+1, 1)
+	conn.connected = make(chan struct{})
+	socket.conns[utpKey{addr.String(), recvID}] = conn
+	socket.mx.Unlock()
+
+	// the syn goes out with the id we receive on, everything after with the one we send on
+	conn.mx.Lock()
+	conn.queue(utpSyn, nil, recvID)
+	conn.mx.Unlock()
+
+	select {
+	case <-conn.connected:
+		return conn, nil
+	case <-conn.done:
+		return nil, conn.err
+	case <-ctx.Done():
+		conn.fail(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+func (socket *utpSocket) readLoop() {
+	defer socket.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := socket.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-socket.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		p, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// the payload is kept by the connection, buf gets reused
+		p.payload = bytes.Clone(p.payload)
+		p.sack = bytes.Clone(p.sack)
+
+		socket.mx.Lock()
+		conn := socket.conns[utpKey{addr.String(), p.connID}]
+		if conn == nil && p.typ == utpSyn {
+			conn = socket.accept(addr, p)
+		}
+		socket.mx.Unlock()
+
+		switch {
+		case conn != nil:
+			conn.handle(p)
+		case p.typ != utpReset && p.typ != utpSyn:
+			// a connection we've forgotten about
+			reset := utpPacket{typ: utpReset, connID: p.connID, seq: uint16(rand.Intn(1 << 16)), ack: p.seq}
+			socket.conn.WriteTo(reset.marshall(), addr)
+		}
+	}
+}
+
+// accept sets up a connection for a peer's syn, or returns nil if we aren't accepting any. Called with mx held
+func (socket *utpSocket) accept(addr net.Addr, syn *utpPacket) *utpConn {
+	if socket.acceptCh == nil {
+		return nil
+	}
+	// their syn has the id we'll send with, they'll send to us with the one after
+	key := utpKey{addr.String(), syn.connID + 1}
+	if conn, ok := socket.conns[key]; ok {
+		// they sent it again, so our ack must have been lost
+		return conn
+	}
+	conn := newUTPConn(socket, addr, syn.connID+1, syn.connID, uint16(rand.Intn(1<<16)))
+	conn.ack = syn.seq
+	select {
+	case socket.acceptCh <- conn:
+	default:
+		// nobody is keeping up with accepting, they'll try again
+		return nil
+	}
+	socket.conns[key] = conn
+	// the syn itself is acked by handle, as a duplicate
+	return conn
+}
+
+func (socket *utpSocket) remove(conn *utpConn) {
+	socket.mx.Lock()
+	defer socket.mx.Unlock()
+	key := utpKey{conn.remote.String(), conn.recvID}
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+}
+
+// tickLoop retransmits whatever has timed out
+func (socket *utpSocket) tickLoop() {
+	defer socket.wg.Done()
+	ticker := socket.clock.NewTicker(utpTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-socket.closed:
+			return
+		}
+		socket.mx.Lock()
+		conns := make([]*utpConn, 0, len(socket.conns))
+		for _, conn := range socket.conns {
+			conns = append(conns, conn)
+		}
+		socket.mx.Unlock()
+		for _, conn := range conns {
+			conn.checkTimeout()
+		}
+	}
+}
+
+// utpOutgoing is a packet that hasn't been acked yet
+type utpOutgoing struct {
+	packet        *utpPacket
+	sentAt        time.Time
+	transmissions int
+	sacked        bool // selectively acked, so it won't be sent again but can't be forgotten until it's acked
+}
+
+// utpConn is a uTP connection, which reliably delivers a stream of bytes like TCP
+type utpConn struct {
+	socket *utpSocket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mx        sync.Mutex
+	changed   chan struct{} // closed and replaced whenever anything a reader or writer waits on changes
+	connected chan struct{} // closed once our syn is acked, nil for connections peers made
+	done      chan struct{} // closed once the connection has failed or finished
+	err       error         // why done was closed
+
+	seq      uint16 // of the next packet we send
+	firstSeq uint16
+	ack      uint16 // the last packet we received in order
+	unacked  []*utpOutgoing
+	inflight int // payload bytes sent but not acked
+	dupAcks  int
+	backoff  int // how many times the retransmit timeout has doubled since we last heard from them
+	lossAt   time.Time
+	resentAt time.Time // when we last retransmitted anything
+	closed   bool      // by us
+	finSeq   *uint16
+
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16]*utpPacket
+
+	// congestion control
+	window    float64 // how many bytes we allow in flight
+	peerWnd   int
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	baseDelay uint32 // lowest one-way delay seen, in microseconds
+	baseAt    time.Time
+	replyDiff uint32 // timestampDiff for our next packet
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUTPConn(socket *utpSocket, remote net.Addr, recvID uint16, sendID uint16, seq uint16) *utpConn {
+	return &utpConn{
+		socket:     socket,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		seq:        seq,
+		firstSeq:   seq,
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+		outOfOrder: make(map[uint16]*utpPacket),
+		window:     4 * utpMaxPayload,
+		peerWnd:    utpRecvWindow,
+		rto:        utpInitialRTO,
+	}
+}
+
+// broadcast wakes everyone waiting on the connection, must be called with mx held
+func (conn *utpConn) broadcast() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// fail ends the connection with err, unless it has already ended
+func (conn *utpConn) fail(err error) {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.finish(err)
+}
+
+// finish ends the connection with err and forgets about it, must be called with mx held
+func (conn *utpConn) finish(err error) {
+	select {
+	case <-conn.done:
+		return
+	default:
+	}
+	conn.err = err
+	close(conn.done)
+	conn.broadcast()
+	conn.socket.remove(conn)
+}
+
+// header fills in what every packet we send has in common, must be called with mx held
+func (conn *utpConn) header(typ uint8, seq uint16) *utpPacket {
+	return &utpPacket{
+		typ:           typ,
+		connID:        conn.sendID,
+		timestamp:     uint32(conn.socket.clock.Now().UnixMicro()),
+		timestampDiff: conn.replyDiff,
+		wnd:           uint32(max(utpRecvWindow-conn.readBuf.Len(), 0)),
+		seq:           seq,
+		ack:           conn.ack,
+	}
+}
+
+// send sends a packet that isn't retransmitted, a state or reset
+func (conn *utpConn) send(typ uint8, payload []byte) {
+	conn.mx.Lock()
+	p := conn.header(typ, conn.seq)
+	conn.mx.Unlock()
+	p.payload = payload
+	conn.socket.conn.WriteTo(p.marshall(), conn.remote)
+}
+
+// queue sends a packet which takes a sequence number and is retransmitted until it's acked, must be called with mx
+// held. connID is only given for a syn
+func (conn *utpConn) queue(typ uint8, payload []byte, connID ...uint16) {
+	p := conn.header(typ, conn.seq)
+	p.payload = payload
+	if len(connID) > 0 {
+		p.connID = connID[0]
+	}
+	conn.seq++
+	conn.unacked = append(conn.unacked, &utpOutgoing{packet: p, sentAt: conn.socket.clock.Now(), transmissions: 1})
+	conn.inflight += len(payload)
+	conn.socket.conn.WriteTo(p.marshall(), conn.remote)
+}
+
+// retransmit sends an unacked packet again with fresh timestamps and ack, must be called with mx held
+func (conn *utpConn) retransmit(out *utpOutgoing) {
+	p := conn.header(out.packet.typ, out.packet.seq)
+	p.connID = out.packet.connID
+	p.payload = out.packet.payload
+	out.packet = p
+	out.sentAt = conn.socket.clock.Now()
+	out.transmissions++
+	conn.resentAt = out.sentAt
+	conn.socket.conn.WriteTo(p.marshall(), conn.remote)
+}
+
+// handle processes a packet from the peer
+func (conn *utpConn) handle(p *utpPacket) {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	select {
+	case <-conn.done:
+		return
+	default:
+	}
+
+	now := conn.socket.clock.Now()
+	conn.replyDiff = uint32(now.UnixMicro()) - p.timestamp
+	conn.peerWnd = int(p.wnd)
+
+	if p.typ == utpReset {
+		conn.finish(errUTPReset)
+		return
+	}
+	if conn.connected != nil {
+		select {
+		case <-conn.connected:
+		default:
+			if p.typ == utpSyn || seqBefore(p.ack, conn.unacked[0].packet.seq) {
+				return
+			}
+			// their first packet tells us where their sequence starts
+			conn.ack = p.seq - 1
+			close(conn.connected)
+		}
+	}
+
+	conn.processAck(p, now)
+
+	switch p.typ {
+	case utpData, utpFin:
+		if p.typ == utpFin {
+			seq := p.seq
+			conn.finSeq = &seq
+		}
+		if seqBefore(conn.ack, p.seq) && len(conn.outOfOrder) < utpMaxOutOfOrder {
+			conn.outOfOrder[p.seq] = p
+		}
+		for {
+			next, ok := conn.outOfOrder[conn.ack+1]
+			if !ok {
+				break
+			}
+			delete(conn.outOfOrder, conn.ack+1)
+			conn.ack++
+			conn.readBuf.Write(next.payload)
+		}
+		conn.broadcast()
+		// acked straight away, including duplicates whose ack may have been lost
+		state := conn.header(utpState, conn.seq)
+		state.sack = conn.selectiveAck()
+		conn.socket.conn.WriteTo(state.marshall(), conn.remote)
+	case utpSyn:
+		// always with where our sequence starts, however much has been written since, as that's what they take
+		// from it
+		state := conn.header(utpState, conn.firstSeq)
+		conn.socket.conn.WriteTo(state.marshall(), conn.remote)
+	}
+
+	// once we've closed and our fin has been acked, the connection can go
+	if conn.closed && len(conn.unacked) == 0 {
+		conn.finish(net.ErrClosed)
+	}
+}
+
+// processAck removes whatever the peer has acked, adjusting the window by how delayed our packets were and
+// whether any were lost. Must be called with mx held
+func (conn *utpConn) processAck(p *utpPacket, now time.Time) {
+	acked, removed := 0, 0
+	for len(conn.unacked) > 0 && !seqBefore(p.ack, conn.unacked[0].packet.seq) {
+		out := conn.unacked[0]
+		conn.unacked = conn.unacked[1:]
+		removed++
+		if !out.sacked {
+			acked += len(out.packet.payload)
+			conn.inflight -= len(out.packet.payload)
+			conn.updateRTT(out, now)
+		}
+	}
+	sacked, lost := conn.processSelectiveAck(p, now)
+	acked += sacked
+
+	switch {
+	case removed == 0 && p.sack == nil && p.typ == utpState && len(conn.unacked) > 0 && p.ack == conn.unacked[0].packet.seq-1:
+		// they keep getting later packets but not the one after p.ack, so it was probably lost
+		conn.dupAcks++
+		if conn.dupAcks == conn.lossThreshold() {
+			lost = true
+			conn.retransmit(conn.unacked[0])
+		}
+	case removed > 0:
+		if conn.dupAcks >= conn.lossThreshold() && p.sack == nil && len(conn.unacked) > 0 {
+			// still recovering, so the next hole is likely lost too
+			conn.retransmit(conn.unacked[0])
+		}
+		conn.dupAcks = 0
+		conn.backoff = 0
+	}
+	// at most once a round trip, as one loss tends to come with others
+	if lost && now.Sub(conn.lossAt) >= conn.rtt {
+		conn.window = max(conn.window/2, utpMinWindow)
+		conn.lossAt = now
+	}
+	if acked == 0 && removed == 0 {
+		return
+	}
+
+	if p.timestampDiff != 0 {
+		delay := p.timestampDiff
+		if conn.baseAt.IsZero() || delay < conn.baseDelay || now.Sub(conn.baseAt) > utpBaseDelayAge {
+			conn.baseDelay = delay
+			conn.baseAt = now
+		}
+		queued := time.Duration(delay-conn.baseDelay) * time.Microsecond
+		offTarget := float64(utpTargetDelay-queued) / float64(utpTargetDelay)
+		conn.window += offTarget * float64(acked) * utpMaxPayload / conn.window
+	} else {
+		conn.window += float64(acked) * utpMaxPayload / conn.window
+	}
+	conn.window = min(max(conn.window, utpMinWindow), utpMaxWindow)
+	conn.broadcast()
+}
+
+// processSelectiveAck marks the packets in p's selective ack as arrived, returning how many bytes that was. Any
+// packet with enough later ones that have arrived is probably lost and is sent again, in which case lost is set.
+// Must be called with mx held
+func (conn *utpConn) processSelectiveAck(p *utpPacket, now time.Time) (int, bool) {
+	if p.sack == nil {
+		return 0, false
+	}
+	acked, later, lost := 0, 0, false
+	for i := len(conn.unacked) - 1; i >= 0; i-- {
+		out := conn.unacked[i]
+		bit := int(out.packet.seq - p.ack - 2)
+		if !out.sacked && bit < len(p.sack)*8 && p.sack[bit/8]&(1<<(bit%8)) != 0 {
+			out.sacked = true
+			acked += len(out.packet.payload)
+			conn.inflight -= len(out.packet.payload)
+			conn.updateRTT(out, now)
+		}
+		if out.sacked {
+			later++
+			continue
+		}
+		// and not again until it's had a chance to arrive
+		if later >= conn.lossThreshold() && now.Sub(out.sentAt) > conn.rtt {
+			lost = true
+			conn.retransmit(out)
+		}
+	}
+	return acked, lost
+}
+
+// lossThreshold is how many later packets have to arrive before one is taken to be lost. That's usually 3, to allow
+// for packets arriving out of order, but fewer when there aren't that many in flight. Must be called with mx held
+func (conn *utpConn) lossThreshold() int {
+	return min(max(len(conn.unacked)-1, 1), 3)
+}
+
+// selectiveAck returns the bitmask of packets that arrived after a lost one, nil if none did. Must be called with
+// mx held
+func (conn *utpConn) selectiveAck() []byte {
+	if len(conn.outOfOrder) == 0 {
+		return nil
+	}
+	furthest := 0
+	for seq := range conn.outOfOrder {
+		furthest = max(furthest, int(seq-conn.ack-2))
+	}
+	// a multiple of 4 bytes, up to 512 packets
+	sack := make([]byte, min(furthest/32+1, 16)*4)
+	for seq := range conn.outOfOrder {
+		if bit := int(seq - conn.ack - 2); bit < len(sack)*8 {
+			sack[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return sack
+}
+
+// updateRTT takes a round trip time sample from a packet that has just been acked, must be called with mx held
+func (conn *utpConn) updateRTT(out *utpOutgoing, now time.Time) {
+	// a packet that was sent more than once can't be timed as we don't know which one was acked, and nor can one sent
+	// before something was lost, as its ack may well have waited for the lost packet
+	if out.transmissions > 1 || out.sentAt.Before(conn.resentAt) {
+		return
+	}
+	sample := now.Sub(out.sentAt)
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVar = sample / 2
+	} else {
+		diff := conn.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		conn.rttVar += (diff - conn.rttVar) / 4
+		conn.rtt += (sample - conn.rtt) / 8
+	}
+	conn.rto = min(max(conn.rtt+4*conn.rttVar, utpMinRTO), utpMaxRTO)
+}
+
+// checkTimeout retransmits the oldest unacked packet if it's been too long, giving up after a few tries
+func (conn *utpConn) checkTimeout() {
+	conn.mx.Lock()
+	if len(conn.unacked) == 0 {
+		conn.mx.Unlock()
+		return
+	}
+	oldest := conn.unacked[0]
+	if conn.socket.clock.Now().Sub(oldest.sentAt) < min(conn.rto<<conn.backoff, utpMaxRTO) {
+		conn.mx.Unlock()
+		return
+	}
+	limit := utpMaxRetransmits
+	if oldest.packet.typ == utpSyn {
+		limit = utpSynRetransmits
+	}
+	if oldest.transmissions > limit {
+		conn.mx.Unlock()
+		conn.fail(errUTPGaveUp)
+		return
+	}
+	conn.window = utpMinWindow
+	conn.backoff = min(conn.backoff+1, 4)
+	conn.retransmit(oldest)
+	conn.mx.Unlock()
+}
+
+// wait blocks until changed is closed, the connection is done or deadline passes, returning an error for the
+// latter two
+func (conn *utpConn) wait(changed chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return errUTPTimeout
+	}
+}
+
+func (conn *utpConn) Read(b []byte) (int, error) {
+	conn.mx.Lock()
+	for {
+		if conn.readBuf.Len() > 0 {
+			n, _ := conn.readBuf.Read(b)
+			conn.mx.Unlock()
+			return n, nil
+		}
+		if conn.finSeq != nil && conn.ack == *conn.finSeq {
+			conn.mx.Unlock()
+			return 0, io.EOF
+		}
+		select {
+		case <-conn.done:
+			err := conn.err
+			conn.mx.Unlock()
+			return 0, err
+		default:
+		}
+		if conn.closed {
+			conn.mx.Unlock()
+			return 0, net.ErrClosed
+		}
+		deadline := conn.readDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			conn.mx.Unlock()
+			return 0, errUTPTimeout
+		}
+		changed := conn.changed
+		conn.mx.Unlock()
+		if err := conn.wait(changed, deadline); err != nil {
+			return 0, err
+		}
+		conn.mx.Lock()
+	}
+}
+
+func (conn *utpConn) Write(b []byte) (int, error) {
+	written := 0
+	conn.mx.Lock()
+	for written < len(b) {
+		select {
+		case <-conn.done:
+			err := conn.err
+			conn.mx.Unlock()
+			return written, err
+		default:
+		}
+		if conn.closed {
+			conn.mx.Unlock()
+			return written, net.ErrClosed
+		}
+		deadline := conn.writeDeadline
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			conn.mx.Unlock()
+			return written, errUTPTimeout
+		}
+
+		n := min(len(b)-written, utpMaxPayload)
+		// one packet may always be in flight, which is how we find out when a full window has room again
+		if conn.inflight == 0 || conn.inflight+n <= min(int(conn.window), conn.peerWnd) {
+			conn.queue(utpData, bytes.Clone(b[written:written+n]))
+			written += n
+			continue
+		}
+		changed := conn.changed
+		conn.mx.Unlock()
+		if err := conn.wait(changed, deadline); err != nil {
+			return written, err
+		}
+		conn.mx.Lock()
+	}
+	conn.mx.Unlock()
+	return written, nil
+}
+
+// Close sends a fin once everything written so far, the connection is forgotten once that's acked
+func (conn *utpConn) Close() error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	select {
+	case <-conn.done:
+	default:
+		conn.queue(utpFin, nil)
+	}
+	conn.broadcast()
+	return nil
+}
+
+func (conn *utpConn) LocalAddr() net.Addr {
+	return conn.socket.conn.LocalAddr()
+}
+
+func (conn *utpConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func (conn *utpConn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *utpConn) SetReadDeadline(t time.Time) error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.readDeadline = t
+	conn.broadcast()
+	return nil
+}
+
+func (conn *utpConn) SetWriteDeadline(t time.Time) error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.writeDeadline = t
+	conn.broadcast()
+	return nil
+}
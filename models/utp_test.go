@@ -0,0 +1,255 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseUTPPacket(t *testing.T) {
+	p := utpPacket{typ: utpData, connID: 513, timestamp: 1234567, timestampDiff: 89, wnd: 1 << 20, seq: 65535, ack: 7, payload: []byte("block")}
+	got, err := parseUTPPacket(p.marshall())
+	if err != nil || !reflect.DeepEqual(*got, p) {
+		t.Errorf("Expected %+v back, got %+v %v", p, got, err)
+	}
+
+	// a selective ack extension, which we skip over
+	withExtension := p.marshall()[:utpHeaderLen]
+	withExtension[1] = 1
+	withExtension = append(withExtension, 0, 4, 0xff, 0xff, 0xff, 0xff)
+	withExtension = append(withExtension, p.payload...)
+	got, err = parseUTPPacket(withExtension)
+	if err != nil || !bytes.Equal(got.payload, p.payload) {
+		t.Errorf("Expected the payload after the extension, got %+v %v", got, err)
+	}
+
+	for _, invalid := range [][]byte{nil, p.marshall()[:10], append([]byte{0x52}, make([]byte, 19)...), append([]byte{0x51}, make([]byte, 19)...)} {
+		if _, err := parseUTPPacket(invalid); err == nil {
+			t.Errorf("Expected %x to be rejected", invalid)
+		}
+	}
+}
+
+// lossyPacketConn drops some of the packets written to it
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+	mx   sync.Mutex
+	rand *rand.Rand
+}
+
+func (lc *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	lc.mx.Lock()
+	drop := lc.rand.Float64() < lc.loss
+	lc.mx.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return lc.PacketConn.WriteTo(b, addr)
+}
+
+var lossSeed int64
+
+// newTestUTPSocket returns a socket on loopback which loses a fraction of the packets it sends, though always the
+// same ones for a given test
+func newTestUTPSocket(t *testing.T, loss float64, accept bool) *utpSocket {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := newUTPSocket(&lossyPacketConn{PacketConn: conn, loss: loss, rand: rand.New(rand.NewSource(atomic.AddInt64(&lossSeed, 1)))}, SystemClock, accept)
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func TestUTPTransfer(t *testing.T) {
+	testCases := []struct {
+		name string
+		loss float64
+	}{
+		{name: "no loss", loss: 0},
+		{name: "5% loss", loss: 0.05},
+		{name: "10% loss", loss: 0.1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newTestUTPSocket(t, tc.loss, true)
+			client := newTestUTPSocket(t, tc.loss, false)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			ours, err := client.DialContext(ctx, server.Addr().String())
+			if err != nil {
+				t.Fatalf("Expected to connect, got %v", err)
+			}
+			theirs, err := server.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ours.SetDeadline(time.Now().Add(20 * time.Second))
+			theirs.SetDeadline(time.Now().Add(20 * time.Second))
+
+			upload := make([]byte, 256<<10)
+			download := make([]byte, 128<<10)
+			rand.Read(upload)
+			rand.Read(download)
+
+			// both ways at once, they close once they've got everything and sent everything
+			uploaded := make(chan error, 1)
+			go func() {
+				_, err := ours.Write(upload)
+				uploaded <- err
+			}()
+			go func() {
+				defer theirs.Close()
+				if _, err := theirs.Write(download); err != nil {
+					t.Errorf("Expected to send the download, got %v", err)
+				}
+				received := make([]byte, len(upload))
+				if _, err := io.ReadFull(theirs, received); err != nil || !bytes.Equal(received, upload) {
+					t.Errorf("Expected the upload to arrive intact, got %v", err)
+				}
+			}()
+			received, err := io.ReadAll(ours)
+			if err != nil || !bytes.Equal(received, download) {
+				t.Errorf("Expected the download to arrive intact and end with EOF, got %d bytes %v", len(received), err)
+			}
+			if err := <-uploaded; err != nil {
+				t.Errorf("Expected to send the upload, got %v", err)
+			}
+			ours.Close()
+		})
+	}
+}
+
+func TestUTPDial(t *testing.T) {
+	notAccepting := newTestUTPSocket(t, 0, false)
+	client := newTestUTPSocket(t, 0, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.DialContext(ctx, notAccepting.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the dial to time out, got %v", err)
+	}
+	if len(client.conns) != 0 {
+		t.Errorf("Expected the failed connection to be forgotten")
+	}
+
+	// closing the socket resets the connections on it
+	server := newTestUTPSocket(t, 0, true)
+	conn, err := client.DialContext(context.Background(), server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, _ := server.Accept()
+	server.Close()
+	if _, err := theirs.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected reads to fail once the socket is closed, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, errUTPReset) {
+		t.Errorf("Expected the connection to be reset, got %v", err)
+	}
+}
+
+// countingListenConfig counts the bytes read by the packet sockets it opens
+type countingListenConfig struct {
+	net.ListenConfig
+	read atomic.Int64
+}
+
+type countingPacketConn struct {
+	net.PacketConn
+	config *countingListenConfig
+}
+
+func (cl *countingListenConfig) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	conn, err := cl.ListenConfig.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &countingPacketConn{PacketConn: conn, config: cl}, nil
+}
+
+func (cc *countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := cc.PacketConn.ReadFrom(b)
+	cc.config.read.Add(int64(n))
+	return n, addr, err
+}
+
+func TestUTPDownload(t *testing.T) {
+	testCases := []struct {
+		name       string
+		seedUTP    bool
+		leecherUTP bool
+		expectUTP  bool
+	}{
+		{name: "utp", seedUTP: true, leecherUTP: true, expectUTP: true},
+		{name: "seed only has tcp", seedUTP: false, leecherUTP: true},
+		{name: "leecher only has tcp", seedUTP: true, leecherUTP: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seedDir := t.TempDir()
+			mi := newSeedData(t, seedDir)
+			_, portString, _ := net.SplitHostPort(unusedAddress(t))
+			port, _ := strconv.Atoi(portString)
+
+			seedSession, err := NewSession(SessionConfig{ListenPort: port, DownloadDir: seedDir, Seed: true, DisableUTP: !tc.seedUTP})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer seedSession.Close()
+			seed, err := seedSession.AddMetaInfo(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go seed.StartDownload(context.Background())
+			for seed.state() != StateSeeding {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			listenConfig := &countingListenConfig{}
+			leechDir := t.TempDir()
+			session, err := NewSession(SessionConfig{ListenPort: -1, DownloadDir: leechDir, ListenConfig: listenConfig, DisableUTP: !tc.leecherUTP})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			leecher, err := session.AddMetaInfo(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leecher.addPeer(newPeer("127.0.0.1", strconv.Itoa(port), leecher.infoHash, leecher), PeerSourceMagnet)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			go leecher.StartDownload(ctx)
+			if err := leecher.Wait(ctx); err != nil {
+				t.Fatalf("Expected the download to succeed, got %v", err)
+			}
+			expected, _ := os.ReadFile(filepath.Join(seedDir, "data", "first"))
+			actual, err := os.ReadFile(filepath.Join(leechDir, "data", "first"))
+			if err != nil || !bytes.Equal(actual, expected) {
+				t.Errorf("Expected the data to match the seed's copy, got error %v", err)
+			}
+			if overUTP := listenConfig.read.Load() > int64(len(expected)); overUTP != tc.expectUTP {
+				t.Errorf("Expected the data to come over uTP: %v, got %v", tc.expectUTP, overUTP)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"errors"
+	"gotorrent/utils"
+	"io"
+	"os"
+)
+
+// VerifyResult is what VerifyData found in the download directory
+type VerifyResult struct {
+	Pieces   int   // in the torrent
+	Verified int   // pieces whose data on disk matched their hash
+	Missing  []int // pieces of files we want that are missing, incomplete or corrupt on disk
+}
+
+// Complete returns whether every piece of the files we want was found on disk
+func (result VerifyResult) Complete() bool {
+	return len(result.Missing) == 0
+}
+
+var errVerifyStarted = errors.New("data can only be verified before the torrent is started")
+
+// VerifyData hash checks whatever of the torrent is already in the download directory, keeping the pieces that
+// match so that they don't need to be downloaded again and can be seeded. It must be called once we have the
+// metadata but before StartDownload
+func (torrent *Torrent) VerifyData() (VerifyResult, error) {
+	if !torrent.hasMetadata.Load() {
+		return VerifyResult{}, errMetadataRequired
+	}
+	if torrent.started.Load() {
+		return VerifyResult{}, errVerifyStarted
+	}
+	torrent.downloadedMx.Lock()
+	defer torrent.downloadedMx.Unlock()
+
+	result := VerifyResult{Pieces: len(torrent.pieces)}
+	files := newDiskReader(torrent.fileEntries())
+	defer files.close()
+
+	for i := range torrent.pieces {
+		piece := &torrent.pieces[i]
+		if piece.isVerified.Load() {
+			result.Verified++
+			continue
+		}
+
+		length := min(torrent.metadata.PieceLen, torrent.metadata.Length-i*torrent.metadata.PieceLen)
+		data := make([]byte, length)
+		err := files.readAt(data, i*torrent.metadata.PieceLen)
+		if err == nil {
+			for j := range piece.blocks {
+				piece.blocks[j].data = data[j*BlockLen : min((j+1)*BlockLen, length)]
+			}
+			if !piece.verify() {
+				err = errPieceHashMismatch
+			}
+		}
+		if err != nil {
+			for j := range piece.blocks {
+				piece.blocks[j].data = nil
+			}
+			if torrent.isPieceWanted(i) {
+				result.Missing = append(result.Missing, i)
+			}
+			continue
+		}
+
+		piece.isVerified.Store(true)
+		piece.numSet = len(piece.blocks)
+		for j := range piece.blocks {
+			utils.SetBit(&torrent.obtainedBlocks, i*torrent.getNumBlocksInPiece()+j)
+		}
+		torrent.numBlocksDownloaded += len(piece.blocks)
+		torrent.numPiecesDownloaded.Add(1)
+		result.Verified++
+	}
+
+	torrent.pieceQueue.filter(func(i int) bool { return torrent.isPieceWanted(i) && !torrent.pieces[i].isVerified.Load() })
+	torrent.progressBar.newOption(torrent.numPiecesDownloaded.Load(), int64(torrent.numWantedPieces))
+
+	// everything is already on disk, so there's nothing to write
+	if torrent.hasAllData() && !torrent.isDownloaded.Load() {
+		torrent.isDownloaded.Store(true)
+		close(torrent.done)
+	}
+	return result, nil
+}
+
+var errPieceHashMismatch = errors.New("piece doesn't match its hash")
+
+// diskReader reads the torrent's contiguous byte stream back from the files in the download directory
+type diskReader struct {
+	entries []fileEntry
+	files   map[int]*os.File // opened as they're needed, by index into entries
+}
+
+func newDiskReader(entries []fileEntry) *diskReader {
+	return &diskReader{entries: entries, files: make(map[int]*os.File)}
+}
+
+// readAt fills buf with the data at offset, padding files read as zeros since they're never written
+func (dr *diskReader) readAt(buf []byte, offset int) error {
+	for i, entry := range dr.entries {
+		start := max(offset, entry.offset)
+		end := min(offset+len(buf), entry.offset+entry.length)
+		if start >= end {
+			continue
+		}
+		chunk := buf[start-offset : end-offset]
+
+		if entry.hasAttr(AttrPadding) {
+			clear(chunk)
+			continue
+		}
+		file, ok := dr.files[i]
+		if !ok {
+			var err error
+			file, err = os.Open(entry.path)
+			if err != nil {
+				return err
+			}
+			dr.files[i] = file
+		}
+		_, err := file.ReadAt(chunk, int64(start-entry.offset))
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dr *diskReader) close() {
+	for _, file := range dr.files {
+		file.Close()
+	}
+}
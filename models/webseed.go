@@ -0,0 +1,322 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Web seed styles, which differ in how a piece is requested over HTTP
+const (
+	GetRightStyle = 0 // BEP 19, the url points at the torrent's files and pieces are fetched with Range requests
+	HoffmanStyle  = 1 // BEP 17, the url is a script which serves pieces given the info hash and piece index
+)
+
+const (
+	webSeedMinBackoff = time.Second
+	webSeedMaxBackoff = 5 * time.Minute
+	maxWebSeedCorrupt = 3 // pieces a web seed can send that fail the hash check before we stop using it
+)
+
+var errWebSeedCorrupt = errors.New("web seed sent a piece that failed the hash check")
+
+// WebSeed is an HTTP server which we can download pieces from, treated as a peer that never chokes us
+type WebSeed struct {
+	url     string
+	style   int
+	torrent *Torrent
+	client  *http.Client
+
+	failures int // consecutive failed requests, used to back off a misbehaving server
+	corrupt  int // pieces it has sent that failed the hash check, after maxWebSeedCorrupt it's dropped
+
+	hashFailures atomic.Int32 // reported by the torrent's block handler and not yet counted
+}
+
+func newWebSeed(link string, style int, torrent *Torrent) *WebSeed {
+	var ws WebSeed
+	ws.url = link
+	ws.style = style
+	ws.torrent = torrent
+	ws.client = &http.Client{Timeout: 60 * time.Second}
+	return &ws
+}
+
+// errRetryAfter is returned when the server asks us to wait before requesting again
+type errRetryAfter struct {
+	wait time.Duration
+}
+
+func (err *errRetryAfter) Error() string {
+	return fmt.Sprintf("web seed asked us to retry after %s", err.wait)
+}
+
+// retryAfter is what a server asked for in seconds, which is never waited for longer than webSeedMaxBackoff and
+// mustn't overflow getting there
+func retryAfter(seconds int) *errRetryAfter {
+	if seconds > int(webSeedMaxBackoff/time.Second) {
+		return &errRetryAfter{webSeedMaxBackoff}
+	}
+	return &errRetryAfter{time.Duration(seconds) * time.Second}
+}
+
+func (torrent *Torrent) addWebSeed(link string, style int) {
+	if _, err := url.Parse(link); err != nil {
+		log.Debug().Err(err).Msg("Skipping invalid web seed url")
+		return
+	}
+	torrent.webSeeds = append(torrent.webSeeds, newWebSeed(link, style, torrent))
+}
+
+// startWebSeeds starts downloading from all web seeds, which can only happen once we have the metadata
+func (torrent *Torrent) startWebSeeds() {
+	torrent.webSeedsOnce.Do(func() {
+		for _, ws := range torrent.webSeeds {
+			torrent.background(func() { ws.run(torrent.ctx) })
+		}
+	})
+}
+
+// run fetches pieces from the torrent's queue until the torrent has been downloaded or ctx is done
+func (ws *WebSeed) run(ctx context.Context) {
+	// the torrent may have been added to a session since we were created
+	ws.client.Transport = ws.torrent.httpTransport
+	defer ws.client.CloseIdleConnections()
+
+	for ctx.Err() == nil {
+		select {
+		case <-ws.torrent.done:
+			return
+		default:
+		}
+		if ws.torrent.paused.Load() {
+			sleep(ctx, ws.torrent.clock, time.Second)
+			continue
+		}
+		if n := int(ws.hashFailures.Swap(0)); n > 0 {
+			ws.corrupt += n
+			if ws.corrupt >= maxWebSeedCorrupt {
+				log.Info().Msg(fmt.Sprintf("web seed %s sent %d corrupt pieces, no longer using it", ws.url, ws.corrupt))
+				ws.drop()
+				return
+			}
+			wait := ws.backoff(errWebSeedCorrupt)
+			log.Debug().Err(errWebSeedCorrupt).Msg(fmt.Sprintf("web seed %s failed, backing off for %s", ws.url, wait))
+			sleep(ctx, ws.torrent.clock, wait)
+			continue
+		}
+
+		piece, err := ws.torrent.pieceQueue.pop()
+		if err != nil {
+			// everything left is already being requested from peers, check back later in case some of it fails
+			sleep(ctx, ws.torrent.clock, time.Second)
+			continue
+		}
+
+		err = ws.fetchPiece(ctx, piece)
+		if err != nil {
+			ws.torrent.pieceQueue.push(piece)
+			if ctx.Err() != nil {
+				return
+			}
+			wait := ws.backoff(err)
+			log.Debug().Err(err).Msg(fmt.Sprintf("web seed %s failed, backing off for %s", ws.url, wait))
+			sleep(ctx, ws.torrent.clock, wait)
+			continue
+		}
+		// the piece is checked once the block handler gets to it, which we hear about through hashFailed. Until then
+		// it's as good as any, unless the server has sent corrupt pieces before, which it keeps backing off for
+		if ws.corrupt == 0 {
+			ws.failures = 0
+		}
+	}
+}
+
+// hashFailed is called by the torrent's block handler when a piece we sent fails the hash check
+func (ws *WebSeed) hashFailed() {
+	ws.hashFailures.Add(1)
+}
+
+// drop stops the torrent waiting on the web seed, which has stopped running
+func (ws *WebSeed) drop() {
+	if int(ws.torrent.droppedWebSeeds.Add(1)) == len(ws.torrent.webSeeds) {
+		close(ws.torrent.webSeedsDropped)
+	}
+}
+
+// backoff returns how long to wait after a failed request, doubling with every consecutive failure
+func (ws *WebSeed) backoff(err error) time.Duration {
+	var retry *errRetryAfter
+	if errors.As(err, &retry) {
+		if retry.wait <= 0 {
+			return webSeedMaxBackoff
+		}
+		return min(retry.wait, webSeedMaxBackoff)
+	}
+
+	wait := webSeedMinBackoff << ws.failures
+	if wait > webSeedMaxBackoff || wait <= 0 {
+		wait = webSeedMaxBackoff
+	} else {
+		ws.failures++
+	}
+	return wait
+}
+
+// fetchPiece downloads an entire piece and hands its blocks to the torrent, which verifies it like any other piece
+func (ws *WebSeed) fetchPiece(ctx context.Context, pieceIndex int) error {
+	torrent := ws.torrent
+	start := pieceIndex * torrent.metadata.PieceLen
+	length := min(torrent.metadata.PieceLen, torrent.metadata.Length-start)
+
+	var data []byte
+	var err error
+	if ws.style == HoffmanStyle {
+		data, err = ws.fetchHoffman(ctx, pieceIndex, length)
+	} else {
+		data, err = ws.fetchRange(ctx, start, length)
+	}
+	if err != nil {
+		return err
+	}
+	torrent.waitDownload(length)
+
+	for offset := 0; offset < length; offset += BlockLen {
+		select {
+		case torrent.torrentBlockCH <- TorrentBlock{pieceIndex, offset, data[offset:min(offset+BlockLen, length)], ws}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// fetchRange downloads length bytes starting at offset within the torrent, which may span several files
+func (ws *WebSeed) fetchRange(ctx context.Context, offset int, length int) ([]byte, error) {
+	data := make([]byte, length)
+
+	for _, entry := range ws.torrent.fileEntries() {
+		// find the part of this file that overlaps with the requested range
+		from := max(offset, entry.offset)
+		to := min(offset+length, entry.offset+entry.length)
+		if from >= to {
+			continue
+		}
+
+		// padding files are all zeros and aren't present on the server
+		if entry.hasAttr(AttrPadding) {
+			continue
+		}
+
+		err := ws.get(ctx, ws.fileURL(entry), from-entry.offset, data[from-offset:to-offset])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// fileURL returns the url of a file on a GetRight-style server, multi-file torrents live under a directory named after the torrent
+func (ws *WebSeed) fileURL(entry fileEntry) string {
+	md := ws.torrent.metadata
+	if len(md.Files) == 0 {
+		// a url not ending in a slash is the file itself
+		if !strings.HasSuffix(ws.url, "/") {
+			return ws.url
+		}
+		return ws.url + url.PathEscape(md.Name)
+	}
+
+	link := strings.TrimSuffix(ws.url, "/") + "/" + url.PathEscape(md.Name)
+	for _, element := range entry.torrentPath {
+		link += "/" + url.PathEscape(element)
+	}
+	return link
+}
+
+// get reads len(buf) bytes from link starting at offset using an HTTP range request
+func (ws *WebSeed) get(ctx context.Context, link string, offset int, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(buf)-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, so skip to the part we asked for
+		_, err = io.CopyN(io.Discard, resp.Body, int64(offset))
+		if err != nil {
+			return err
+		}
+	default:
+		return ws.statusError(resp)
+	}
+
+	_, err = io.ReadFull(resp.Body, buf)
+	return err
+}
+
+// fetchHoffman requests a piece from a BEP 17 seeding script
+func (ws *WebSeed) fetchHoffman(ctx context.Context, pieceIndex int, length int) ([]byte, error) {
+	link, err := url.Parse(ws.url)
+	if err != nil {
+		return nil, err
+	}
+	query := link.Query()
+	query.Set("info_hash", string(ws.torrent.infoHash))
+	query.Set("piece", strconv.Itoa(pieceIndex))
+	link.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		// BEP 17 - the body of a 503 is the number of seconds to wait before retrying
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err == nil && seconds > 0 {
+			return nil, retryAfter(seconds)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, ws.statusError(resp)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (ws *WebSeed) statusError(resp *http.Response) error {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return retryAfter(seconds)
+	}
+	return errors.New("web seed responded with " + resp.Status)
+}
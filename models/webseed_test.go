@@ -0,0 +1,214 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// hashPieces returns the concatenated sha1 hashes of data split into pieceLen sized pieces
+func hashPieces(data []byte, pieceLen int) string {
+	var pieces []byte
+	for offset := 0; offset < len(data); offset += pieceLen {
+		checksum := sha1.Sum(data[offset:min(offset+pieceLen, len(data))])
+		pieces = append(pieces, checksum[:]...)
+	}
+	return string(pieces)
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	first := make([]byte, 3*BlockLen+123)
+	second := make([]byte, 5*BlockLen)
+	rand.Read(first)
+	rand.Read(second)
+	padding := make([]byte, 4*BlockLen-len(first)%(4*BlockLen))
+
+	// serve the files the way a GetRight-style mirror would, under a directory named after the torrent
+	served := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(served, "mirror", "sub"), 0770); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(served, "mirror", "first"), first, 0644)
+	os.WriteFile(filepath.Join(served, "mirror", "sub", "second"), second, 0644)
+	server := httptest.NewServer(http.FileServer(http.Dir(served)))
+	defer server.Close()
+
+	data := append(append(append([]byte{}, first...), padding...), second...)
+	md := Metadata{
+		Name:     "mirror",
+		PieceLen: 4 * BlockLen,
+		Pieces:   hashPieces(data, 4*BlockLen),
+		Files: []MetadataFile{
+			{Length: len(first), Path: []string{"first"}},
+			{Length: len(padding), Path: []string{".pad", "1"}, Attr: "p"},
+			{Length: len(second), Path: []string{"sub", "second"}},
+		},
+	}
+	var info bytes.Buffer
+	if err := bencode.Marshal(&info, md); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := NewTorrentFromMetaInfo(&MetaInfo{URLList: []string{server.URL + "/"}, InfoBytes: info.Bytes()}, 10)
+	if err != nil {
+		t.Fatalf("Expected no error but got: %v", err)
+	}
+	torrent.downloadDir = t.TempDir()
+	go torrent.StartDownload(context.Background())
+
+	select {
+	case <-torrent.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Torrent did not finish downloading from the web seed")
+	}
+
+	got, err := os.ReadFile(filepath.Join(torrent.downloadDir, "mirror", "first"))
+	if err != nil || !bytes.Equal(got, first) {
+		t.Errorf("first was not downloaded correctly: %v", err)
+	}
+	got, err = os.ReadFile(filepath.Join(torrent.downloadDir, "mirror", "sub", "second"))
+	if err != nil || !bytes.Equal(got, second) {
+		t.Errorf("second was not downloaded correctly: %v", err)
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	ws := newWebSeed("http://example.com", GetRightStyle, nil)
+
+	var last time.Duration
+	for i := 0; i < 20; i++ {
+		wait := ws.backoff(os.ErrNotExist)
+		if wait < last || wait > webSeedMaxBackoff {
+			t.Fatalf("Unexpected backoff %s after %s", wait, last)
+		}
+		last = wait
+	}
+	if last != webSeedMaxBackoff {
+		t.Errorf("Expected backoff to be capped at %s, got %s", webSeedMaxBackoff, last)
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected time.Duration
+	}{
+		{"retry after", &errRetryAfter{3 * time.Second}, 3 * time.Second},
+		{"too long", &errRetryAfter{time.Hour}, webSeedMaxBackoff},
+		{"negative", &errRetryAfter{-time.Second}, webSeedMaxBackoff},
+		{"zero", &errRetryAfter{0}, webSeedMaxBackoff},
+		{"seconds", retryAfter(7), 7 * time.Second},
+		{"seconds overflowing", retryAfter(math.MaxInt), webSeedMaxBackoff},
+	}
+	for _, tc := range testCases {
+		if wait := ws.backoff(tc.err); wait != tc.expected {
+			t.Errorf("%s: expected to wait %s, got %s", tc.name, tc.expected, wait)
+		}
+	}
+}
+
+func TestWebSeedRetryAfterHeader(t *testing.T) {
+	ws := newWebSeed("http://example.com", GetRightStyle, nil)
+	// 0 for headers that don't ask us to wait
+	testCases := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"99999999999999", webSeedMaxBackoff},
+		{"-5", 0},
+		{"soon", 0},
+	}
+
+	for _, tc := range testCases {
+		resp := &http.Response{Status: "429 Too Many Requests", Header: http.Header{"Retry-After": {tc.header}}}
+		var retry *errRetryAfter
+		err := ws.statusError(resp)
+		if !errors.As(err, &retry) {
+			if tc.expected != 0 {
+				t.Errorf("%s: expected to be asked to retry, got %v", tc.header, err)
+			}
+			continue
+		}
+		if retry.wait != tc.expected || ws.backoff(err) != tc.expected {
+			t.Errorf("%s: expected to wait %s, got %s", tc.header, tc.expected, retry.wait)
+		}
+	}
+}
+
+func TestWebSeedCorrupt(t *testing.T) {
+	data := make([]byte, 8*BlockLen)
+	rand.Read(data)
+	// every byte of what's served is wrong
+	corrupt := make([]byte, len(data))
+	for i := range data {
+		corrupt[i] = data[i] ^ 0xff
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "corrupt", time.Time{}, bytes.NewReader(corrupt))
+	}))
+	defer server.Close()
+
+	md := Metadata{Name: "corrupt", PieceLen: 2 * BlockLen, Length: len(data), Pieces: hashPieces(data, 2*BlockLen)}
+	var info bytes.Buffer
+	if err := bencode.Marshal(&info, md); err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := NewTorrentFromMetaInfo(&MetaInfo{URLList: []string{server.URL}, InfoBytes: info.Bytes()}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = t.TempDir()
+	clock := newFakeClock()
+	torrent.clock = clock
+	go torrent.torrentBlockHandler()
+	defer torrent.cancel()
+
+	ws := torrent.webSeeds[0]
+	stopped := make(chan struct{})
+	go func() {
+		ws.run(torrent.ctx)
+		close(stopped)
+	}()
+	// skip through the backoff between pieces
+	deadline := time.After(10 * time.Second)
+	for running := true; running; {
+		select {
+		case <-stopped:
+			running = false
+		case <-time.After(time.Millisecond):
+			clock.advance(webSeedMaxBackoff)
+		case <-deadline:
+			t.Fatal("Expected the web seed to be dropped")
+		}
+	}
+
+	if ws.corrupt != maxWebSeedCorrupt || ws.failures == 0 {
+		t.Errorf("Expected %d corrupt pieces to be backed off from, got %d and %d failures", maxWebSeedCorrupt, ws.corrupt, ws.failures)
+	}
+	// one more piece may have been fetched before hearing about the last
+	if n := requests.Load(); n < maxWebSeedCorrupt || n > maxWebSeedCorrupt+1 {
+		t.Errorf("Expected about %d pieces to be requested, got %d", maxWebSeedCorrupt, n)
+	}
+	select {
+	case <-torrent.webSeedsDropped:
+	default:
+		t.Error("Expected the torrent to stop waiting on its only web seed")
+	}
+	if torrent.numPiecesDownloaded.Load() != 0 {
+		t.Error("Expected none of the corrupt pieces to be kept")
+	}
+}
@@ -0,0 +1,340 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// wireError is why a message from a peer was refused, before any more of it than its length and id was read. It
+// matches errInvalidMessage with errors.Is
+type wireError struct {
+	id     int // -1 if the length was refused before the id was read
+	length int // from the length prefix, which includes the id
+	reason string
+}
+
+func (err *wireError) Error() string {
+	if err.id < 0 {
+		return fmt.Sprintf("peer sent a message of length %d: %s", err.length, err.reason)
+	}
+	return fmt.Sprintf("peer sent message %d of length %d: %s", err.id, err.length, err.reason)
+}
+
+func (err *wireError) Unwrap() error {
+	return errInvalidMessage
+}
+
+// messageLengths returns the shortest and longest a message with the given id may be, counting the id. numPieces is
+// 0 if we don't have the metadata yet, until then a bitfield can be any length. Messages we don't know are only
+// held to maxMessageLen
+func messageLengths(id int, numPieces int) (int, int) {
+	switch id {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		return 1, 1
+	case Have, Suggest, AllowedFast:
+		return 5, 5
+	case Request, Cancel, Reject:
+		return 13, 13
+	case Port:
+		return 3, 3
+	case PIECE:
+		// we never request more than a block
+		return 9, 9 + BlockLen
+	case Bitfield:
+		if numPieces > 0 {
+			return 1 + (numPieces+7)/8, 1 + (numPieces+7)/8
+		}
+		return 1, maxMessageLen
+	case Extended:
+		return 2, maxMessageLen
+	default:
+		return 1, maxMessageLen
+	}
+}
+
+// readMessage reads the next message from r, which should be buffered as it takes a few reads. Its length is
+// checked against its id before the rest is read, and a bitfield against the number of pieces if that's known. A
+// keep alive is returned as a message with a length prefix of 0
+func readMessage(r io.Reader, numPieces int) (Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return Message{}, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:4]))
+	if length == 0 {
+		return Message{}, nil
+	}
+	if length > maxMessageLen {
+		return Message{}, &wireError{id: -1, length: length, reason: "too long"}
+	}
+
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return Message{}, err
+	}
+	id := int(header[4])
+	shortest, longest := messageLengths(id, numPieces)
+	if length < shortest {
+		return Message{}, &wireError{id: id, length: length, reason: "too short"}
+	}
+	if length > longest {
+		return Message{}, &wireError{id: id, length: length, reason: "too long"}
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Message{}, err
+	}
+	// the bits past the last piece have to be cleared
+	if id == Bitfield && numPieces > 0 && numPieces%8 != 0 && payload[len(payload)-1]<<(numPieces%8) != 0 {
+		return Message{}, &wireError{id: id, length: length, reason: "spare bits set"}
+	}
+	return Message{uint32(length), id, payload}, nil
+}
+
+// marshall is what readMessage reads back, it trusts lengthPrefix to be right
+func (message *Message) marshall() []byte {
+	packet := make([]byte, 4) // len_prefix (4) + id (1)
+	binary.BigEndian.PutUint32(packet[0:], message.lengthPrefix)
+	packet = append(packet, uint8(message.id))
+	if message.payload != nil {
+		packet = append(packet, message.payload...)
+	}
+	return packet
+}
+
+// marshall works the length prefix out from the payload, unlike Message's
+func (message *ExtendedMessage) marshall() []byte {
+	encoded := message.encode()
+	return encoded.marshall()
+}
+
+// peerMessage is a message decoded into what it says by decodeMessage, encode turns it back into a Message
+type peerMessage interface {
+	encode() Message
+}
+
+// the messages that are only an id
+type (
+	chokeMessage         struct{}
+	unchokeMessage       struct{}
+	interestedMessage    struct{}
+	notInterestedMessage struct{}
+	haveAllMessage       struct{}
+	haveNoneMessage      struct{}
+)
+
+func (chokeMessage) encode() Message         { return Message{1, Choke, nil} }
+func (unchokeMessage) encode() Message       { return Message{1, Unchoke, nil} }
+func (interestedMessage) encode() Message    { return Message{1, Interested, nil} }
+func (notInterestedMessage) encode() Message { return Message{1, NotInterested, nil} }
+func (haveAllMessage) encode() Message       { return Message{1, HaveAll, nil} }
+func (haveNoneMessage) encode() Message      { return Message{1, HaveNone, nil} }
+
+// the messages that are only a piece index
+type (
+	haveMessage        struct{ index int }
+	suggestMessage     struct{ index int }
+	allowedFastMessage struct{ index int }
+)
+
+func (msg haveMessage) encode() Message        { return indexMessage(Have, msg.index) }
+func (msg suggestMessage) encode() Message     { return indexMessage(Suggest, msg.index) }
+func (msg allowedFastMessage) encode() Message { return indexMessage(AllowedFast, msg.index) }
+
+func indexMessage(id int, index int) Message {
+	return Message{5, id, binary.BigEndian.AppendUint32(nil, uint32(index))}
+}
+
+// blockRequest is a block of a piece, as REQUEST, CANCEL and REJECT REQUEST give it
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+type (
+	requestMessage blockRequest
+	cancelMessage  blockRequest
+	rejectMessage  blockRequest
+)
+
+func (msg requestMessage) encode() Message { return blockRequest(msg).message(Request) }
+func (msg cancelMessage) encode() Message  { return blockRequest(msg).message(Cancel) }
+func (msg rejectMessage) encode() Message  { return blockRequest(msg).message(Reject) }
+
+func (request blockRequest) message(id int) Message {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(request.index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(request.begin))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(request.length))
+	return Message{13, id, payload}
+}
+
+func decodeBlockRequest(payload []byte) blockRequest {
+	return blockRequest{
+		index:  int(binary.BigEndian.Uint32(payload[0:])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:])),
+		length: int(binary.BigEndian.Uint32(payload[8:])),
+	}
+}
+
+type bitfieldMessage struct {
+	bitfield []byte
+}
+
+func (msg bitfieldMessage) encode() Message {
+	return Message{uint32(1 + len(msg.bitfield)), Bitfield, msg.bitfield}
+}
+
+// pieceMessage is a block that was requested, its length is the block's
+type pieceMessage struct {
+	index int
+	begin int
+	block []byte
+}
+
+func (msg pieceMessage) encode() Message {
+	payload := make([]byte, 8+len(msg.block))
+	binary.BigEndian.PutUint32(payload[0:], uint32(msg.index))
+	binary.BigEndian.PutUint32(payload[4:], uint32(msg.begin))
+	copy(payload[8:], msg.block)
+	return Message{uint32(1 + len(payload)), PIECE, payload}
+}
+
+// portMessage is the DHT port of a peer, which we have no use for without a DHT
+type portMessage struct {
+	port int
+}
+
+func (msg portMessage) encode() Message {
+	return Message{3, Port, binary.BigEndian.AppendUint16(nil, uint16(msg.port))}
+}
+
+func (message ExtendedMessage) encode() Message {
+	payload := append([]byte{message.extendedID}, message.payload...)
+	return Message{uint32(1 + len(payload)), Extended, payload}
+}
+
+// decodeMessage decodes a message read by readMessage into what it says. The length is checked against the id
+// again so that any message can be given to it, all but a bitfield's that is, which readMessage checks against the
+// number of pieces
+func decodeMessage(message Message) (peerMessage, error) {
+	payload := message.payload
+	shortest, longest := messageLengths(message.id, 0)
+	if 1+len(payload) < shortest || 1+len(payload) > longest {
+		return nil, &wireError{id: message.id, length: int(message.lengthPrefix), reason: "wrong length"}
+	}
+
+	switch message.id {
+	case Choke:
+		return chokeMessage{}, nil
+	case Unchoke:
+		return unchokeMessage{}, nil
+	case Interested:
+		return interestedMessage{}, nil
+	case NotInterested:
+		return notInterestedMessage{}, nil
+	case HaveAll:
+		return haveAllMessage{}, nil
+	case HaveNone:
+		return haveNoneMessage{}, nil
+	case Have:
+		return haveMessage{int(binary.BigEndian.Uint32(payload))}, nil
+	case Suggest:
+		return suggestMessage{int(binary.BigEndian.Uint32(payload))}, nil
+	case AllowedFast:
+		return allowedFastMessage{int(binary.BigEndian.Uint32(payload))}, nil
+	case Request:
+		return requestMessage(decodeBlockRequest(payload)), nil
+	case Cancel:
+		return cancelMessage(decodeBlockRequest(payload)), nil
+	case Reject:
+		return rejectMessage(decodeBlockRequest(payload)), nil
+	case Bitfield:
+		return bitfieldMessage{payload}, nil
+	case PIECE:
+		return pieceMessage{int(binary.BigEndian.Uint32(payload[0:])), int(binary.BigEndian.Uint32(payload[4:])), payload[8:]}, nil
+	case Port:
+		return portMessage{int(binary.BigEndian.Uint16(payload))}, nil
+	case Extended:
+		return message.extended(), nil
+	default:
+		return nil, &wireError{id: message.id, length: int(message.lengthPrefix), reason: "unknown message"}
+	}
+}
+
+// getHandshakeMessage returns our handshake, advertising the extension protocol and the fast extension
+func getHandshakeMessage(infoHash []byte, peerID []byte) []byte {
+	pstrlen := 19
+	pstr := "BitTorrent protocol"
+
+	packet := make([]byte, 49+pstrlen)
+	copy(packet[0:], []uint8{uint8(pstrlen)})
+	copy(packet[1:], []byte(pstr))
+	packet[25] = 16 // extension protocol (BEP 10)
+	packet[27] = 4  // fast extension (BEP 6)
+	copy(packet[28:], infoHash)
+	copy(packet[48:], peerID)
+
+	return packet
+}
+
+// readHandshake reads a peer's handshake, returning the info hash they want and their reserved bytes
+func readHandshake(conn io.Reader) ([]byte, []byte, error) {
+	buf := make([]byte, 68)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, nil, errors.New("could not read handshake from peer")
+	}
+	if buf[0] != 19 || string(buf[1:20]) != "BitTorrent protocol" {
+		return nil, nil, errors.New("peer sent an unknown protocol")
+	}
+	return buf[28:48], buf[20:28], nil
+}
+
+// getExtendedHandshakeMessage returns our extended handshake, metadataSize is 0 until we have the info dictionary to
+// serve to peers
+func getExtendedHandshakeMessage(extensions map[string]int, metadataSize int) []byte {
+	// <message_len><message_id == 20><handshake_identifier == 0><payload>
+	var b bytes.Buffer
+	err := bencode.Marshal(&b, struct {
+		Extensions   map[string]int `bencode:"m"`
+		MetadataSize int            `bencode:"metadata_size,omitempty"`
+		Requests     int            `bencode:"reqq"`
+	}{extensions, metadataSize, maxPeerRequests})
+	if err != nil {
+		panic(err)
+	}
+	payload := b.Bytes()
+	messageLen := uint32(len(payload) + 2)
+
+	packet := make([]byte, messageLen+4)
+	binary.BigEndian.PutUint32(packet[0:], messageLen)
+	packet[4] = Extended
+	packet[5] = 0 // the handshake's extended id
+	copy(packet[6:], payload)
+
+	return packet
+}
+
+// extended splits an EXTENDED message into its extended id and payload, readMessage having made sure there's an id
+func (message *Message) extended() ExtendedMessage {
+	return ExtendedMessage{message.lengthPrefix, uint8(message.id), message.payload[0], message.payload[1:]}
+}
+
+// splitExtended splits the payload of an extension message into its bencoded dictionary and whatever raw data
+// follows it, such as a metadata piece
+func splitExtended(payload []byte) ([]byte, []byte, error) {
+	end, err := bencodeEnd(payload, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload[0] != 'd' {
+		return nil, nil, errMalformedBencode
+	}
+	return payload[:end], payload[end:], nil
+}
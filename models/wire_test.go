@@ -0,0 +1,369 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// frame prefixes a message with its length, which doesn't have to be right
+func frame(length int, rest ...byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(length)), rest...)
+}
+
+func TestReadMessage(t *testing.T) {
+	testCases := []struct {
+		name      string
+		data      []byte
+		numPieces int
+		expected  Message
+		expectErr error // errInvalidMessage for a *wireError
+	}{
+		{name: "keep alive", data: frame(0)},
+		{name: "unchoke", data: frame(1, Unchoke), expected: Message{1, Unchoke, []byte{}}},
+		{name: "have", data: frame(5, Have, 0, 0, 0, 7), expected: Message{5, Have, []byte{0, 0, 0, 7}}},
+		{name: "bitfield", data: frame(3, Bitfield, 0xff, 0xc0), numPieces: 10, expected: Message{3, Bitfield, []byte{0xff, 0xc0}}},
+		{name: "bitfield before metadata", data: frame(4, Bitfield, 1, 2, 3), expected: Message{4, Bitfield, []byte{1, 2, 3}}},
+		{name: "extended", data: frame(3, Extended, 1, 'x'), expected: Message{3, Extended, []byte{1, 'x'}}},
+		{name: "unknown id", data: frame(2, 99, 0), expected: Message{2, 99, []byte{0}}},
+		{name: "choke with payload", data: frame(2, Choke, 0), expectErr: errInvalidMessage},
+		{name: "short have", data: frame(4, Have, 0, 0, 7), expectErr: errInvalidMessage},
+		{name: "long request", data: frame(14, Request), expectErr: errInvalidMessage},
+		{name: "piece longer than a block", data: frame(BlockLen+10, PIECE), expectErr: errInvalidMessage},
+		{name: "bitfield too long", data: frame(4, Bitfield, 0xff, 0xc0, 0), numPieces: 10, expectErr: errInvalidMessage},
+		{name: "bitfield spare bits", data: frame(3, Bitfield, 0xff, 0xe0), numPieces: 10, expectErr: errInvalidMessage},
+		{name: "extended without id", data: frame(1, Extended), expectErr: errInvalidMessage},
+		{name: "too long", data: frame(maxMessageLen + 1), expectErr: errInvalidMessage},
+		{name: "truncated payload", data: frame(5, Have, 0, 0), expectErr: io.ErrUnexpectedEOF},
+		{name: "truncated length", data: []byte{0, 0}, expectErr: io.ErrUnexpectedEOF},
+		{name: "empty", expectErr: io.EOF},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			message, err := readMessage(bytes.NewReader(tc.data), tc.numPieces)
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Fatalf("Expected %v, got %v", tc.expectErr, err)
+				}
+				var wireErr *wireError
+				if errors.As(err, &wireErr) != (tc.expectErr == errInvalidMessage) {
+					t.Errorf("Expected a wireError only for invalid messages, got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if message.lengthPrefix != tc.expected.lengthPrefix || message.id != tc.expected.id || !bytes.Equal(message.payload, tc.expected.payload) {
+				t.Errorf("Expected %v, got %v", tc.expected, message)
+			}
+		})
+	}
+}
+
+func TestOutOfRangePiece(t *testing.T) {
+	seedDir := t.TempDir()
+	torrent, err := NewTorrentFromMetaInfo(newSeedData(t, seedDir), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.downloadDir = t.TempDir()
+	first, _ := os.ReadFile(filepath.Join(seedDir, "data", "first"))
+	numPieces := len(torrent.pieces)
+
+	testCases := []struct {
+		name   string
+		index  int
+		offset int
+	}{
+		{name: "index past the last piece", index: numPieces},
+		{name: "offset past the last block", index: 0, offset: len(torrent.pieces[0].blocks) * BlockLen},
+	}
+
+	pr := newPeerReader(newPeer("10.0.0.1", "6881", torrent.infoHash, torrent))
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := binary.BigEndian.AppendUint32(nil, uint32(tc.index))
+			payload = binary.BigEndian.AppendUint32(payload, uint32(tc.offset))
+			payload = append(payload, 1, 2, 3)
+			err := pr.dispatch(context.Background(), Message{uint32(1 + len(payload)), PIECE, payload})
+			var wireErr *wireError
+			if !errors.As(err, &wireErr) {
+				t.Errorf("Expected a wireError, got %v", err)
+			}
+		})
+	}
+
+	// one that gets past the reader doesn't stop the blocks after it being handled
+	go torrent.torrentBlockHandler()
+	defer torrent.cancel()
+	torrent.torrentBlockCH <- TorrentBlock{numPieces, 0, first[:BlockLen], nil}
+	torrent.torrentBlockCH <- TorrentBlock{0, 0, first[:BlockLen], nil}
+	// which has been handled once the handler takes the next
+	torrent.torrentBlockCH <- TorrentBlock{numPieces, 0, first[:BlockLen], nil}
+	if !torrent.pieces[0].isVerified.Load() {
+		t.Errorf("Expected the valid block to be handled after the out of range one")
+	}
+}
+
+func TestUnrequestedBlock(t *testing.T) {
+	torrent, err := NewTorrentFromMetaInfo(newSeedData(t, t.TempDir()), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := newPeer("10.0.0.1", "6881", torrent.infoHash, torrent)
+	pr := newPeerReader(peer)
+	block := pieceMessage{1, 0, make([]byte, BlockLen)}
+	handed := func() bool {
+		t.Helper()
+		got := make(chan TorrentBlock, 1)
+		go func() {
+			select {
+			case b := <-torrent.torrentBlockCH:
+				got <- b
+			case <-time.After(100 * time.Millisecond):
+			}
+		}()
+		if err := pr.dispatch(context.Background(), block.encode()); err != nil {
+			t.Fatalf("Expected a block to never disconnect them, got %v", err)
+		}
+		select {
+		case <-got:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	if handed() {
+		t.Errorf("Expected a block we never asked for to be ignored")
+	}
+	peer.requested[blockRequest{1, 0, BlockLen}] = true
+	if !handed() {
+		t.Errorf("Expected the block we asked for to be handed to the torrent")
+	}
+	if handed() || len(peer.requested) != 0 {
+		t.Errorf("Expected the block sent a second time to be ignored, with %d requests left", len(peer.requested))
+	}
+	// nor can they reject what they've already sent
+	if err := peer.releaseRequest(blockRequest{1, 0, BlockLen}); !errors.Is(err, errInvalidMessage) {
+		t.Errorf("Expected %v rejecting a block that was sent, got %v", errInvalidMessage, err)
+	}
+}
+
+func TestReadMessageStream(t *testing.T) {
+	// messages back to back, read a byte at a time, come out whole
+	var stream []byte
+	messages := []Message{{1, Interested, []byte{}}, {13, Request, make([]byte, 12)}, {9 + 100, PIECE, bytes.Repeat([]byte{7}, 108)}}
+	for _, message := range messages {
+		stream = append(stream, message.marshall()...)
+	}
+	r := bufio.NewReader(io.LimitReader(&oneByteReader{bytes.NewReader(stream)}, int64(len(stream))))
+	for _, expected := range messages {
+		message, err := readMessage(r, 0)
+		if err != nil || message.id != expected.id || !bytes.Equal(message.payload, expected.payload) {
+			t.Fatalf("Expected %v, got %v %v", expected, message, err)
+		}
+	}
+	if _, err := readMessage(r, 0); err != io.EOF {
+		t.Errorf("Expected EOF at the end of the stream, got %v", err)
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (ob *oneByteReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return ob.r.Read(b[:1])
+}
+
+func TestSplitExtended(t *testing.T) {
+	testCases := []struct {
+		name      string
+		payload   string
+		dict      string
+		rest      string
+		expectErr bool
+	}{
+		{name: "dictionary only", payload: "d8:msg_typei0e5:piecei0ee", dict: "d8:msg_typei0e5:piecei0ee"},
+		{name: "metadata piece", payload: "d8:msg_typei1e5:piecei0e10:total_sizei3eeabc", dict: "d8:msg_typei1e5:piecei0e10:total_sizei3ee", rest: "abc"},
+		// which the old search for "ee" got wrong
+		{name: "nested", payload: "d1:md11:ut_metadatai1eeeee", dict: "d1:md11:ut_metadatai1eee", rest: "ee"},
+		{name: "not a dictionary", payload: "i1e", expectErr: true},
+		{name: "unterminated", payload: "d1:ai1e", expectErr: true},
+		{name: "empty", payload: "", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dict, rest, err := splitExtended([]byte(tc.payload))
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected an error, got %q %q", dict, rest)
+				}
+				return
+			}
+			if err != nil || string(dict) != tc.dict || string(rest) != tc.rest {
+				t.Errorf("Expected %q %q, got %q %q %v", tc.dict, tc.rest, dict, rest, err)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     []byte
+		expected peerMessage
+	}{
+		{name: "choke", data: frame(1, Choke), expected: chokeMessage{}},
+		{name: "not interested", data: frame(1, NotInterested), expected: notInterestedMessage{}},
+		{name: "have all", data: frame(1, HaveAll), expected: haveAllMessage{}},
+		{name: "have", data: frame(5, Have, 0, 0, 1, 2), expected: haveMessage{258}},
+		{name: "allowed fast", data: frame(5, AllowedFast, 0, 0, 0, 9), expected: allowedFastMessage{9}},
+		{name: "bitfield", data: frame(3, Bitfield, 0xff, 0xc0), expected: bitfieldMessage{[]byte{0xff, 0xc0}}},
+		{name: "request", data: frame(13, Request, 0, 0, 0, 3, 0, 0, 0x40, 0, 0, 0, 0x40, 0), expected: requestMessage{3, BlockLen, BlockLen}},
+		{name: "reject", data: frame(13, Reject, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 10), expected: rejectMessage{3, 0, 10}},
+		{name: "piece", data: frame(12, PIECE, 0, 0, 0, 1, 0, 0, 0x40, 0, 'a', 'b', 'c'), expected: pieceMessage{1, BlockLen, []byte("abc")}},
+		{name: "port", data: frame(3, Port, 0x1a, 0xe1), expected: portMessage{6881}},
+		{name: "extended", data: frame(3, Extended, 1, 'x'), expected: ExtendedMessage{3, Extended, 1, []byte{'x'}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			message, err := readMessage(bytes.NewReader(tc.data), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decodeMessage(message)
+			if err != nil || !reflect.DeepEqual(decoded, tc.expected) {
+				t.Fatalf("Expected %#v, got %#v %v", tc.expected, decoded, err)
+			}
+			encoded := tc.expected.encode()
+			if !bytes.Equal(encoded.marshall(), tc.data) {
+				t.Errorf("Expected %#v to encode to %x, got %x", tc.expected, tc.data, encoded.marshall())
+			}
+		})
+	}
+
+	// which can be given messages that didn't come from readMessage
+	var wireErr *wireError
+	if _, err := decodeMessage(Message{3, Have, []byte{0, 1}}); !errors.As(err, &wireErr) {
+		t.Errorf("Expected a wireError for a short have, got %v", err)
+	}
+	if _, err := decodeMessage(Message{1, 99, nil}); !errors.As(err, &wireErr) {
+		t.Errorf("Expected a wireError for an unknown message, got %v", err)
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(frame(5, Have, 0, 0, 0, 7), 0)
+	f.Add(frame(3, Bitfield, 0xff, 0xc0), 10)
+	f.Add(append(frame(13, Request), make([]byte, 12)...), 0)
+	f.Add(frame(4, Extended, 0, 'd', 'e'), 0)
+	f.Add(frame(0), 0)
+	f.Fuzz(func(t *testing.T, data []byte, numPieces int) {
+		if numPieces < 0 || numPieces > 1<<16 {
+			return
+		}
+		if len(data) > 0 {
+			// taking data as an id and payload, what we marshall reads back the same unless it's refused
+			sent := Message{uint32(len(data)), int(data[0]), data[1:]}
+			read, err := readMessage(bytes.NewReader(sent.marshall()), numPieces)
+			shortest, longest := messageLengths(sent.id, numPieces)
+			fits := len(data) >= shortest && len(data) <= longest
+			var wireErr *wireError
+			switch {
+			case err != nil && !errors.As(err, &wireErr):
+				t.Fatalf("Expected message %d to be read or refused, got %v", sent.id, err)
+			case err != nil && fits && sent.id != Bitfield:
+				t.Fatalf("Expected message %d of length %d to be read, got %v", sent.id, len(data), err)
+			case err == nil && !fits:
+				t.Fatalf("Expected message %d of length %d to be refused", sent.id, len(data))
+			case err == nil && (read.lengthPrefix != sent.lengthPrefix || read.id != sent.id || !bytes.Equal(read.payload, sent.payload)):
+				t.Fatalf("Expected %v to read back the same, got %v", sent, read)
+			}
+		}
+		r := bytes.NewReader(data)
+		message, err := readMessage(r, numPieces)
+		if err != nil {
+			return
+		}
+		consumed := data[:len(data)-r.Len()]
+		if message.lengthPrefix == 0 {
+			if len(consumed) != 4 {
+				t.Fatalf("Expected a keep alive to be 4 bytes, read %d", len(consumed))
+			}
+			return
+		}
+		shortest, longest := messageLengths(message.id, numPieces)
+		if int(message.lengthPrefix) < shortest || int(message.lengthPrefix) > longest {
+			t.Fatalf("Accepted message %d of length %d", message.id, message.lengthPrefix)
+		}
+		if !bytes.Equal(message.marshall(), consumed) {
+			t.Fatalf("Expected %x to marshall back to what was read, got %x", consumed, message.marshall())
+		}
+		if message.id == Extended {
+			// mustn't panic whatever follows the extended id
+			splitExtended(message.extended().payload)
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add(byte(Have), []byte{0, 0, 0, 7})
+	f.Add(byte(Request), make([]byte, 12))
+	f.Add(byte(PIECE), []byte{0, 0, 0, 1, 0, 0, 0, 0, 'a'})
+	f.Add(byte(Port), []byte{0x1a, 0xe1})
+	f.Add(byte(Extended), []byte{1, 'd', 'e'})
+	f.Add(byte(HaveNone), []byte{})
+	f.Fuzz(func(t *testing.T, id byte, payload []byte) {
+		message := Message{uint32(1 + len(payload)), int(id), payload}
+		decoded, err := decodeMessage(message)
+		if err != nil {
+			return
+		}
+		// what we decode encodes back to the same bytes, and decodes to the same again
+		encoded := decoded.encode()
+		if !bytes.Equal(encoded.marshall(), message.marshall()) {
+			t.Fatalf("Expected %#v to encode to %x, got %x", decoded, message.marshall(), encoded.marshall())
+		}
+		again, err := decodeMessage(encoded)
+		if err != nil || !reflect.DeepEqual(again, decoded) {
+			t.Fatalf("Expected %#v to decode to the same, got %#v %v", decoded, again, err)
+		}
+	})
+}
+
+func FuzzSplitExtended(f *testing.F) {
+	f.Add([]byte("d8:msg_typei1e5:piecei0e10:total_sizei3eeabc"))
+	f.Add([]byte("d1:md11:ut_metadatai1eeee"))
+	f.Add([]byte("d1:ai-1e1:bl1:xee"))
+	f.Add([]byte("i1e"))
+	f.Add([]byte("200000000000"))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		// mustn't panic whatever the peer sent
+		decodeHandshake(payload)
+		decodeMetadataRequest(payload)
+		dict, rest, err := splitExtended(payload)
+		if err != nil {
+			return
+		}
+		if dict[0] != 'd' || dict[len(dict)-1] != 'e' || !bytes.Equal(append(dict[:len(dict):len(dict)], rest...), payload) {
+			t.Fatalf("Expected %q to split into a dictionary and the rest, got %q %q", payload, dict, rest)
+		}
+	})
+}
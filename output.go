@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gotorrent/client"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes of a download, so that scripts wrapping gotorrent can tell what went wrong. With several torrents
+// the worst of their codes is used, 2 is left for usage errors as that's what the flag package exits with
+const (
+	exitSuccess     = 0
+	exitError       = 1   // couldn't start, e.g. an unreadable .torrent file
+	exitNoPeers     = 3   // ran out of peers before finishing
+	exitMetadata    = 4   // connected to peers but never got the metadata from them
+	exitStorage     = 5   // downloaded, but couldn't write everything to disk
+	exitInterrupted = 130 // stopped by ctrl-c
+)
+
+// exitSeverity orders the exit codes from least to most severe
+var exitSeverity = []int{exitSuccess, exitInterrupted, exitNoPeers, exitMetadata, exitError, exitStorage}
+
+// worseExit returns whichever of two exit codes is more severe
+func worseExit(a int, b int) int {
+	for _, code := range exitSeverity {
+		if code == a {
+			return b
+		}
+		if code == b {
+			return a
+		}
+	}
+	return a
+}
+
+// results of a download as reported in summary records
+var exitResults = map[int]string{
+	exitSuccess:     "success",
+	exitError:       "error",
+	exitNoPeers:     "no_peers",
+	exitMetadata:    "metadata_failed",
+	exitStorage:     "storage_failed",
+	exitInterrupted: "interrupted",
+}
+
+const progressInterval = time.Second
+
+// reporter writes what's happening to each torrent as newline-delimited JSON for -output=json, leaving stdout
+// untouched otherwise
+type reporter struct {
+	out io.Writer // nil unless reporting in JSON
+	mx  sync.Mutex
+}
+
+// recordHeader starts every record
+type recordHeader struct {
+	Type     string    `json:"type"` // state, progress, file, storage_error or summary
+	Time     time.Time `json:"time"`
+	InfoHash string    `json:"info_hash"`
+	Name     string    `json:"name"`
+}
+
+type stateRecord struct {
+	recordHeader
+	State string `json:"state"`
+}
+
+type progressRecord struct {
+	recordHeader
+	BytesDownloaded  int      `json:"bytes_downloaded"`
+	BytesWanted      int      `json:"bytes_wanted"`
+	PiecesDownloaded int      `json:"pieces_downloaded"`
+	PiecesWanted     int      `json:"pieces_wanted"`
+	DownloadRate     int      `json:"download_rate"` // bytes per second
+	UploadRate       int      `json:"upload_rate"`
+	Peers            int      `json:"peers"`
+	KnownPeers       int      `json:"known_peers"`
+	ETA              *float64 `json:"eta_seconds"` // null when we aren't downloading
+}
+
+type fileRecord struct {
+	recordHeader
+	Path string `json:"path"`
+}
+
+type storageErrorRecord struct {
+	recordHeader
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type summaryRecord struct {
+	recordHeader
+	Result          string  `json:"result"`
+	ExitCode        int     `json:"exit_code"`
+	Error           string  `json:"error,omitempty"`
+	BytesDownloaded int     `json:"bytes_downloaded"`
+	BytesWanted     int     `json:"bytes_wanted"`
+	Elapsed         float64 `json:"elapsed_seconds"`
+}
+
+func newReporter(format string) (*reporter, error) {
+	switch format {
+	case "text":
+		return &reporter{}, nil
+	case "json":
+		return &reporter{out: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, use text or json", format)
+	}
+}
+
+// human returns where messages meant for people go, stderr when stdout is reserved for JSON
+func (r *reporter) human() io.Writer {
+	if r.out != nil {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+func (r *reporter) write(record interface{}) {
+	if r.out == nil {
+		return
+	}
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	json.NewEncoder(r.out).Encode(record)
+}
+
+func newHeader(recordType string, torrent *client.Torrent) recordHeader {
+	info := torrent.Info()
+	infoHash := info.InfoHash
+	if len(infoHash) == 0 {
+		infoHash = info.InfoHashV2
+	}
+	return recordHeader{Type: recordType, Time: time.Now(), InfoHash: hex.EncodeToString(infoHash), Name: info.Name}
+}
+
+// stateName returns a state's name in the snake case used throughout the records
+func stateName(state int) string {
+	return strings.ReplaceAll(client.StateName(state), " ", "_")
+}
+
+// download waits for a torrent to finish or ctx to be done, reporting on it along the way, and returns its exit code
+func (r *reporter) download(ctx context.Context, torrent *client.Torrent) int {
+	started := time.Now()
+	sub := torrent.Subscribe()
+	defer sub.Close()
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- torrent.Wait(ctx) }()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	connected := false
+	var storageErr error
+	handle := func(ev client.Event) {
+		switch ev.Type {
+		case client.EventPeerConnected:
+			connected = true
+		case client.EventFileCompleted:
+			r.write(fileRecord{newHeader("file", torrent), ev.File})
+		case client.EventStorageError:
+			storageErr = ev.Err
+			r.write(storageErrorRecord{newHeader("storage_error", torrent), ev.File, ev.Err.Error()})
+		}
+	}
+
+	lastState := -1
+	reportState := func() {
+		state := torrent.Stats().State
+		if state != lastState {
+			lastState = state
+			r.write(stateRecord{newHeader("state", torrent), stateName(state)})
+		}
+	}
+	reportState()
+
+	var err error
+	events := sub.Events()
+wait:
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// the client was closed
+				events = nil
+				continue
+			}
+			handle(ev)
+			if ev.Type == client.EventMetadataReceived {
+				reportState()
+			}
+		case <-ticker.C:
+			reportState()
+			r.write(newProgressRecord(torrent))
+		case err = <-waitErr:
+			break wait
+		}
+	}
+	// files are reported as they're written, which happens before Wait returns
+	sub.Drain()
+	for ev := range sub.Events() {
+		handle(ev)
+	}
+	reportState()
+
+	stats := torrent.Stats()
+	outcome := downloadOutcome{err, storageErr, ctx.Err() != nil, connected, torrent.Info().HasMetadata}
+	code := outcome.exitCode()
+	if storageErr != nil {
+		err = storageErr
+	}
+
+	summary := summaryRecord{
+		recordHeader:    newHeader("summary", torrent),
+		Result:          exitResults[code],
+		ExitCode:        code,
+		BytesDownloaded: stats.BytesDownloaded,
+		BytesWanted:     stats.BytesWanted,
+		Elapsed:         time.Since(started).Seconds(),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+		fmt.Fprintln(r.human(), torrent.Info().Name+": "+err.Error())
+	}
+	r.write(summary)
+	return code
+}
+
+// downloadOutcome is how a download ended, err being what Wait returned
+type downloadOutcome struct {
+	err         error
+	storageErr  error // the last storage error, which is reported even if Wait succeeded
+	interrupted bool
+	connected   bool // to any peer
+	hasMetadata bool
+}
+
+// exitCode returns the exit code of a download that ended in outcome
+func (outcome downloadOutcome) exitCode() int {
+	switch {
+	case outcome.storageErr != nil:
+		return exitStorage
+	case outcome.err == nil:
+		return exitSuccess
+	case outcome.interrupted:
+		return exitInterrupted
+	case errors.Is(outcome.err, client.ErrBadMetadata), outcome.connected && !outcome.hasMetadata:
+		return exitMetadata
+	default:
+		return exitNoPeers
+	}
+}
+
+func newProgressRecord(torrent *client.Torrent) progressRecord {
+	stats := torrent.Stats()
+	record := progressRecord{
+		recordHeader:     newHeader("progress", torrent),
+		BytesDownloaded:  stats.BytesDownloaded,
+		BytesWanted:      stats.BytesWanted,
+		PiecesDownloaded: stats.PiecesDownloaded,
+		PiecesWanted:     stats.PiecesWanted,
+		DownloadRate:     stats.DownloadRate,
+		UploadRate:       stats.UploadRate,
+		Peers:            stats.ConnectedPeers,
+		KnownPeers:       stats.KnownPeers,
+	}
+	if stats.State == client.StateDownloading && stats.DownloadRate > 0 {
+		eta := float64(stats.BytesWanted-stats.BytesDownloaded) / float64(stats.DownloadRate)
+		record.ETA = &eta
+	}
+	return record
+}
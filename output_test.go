@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gotorrent/client"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWorseExit(t *testing.T) {
+	testCases := []struct {
+		a        int
+		b        int
+		expected int
+	}{
+		{exitSuccess, exitSuccess, exitSuccess},
+		{exitSuccess, exitInterrupted, exitInterrupted},
+		{exitInterrupted, exitNoPeers, exitNoPeers},
+		{exitNoPeers, exitMetadata, exitMetadata},
+		{exitMetadata, exitError, exitError},
+		{exitError, exitStorage, exitStorage},
+		{exitSuccess, exitStorage, exitStorage},
+	}
+
+	for _, tc := range testCases {
+		// whichever order they come in
+		if got := worseExit(tc.a, tc.b); got != tc.expected {
+			t.Errorf("Expected worseExit(%d, %d) to be %d, got %d", tc.a, tc.b, tc.expected, got)
+		}
+		if got := worseExit(tc.b, tc.a); got != tc.expected {
+			t.Errorf("Expected worseExit(%d, %d) to be %d, got %d", tc.b, tc.a, tc.expected, got)
+		}
+	}
+
+	// every code has a place in the order and a result for summaries
+	for _, code := range []int{exitSuccess, exitError, exitNoPeers, exitMetadata, exitStorage, exitInterrupted} {
+		found := false
+		for _, ordered := range exitSeverity {
+			found = found || ordered == code
+		}
+		if !found {
+			t.Errorf("Exit code %d is missing from exitSeverity", code)
+		}
+		if exitResults[code] == "" {
+			t.Errorf("Exit code %d has no result", code)
+		}
+	}
+}
+
+func TestDownloadExitCode(t *testing.T) {
+	stopped := errors.New("torrent stopped before it finished downloading")
+	testCases := []struct {
+		name     string
+		outcome  downloadOutcome
+		expected int
+	}{
+		{name: "downloaded", outcome: downloadOutcome{hasMetadata: true, connected: true}, expected: exitSuccess},
+		{name: "no peers", outcome: downloadOutcome{err: stopped}, expected: exitNoPeers},
+		{name: "peers ran out with the metadata", outcome: downloadOutcome{err: stopped, connected: true, hasMetadata: true}, expected: exitNoPeers},
+		{name: "peers never sent the metadata", outcome: downloadOutcome{err: stopped, connected: true}, expected: exitMetadata},
+		{name: "metadata couldn't be parsed", outcome: downloadOutcome{err: fmt.Errorf("%w: bad", client.ErrBadMetadata)}, expected: exitMetadata},
+		{name: "storage", outcome: downloadOutcome{storageErr: errors.New("disk full"), hasMetadata: true}, expected: exitStorage},
+		{name: "storage beats interrupted", outcome: downloadOutcome{err: stopped, storageErr: errors.New("disk full"), interrupted: true}, expected: exitStorage},
+		{name: "interrupted", outcome: downloadOutcome{err: stopped, interrupted: true, connected: true}, expected: exitInterrupted},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.outcome.exitCode(); got != tc.expected {
+				t.Errorf("Expected exit code %d, got %d", tc.expected, got)
+			}
+		})
+	}
+
+	// which are the codes scripts rely on
+	if exitError != 1 || exitNoPeers != 3 || exitMetadata != 4 || exitStorage != 5 || exitInterrupted != 130 {
+		t.Errorf("Exit codes have changed: %d %d %d %d %d", exitError, exitNoPeers, exitMetadata, exitStorage, exitInterrupted)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	header := func(recordType string) recordHeader {
+		return recordHeader{Type: recordType, Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), InfoHash: "abcd", Name: "ubuntu"}
+	}
+	eta := 2.5
+	testCases := []struct {
+		name     string
+		record   interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:   "state",
+			record: stateRecord{header("state"), stateName(client.StateFetchingMetadata)},
+			expected: map[string]interface{}{
+				"type": "state", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu", "state": "fetching_metadata",
+			},
+		},
+		{
+			name:   "progress",
+			record: progressRecord{header("progress"), 10, 20, 1, 2, 4, 0, 3, 9, &eta},
+			expected: map[string]interface{}{
+				"type": "progress", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu",
+				"bytes_downloaded": 10.0, "bytes_wanted": 20.0, "pieces_downloaded": 1.0, "pieces_wanted": 2.0,
+				"download_rate": 4.0, "upload_rate": 0.0, "peers": 3.0, "known_peers": 9.0, "eta_seconds": 2.5,
+			},
+		},
+		{
+			name:   "progress without an eta",
+			record: progressRecord{recordHeader: header("progress")},
+			expected: map[string]interface{}{
+				"type": "progress", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu",
+				"bytes_downloaded": 0.0, "bytes_wanted": 0.0, "pieces_downloaded": 0.0, "pieces_wanted": 0.0,
+				"download_rate": 0.0, "upload_rate": 0.0, "peers": 0.0, "known_peers": 0.0, "eta_seconds": nil,
+			},
+		},
+		{
+			name:   "file",
+			record: fileRecord{header("file"), "ubuntu/ubuntu.iso"},
+			expected: map[string]interface{}{
+				"type": "file", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu", "path": "ubuntu/ubuntu.iso",
+			},
+		},
+		{
+			name:   "summary",
+			record: summaryRecord{header("summary"), exitResults[exitError], exitError, "could not start", 0, 20, 1.5},
+			expected: map[string]interface{}{
+				"type": "summary", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu",
+				"result": "error", "exit_code": 1.0, "error": "could not start", "bytes_downloaded": 0.0, "bytes_wanted": 20.0,
+				"elapsed_seconds": 1.5,
+			},
+		},
+		{
+			name:   "successful summary",
+			record: summaryRecord{header("summary"), exitResults[exitSuccess], exitSuccess, "", 20, 20, 1.5},
+			expected: map[string]interface{}{
+				"type": "summary", "time": "2026-01-02T03:04:05Z", "info_hash": "abcd", "name": "ubuntu",
+				"result": "success", "exit_code": 0.0, "bytes_downloaded": 20.0, "bytes_wanted": 20.0, "elapsed_seconds": 1.5,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			r := &reporter{out: &out}
+			r.write(tc.record)
+
+			// one record per line
+			line := out.Bytes()
+			if bytes.Count(line, []byte("\n")) != 1 || line[len(line)-1] != '\n' {
+				t.Fatalf("Expected a single line, got %q", line)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(line, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	// a text reporter has nowhere to write records
+	text, _ := newReporter("text")
+	text.write(stateRecord{header("state"), "downloading"})
+	if _, err := newReporter("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown output format")
+	}
+}
@@ -0,0 +1,762 @@
+package rpc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gotorrent/client"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Torrent statuses from the transmission spec
+const (
+	statusStopped      = 0
+	statusCheckWait    = 1
+	statusCheck        = 2
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+// Torrent error codes from the transmission spec
+const (
+	errorNone           = 0
+	errorTrackerWarning = 1
+	errorTrackerError   = 2
+	errorLocal          = 3
+)
+
+const maxTorrentFileSize = 10 << 20 // for .torrent files fetched by url
+
+var errNoSuchTorrent = errors.New("no torrent with that id")
+
+// resolve turns the "ids" argument of a method into which of entries it refers to. It may be left out for every
+// torrent, be a single id or hash, "recently-active", or a list of ids and hashes. Must be called with mx held
+func (server *Server) resolve(entries []*torrentEntry, ids json.RawMessage) ([]*torrentEntry, error) {
+	if len(ids) == 0 || string(ids) == "null" {
+		return entries, nil
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(ids, &list) != nil {
+		var single string
+		if json.Unmarshal(ids, &single) == nil && single == "recently-active" {
+			var active []*torrentEntry
+			for _, entry := range entries {
+				if time.Since(entry.active) < recentlyActive || entry.handle.Stats().State == client.StateDownloading {
+					active = append(active, entry)
+				}
+			}
+			return active, nil
+		}
+		list = []json.RawMessage{ids}
+	}
+
+	var resolved []*torrentEntry
+	for _, raw := range list {
+		var id int
+		var hash string
+		switch {
+		case json.Unmarshal(raw, &id) == nil:
+			entry, ok := server.byID[id]
+			if !ok {
+				return nil, errNoSuchTorrent
+			}
+			resolved = append(resolved, entry)
+		case json.Unmarshal(raw, &hash) == nil:
+			infoHash, err := hex.DecodeString(hash)
+			if err != nil {
+				return nil, errors.New("invalid torrent hash " + hash)
+			}
+			handle := server.client.Get(infoHash)
+			if handle == nil {
+				return nil, errNoSuchTorrent
+			}
+			resolved = append(resolved, server.entry(handle))
+		default:
+			return nil, errors.New("invalid torrent id")
+		}
+	}
+	return resolved, nil
+}
+
+type torrentAddArgs struct {
+	Filename      string `json:"filename"` // a magnet link, url of a .torrent file or path to one
+	Metainfo      string `json:"metainfo"` // a base64 encoded .torrent file
+	Paused        bool   `json:"paused"`
+	DownloadDir   string `json:"download-dir"`
+	FilesWanted   []int  `json:"files-wanted"` // only applied if we already have the metadata, ie not for magnet links
+	FilesUnwanted []int  `json:"files-unwanted"`
+}
+
+func (server *Server) torrentAdd(raw json.RawMessage) (map[string]interface{}, error) {
+	var args torrentAddArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	config := server.client.Config()
+	if args.DownloadDir != "" && filepath.Clean(args.DownloadDir) != filepath.Clean(config.DownloadDir) {
+		return nil, errors.New("torrents can only be downloaded to " + config.DownloadDir)
+	}
+
+	var handle *client.Torrent
+	switch {
+	case args.Metainfo != "":
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, errors.New("invalid metainfo")
+		}
+		handle, err = server.client.AddTorrentData(data)
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		handle, err = server.client.AddMagnet(args.Filename)
+	case strings.HasPrefix(args.Filename, "http://") || strings.HasPrefix(args.Filename, "https://"):
+		var data []byte
+		data, err = fetchTorrentFile(server.client.HTTPTransport(), args.Filename)
+		if err != nil {
+			return nil, err
+		}
+		handle, err = server.client.AddTorrentData(data)
+	case args.Filename != "":
+		handle, err = server.client.AddTorrentFile(args.Filename)
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+
+	duplicate := errors.Is(err, client.ErrDuplicate)
+	if err != nil && !duplicate {
+		return nil, err
+	}
+
+	server.mx.Lock()
+	entry := server.entry(handle)
+	server.mx.Unlock()
+	added := map[string]interface{}{
+		"id":         entry.id,
+		"name":       handle.Info().Name,
+		"hashString": hashString(handle.Info()),
+	}
+	if duplicate {
+		return map[string]interface{}{"torrent-duplicate": added}, nil
+	}
+
+	if args.Paused {
+		handle.Pause()
+	}
+	for _, i := range args.FilesUnwanted {
+		handle.SetFilePriority(i, client.PrioritySkip)
+	}
+	for _, i := range args.FilesWanted {
+		handle.SetFilePriority(i, client.PriorityNormal)
+	}
+	return map[string]interface{}{"torrent-added": added}, nil
+}
+
+// fetchTorrentFile downloads a .torrent file for torrent-add over the client's transport, so that it goes through
+// the same proxy as everything else
+func fetchTorrentFile(transport http.RoundTripper, url string) ([]byte, error) {
+	httpClient := http.Client{Timeout: 30 * time.Second, Transport: transport}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("could not fetch torrent file: " + resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTorrentFileSize {
+		return nil, errors.New("torrent file is too large")
+	}
+	return data, nil
+}
+
+func hashString(info client.Info) string {
+	if len(info.InfoHash) != 0 {
+		return hex.EncodeToString(info.InfoHash)
+	}
+	return hex.EncodeToString(info.InfoHashV2)
+}
+
+type torrentGetArgs struct {
+	IDs    json.RawMessage `json:"ids"`
+	Fields []string        `json:"fields"`
+	Format string          `json:"format"` // "objects" by default, or "table"
+}
+
+func (server *Server) torrentGet(raw json.RawMessage) (map[string]interface{}, error) {
+	var args torrentGetArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	all := server.sync()
+	entries, err := server.resolve(all, args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	position := make(map[*torrentEntry]int)
+	for i, entry := range all {
+		position[entry] = i
+	}
+
+	result := map[string]interface{}{}
+	var objects []map[string]interface{}
+	for _, entry := range entries {
+		objects = append(objects, server.torrentFields(entry, position[entry], args.Fields))
+	}
+
+	if args.Format == "table" {
+		table := []interface{}{args.Fields}
+		for _, object := range objects {
+			row := make([]interface{}, len(args.Fields))
+			for i, field := range args.Fields {
+				row[i] = object[field]
+			}
+			table = append(table, row)
+		}
+		result["torrents"] = table
+	} else {
+		if objects == nil {
+			objects = []map[string]interface{}{}
+		}
+		result["torrents"] = objects
+	}
+
+	var ids string
+	json.Unmarshal(args.IDs, &ids)
+	if ids == "recently-active" {
+		result["removed"] = server.recentlyRemoved()
+	}
+	return result, nil
+}
+
+// torrentFields returns the requested fields of a torrent, leaving out any we don't know
+func (server *Server) torrentFields(entry *torrentEntry, position int, fields []string) map[string]interface{} {
+	info := entry.handle.Info()
+	stats := entry.handle.Stats()
+	files := entry.handle.Files()
+	left := stats.BytesWanted - stats.BytesDownloaded
+
+	object := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		var value interface{}
+		switch field {
+		case "id":
+			value = entry.id
+		case "name":
+			value = info.Name
+		case "hashString":
+			value = hashString(info)
+		case "status":
+			value = status(stats.State)
+		case "error":
+			value = errorNone
+			if stats.State == client.StateStopped {
+				value = errorLocal
+			}
+		case "errorString":
+			value = ""
+			if stats.State == client.StateStopped {
+				value = "stopped before it finished, most likely out of peers"
+			}
+		case "addedDate":
+			value = entry.added.Unix()
+		case "activityDate":
+			value = entry.active.Unix()
+		case "doneDate":
+			value = 0
+			if !entry.done.IsZero() {
+				value = entry.done.Unix()
+			}
+		case "comment":
+			value = info.Comment
+		case "creator":
+			value = info.CreatedBy
+		case "downloadDir":
+			value = server.client.Config().DownloadDir
+		case "isPrivate":
+			value = info.Private
+		case "isFinished":
+			value = stats.State == client.StateDone || stats.State == client.StateSeeding
+		case "isStalled":
+			value = false
+		case "magnetLink":
+			value = entry.handle.MagnetLink()
+		case "metadataPercentComplete":
+			value = 0
+			if info.HasMetadata {
+				value = 1
+			}
+		case "pieceCount":
+			value = info.NumPieces
+		case "pieceSize":
+			value = info.PieceLength
+		case "totalSize":
+			value = info.Length
+		case "sizeWhenDone":
+			value = stats.BytesWanted
+		case "leftUntilDone":
+			value = left
+		case "haveValid":
+			value = stats.BytesDownloaded
+		case "haveUnchecked":
+			value = 0
+		case "percentDone":
+			value = 0.0
+			if stats.BytesWanted != 0 {
+				value = float64(stats.BytesDownloaded) / float64(stats.BytesWanted)
+			} else if info.HasMetadata {
+				value = 1.0
+			}
+		case "downloadedEver":
+			value = stats.BytesReceived
+		case "uploadedEver":
+			value = stats.BytesSent
+		case "uploadRatio":
+			value = -1.0
+			if stats.BytesReceived != 0 {
+				value = float64(stats.BytesSent) / float64(stats.BytesReceived)
+			}
+		case "rateDownload":
+			value = stats.DownloadRate
+		case "rateUpload":
+			value = stats.UploadRate
+		case "downloadLimit":
+			value = entry.downloadLimit
+		case "downloadLimited":
+			value = entry.downloadLimited
+		case "uploadLimit":
+			value = entry.uploadLimit
+		case "uploadLimited":
+			value = entry.uploadLimited
+		case "eta":
+			value = -1
+			if stats.DownloadRate > 0 && left > 0 {
+				value = left / stats.DownloadRate
+			}
+		case "peersConnected", "peersSendingToUs":
+			value = stats.ConnectedPeers
+		case "peersGettingFromUs":
+			value = 0
+		case "queuePosition":
+			value = position
+		case "recheckProgress":
+			value = 0.0
+		case "labels":
+			value = []string{}
+		case "files":
+			list := []map[string]interface{}{}
+			for _, file := range files {
+				list = append(list, map[string]interface{}{"name": file.Path, "length": file.Length, "bytesCompleted": file.BytesCompleted})
+			}
+			value = list
+		case "fileStats":
+			list := []map[string]interface{}{}
+			for _, file := range files {
+				list = append(list, map[string]interface{}{"bytesCompleted": file.BytesCompleted, "wanted": file.Priority != client.PrioritySkip, "priority": 0})
+			}
+			value = list
+		case "wanted":
+			wanted := []int{}
+			for _, file := range files {
+				if file.Priority == client.PrioritySkip {
+					wanted = append(wanted, 0)
+				} else {
+					wanted = append(wanted, 1)
+				}
+			}
+			value = wanted
+		case "priorities":
+			value = make([]int, len(files)) // we only have normal priority
+		default:
+			continue
+		}
+		object[field] = value
+	}
+	return object
+}
+
+// status converts one of our states into a transmission status
+func status(state int) int {
+	switch state {
+	case client.StateQueued:
+		return statusDownloadWait
+	case client.StateFetchingMetadata, client.StateDownloading:
+		return statusDownload
+	case client.StateSeeding:
+		return statusSeed
+	default:
+		// finished torrents that aren't being seeded are stopped like any other
+		return statusStopped
+	}
+}
+
+type torrentSetArgs struct {
+	IDs             json.RawMessage `json:"ids"`
+	FilesWanted     []int           `json:"files-wanted"`
+	FilesUnwanted   []int           `json:"files-unwanted"`
+	DownloadLimit   *int            `json:"downloadLimit"`
+	DownloadLimited *bool           `json:"downloadLimited"`
+	UploadLimit     *int            `json:"uploadLimit"`
+	UploadLimited   *bool           `json:"uploadLimited"`
+}
+
+func (server *Server) torrentSet(raw json.RawMessage) (map[string]interface{}, error) {
+	var args torrentSetArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	if (args.DownloadLimit != nil && *args.DownloadLimit < 0) || (args.UploadLimit != nil && *args.UploadLimit < 0) {
+		return nil, errors.New("invalid torrent limit")
+	}
+
+	server.mx.Lock()
+	entries, err := server.resolve(server.sync(), args.IDs)
+	if err == nil {
+		for _, entry := range entries {
+			server.setTorrentLimits(entry, args)
+		}
+	}
+	server.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		for _, i := range args.FilesUnwanted {
+			errs = append(errs, entry.handle.SetFilePriority(i, client.PrioritySkip))
+		}
+		for _, i := range args.FilesWanted {
+			errs = append(errs, entry.handle.SetFilePriority(i, client.PriorityNormal))
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// setTorrentLimits applies any limits in args to the torrent, must be called with mx held
+func (server *Server) setTorrentLimits(entry *torrentEntry, args torrentSetArgs) {
+	if args.DownloadLimit == nil && args.DownloadLimited == nil && args.UploadLimit == nil && args.UploadLimited == nil {
+		return
+	}
+	if args.DownloadLimit != nil {
+		entry.downloadLimit = *args.DownloadLimit
+	}
+	if args.DownloadLimited != nil {
+		entry.downloadLimited = *args.DownloadLimited
+	}
+	if args.UploadLimit != nil {
+		entry.uploadLimit = *args.UploadLimit
+	}
+	if args.UploadLimited != nil {
+		entry.uploadLimited = *args.UploadLimited
+	}
+
+	var downloadRate, uploadRate int
+	if entry.downloadLimited {
+		downloadRate = entry.downloadLimit * 1000
+	}
+	if entry.uploadLimited {
+		uploadRate = entry.uploadLimit * 1000
+	}
+	entry.handle.SetRateLimits(downloadRate, uploadRate)
+}
+
+type idsArgs struct {
+	IDs json.RawMessage `json:"ids"`
+}
+
+// forEach calls fn on every torrent named by the ids argument
+func (server *Server) forEach(raw json.RawMessage, fn func(entry *torrentEntry) error) error {
+	var args idsArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return err
+	}
+
+	server.mx.Lock()
+	entries, err := server.resolve(server.sync(), args.IDs)
+	server.mx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		errs = append(errs, fn(entry))
+	}
+	return errors.Join(errs...)
+}
+
+func (server *Server) torrentStart(raw json.RawMessage) (map[string]interface{}, error) {
+	return nil, server.forEach(raw, func(entry *torrentEntry) error {
+		entry.handle.Resume()
+		return nil
+	})
+}
+
+// torrentStop pauses torrents, transmission's stopped torrents can be started again just like our paused ones
+func (server *Server) torrentStop(raw json.RawMessage) (map[string]interface{}, error) {
+	return nil, server.forEach(raw, func(entry *torrentEntry) error {
+		entry.handle.Pause()
+		return nil
+	})
+}
+
+type torrentRemoveArgs struct {
+	DeleteLocalData bool `json:"delete-local-data"`
+}
+
+func (server *Server) torrentRemove(raw json.RawMessage) (map[string]interface{}, error) {
+	var args torrentRemoveArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, server.forEach(raw, func(entry *torrentEntry) error {
+		var err error
+		if args.DeleteLocalData {
+			err = entry.handle.Delete()
+		} else {
+			err = entry.handle.Drop()
+		}
+		server.mx.Lock()
+		if _, ok := server.byID[entry.id]; ok {
+			server.forget(entry)
+		}
+		server.mx.Unlock()
+		return err
+	})
+}
+
+type sessionGetArgs struct {
+	Fields []string `json:"fields"` // every field if empty
+}
+
+func (server *Server) sessionGet(raw json.RawMessage) (map[string]interface{}, error) {
+	var args sessionGetArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	config := server.client.Config()
+	server.mx.Lock()
+	session := map[string]interface{}{
+		"version":                  "gotorrent",
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               server.sessionID,
+		"download-dir":             config.DownloadDir,
+		"peer-port":                config.ListenPort,
+		"peer-limit-global":        config.MaxConnections,
+		"peer-limit-per-torrent":   config.MaxPeersPerTorrent,
+		"speed-limit-down":         server.speedLimitDown,
+		"speed-limit-down-enabled": server.speedLimitDownEnabled,
+		"speed-limit-up":           server.speedLimitUp,
+		"speed-limit-up-enabled":   server.speedLimitUpEnabled,
+		"alt-speed-down":           server.altSpeedDown,
+		"alt-speed-up":             server.altSpeedUp,
+		"alt-speed-enabled":        server.altSpeedEnabled,
+		"alt-speed-time-enabled":   server.altSpeedTimeEnabled,
+		"alt-speed-time-begin":     server.altSpeedTimeBegin,
+		"alt-speed-time-end":       server.altSpeedTimeEnd,
+		"alt-speed-time-day":       server.altSpeedTimeDay,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1000,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+	server.mx.Unlock()
+
+	if len(args.Fields) == 0 {
+		return session, nil
+	}
+	result := map[string]interface{}{}
+	for _, field := range args.Fields {
+		if value, ok := session[field]; ok {
+			result[field] = value
+		}
+	}
+	return result, nil
+}
+
+type sessionSetArgs struct {
+	SpeedLimitDown        *int  `json:"speed-limit-down"`
+	SpeedLimitDownEnabled *bool `json:"speed-limit-down-enabled"`
+	SpeedLimitUp          *int  `json:"speed-limit-up"`
+	SpeedLimitUpEnabled   *bool `json:"speed-limit-up-enabled"`
+	AltSpeedDown          *int  `json:"alt-speed-down"`
+	AltSpeedUp            *int  `json:"alt-speed-up"`
+	AltSpeedEnabled       *bool `json:"alt-speed-enabled"`
+	AltSpeedTimeEnabled   *bool `json:"alt-speed-time-enabled"`
+	AltSpeedTimeBegin     *int  `json:"alt-speed-time-begin"`
+	AltSpeedTimeEnd       *int  `json:"alt-speed-time-end"`
+	AltSpeedTimeDay       *int  `json:"alt-speed-time-day"`
+}
+
+func (server *Server) sessionSet(raw json.RawMessage) (map[string]interface{}, error) {
+	var args sessionSetArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	if args.SpeedLimitDown != nil {
+		if *args.SpeedLimitDown < 0 {
+			return nil, fmt.Errorf("invalid speed-limit-down %d", *args.SpeedLimitDown)
+		}
+		server.speedLimitDown = *args.SpeedLimitDown
+	}
+	if args.SpeedLimitDownEnabled != nil {
+		server.speedLimitDownEnabled = *args.SpeedLimitDownEnabled
+	}
+	if args.SpeedLimitUp != nil {
+		if *args.SpeedLimitUp < 0 {
+			return nil, fmt.Errorf("invalid speed-limit-up %d", *args.SpeedLimitUp)
+		}
+		server.speedLimitUp = *args.SpeedLimitUp
+	}
+	if args.SpeedLimitUpEnabled != nil {
+		server.speedLimitUpEnabled = *args.SpeedLimitUpEnabled
+	}
+
+	var downloadRate, uploadRate int
+	if server.speedLimitDownEnabled {
+		downloadRate = server.speedLimitDown * 1000
+	}
+	if server.speedLimitUpEnabled {
+		uploadRate = server.speedLimitUp * 1000
+	}
+	server.client.SetRateLimits(downloadRate, uploadRate)
+	return nil, server.setAltSpeed(args)
+}
+
+// setAltSpeed applies any turtle mode settings in args as the client's rate schedule, must be called with mx held
+func (server *Server) setAltSpeed(args sessionSetArgs) error {
+	ints := []struct {
+		name  string
+		value *int
+		max   int
+		field *int
+	}{
+		{"alt-speed-down", args.AltSpeedDown, math.MaxInt32, &server.altSpeedDown},
+		{"alt-speed-up", args.AltSpeedUp, math.MaxInt32, &server.altSpeedUp},
+		{"alt-speed-time-begin", args.AltSpeedTimeBegin, 24*60 - 1, &server.altSpeedTimeBegin},
+		{"alt-speed-time-end", args.AltSpeedTimeEnd, 24*60 - 1, &server.altSpeedTimeEnd},
+		{"alt-speed-time-day", args.AltSpeedTimeDay, everyDay, &server.altSpeedTimeDay},
+	}
+	changed := args.AltSpeedEnabled != nil || args.AltSpeedTimeEnabled != nil
+	for _, i := range ints {
+		if i.value == nil {
+			continue
+		}
+		if *i.value < 0 || *i.value > i.max {
+			return fmt.Errorf("invalid %s %d", i.name, *i.value)
+		}
+		*i.field = *i.value
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if args.AltSpeedEnabled != nil {
+		server.altSpeedEnabled = *args.AltSpeedEnabled
+	}
+	if args.AltSpeedTimeEnabled != nil {
+		server.altSpeedTimeEnabled = *args.AltSpeedTimeEnabled
+	}
+
+	// a schedule's limit of 0 would mean unlimited, whereas transmission would stop altogether, so go as slow as we can
+	schedule := client.RateSchedule{DownloadRate: max(server.altSpeedDown*1000, 1), UploadRate: max(server.altSpeedUp*1000, 1)}
+	switch {
+	case server.altSpeedEnabled:
+		// the same start and end, so all day every day
+		server.client.SetRateSchedule(schedule)
+	case server.altSpeedTimeEnabled:
+		schedule.Start = time.Duration(server.altSpeedTimeBegin) * time.Minute
+		schedule.End = time.Duration(server.altSpeedTimeEnd) * time.Minute
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if server.altSpeedTimeDay&(1<<day) != 0 {
+				schedule.Days = append(schedule.Days, day)
+			}
+		}
+		if len(schedule.Days) == 0 {
+			// no days at all, rather than every day
+			server.client.SetRateSchedule()
+			return nil
+		}
+		server.client.SetRateSchedule(schedule)
+	default:
+		server.client.SetRateSchedule()
+	}
+	return nil
+}
+
+func (server *Server) sessionStats(raw json.RawMessage) (map[string]interface{}, error) {
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	entries := server.sync()
+	result := map[string]interface{}{"torrentCount": len(entries)}
+	var active, paused, downloadSpeed, uploadSpeed int
+	received, sent := server.removedReceived, server.removedSent
+	for _, entry := range entries {
+		stats := entry.handle.Stats()
+		switch stats.State {
+		case client.StateFetchingMetadata, client.StateDownloading, client.StateSeeding:
+			active++
+		case client.StatePaused:
+			paused++
+		}
+		downloadSpeed += stats.DownloadRate
+		uploadSpeed += stats.UploadRate
+		received += stats.BytesReceived
+		sent += stats.BytesSent
+	}
+	result["activeTorrentCount"] = active
+	result["pausedTorrentCount"] = paused
+	result["downloadSpeed"] = downloadSpeed
+	result["uploadSpeed"] = uploadSpeed
+
+	// nothing is persisted between runs, so the cumulative stats are just this session's
+	stats := map[string]interface{}{
+		"uploadedBytes":   sent,
+		"downloadedBytes": received,
+		"filesAdded":      server.nextID - 1,
+		"sessionCount":    1,
+		"secondsActive":   int(time.Since(server.started).Seconds()),
+	}
+	result["cumulative-stats"] = stats
+	result["current-stats"] = stats
+	return result, nil
+}
@@ -0,0 +1,337 @@
+// Package rpc serves the core of the Transmission RPC protocol on top of a client.Client, so that tools written for
+// Transmission (transmission-remote, Flood and the like) can control gotorrent.
+//
+// Only the methods and fields that map onto gotorrent are implemented, anything else is ignored the same way
+// Transmission ignores fields it doesn't know.
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gotorrent/client"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Path is where Transmission clients expect to find the RPC endpoint
+const Path = "/transmission/rpc"
+
+const (
+	sessionIDHeader   = "X-Transmission-Session-Id"
+	rpcVersion        = 17
+	rpcVersionMinimum = 14
+	maxRequestSize    = 16 << 20         // requests may carry a base64 .torrent file
+	recentlyActive    = 60 * time.Second // how long torrents and removals count as "recently-active"
+	defaultSpeedLimit = 100              // kB/s, what a disabled limit is set to until it's changed
+
+	// transmission's turtle mode defaults, 50 kB/s from 9:00 to 17:00 every day
+	defaultAltSpeed      = 50
+	defaultAltSpeedBegin = 9 * 60
+	defaultAltSpeedEnd   = 17 * 60
+	everyDay             = 127
+)
+
+// ServerConfig configures a Server
+type ServerConfig struct {
+	Username string // if either this or Password is set, requests must use basic auth
+	Password string
+}
+
+// Server is an http.Handler which implements the Transmission RPC protocol
+type Server struct {
+	client    *client.Client
+	config    ServerConfig
+	sessionID string
+	started   time.Time
+
+	torrents map[*client.Torrent]*torrentEntry
+	byID     map[int]*torrentEntry
+	nextID   int
+	removed  []removedTorrent
+
+	// totals of torrents that have since been removed, for session-stats
+	removedReceived int
+	removedSent     int
+
+	// transmission keeps a limit's value separately from whether it's enabled, we only have the value
+	speedLimitDown        int // kB/s
+	speedLimitDownEnabled bool
+	speedLimitUp          int
+	speedLimitUpEnabled   bool
+
+	// turtle mode, which we turn into the client's rate schedule
+	altSpeedDown        int  // kB/s
+	altSpeedUp          int  // kB/s
+	altSpeedEnabled     bool // all the time
+	altSpeedTimeEnabled bool // between begin and end on the given days
+	altSpeedTimeBegin   int  // minutes since midnight
+	altSpeedTimeEnd     int
+	altSpeedTimeDay     int // bitmask of days, sunday being 1 and saturday 64
+
+	mx     sync.Mutex
+	events *client.Subscription
+	wg     sync.WaitGroup
+}
+
+// torrentEntry is a torrent along with what transmission tracks about it that we don't
+type torrentEntry struct {
+	id     int
+	handle *client.Torrent
+	added  time.Time
+	done   time.Time // zero until the torrent has been downloaded
+	active time.Time // the last time anything happened to the torrent
+
+	// the torrent's own limits, kept the same way as the session's
+	downloadLimit   int // kB/s
+	downloadLimited bool
+	uploadLimit     int
+	uploadLimited   bool
+}
+
+type removedTorrent struct {
+	id int
+	at time.Time
+}
+
+// request and response are the bodies of an RPC call
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string                 `json:"result"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Tag       json.RawMessage        `json:"tag,omitempty"`
+}
+
+// NewServer returns a server controlling c, it should be closed before c is
+func NewServer(c *client.Client, config ServerConfig) *Server {
+	server := &Server{
+		client:   c,
+		config:   config,
+		started:  time.Now(),
+		torrents: make(map[*client.Torrent]*torrentEntry),
+		byID:     make(map[int]*torrentEntry),
+		nextID:   1,
+	}
+
+	id := make([]byte, 24)
+	rand.Read(id)
+	server.sessionID = hex.EncodeToString(id)
+
+	clientConfig := c.Config()
+	server.speedLimitDown, server.speedLimitDownEnabled = speedLimit(clientConfig.DownloadRate)
+	server.speedLimitUp, server.speedLimitUpEnabled = speedLimit(clientConfig.UploadRate)
+	server.altSpeedDown, server.altSpeedUp = defaultAltSpeed, defaultAltSpeed
+	server.altSpeedTimeBegin, server.altSpeedTimeEnd, server.altSpeedTimeDay = defaultAltSpeedBegin, defaultAltSpeedEnd, everyDay
+	// we can only show the first of the client's schedules
+	if len(clientConfig.Schedule) > 0 {
+		schedule := clientConfig.Schedule[0]
+		server.altSpeedDown, _ = speedLimit(schedule.DownloadRate)
+		server.altSpeedUp, _ = speedLimit(schedule.UploadRate)
+		server.altSpeedTimeEnabled = true
+		server.altSpeedTimeBegin = int(schedule.Start / time.Minute)
+		server.altSpeedTimeEnd = int(schedule.End / time.Minute)
+		server.altSpeedTimeDay = everyDay
+		if len(schedule.Days) > 0 {
+			server.altSpeedTimeDay = 0
+			for _, day := range schedule.Days {
+				server.altSpeedTimeDay |= 1 << day
+			}
+		}
+	}
+
+	server.events = c.Subscribe()
+	server.wg.Add(1)
+	go server.watchEvents()
+	return server
+}
+
+// speedLimit converts a rate in bytes per second into transmission's kB/s and whether it's enabled
+func speedLimit(rate int) (int, bool) {
+	if rate <= 0 {
+		return defaultSpeedLimit, false
+	}
+	return max(rate/1000, 1), true
+}
+
+// Close stops keeping track of the client's torrents
+func (server *Server) Close() {
+	server.events.Close()
+	server.wg.Wait()
+}
+
+// watchEvents keeps track of when torrents were last active and when they finished
+func (server *Server) watchEvents() {
+	defer server.wg.Done()
+	for ev := range server.events.Events() {
+		handle := server.client.Get(ev.InfoHash)
+		if handle == nil {
+			continue
+		}
+		server.mx.Lock()
+		entry := server.entry(handle)
+		entry.active = ev.Time
+		if ev.Type == client.EventTorrentCompleted {
+			entry.done = ev.Time
+		}
+		server.mx.Unlock()
+	}
+}
+
+// entry returns the entry of a torrent, giving it an id if it's new, must be called with mx held
+func (server *Server) entry(handle *client.Torrent) *torrentEntry {
+	entry, ok := server.torrents[handle]
+	if !ok {
+		now := time.Now()
+		entry = &torrentEntry{id: server.nextID, handle: handle, added: now, active: now}
+		downloadRate, uploadRate := handle.RateLimits()
+		entry.downloadLimit, entry.downloadLimited = speedLimit(downloadRate)
+		entry.uploadLimit, entry.uploadLimited = speedLimit(uploadRate)
+		server.nextID++
+		server.torrents[handle] = entry
+		server.byID[entry.id] = entry
+	}
+	return entry
+}
+
+// sync picks up torrents added to or dropped from the client behind our back, returning every torrent by id.
+// Must be called with mx held
+func (server *Server) sync() []*torrentEntry {
+	current := make(map[*client.Torrent]bool)
+	for _, handle := range server.client.Torrents() {
+		current[handle] = true
+		server.entry(handle)
+	}
+	for handle, entry := range server.torrents {
+		if !current[handle] {
+			server.forget(entry)
+		}
+	}
+
+	entries := make([]*torrentEntry, 0, len(server.byID))
+	for id := 1; id < server.nextID; id++ {
+		if entry, ok := server.byID[id]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// forget removes a torrent that is no longer in the client, must be called with mx held
+func (server *Server) forget(entry *torrentEntry) {
+	stats := entry.handle.Stats()
+	server.removedReceived += stats.BytesReceived
+	server.removedSent += stats.BytesSent
+
+	delete(server.torrents, entry.handle)
+	delete(server.byID, entry.id)
+	server.removed = append(server.removed, removedTorrent{entry.id, time.Now()})
+}
+
+// recentlyRemoved returns the ids of torrents removed within the last minute, dropping any older ones
+func (server *Server) recentlyRemoved() []int {
+	ids := []int{}
+	kept := server.removed[:0]
+	for _, removed := range server.removed {
+		if time.Since(removed.at) < recentlyActive {
+			kept = append(kept, removed)
+			ids = append(ids, removed.id)
+		}
+	}
+	server.removed = kept
+	return ids
+}
+
+// ServeHTTP checks the request's credentials and session id before calling the method it names
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gotorrent"`)
+		http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// clients learn the session id from a 409, which protects against cross-site requests
+	if r.Header.Get(sessionIDHeader) != server.sessionID {
+		w.Header().Set(sessionIDHeader, server.sessionID)
+		http.Error(w, "409: Conflict\n\nInvalid session id, use the "+sessionIDHeader+" header from this response", http.StatusConflict)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req request
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "400: Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	resp := response{Result: "success", Tag: req.Tag}
+	resp.Arguments, err = server.call(req.Method, req.Arguments)
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = map[string]interface{}{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (server *Server) authorized(r *http.Request) bool {
+	if server.config.Username == "" && server.config.Password == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// compare both, so that a wrong username takes as long as a wrong password
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(server.config.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(server.config.Password)) == 1
+	return usernameOK && passwordOK
+}
+
+var errUnknownMethod = errors.New("method name not recognized")
+
+func (server *Server) call(method string, args json.RawMessage) (map[string]interface{}, error) {
+	// every method takes an object, which may be left out entirely
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+
+	switch method {
+	case "torrent-add":
+		return server.torrentAdd(args)
+	case "torrent-get":
+		return server.torrentGet(args)
+	case "torrent-set":
+		return server.torrentSet(args)
+	case "torrent-start", "torrent-start-now":
+		return server.torrentStart(args)
+	case "torrent-stop":
+		return server.torrentStop(args)
+	case "torrent-remove":
+		return server.torrentRemove(args)
+	case "session-get":
+		return server.sessionGet(args)
+	case "session-set":
+		return server.sessionSet(args)
+	case "session-stats":
+		return server.sessionStats(args)
+	default:
+		return nil, errUnknownMethod
+	}
+}
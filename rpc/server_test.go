@@ -0,0 +1,336 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"gotorrent/client"
+	"gotorrent/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the RPC for a client that doesn't listen for peers
+func newTestServer(t *testing.T, config ServerConfig) (*httptest.Server, *Server) {
+	t.Helper()
+	c, err := client.New(t.TempDir(), client.WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c, config)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Close()
+		c.Close()
+	})
+	return httpServer, server
+}
+
+// call makes an RPC call with the right session id, failing the test if the call itself fails
+func call(t *testing.T, url string, server *Server, method string, args interface{}) response {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"method": method, "arguments": args, "tag": 7})
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set(sessionIDHeader, server.sessionID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s returned %s", method, resp.Status)
+	}
+
+	var result response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Tag) != "7" {
+		t.Errorf("Expected the tag to be echoed, got %s", result.Tag)
+	}
+	return result
+}
+
+func TestHandshakeAndAuth(t *testing.T) {
+	httpServer, server := newTestServer(t, ServerConfig{Username: "user", Password: "pass"})
+
+	testCases := []struct {
+		name      string
+		username  string
+		password  string
+		sessionID string
+		expected  int
+	}{
+		{name: "no credentials", sessionID: server.sessionID, expected: http.StatusUnauthorized},
+		{name: "wrong password", username: "user", password: "wrong", sessionID: server.sessionID, expected: http.StatusUnauthorized},
+		{name: "no session id", username: "user", password: "pass", expected: http.StatusConflict},
+		{name: "stale session id", username: "user", password: "pass", sessionID: "stale", expected: http.StatusConflict},
+		{name: "valid", username: "user", password: "pass", sessionID: server.sessionID, expected: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, httpServer.URL, bytes.NewReader([]byte(`{"method":"session-get"}`)))
+			if tc.username != "" {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			if tc.sessionID != "" {
+				req.Header.Set(sessionIDHeader, tc.sessionID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.expected {
+				t.Errorf("Expected %d, got %s", tc.expected, resp.Status)
+			}
+			// the session id is how clients recover from a 409
+			if resp.StatusCode == http.StatusConflict && resp.Header.Get(sessionIDHeader) != server.sessionID {
+				t.Errorf("Expected the session id in the 409 response, got %q", resp.Header.Get(sessionIDHeader))
+			}
+		})
+	}
+}
+
+// newTorrentFile returns a base64 .torrent with two files, which nobody is seeding
+func newTorrentFile(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "dir")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte{1}, 32768), 0644)
+	os.WriteFile(filepath.Join(dir, "b"), bytes.Repeat([]byte{2}, 32768), 0644)
+	mi, err := models.CreateTorrent(models.CreateOptions{Path: dir, PieceLen: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := mi.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestTorrentMethods(t *testing.T) {
+	httpServer, server := newTestServer(t, ServerConfig{})
+	url := httpServer.URL
+
+	resp := call(t, url, server, "torrent-add", map[string]interface{}{"metainfo": newTorrentFile(t), "paused": true, "files-unwanted": []int{1}})
+	if resp.Result != "success" {
+		t.Fatal(resp.Result)
+	}
+	added, ok := resp.Arguments["torrent-added"].(map[string]interface{})
+	if !ok || added["id"] != 1.0 || added["name"] != "dir" {
+		t.Fatalf("Unexpected torrent-add response %v", resp.Arguments)
+	}
+	hash := added["hashString"].(string)
+
+	resp = call(t, url, server, "torrent-add", map[string]interface{}{"filename": "magnet:?xt=urn:btih:" + hash})
+	if duplicate, ok := resp.Arguments["torrent-duplicate"].(map[string]interface{}); !ok || duplicate["id"] != 1.0 {
+		t.Errorf("Expected the magnet link to be a duplicate, got %v", resp.Arguments)
+	}
+	resp = call(t, url, server, "torrent-add", map[string]interface{}{"filename": "magnet:?xt=urn:btih:" + "abababababababababababababababababababab"})
+	if _, ok := resp.Arguments["torrent-added"]; !ok {
+		t.Fatalf("Unexpected torrent-add response %v", resp.Arguments)
+	}
+
+	get := func(ids interface{}) []map[string]interface{} {
+		t.Helper()
+		resp := call(t, url, server, "torrent-get", map[string]interface{}{"ids": ids, "fields": []string{"id", "name", "status", "wanted", "sizeWhenDone", "totalSize", "unknownField"}})
+		if resp.Result != "success" {
+			t.Fatal(resp.Result)
+		}
+		var torrents []map[string]interface{}
+		for _, torrent := range resp.Arguments["torrents"].([]interface{}) {
+			torrents = append(torrents, torrent.(map[string]interface{}))
+		}
+		return torrents
+	}
+
+	testCases := []struct {
+		name     string
+		ids      interface{}
+		expected []float64
+	}{
+		{name: "every torrent", ids: nil, expected: []float64{1, 2}},
+		{name: "single id", ids: 2, expected: []float64{2}},
+		{name: "hash", ids: hash, expected: []float64{1}},
+		{name: "list", ids: []interface{}{2, hash}, expected: []float64{2, 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			torrents := get(tc.ids)
+			if len(torrents) != len(tc.expected) {
+				t.Fatalf("Expected torrents %v, got %v", tc.expected, torrents)
+			}
+			for i, torrent := range torrents {
+				if torrent["id"] != tc.expected[i] {
+					t.Errorf("Expected torrents %v, got %v", tc.expected, torrents)
+				}
+				if _, ok := torrent["unknownField"]; ok {
+					t.Errorf("Unknown fields should be left out")
+				}
+			}
+		})
+	}
+
+	torrent := get(1)[0]
+	if torrent["status"] != float64(statusStopped) || torrent["totalSize"] != 65536.0 || torrent["sizeWhenDone"] != 32768.0 {
+		t.Errorf("Unexpected torrent %v", torrent)
+	}
+	if wanted := torrent["wanted"].([]interface{}); len(wanted) != 2 || wanted[0] != 1.0 || wanted[1] != 0.0 {
+		t.Errorf("Expected only the first file to be wanted, got %v", wanted)
+	}
+
+	call(t, url, server, "torrent-set", map[string]interface{}{"ids": 1, "files-wanted": []int{1}})
+	if torrent := get(1)[0]; torrent["sizeWhenDone"] != 65536.0 {
+		t.Errorf("Expected both files to be wanted after torrent-set, got %v", torrent)
+	}
+	call(t, url, server, "torrent-set", map[string]interface{}{"ids": 1, "downloadLimit": 300, "downloadLimited": true, "uploadLimit": 40})
+	resp = call(t, url, server, "torrent-get", map[string]interface{}{"ids": 1, "fields": []string{"downloadLimit", "downloadLimited", "uploadLimit", "uploadLimited"}})
+	limits := resp.Arguments["torrents"].([]interface{})[0].(map[string]interface{})
+	if limits["downloadLimit"] != 300.0 || limits["downloadLimited"] != true || limits["uploadLimit"] != 40.0 || limits["uploadLimited"] != false {
+		t.Errorf("Unexpected torrent limits %v", limits)
+	}
+	if download, upload := server.byID[1].handle.RateLimits(); download != 300000 || upload != 0 {
+		t.Errorf("Expected a 300 kB/s download limit and no upload limit, got %d and %d", download, upload)
+	}
+	if resp := call(t, url, server, "torrent-set", map[string]interface{}{"ids": 1, "uploadLimit": -5}); resp.Result == "success" {
+		t.Errorf("Expected a negative torrent limit to be rejected")
+	}
+
+	call(t, url, server, "torrent-start", map[string]interface{}{"ids": 1})
+	if status := get(1)[0]["status"]; status != float64(statusDownload) {
+		t.Errorf("Expected the torrent to be downloading after torrent-start, got %v", status)
+	}
+	call(t, url, server, "torrent-stop", map[string]interface{}{"ids": []int{1}})
+	if status := get(1)[0]["status"]; status != float64(statusStopped) {
+		t.Errorf("Expected the torrent to be stopped after torrent-stop, got %v", status)
+	}
+
+	stats := call(t, url, server, "session-stats", nil).Arguments
+	if stats["torrentCount"] != 2.0 || stats["pausedTorrentCount"] != 1.0 {
+		t.Errorf("Unexpected session stats %v", stats)
+	}
+
+	if resp := call(t, url, server, "torrent-remove", map[string]interface{}{"ids": []int{1}, "delete-local-data": true}); resp.Result != "success" {
+		t.Fatal(resp.Result)
+	}
+	if torrents := get(nil); len(torrents) != 1 || torrents[0]["id"] != 2.0 {
+		t.Errorf("Expected only the second torrent to remain, got %v", torrents)
+	}
+	resp = call(t, url, server, "torrent-get", map[string]interface{}{"ids": "recently-active", "fields": []string{"id"}})
+	if removed := resp.Arguments["removed"].([]interface{}); len(removed) != 1 || removed[0] != 1.0 {
+		t.Errorf("Expected the first torrent to be recently removed, got %v", removed)
+	}
+	if resp := call(t, url, server, "torrent-start", map[string]interface{}{"ids": 1}); resp.Result == "success" {
+		t.Errorf("Expected an error starting a removed torrent")
+	}
+	if resp := call(t, url, server, "no-such-method", nil); resp.Result != errUnknownMethod.Error() {
+		t.Errorf("Expected an unknown method error, got %q", resp.Result)
+	}
+}
+
+func TestSessionMethods(t *testing.T) {
+	httpServer, server := newTestServer(t, ServerConfig{})
+	url := httpServer.URL
+
+	session := call(t, url, server, "session-get", nil).Arguments
+	if session["rpc-version"] != float64(rpcVersion) || session["speed-limit-down-enabled"] != false || session["session-id"] != server.sessionID {
+		t.Errorf("Unexpected session %v", session)
+	}
+
+	call(t, url, server, "session-set", map[string]interface{}{"speed-limit-down": 500, "speed-limit-down-enabled": true, "speed-limit-up": 20})
+	session = call(t, url, server, "session-get", map[string]interface{}{"fields": []string{"speed-limit-down", "speed-limit-down-enabled", "speed-limit-up", "speed-limit-up-enabled"}}).Arguments
+	if len(session) != 4 || session["speed-limit-down"] != 500.0 || session["speed-limit-down-enabled"] != true || session["speed-limit-up"] != 20.0 || session["speed-limit-up-enabled"] != false {
+		t.Errorf("Unexpected session %v", session)
+	}
+	// only the enabled limit applies
+	if config := server.client.Config(); config.DownloadRate != 500000 || config.UploadRate != 0 {
+		t.Errorf("Expected a 500 kB/s download limit and no upload limit, got %d and %d", config.DownloadRate, config.UploadRate)
+	}
+
+	if resp := call(t, url, server, "session-set", map[string]interface{}{"speed-limit-up": -1}); resp.Result == "success" {
+		t.Errorf("Expected a negative limit to be rejected")
+	}
+
+	session = call(t, url, server, "session-get", map[string]interface{}{"fields": []string{"alt-speed-enabled", "alt-speed-time-enabled", "alt-speed-down"}}).Arguments
+	if session["alt-speed-enabled"] != false || session["alt-speed-time-enabled"] != false || session["alt-speed-down"] != float64(defaultAltSpeed) {
+		t.Errorf("Unexpected turtle mode %v", session)
+	}
+
+	// turtle mode on weekdays, 2 = monday and 32 = friday
+	call(t, url, server, "session-set", map[string]interface{}{"alt-speed-down": 100, "alt-speed-up": 0, "alt-speed-time-enabled": true,
+		"alt-speed-time-begin": 60, "alt-speed-time-end": 120, "alt-speed-time-day": 2 | 32})
+	schedule := server.client.Config().Schedule
+	expected := client.RateSchedule{Days: []time.Weekday{time.Monday, time.Friday}, Start: time.Hour, End: 2 * time.Hour, DownloadRate: 100000, UploadRate: 1}
+	if len(schedule) != 1 || !reflect.DeepEqual(schedule[0], expected) {
+		t.Errorf("Expected a schedule of %+v, got %+v", expected, schedule)
+	}
+	call(t, url, server, "session-set", map[string]interface{}{"alt-speed-enabled": true})
+	if schedule := server.client.Config().Schedule; len(schedule) != 1 || schedule[0].Days != nil || schedule[0].Start != schedule[0].End {
+		t.Errorf("Expected turtle mode all day every day, got %+v", schedule)
+	}
+	call(t, url, server, "session-set", map[string]interface{}{"alt-speed-enabled": false, "alt-speed-time-enabled": false})
+	if schedule := server.client.Config().Schedule; len(schedule) != 0 {
+		t.Errorf("Expected turtle mode to be off, got %+v", schedule)
+	}
+	if resp := call(t, url, server, "session-set", map[string]interface{}{"alt-speed-time-begin": 1440}); resp.Result == "success" {
+		t.Errorf("Expected a time past the end of the day to be rejected")
+	}
+}
+
+// countingDialer records the addresses it's asked to dial
+type countingDialer struct {
+	net.Dialer
+	dialed []string
+	mx     sync.Mutex
+}
+
+func (dialer *countingDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer.mx.Lock()
+	dialer.dialed = append(dialer.dialed, address)
+	dialer.mx.Unlock()
+	return dialer.Dialer.DialContext(ctx, network, address)
+}
+
+func TestTorrentAddURLUsesDialer(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(newTorrentFile(t))
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer source.Close()
+
+	dialer := &countingDialer{}
+	c, err := client.New(t.TempDir(), client.WithoutListening(), client.WithDialer(dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(c, ServerConfig{})
+	httpServer := httptest.NewServer(server)
+	defer func() {
+		httpServer.Close()
+		server.Close()
+		c.Close()
+	}()
+
+	resp := call(t, httpServer.URL, server, "torrent-add", map[string]interface{}{"filename": source.URL + "/a.torrent", "paused": true})
+	if _, ok := resp.Arguments["torrent-added"]; !ok {
+		t.Fatalf("Unexpected torrent-add response %v %v", resp.Result, resp.Arguments)
+	}
+	dialer.mx.Lock()
+	defer dialer.mx.Unlock()
+	if !reflect.DeepEqual(dialer.dialed, []string{source.Listener.Addr().String()}) {
+		t.Errorf("Expected the torrent file to be fetched through the client's dialer, dialed %v", dialer.dialed)
+	}
+}
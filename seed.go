@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gotorrent/client"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runSeed implements `gotorrent seed`, which uploads torrents whose data is already in the download directory until
+// it's interrupted. Anything missing is downloaded first
+func runSeed(args []string) error {
+	flags := newFlagSet("seed", "<.torrent files...>")
+	parseFlags(flags, args, 1, -1)
+
+	c, err := client.New(downloadDir,
+		client.WithSeeding(),
+		client.WithListenPort(port),
+		client.WithMaxConnections(maxConnections),
+		client.WithMaxPeersPerTorrent(connections),
+		client.WithRateLimits(downloadRate*1024, uploadRate*1024),
+		client.WithRateSchedule(schedules...),
+		client.WithProxy(proxy, proxyOnly),
+		client.WithEncryption(int(encryption)),
+		client.WithUTP(useUTP),
+		client.WithOutput(os.Stdout),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stopMetrics, err := serveMetrics(c)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	var torrents []*client.Torrent
+	for _, arg := range flags.Args() {
+		// without the metadata there'd be nothing to check the data against
+		if strings.HasPrefix(arg, "magnet:") {
+			return errors.New("seeding needs a .torrent file, use gotorrent magnet to fetch one")
+		}
+		torr, err := c.AddTorrentFile(arg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		torrents = append(torrents, torr)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Println("Seeding, press ctrl-c to stop")
+	<-ctx.Done()
+
+	for _, torr := range torrents {
+		stats := torr.Stats()
+		fmt.Printf("%s: sent %s\n", torr.Info().Name, formatSize(stats.BytesSent))
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package swarmtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Behaviour is how a seeder treats the peers that connect to it
+type Behaviour int
+
+const (
+	Honest           Behaviour = iota
+	DropConnection             // hangs up after sending a few blocks, every time it's connected to
+	CorruptBlocks              // flips a byte in every block it sends
+	ChokeForever               // sends its bitfield but never unchokes, so nothing can be requested
+	OversizedMessage           // answers the first request with a message far longer than any valid one
+	FastChoker                 // uses the fast extension to allow every piece to be requested, but never unchokes
+	FastRejecter               // uses the fast extension to reject the first request for every block
+)
+
+// message ids from BEP 3
+const (
+	msgChoke         = 0
+	msgUnchoke       = 1
+	msgInterested    = 2
+	msgNotInterested = 3
+	msgHave          = 4
+	msgBitfield      = 5
+	msgRequest       = 6
+	msgPiece         = 7
+	msgCancel        = 8
+
+	// and BEP 6
+	msgHaveAll       = 14
+	msgReject        = 16
+	msgAllowedFast   = 17
+	fastExtensionBit = 0x04 // of the last reserved byte
+)
+
+const (
+	maxBlockLen       = 16 * 1024
+	blocksBeforeDrop  = 3
+	maxIncomingLength = 1 << 20 // we never need anything longer from a client
+)
+
+var (
+	errWrongTorrent = errors.New("peer asked for a different torrent")
+	errNoFast       = errors.New("peer doesn't support the fast extension")
+)
+
+// Seeder serves a torrent to whoever connects to it
+type Seeder struct {
+	Addr      *net.TCPAddr
+	Behaviour Behaviour
+
+	torrent  *Torrent
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	connsMx  sync.Mutex
+	wg       sync.WaitGroup
+
+	connections atomic.Int64
+	blocksSent  atomic.Int64
+	rejections  atomic.Int64
+}
+
+func newSeeder(torrent *Torrent, address string, behaviour Behaviour) (*Seeder, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	seeder := &Seeder{
+		Addr:      listener.Addr().(*net.TCPAddr),
+		Behaviour: behaviour,
+		torrent:   torrent,
+		listener:  listener,
+		conns:     make(map[net.Conn]struct{}),
+	}
+	seeder.wg.Add(1)
+	go seeder.acceptLoop()
+	return seeder, nil
+}
+
+// Connections returns how many times peers have connected to the seeder
+func (seeder *Seeder) Connections() int {
+	return int(seeder.connections.Load())
+}
+
+// BlocksSent returns how many blocks the seeder has sent, corrupted or not
+func (seeder *Seeder) BlocksSent() int {
+	return int(seeder.blocksSent.Load())
+}
+
+// Rejections returns how many requests the seeder has rejected
+func (seeder *Seeder) Rejections() int {
+	return int(seeder.rejections.Load())
+}
+
+// Close stops listening and disconnects every peer, waiting for their connections to finish
+func (seeder *Seeder) Close() {
+	seeder.listener.Close()
+	seeder.connsMx.Lock()
+	for conn := range seeder.conns {
+		conn.Close()
+	}
+	seeder.connsMx.Unlock()
+	seeder.wg.Wait()
+}
+
+func (seeder *Seeder) acceptLoop() {
+	defer seeder.wg.Done()
+	for {
+		conn, err := seeder.listener.Accept()
+		if err != nil {
+			return
+		}
+		seeder.accept(conn)
+	}
+}
+
+// accept serves conn in the background, until either side hangs up or the seeder is closed
+func (seeder *Seeder) accept(conn net.Conn) {
+	seeder.connections.Add(1)
+	seeder.connsMx.Lock()
+	seeder.conns[conn] = struct{}{}
+	seeder.connsMx.Unlock()
+
+	seeder.wg.Add(1)
+	go func() {
+		defer seeder.wg.Done()
+		seeder.serve(conn)
+		conn.Close()
+		seeder.connsMx.Lock()
+		delete(seeder.conns, conn)
+		seeder.connsMx.Unlock()
+	}()
+}
+
+// serve handshakes with a peer then answers its messages until either side hangs up
+func (seeder *Seeder) serve(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(handshake[28:48], seeder.torrent.InfoHash) {
+		return errWrongTorrent
+	}
+	// no reserved bits unless we're using the fast extension, which both sides have to support
+	fast := seeder.Behaviour == FastChoker || seeder.Behaviour == FastRejecter
+	if fast && handshake[27]&fastExtensionBit == 0 {
+		return errNoFast
+	}
+	reserved := make([]byte, 8)
+	if fast {
+		reserved[7] = fastExtensionBit
+	}
+	reply := append([]byte{19}, "BitTorrent protocol"...)
+	reply = append(reply, reserved...)
+	reply = append(reply, seeder.torrent.InfoHash...)
+	reply = append(reply, bytes.Repeat([]byte{'S'}, 20)...)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return err
+	}
+
+	err = seeder.sendHaves(conn, fast)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	rejected := make(map[string]bool)
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case msgInterested:
+			if seeder.Behaviour != ChokeForever && seeder.Behaviour != FastChoker {
+				err = writeMessage(conn, msgUnchoke, nil)
+			}
+		case msgRequest:
+			if len(payload) != 12 || seeder.Behaviour == ChokeForever {
+				continue
+			}
+			if seeder.Behaviour == OversizedMessage {
+				// claim a 1GiB piece message, the client has to give up on us rather than try to read it
+				header := make([]byte, 5)
+				binary.BigEndian.PutUint32(header, 1<<30)
+				header[4] = msgPiece
+				conn.Write(header)
+				_, err = conn.Write(make([]byte, 2*maxBlockLen))
+				continue
+			}
+			if seeder.Behaviour == DropConnection && sent == blocksBeforeDrop {
+				return nil
+			}
+			if seeder.Behaviour == FastRejecter && !rejected[string(payload)] {
+				rejected[string(payload)] = true
+				seeder.rejections.Add(1)
+				err = writeMessage(conn, msgReject, payload)
+				continue
+			}
+			err = seeder.sendBlock(conn, payload)
+			sent++
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendHaves tells a peer that we have every piece, with HAVE ALL if we're using the fast extension. A FastChoker
+// then allows every piece fast
+func (seeder *Seeder) sendHaves(conn net.Conn, fast bool) error {
+	if !fast {
+		bitfield := make([]byte, (seeder.torrent.numPieces()+7)/8)
+		for i := 0; i < seeder.torrent.numPieces(); i++ {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+		return writeMessage(conn, msgBitfield, bitfield)
+	}
+
+	err := writeMessage(conn, msgHaveAll, nil)
+	for i := 0; i < seeder.torrent.numPieces() && err == nil && seeder.Behaviour == FastChoker; i++ {
+		err = writeMessage(conn, msgAllowedFast, binary.BigEndian.AppendUint32(nil, uint32(i)))
+	}
+	return err
+}
+
+// sendBlock answers a request, whose payload is the index, begin and length of the block that's wanted
+func (seeder *Seeder) sendBlock(conn net.Conn, request []byte) error {
+	index := int(binary.BigEndian.Uint32(request[0:]))
+	begin := int(binary.BigEndian.Uint32(request[4:]))
+	length := int(binary.BigEndian.Uint32(request[8:]))
+	if index >= seeder.torrent.numPieces() || length > maxBlockLen || begin+length > seeder.torrent.pieceLength(index) {
+		return errors.New("peer requested a block that doesn't exist")
+	}
+
+	offset := index*seeder.torrent.PieceLen + begin
+	payload := append([]byte{}, request[:8]...)
+	payload = append(payload, seeder.torrent.data[offset:offset+length]...)
+	if seeder.Behaviour == CorruptBlocks && length != 0 {
+		payload[8] ^= 0xff
+	}
+	seeder.blocksSent.Add(1)
+	return writeMessage(conn, msgPiece, payload)
+}
+
+func writeMessage(conn net.Conn, id byte, payload []byte) error {
+	message := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(message, uint32(1+len(payload)))
+	message[4] = id
+	_, err := conn.Write(append(message, payload...))
+	return err
+}
+
+// readMessage returns the next message from conn, skipping keep alives
+func readMessage(conn net.Conn) (byte, []byte, error) {
+	for {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		lengthBuf := make([]byte, 4)
+		_, err := io.ReadFull(conn, lengthBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length == 0 {
+			continue
+		}
+		if length > maxIncomingLength {
+			return 0, nil, errors.New("peer sent an oversized message")
+		}
+		message := make([]byte, length)
+		_, err = io.ReadFull(conn, message)
+		if err != nil {
+			return 0, nil, err
+		}
+		return message[0], message[1:], nil
+	}
+}
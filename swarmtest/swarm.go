@@ -0,0 +1,172 @@
+// Package swarmtest runs a whole swarm in process for integration tests: a generated torrent, fake HTTP and UDP
+// trackers and seeders serving it over loopback, some of which may be told to misbehave. The seeders speak the wire
+// protocol themselves rather than through models, so that they check our client against an independent
+// implementation
+package swarmtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"gotorrent/models"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Torrent is a generated torrent along with all of its data
+type Torrent struct {
+	MetaInfo *models.MetaInfo
+	InfoHash []byte
+	Files    map[string][]byte // contents of each file, by its slash separated path within the download directory
+	PieceLen int
+
+	data []byte // every file back to back, as pieces are laid out
+}
+
+// NewTorrent generates a torrent of random data called name, with a file of each of the given lengths. One length
+// gives a single file torrent, more put files called 0, 1, ... in a directory called name
+func NewTorrent(name string, pieceLen int, fileLengths ...int) (*Torrent, error) {
+	if len(fileLengths) == 0 {
+		return nil, errors.New("a torrent needs at least one file")
+	}
+
+	torrent := &Torrent{Files: make(map[string][]byte), PieceLen: pieceLen}
+	md := models.Metadata{Name: name, PieceLen: pieceLen}
+	for i, length := range fileLengths {
+		data := make([]byte, length)
+		rand.Read(data)
+		torrent.data = append(torrent.data, data...)
+
+		if len(fileLengths) == 1 {
+			md.Length = length
+			torrent.Files[name] = data
+			break
+		}
+		path := []string{strconv.Itoa(i)}
+		md.Files = append(md.Files, models.MetadataFile{Length: length, Path: path})
+		torrent.Files[name+"/"+path[0]] = data
+	}
+
+	var pieces bytes.Buffer
+	for offset := 0; offset < len(torrent.data); offset += pieceLen {
+		hash := sha1.Sum(torrent.data[offset:min(offset+pieceLen, len(torrent.data))])
+		pieces.Write(hash[:])
+	}
+	md.Pieces = pieces.String()
+
+	var info bytes.Buffer
+	err := bencode.Marshal(&info, md)
+	if err != nil {
+		return nil, err
+	}
+	infoHash := sha1.Sum(info.Bytes())
+	torrent.InfoHash = infoHash[:]
+	torrent.MetaInfo = &models.MetaInfo{InfoBytes: info.Bytes()}
+	return torrent, nil
+}
+
+func (torrent *Torrent) numPieces() int {
+	return (len(torrent.data) + torrent.PieceLen - 1) / torrent.PieceLen
+}
+
+func (torrent *Torrent) pieceLength(index int) int {
+	return min(torrent.PieceLen, len(torrent.data)-index*torrent.PieceLen)
+}
+
+// Verify checks that every file was downloaded into dir intact
+func (torrent *Torrent) Verify(dir string) error {
+	for path, expected := range torrent.Files {
+		actual, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(actual, expected) {
+			return fmt.Errorf("%s doesn't match what was seeded", path)
+		}
+	}
+	return nil
+}
+
+// Swarm is a torrent's seeders and the trackers that know about them
+type Swarm struct {
+	Torrent     *Torrent
+	Seeders     []*Seeder
+	HTTPTracker *Tracker
+	UDPTracker  *Tracker
+}
+
+// NewSwarm starts a seeder with each of the given behaviours, along with an HTTP and a UDP tracker returning all of
+// them, and adds both trackers to the torrent's announce list. Each seeder listens on its own loopback address
+// (127.0.0.2, 127.0.0.3, ...) as clients only connect to one peer per ip address, which needs an OS that routes
+// all of 127.0.0.0/8 to loopback, as Linux does
+func NewSwarm(torrent *Torrent, behaviours ...Behaviour) (*Swarm, error) {
+	swarm := &Swarm{Torrent: torrent}
+	var addrs []*net.TCPAddr
+	for i, behaviour := range behaviours {
+		seeder, err := newSeeder(torrent, fmt.Sprintf("127.0.0.%d:0", i+2), behaviour)
+		if err != nil {
+			swarm.Close()
+			return nil, err
+		}
+		swarm.Seeders = append(swarm.Seeders, seeder)
+		addrs = append(addrs, seeder.Addr)
+	}
+
+	var err error
+	swarm.HTTPTracker, err = newHTTPTracker(addrs)
+	if err != nil {
+		swarm.Close()
+		return nil, err
+	}
+	swarm.UDPTracker, err = newUDPTracker(addrs)
+	if err != nil {
+		swarm.Close()
+		return nil, err
+	}
+
+	torrent.MetaInfo.Announce = swarm.HTTPTracker.URL
+	torrent.MetaInfo.AnnounceList = [][]string{{swarm.HTTPTracker.URL}, {swarm.UDPTracker.URL}}
+	return swarm, nil
+}
+
+// Close stops the trackers and seeders, disconnecting every peer
+func (swarm *Swarm) Close() {
+	for _, seeder := range swarm.Seeders {
+		seeder.Close()
+	}
+	if swarm.HTTPTracker != nil {
+		swarm.HTTPTracker.Close()
+	}
+	if swarm.UDPTracker != nil {
+		swarm.UDPTracker.Close()
+	}
+}
+
+// Dialer returns a dialer that connects to the seeders over net.Pipe rather than loopback, for use as
+// models.SessionConfig.Dialer. Anything else, such as the HTTP tracker, is dialed as usual
+func (swarm *Swarm) Dialer() models.Dialer {
+	return &pipeDialer{swarm: swarm}
+}
+
+type pipeDialer struct {
+	swarm  *Swarm
+	dialer net.Dialer
+}
+
+func (dialer *pipeDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	for _, seeder := range dialer.swarm.Seeders {
+		if seeder.Addr.String() == address {
+			client, server := net.Pipe()
+			seeder.accept(server)
+			return client, nil
+		}
+	}
+	return dialer.dialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,197 @@
+package swarmtest
+
+import (
+	"bytes"
+	"context"
+	"gotorrent/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestSwarm starts a swarm for torrent, skipping the test if the seeders' loopback addresses aren't available
+func newTestSwarm(t *testing.T, torrent *Torrent, behaviours ...Behaviour) *Swarm {
+	t.Helper()
+	swarm, err := NewSwarm(torrent, behaviours...)
+	if err != nil {
+		t.Skipf("Could not start the swarm, this needs all of 127.0.0.0/8 on loopback: %v", err)
+	}
+	t.Cleanup(swarm.Close)
+	return swarm
+}
+
+// download downloads the swarm's torrent into a new directory, returning it once the download is written. A nil
+// dialer connects over the network
+func download(t *testing.T, swarm *Swarm, dialer models.Dialer) string {
+	t.Helper()
+	dir := t.TempDir()
+	session, err := models.NewSession(models.SessionConfig{ListenPort: -1, DownloadDir: dir, Dialer: dialer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	torrent, err := session.AddMetaInfo(swarm.Torrent.MetaInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	go torrent.StartDownload(ctx)
+	if err := torrent.Wait(ctx); err != nil {
+		t.Fatalf("Expected the download to finish, got %v", err)
+	}
+	return dir
+}
+
+func TestDownload(t *testing.T) {
+	testCases := []struct {
+		name        string
+		fileLengths []int
+		behaviours  []Behaviour
+		trackers    func(swarm *Swarm) []string
+	}{
+		{
+			name:        "http tracker",
+			fileLengths: []int{100000},
+			behaviours:  []Behaviour{Honest},
+			trackers:    func(swarm *Swarm) []string { return []string{swarm.HTTPTracker.URL} },
+		},
+		{
+			name:        "udp tracker",
+			fileLengths: []int{100000},
+			behaviours:  []Behaviour{Honest},
+			trackers:    func(swarm *Swarm) []string { return []string{swarm.UDPTracker.URL} },
+		},
+		{
+			name:        "multiple files",
+			fileLengths: []int{40000, 0, 3, 70000},
+			behaviours:  []Behaviour{Honest, Honest, Honest},
+			trackers:    func(swarm *Swarm) []string { return []string{swarm.HTTPTracker.URL, swarm.UDPTracker.URL} },
+		},
+		{
+			name:        "misbehaving seeders",
+			fileLengths: []int{300000, 50000},
+			behaviours:  []Behaviour{CorruptBlocks, DropConnection, ChokeForever, OversizedMessage, Honest},
+			trackers:    func(swarm *Swarm) []string { return []string{swarm.HTTPTracker.URL, swarm.UDPTracker.URL} },
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			torrent, err := NewTorrent("swarm", 32*1024, tc.fileLengths...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swarm := newTestSwarm(t, torrent, tc.behaviours...)
+			trackers := tc.trackers(swarm)
+			torrent.MetaInfo.Announce = trackers[0]
+			torrent.MetaInfo.AnnounceList = nil
+			for _, tracker := range trackers {
+				torrent.MetaInfo.AnnounceList = append(torrent.MetaInfo.AnnounceList, []string{tracker})
+			}
+
+			dir := download(t, swarm, nil)
+			if err := torrent.Verify(dir); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDownloadOverPipes(t *testing.T) {
+	torrent, err := NewTorrent("piped", 16*1024, 120000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swarm := newTestSwarm(t, torrent, Honest, CorruptBlocks, Honest)
+	dir := download(t, swarm, swarm.Dialer())
+	if err := torrent.Verify(dir); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadAnnounces(t *testing.T) {
+	const length = 50000
+	torrent, err := NewTorrent("announced", 16*1024, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swarm := newTestSwarm(t, torrent, Honest)
+	download(t, swarm, nil)
+
+	// the session has been closed by now, so we've told both trackers that we've left
+	for _, tracker := range []*Tracker{swarm.HTTPTracker, swarm.UDPTracker} {
+		announces := tracker.Announces()
+		if len(announces) == 0 {
+			t.Fatalf("%s received no announces", tracker.URL)
+		}
+		var events []string
+		for _, announce := range announces {
+			if !bytes.Equal(announce.InfoHash, torrent.InfoHash) {
+				t.Errorf("%s received an announce for the wrong info hash", tracker.URL)
+			}
+			if announce.Event != "" {
+				events = append(events, announce.Event)
+			}
+		}
+		if !reflect.DeepEqual(events, []string{"started", "completed", "stopped"}) {
+			t.Errorf("Expected %s to hear that we started, completed and stopped, got %q", tracker.URL, events)
+		}
+
+		if first := announces[0]; first.Left != length || first.Downloaded != 0 {
+			t.Errorf("Expected the first announce to %s to have everything left, got %+v", tracker.URL, first)
+		}
+		// every announce after we finish reports the whole torrent as downloaded
+		for _, announce := range announces {
+			if announce.Event != "completed" && announce.Event != "stopped" {
+				continue
+			}
+			if announce.Left != 0 || announce.Downloaded < length || announce.Uploaded <= 0 {
+				t.Errorf("Expected %s announce to %s to have nothing left and %d bytes downloaded, got %+v", announce.Event, tracker.URL, length, announce)
+			}
+		}
+	}
+}
+
+func TestMisbehavingSeedersAreUsed(t *testing.T) {
+	torrent, err := NewTorrent("misbehaving", 16*1024, 200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swarm := newTestSwarm(t, torrent, Honest, CorruptBlocks, DropConnection)
+	download(t, swarm, nil)
+
+	// make sure the misbehaviour was actually exercised rather than the honest seeder doing all the work
+	for _, seeder := range swarm.Seeders[1:] {
+		if seeder.Connections() == 0 {
+			t.Errorf("Seeder %d was never connected to", seeder.Behaviour)
+		}
+	}
+}
+
+func TestFastExtension(t *testing.T) {
+	testCases := []struct {
+		name      string
+		behaviour Behaviour
+	}{
+		{name: "allowed fast while choked", behaviour: FastChoker},
+		{name: "rejected requests", behaviour: FastRejecter},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			torrent, err := NewTorrent("fast", 16*1024, 150000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the only seeder, so the download can only finish if the client plays along
+			swarm := newTestSwarm(t, torrent, tc.behaviour)
+			dir := download(t, swarm, nil)
+			if err := torrent.Verify(dir); err != nil {
+				t.Error(err)
+			}
+			if tc.behaviour == FastRejecter && swarm.Seeders[0].Rejections() == 0 {
+				t.Error("Expected the seeder to have rejected requests")
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package swarmtest
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const announceInterval = 1800 // seconds
+
+// udp tracker actions and events from BEP 15
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+)
+
+var udpEvents = []string{"", "completed", "started", "stopped"}
+
+// Announce is an announce a tracker received
+type Announce struct {
+	InfoHash   []byte
+	Port       int
+	Event      string // empty for a regular announce
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// Tracker returns every seeder in the swarm to whoever announces to it, over either HTTP or UDP
+type Tracker struct {
+	URL string
+
+	peers      []byte // compact form of the seeders' addresses
+	numPeers   int
+	announces  []Announce
+	mx         sync.Mutex
+	httpServer *httptest.Server
+	udpConn    net.PacketConn
+	wg         sync.WaitGroup
+}
+
+func compactPeers(addrs []*net.TCPAddr) []byte {
+	var peers []byte
+	for _, addr := range addrs {
+		peers = append(peers, addr.IP.To4()...)
+		peers = binary.BigEndian.AppendUint16(peers, uint16(addr.Port))
+	}
+	return peers
+}
+
+func newHTTPTracker(addrs []*net.TCPAddr) (*Tracker, error) {
+	tracker := &Tracker{peers: compactPeers(addrs), numPeers: len(addrs)}
+	tracker.httpServer = httptest.NewServer(http.HandlerFunc(tracker.serveHTTP))
+	tracker.URL = tracker.httpServer.URL + "/announce"
+	return tracker, nil
+}
+
+func (tracker *Tracker) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	port, _ := strconv.Atoi(query.Get("port"))
+	uploaded, _ := strconv.ParseInt(query.Get("uploaded"), 10, 64)
+	downloaded, _ := strconv.ParseInt(query.Get("downloaded"), 10, 64)
+	left, _ := strconv.ParseInt(query.Get("left"), 10, 64)
+	tracker.record(Announce{
+		InfoHash:   []byte(query.Get("info_hash")),
+		Port:       port,
+		Event:      query.Get("event"),
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+	})
+
+	bencode.Marshal(w, map[string]interface{}{
+		"interval":   announceInterval,
+		"complete":   tracker.numPeers,
+		"incomplete": 0,
+		"peers":      string(tracker.peers),
+	})
+}
+
+func newUDPTracker(addrs []*net.TCPAddr) (*Tracker, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tracker := &Tracker{peers: compactPeers(addrs), numPeers: len(addrs), udpConn: conn}
+	tracker.URL = "udp://" + conn.LocalAddr().String() + "/announce"
+	tracker.wg.Add(1)
+	go tracker.serveUDP()
+	return tracker, nil
+}
+
+// serveUDP answers connect and announce requests. Connection ids aren't checked, the client only needs to get one
+func (tracker *Tracker) serveUDP() {
+	defer tracker.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := tracker.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buf[8:])
+		transactionID := binary.BigEndian.Uint32(buf[12:])
+
+		response := binary.BigEndian.AppendUint32(nil, action)
+		response = binary.BigEndian.AppendUint32(response, transactionID)
+		switch {
+		case action == actionConnect:
+			response = binary.BigEndian.AppendUint64(response, 0x5357524d) // any connection id will do
+		case action == actionAnnounce && n >= 98:
+			event := int(binary.BigEndian.Uint32(buf[80:]))
+			if event >= len(udpEvents) {
+				continue
+			}
+			tracker.record(Announce{
+				InfoHash:   append([]byte{}, buf[16:36]...),
+				Port:       int(binary.BigEndian.Uint16(buf[96:])),
+				Event:      udpEvents[event],
+				Downloaded: int64(binary.BigEndian.Uint64(buf[56:])),
+				Left:       int64(binary.BigEndian.Uint64(buf[64:])),
+				Uploaded:   int64(binary.BigEndian.Uint64(buf[72:])),
+			})
+			response = binary.BigEndian.AppendUint32(response, announceInterval)
+			response = binary.BigEndian.AppendUint32(response, 0) // leechers
+			response = binary.BigEndian.AppendUint32(response, uint32(tracker.numPeers))
+			response = append(response, tracker.peers...)
+		default:
+			continue
+		}
+		tracker.udpConn.WriteTo(response, addr)
+	}
+}
+
+func (tracker *Tracker) record(announce Announce) {
+	tracker.mx.Lock()
+	defer tracker.mx.Unlock()
+	tracker.announces = append(tracker.announces, announce)
+}
+
+// Announces returns every announce the tracker has received, in the order they arrived
+func (tracker *Tracker) Announces() []Announce {
+	tracker.mx.Lock()
+	defer tracker.mx.Unlock()
+	return append([]Announce{}, tracker.announces...)
+}
+
+// Close stops the tracker
+func (tracker *Tracker) Close() {
+	if tracker.httpServer != nil {
+		tracker.httpServer.Close()
+	}
+	if tracker.udpConn != nil {
+		tracker.udpConn.Close()
+		tracker.wg.Wait()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"gotorrent/client"
+	"gotorrent/tui"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runTUI implements `gotorrent get -tui`, downloading any torrents given as arguments while showing the terminal UI,
+// where more can be added
+func runTUI(args []string) error {
+	c, err := client.New(downloadDir,
+		client.WithListenPort(port),
+		client.WithMaxConnections(maxConnections),
+		client.WithMaxPeersPerTorrent(connections),
+		client.WithRateLimits(downloadRate*1024, uploadRate*1024),
+		client.WithRateSchedule(schedules...),
+		client.WithProxy(proxy, proxyOnly),
+		client.WithEncryption(int(encryption)),
+		client.WithUTP(useUTP),
+		client.WithMetadataDir("."),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stopMetrics, err := serveMetrics(c)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "magnet:") {
+			_, err = c.AddMagnet(arg)
+		} else {
+			_, err = c.AddTorrentFile(arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return tui.Run(ctx, c)
+}
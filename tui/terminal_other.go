@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package tui
+
+import "errors"
+
+var errUnsupportedTerminal = errors.New("the terminal UI isn't supported on this platform")
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errUnsupportedTerminal
+}
+
+func terminalSize(fd int) (int, int, error) {
+	return 0, 0, errUnsupportedTerminal
+}
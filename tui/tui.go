@@ -0,0 +1,577 @@
+// Package tui is a full-screen terminal interface to a client.Client, listing every torrent along with the peers,
+// trackers and files of whichever one is selected.
+package tui
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"gotorrent/client"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Views of the selected torrent below the list of torrents
+const (
+	viewPeers    = 0
+	viewTrackers = 1
+	viewFiles    = 2
+)
+
+var viewNames = []string{"Peers", "Trackers", "Files"}
+
+const (
+	refreshInterval = 500 * time.Millisecond
+	defaultWidth    = 80 // used when the terminal won't tell us its size
+	defaultHeight   = 24
+
+	enterAltScreen = "\x1b[?1049h"
+	exitAltScreen  = "\x1b[?1049l"
+	hideCursor     = "\x1b[?25l"
+	showCursor     = "\x1b[?25h"
+	clearLine      = "\x1b[K"
+	clearBelow     = "\x1b[J"
+	home           = "\x1b[H"
+	reverse        = "\x1b[7m"
+	reset          = "\x1b[0m"
+)
+
+// Keys that arrive as escape sequences
+const (
+	keyUp     = "\x1b[A"
+	keyDown   = "\x1b[B"
+	keyEscape = "\x1b"
+	keyEnter  = "\r"
+	keyCtrlC  = "\x03"
+)
+
+const help = "↑/↓ torrent  tab view  [/] file  space skip file  p pause  a add magnet  q quit"
+
+// ui is the state of the interface between redraws
+type ui struct {
+	client *client.Client
+	out    io.Writer
+
+	torrents []*client.Torrent // in the order they were added, which client.Torrents doesn't keep
+	selected int
+	view     int
+	file     int    // highlighted file in the files view
+	adding   bool   // whether we're prompting for a magnet link
+	input    string // magnet link typed so far
+	message  string // result of the last action, replaced by log lines as they come in
+	logs     *logBuffer
+
+	width  int
+	height int
+}
+
+func newUI(c *client.Client, out io.Writer) *ui {
+	return &ui{client: c, out: out, logs: &logBuffer{}, width: defaultWidth, height: defaultHeight}
+}
+
+// Run takes over the terminal until q is pressed or ctx is done, showing c's torrents. While it runs, log lines are
+// shown at the bottom of the screen instead of being written to stderr
+func Run(ctx context.Context, c *client.Client) error {
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	ui := newUI(c, os.Stdout)
+	logger := log.Logger
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: ui.logs, NoColor: true, TimeFormat: "15:04:05"}).With().Timestamp().Logger()
+	defer func() { log.Logger = logger }()
+
+	fmt.Fprint(ui.out, enterAltScreen+hideCursor)
+	defer fmt.Fprint(ui.out, showCursor+exitAltScreen)
+
+	// the reader is left blocked on stdin when we return, which is fine as we're only run until the program exits
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		ui.width, ui.height, err = terminalSize(fd)
+		if err != nil || ui.width <= 0 || ui.height <= 0 {
+			ui.width, ui.height = defaultWidth, defaultHeight
+		}
+		fmt.Fprint(ui.out, ui.render())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case key, ok := <-keys:
+			if !ok || !ui.handleKey(key) {
+				return nil
+			}
+		}
+	}
+}
+
+// readKeys sends whatever is read from r in one go, which is a single key press unless something was pasted
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			keys <- string(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// logBuffer keeps the last line logged, to show in the status line
+type logBuffer struct {
+	mx   sync.Mutex
+	last string
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if line != "" {
+		lb.mx.Lock()
+		lb.last = line
+		lb.mx.Unlock()
+	}
+	return len(p), nil
+}
+
+// take returns the last line logged since it was last called
+func (lb *logBuffer) take() string {
+	lb.mx.Lock()
+	defer lb.mx.Unlock()
+	line := lb.last
+	lb.last = ""
+	return line
+}
+
+// sync picks up torrents that have been added or dropped since we last looked, keeping the rest in order
+func (ui *ui) sync() {
+	current := make(map[*client.Torrent]bool)
+	for _, torrent := range ui.client.Torrents() {
+		current[torrent] = true
+	}
+
+	kept := ui.torrents[:0]
+	for _, torrent := range ui.torrents {
+		if current[torrent] {
+			kept = append(kept, torrent)
+			delete(current, torrent)
+		}
+	}
+	ui.torrents = kept
+	for torrent := range current {
+		ui.torrents = append(ui.torrents, torrent)
+	}
+
+	ui.selected = max(min(ui.selected, len(ui.torrents)-1), 0)
+}
+
+// current returns the selected torrent, or nil if there aren't any
+func (ui *ui) current() *client.Torrent {
+	if len(ui.torrents) == 0 {
+		return nil
+	}
+	return ui.torrents[ui.selected]
+}
+
+// handleKey acts on a key press, returning false if we should quit
+func (ui *ui) handleKey(key string) bool {
+	if ui.adding {
+		ui.handlePromptKey(key)
+		return true
+	}
+
+	ui.sync()
+	torrent := ui.current()
+	switch key {
+	case "q", keyCtrlC:
+		return false
+	case "k", keyUp:
+		ui.selected = max(ui.selected-1, 0)
+		ui.file = 0
+	case "j", keyDown:
+		ui.selected = min(ui.selected+1, max(len(ui.torrents)-1, 0))
+		ui.file = 0
+	case "\t":
+		ui.view = (ui.view + 1) % len(viewNames)
+	case "1", "2", "3":
+		ui.view = int(key[0] - '1')
+	case "[":
+		ui.file = max(ui.file-1, 0)
+	case "]":
+		if torrent != nil {
+			ui.file = min(ui.file+1, max(len(torrent.Files())-1, 0))
+		}
+	case " ":
+		ui.toggleFile(torrent)
+	case "p":
+		if torrent == nil {
+			break
+		}
+		if torrent.Stats().State == client.StatePaused {
+			torrent.Resume()
+			ui.message = "Resumed " + torrentName(torrent)
+		} else {
+			torrent.Pause()
+			ui.message = "Paused " + torrentName(torrent)
+		}
+	case "a":
+		ui.adding = true
+		ui.input = ""
+	}
+	return true
+}
+
+// handlePromptKey edits the magnet link being typed, adding it on enter
+func (ui *ui) handlePromptKey(key string) {
+	switch key {
+	case keyEscape, keyCtrlC:
+		ui.adding = false
+		return
+	case "\x7f", "\b":
+		_, size := utf8.DecodeLastRuneInString(ui.input)
+		ui.input = ui.input[:len(ui.input)-size]
+		return
+	}
+	if strings.HasPrefix(key, "\x1b") {
+		return
+	}
+
+	// a pasted link may arrive along with the enter that follows it
+	text, submit := strings.CutSuffix(key, keyEnter)
+	for _, r := range text {
+		if r >= ' ' && r != 0x7f {
+			ui.input += string(r)
+		}
+	}
+	if !submit {
+		return
+	}
+
+	ui.adding = false
+	link := strings.TrimSpace(ui.input)
+	if link == "" {
+		return
+	}
+	torrent, err := ui.client.AddMagnet(link)
+	if err != nil {
+		ui.message = "Couldn't add the magnet link: " + err.Error()
+		return
+	}
+	ui.message = "Added " + torrentName(torrent)
+	ui.sync()
+	for i, t := range ui.torrents {
+		if t == torrent {
+			ui.selected = i
+			ui.file = 0
+		}
+	}
+}
+
+// toggleFile skips the highlighted file, or unskips it if it's already skipped
+func (ui *ui) toggleFile(torrent *client.Torrent) {
+	if torrent == nil || ui.view != viewFiles {
+		return
+	}
+	files := torrent.Files()
+	if ui.file >= len(files) {
+		return
+	}
+	priority := client.PrioritySkip
+	if files[ui.file].Priority == client.PrioritySkip {
+		priority = client.PriorityNormal
+	}
+	err := torrent.SetFilePriority(ui.file, priority)
+	if err != nil {
+		ui.message = err.Error()
+	}
+}
+
+// render returns everything needed to redraw the screen
+func (ui *ui) render() string {
+	ui.sync()
+	if line := ui.logs.take(); line != "" {
+		ui.message = line
+	}
+
+	var lines []string
+	var down, up int
+	for _, torrent := range ui.torrents {
+		stats := torrent.Stats()
+		down += stats.DownloadRate
+		up += stats.UploadRate
+	}
+	lines = append(lines, fmt.Sprintf("gotorrent  %d torrents  ↓ %s  ↑ %s", len(ui.torrents), formatRate(down), formatRate(up)))
+	lines = append(lines, "")
+
+	// the torrents get up to a third of the screen, the selected torrent's view gets what's left apart from the
+	// header, the view's tabs and the status and help lines at the bottom
+	torrentRows := min(max(len(ui.torrents), 1), max((ui.height-6)/3, 1))
+	lines = append(lines, fmt.Sprintf("  %-30s %-17s %-12s %10s %10s %5s %8s", "NAME", "STATE", "PROGRESS", "DOWN", "UP", "PEERS", "ETA"))
+	if len(ui.torrents) == 0 {
+		lines = append(lines, "  No torrents, press a to add a magnet link")
+	}
+	first := scrollOffset(ui.selected, torrentRows, len(ui.torrents))
+	for i := first; i < min(first+torrentRows, len(ui.torrents)); i++ {
+		lines = append(lines, ui.torrentLine(ui.torrents[i], i == ui.selected))
+	}
+	lines = append(lines, "")
+
+	var tabs []string
+	for i, name := range viewNames {
+		if i == ui.view {
+			name = reverse + " " + name + " " + reset
+		} else {
+			name = " " + name + " "
+		}
+		tabs = append(tabs, name)
+	}
+	lines = append(lines, strings.Join(tabs, " "))
+
+	rows := max(ui.height-len(lines)-2, 1)
+	if torrent := ui.current(); torrent != nil {
+		switch ui.view {
+		case viewPeers:
+			lines = append(lines, peerLines(torrent, rows)...)
+		case viewTrackers:
+			lines = append(lines, trackerLines(torrent, rows)...)
+		case viewFiles:
+			lines = append(lines, ui.fileLines(torrent, rows)...)
+		}
+	}
+
+	for len(lines) < ui.height-2 {
+		lines = append(lines, "")
+	}
+	if ui.adding {
+		lines = append(lines, "Magnet link: "+ui.input+"_")
+	} else {
+		lines = append(lines, ui.message)
+	}
+	lines = append(lines, help)
+
+	var sb strings.Builder
+	sb.WriteString(home)
+	for i, line := range lines[:min(len(lines), ui.height)] {
+		if i > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString(truncate(line, ui.width))
+		sb.WriteString(clearLine)
+	}
+	sb.WriteString(clearBelow)
+	return sb.String()
+}
+
+// scrollOffset returns the first of n items to show in rows lines so that the selected one is visible
+func scrollOffset(selected int, rows int, n int) int {
+	if n <= rows || selected < rows/2 {
+		return 0
+	}
+	return min(selected-rows/2, n-rows)
+}
+
+func (ui *ui) torrentLine(torrent *client.Torrent, selected bool) string {
+	stats := torrent.Stats()
+	marker := "  "
+	if selected {
+		marker = "> "
+	}
+
+	progress := 0.0
+	if stats.BytesWanted > 0 {
+		progress = float64(stats.BytesDownloaded) / float64(stats.BytesWanted)
+	}
+	eta := "-"
+	if stats.State == client.StateDownloading && stats.DownloadRate > 0 {
+		eta = formatDuration(time.Duration(stats.BytesWanted-stats.BytesDownloaded) / time.Duration(stats.DownloadRate) * time.Second)
+	}
+
+	return fmt.Sprintf("%s%-30s %-17s %-12s %10s %10s %5d %8s", marker, truncate(torrentName(torrent), 30), client.StateName(stats.State),
+		progressBar(progress, 6), formatRate(stats.DownloadRate), formatRate(stats.UploadRate), stats.ConnectedPeers, eta)
+}
+
+func peerLines(torrent *client.Torrent, rows int) []string {
+	peers := torrent.Peers()
+	lines := []string{fmt.Sprintf("  %-40s %-20s %-5s %10s %10s %5s", "ADDRESS", "CLIENT", "FLAGS", "DOWN", "UP", "REQS")}
+	if len(peers) == 0 {
+		lines = append(lines, "  Not connected to any peers")
+	}
+	for _, peer := range peers[:min(len(peers), rows-1)] {
+		lines = append(lines, fmt.Sprintf("  %-40s %-20s %-5s %10s %10s %5d", peer.Address, truncate(peer.Client, 20), peerFlags(peer),
+			formatRate(peer.DownloadRate), formatRate(peer.UploadRate), peer.Requests))
+	}
+	if len(peers) > rows-1 {
+		lines[len(lines)-1] = fmt.Sprintf("  ... and %d more", len(peers)-rows+2)
+	}
+	return lines
+}
+
+var peerSourceFlags = map[int]string{
+	client.PeerSourceTracker:  "T",
+	client.PeerSourceMagnet:   "M",
+	client.PeerSourceIncoming: "I",
+	client.PeerSourcePEX:      "X",
+	client.PeerSourceDHT:      "H",
+	client.PeerSourceLSD:      "L",
+}
+
+// peerFlags sums a peer up in a few letters: c if they're choking us or u if not, e if they support extensions,
+// E if the connection is encrypted, P if it's over uTP, then where we found them
+func peerFlags(peer client.Peer) string {
+	flags := "u"
+	if peer.Choked {
+		flags = "c"
+	}
+	if peer.Extended {
+		flags += "e"
+	}
+	if peer.Encrypted {
+		flags += "E"
+	}
+	if peer.UTP {
+		flags += "P"
+	}
+	return flags + peerSourceFlags[peer.Source]
+}
+
+func trackerLines(torrent *client.Torrent, rows int) []string {
+	trackers := torrent.Trackers()
+	lines := []string{fmt.Sprintf("  %-50s %-20s %7s %8s %8s", "URL", "STATUS", "SEEDERS", "LEECHERS", "NEXT")}
+	if len(trackers) == 0 {
+		lines = append(lines, "  No trackers")
+	}
+	for _, tracker := range trackers[:min(len(trackers), rows-1)] {
+		status := "not announced"
+		if tracker.Err != nil {
+			status = "error: " + tracker.Err.Error()
+		} else if !tracker.LastAnnounce.IsZero() {
+			status = "ok"
+		}
+		next := "-"
+		if !tracker.NextAnnounce.IsZero() {
+			next = formatDuration(max(time.Until(tracker.NextAnnounce), 0))
+		}
+		lines = append(lines, fmt.Sprintf("  %-50s %-20s %7d %8d %8s", truncate(tracker.URL, 50), truncate(status, 20), tracker.Seeders, tracker.Leechers, next))
+	}
+	return lines
+}
+
+func (ui *ui) fileLines(torrent *client.Torrent, rows int) []string {
+	files := torrent.Files()
+	lines := []string{fmt.Sprintf("  %-12s %-8s %10s  %s", "PROGRESS", "PRIORITY", "SIZE", "PATH")}
+	if files == nil {
+		lines = append(lines, "  Waiting for metadata")
+		return lines
+	}
+
+	ui.file = min(ui.file, len(files)-1)
+	first := scrollOffset(ui.file, rows-1, len(files))
+	for i := first; i < min(first+rows-1, len(files)); i++ {
+		file := files[i]
+		marker := "  "
+		if i == ui.file {
+			marker = "> "
+		}
+		progress := 1.0
+		if file.Length > 0 {
+			progress = float64(file.BytesCompleted) / float64(file.Length)
+		}
+		priority := "normal"
+		if file.Priority == client.PrioritySkip {
+			priority = "skip"
+		}
+		lines = append(lines, fmt.Sprintf("%s%-12s %-8s %10s  %s", marker, progressBar(progress, 6), priority, formatBytes(file.Length), file.Path))
+	}
+	return lines
+}
+
+// torrentName returns the torrent's name, or its info hash until we have the metadata
+func torrentName(torrent *client.Torrent) string {
+	info := torrent.Info()
+	if info.Name != "" {
+		return info.Name
+	}
+	if len(info.InfoHash) != 0 {
+		return hex.EncodeToString(info.InfoHash)
+	}
+	return hex.EncodeToString(info.InfoHashV2)
+}
+
+// progressBar draws a bar width characters wide followed by the percentage
+func progressBar(progress float64, width int) string {
+	progress = min(max(progress, 0), 1)
+	filled := int(progress * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(" ", width-filled) + "]" + fmt.Sprintf("%4d%%", int(progress*100))
+}
+
+// truncate cuts s down to at most width characters, ignoring escape sequences which take up no space
+func truncate(s string, width int) string {
+	var sb strings.Builder
+	n := 0
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = r < '@' || r > '~' || r == '['
+		case r == '\x1b':
+			escaped = true
+		case n == width:
+			continue
+		default:
+			n++
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// formatBytes returns n in the largest unit that keeps it at least 1
+func formatBytes(n int) string {
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(byteUnits)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, byteUnits[unit])
+}
+
+func formatRate(rate int) string {
+	return formatBytes(rate) + "/s"
+}
+
+// formatDuration rounds d to its two largest units, e.g. 1h05m or 3m20s
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%02dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", d/time.Minute, d%time.Minute/time.Second)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
@@ -0,0 +1,131 @@
+package tui
+
+import (
+	"bytes"
+	"gotorrent/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestUI(t *testing.T) *ui {
+	t.Helper()
+	c, err := client.New(t.TempDir(), client.WithoutListening())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	ui := newUI(c, &bytes.Buffer{})
+	ui.width, ui.height = 120, 30
+	return ui
+}
+
+func TestAddPauseAndQuit(t *testing.T) {
+	ui := newTestUI(t)
+	if screen := ui.render(); !strings.Contains(screen, "No torrents") {
+		t.Errorf("Expected an empty list of torrents, got %q", screen)
+	}
+
+	// typed a key at a time, then pasted along with enter
+	for _, key := range []string{"a", "x", "\x7f", "magnet:?xt=urn:btih:", "abababababababababababababababababababab\r"} {
+		if !ui.handleKey(key) {
+			t.Fatalf("Didn't expect %q to quit", key)
+		}
+	}
+	if ui.adding || len(ui.torrents) != 1 {
+		t.Fatalf("Expected the magnet link to be added, got %d torrents and message %q", len(ui.torrents), ui.message)
+	}
+	screen := ui.render()
+	if !strings.Contains(screen, "ababababababababababababababab") {
+		t.Errorf("Expected the new torrent to be listed, got %q", screen)
+	}
+
+	ui.handleKey("p")
+	if state := ui.torrents[0].Stats().State; state != client.StatePaused {
+		t.Errorf("Expected the torrent to be paused, got %s", client.StateName(state))
+	}
+	if screen := ui.render(); !strings.Contains(screen, "paused") {
+		t.Errorf("Expected the torrent to be shown as paused, got %q", screen)
+	}
+	ui.handleKey("p")
+	if state := ui.torrents[0].Stats().State; state == client.StatePaused {
+		t.Errorf("Expected the torrent to be resumed")
+	}
+
+	ui.handleKey("a")
+	ui.handleKey("not a magnet link\r")
+	if !strings.HasPrefix(ui.message, "Couldn't add") || len(ui.torrents) != 1 {
+		t.Errorf("Expected an invalid link to be reported, got %q", ui.message)
+	}
+	ui.handleKey("a")
+	ui.handleKey(keyEscape)
+	if ui.adding {
+		t.Errorf("Expected escape to cancel adding a magnet link")
+	}
+
+	if ui.handleKey("q") {
+		t.Errorf("Expected q to quit")
+	}
+}
+
+func TestRenderFitsScreen(t *testing.T) {
+	ui := newTestUI(t)
+	for i := 0; i < 20; i++ {
+		_, err := ui.client.AddMagnet("magnet:?xt=urn:btih:" + strings.Repeat(string(rune('a'+i%6)), 39) + string(rune('0'+i%10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ui.width, ui.height = 40, 10
+
+	for _, view := range []string{"1", "2", "3"} {
+		ui.handleKey(view)
+		lines := strings.Split(ui.render(), "\r\n")
+		if len(lines) != ui.height {
+			t.Errorf("Expected %d lines in view %s, got %d", ui.height, view, len(lines))
+		}
+		for _, line := range lines {
+			if n := len([]rune(stripEscapes(line))); n > ui.width {
+				t.Errorf("Expected lines to be at most %d wide, got %d: %q", ui.width, n, line)
+			}
+		}
+	}
+}
+
+// stripEscapes removes the escape sequences that render adds to each line
+func stripEscapes(s string) string {
+	for _, seq := range []string{home, clearLine, clearBelow, reverse, reset} {
+		s = strings.ReplaceAll(s, seq, "")
+	}
+	return s
+}
+
+func TestFormatting(t *testing.T) {
+	testCases := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{name: "bytes", actual: formatBytes(512), expected: "512 B"},
+		{name: "kibibytes", actual: formatBytes(1536), expected: "1.5 KiB"},
+		{name: "gibibytes", actual: formatBytes(3 << 30), expected: "3.0 GiB"},
+		{name: "rate", actual: formatRate(2 << 20), expected: "2.0 MiB/s"},
+		{name: "seconds", actual: formatDuration(42 * time.Second), expected: "42s"},
+		{name: "minutes", actual: formatDuration(3*time.Minute + 20*time.Second), expected: "3m20s"},
+		{name: "hours", actual: formatDuration(time.Hour + 5*time.Minute + 10*time.Second), expected: "1h05m"},
+		{name: "days", actual: formatDuration(50 * time.Hour), expected: "2d02h"},
+		{name: "empty bar", actual: progressBar(0, 4), expected: "[    ]   0%"},
+		{name: "half bar", actual: progressBar(0.5, 4), expected: "[##  ]  50%"},
+		{name: "full bar", actual: progressBar(1.5, 4), expected: "[####] 100%"},
+		{name: "truncate", actual: truncate("héllo world", 5), expected: "héllo"},
+		{name: "truncate escapes", actual: truncate(reverse+"abc"+reset, 2), expected: reverse + "ab" + reset},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.actual != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, tc.actual)
+			}
+		})
+	}
+}
@@ -45,3 +45,18 @@ func BitIsSet(data []byte, pos int) (bool, error) {
 
 	return data[(pos/int(8))]>>(7-(pos%8))&1 == 1, nil
 }
+
+// GeneratePeerID returns a new Azureus-style peer id of the form -GT0001-<12 random characters>
+func GeneratePeerID() ([]byte, error) {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	peerID := []byte("-GT0001-")
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	for _, b := range random {
+		peerID = append(peerID, chars[int(b)%len(chars)])
+	}
+	return peerID, nil
+}
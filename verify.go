@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"gotorrent/models"
+	"strconv"
+	"strings"
+)
+
+// runVerify implements `gotorrent verify`, which hash checks the data of a .torrent file in the download directory
+// and exits with 1 unless all of it is there
+func runVerify(args []string) error {
+	flags := newFlagSet("verify", "<.torrent file>")
+	parseFlags(flags, args, 1, 1)
+
+	metaInfo, err := readMetaInfo(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// we only read from disk, so don't listen
+	session, err := models.NewSession(models.SessionConfig{ListenPort: -1, DownloadDir: downloadDir})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	torr, err := session.AddMetaInfo(metaInfo)
+	if err != nil {
+		return err
+	}
+
+	result, err := torr.VerifyData()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d of %d pieces verified\n", torr.Name(), result.Verified, result.Pieces)
+	if !result.Complete() {
+		fmt.Printf("Missing or corrupt: %s\n", formatRanges(result.Missing))
+		return exitStatus(exitError)
+	}
+	return nil
+}
+
+// formatRanges shortens a sorted list of indices by collapsing runs, e.g. 1-3,7
+func formatRanges(indices []int) string {
+	var ranges []string
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(indices[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(indices[i])+"-"+strconv.Itoa(indices[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}